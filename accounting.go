@@ -0,0 +1,92 @@
+package main
+
+import (
+	"kacha-psp/ledger"
+	"kacha-psp/store"
+	"log"
+	"sort"
+	"time"
+)
+
+// recordInLedger posts the money a successful transaction moved, and its
+// fee. It runs on every update of a transaction; entries are keyed by
+// transaction so each is posted once.
+func (s *server) recordInLedger(tx *store.Transaction) {
+	if tx.Status != store.StatusSuccess && tx.LateStatus != store.StatusSuccess {
+		return
+	}
+	merchant, provider := ledger.MerchantAccount(tx.Merchant), ledger.ProviderAccount(tx.Provider)
+	entry := ledger.Entry{
+		Key:           "tx:" + tx.ID,
+		Merchant:      tx.Merchant,
+		TransactionID: tx.ID,
+		At:            settledAt(tx),
+	}
+	switch {
+	case tx.Type == store.TypeOTPPayment || tx.Type == store.TypePushUSSD:
+		entry.Kind = ledger.KindCollection
+		entry.Description = "payment " + tx.TraceNumber + " from " + tx.Phone
+		entry.Postings = ledger.Move(provider, merchant, tx.Amount)
+	case tx.Type == store.TypeTransfer && tx.Source == sourceRefund:
+		entry.Kind = ledger.KindRefund
+		entry.RelatedID = tx.SourceID
+		entry.Description = "refund to " + tx.Phone
+		entry.Postings = ledger.Move(merchant, provider, tx.Amount)
+	case tx.Type == store.TypeTransfer:
+		entry.Kind = ledger.KindPayout
+		entry.Description = "transfer to " + tx.Phone
+		entry.Postings = ledger.Move(merchant, provider, tx.Amount)
+	default:
+		return
+	}
+	if _, _, err := s.ledger.Post(entry, time.Now()); err != nil {
+		log.Printf("[Ledger] failed to post %s %s: %v", tx.Type, tx.ID, err)
+	}
+	if tx.Fee <= 0 {
+		return
+	}
+	fee := ledger.Entry{
+		Key:           "fee:" + tx.ID,
+		Kind:          ledger.KindFee,
+		Merchant:      tx.Merchant,
+		TransactionID: tx.ID,
+		Description:   "fee for " + string(tx.Type) + " " + tx.ID,
+		Postings:      ledger.Move(merchant, ledger.FeeAccount, tx.Fee),
+		At:            entry.At,
+	}
+	if _, _, err := s.ledger.Post(fee, time.Now()); err != nil {
+		log.Printf("[Ledger] failed to post fee for %s: %v", tx.ID, err)
+	}
+}
+
+// settledAt is when a transaction's money moved, as far as the gateway knows
+func settledAt(tx *store.Transaction) time.Time {
+	if tx.Status != store.StatusSuccess && tx.LateAt != nil {
+		return *tx.LateAt
+	}
+	return tx.UpdatedAt
+}
+
+// backfillLedger posts the transactions that succeeded before the ledger
+// existed, oldest first
+func (s *server) backfillLedger() {
+	if !s.ledger.Empty() {
+		return
+	}
+	txs := s.txs.List(store.Filter{})
+	sort.Slice(txs, func(i, j int) bool { return settledAt(txs[i]).Before(settledAt(txs[j])) })
+	for _, tx := range txs {
+		s.recordInLedger(tx)
+	}
+}
+
+// checkLedger verifies the ledger's invariants and raises an alert if they fail
+func (s *server) checkLedger() {
+	if r := s.ledger.Check(); !r.OK {
+		log.Printf("[Ledger] ALERT: invariant check failed over %d entries: %v", r.Entries, r.Errors)
+	}
+}
+
+func (s *server) snapshotLedger() {
+	s.ledger.Snapshot(time.Now())
+}
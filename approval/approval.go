@@ -0,0 +1,258 @@
+package approval
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"kacha-psp/kacha"
+	"kacha-psp/store"
+)
+
+const DefaultTTL = 24 * time.Hour
+
+var (
+	ErrNotFound      = errors.New("approval not found")
+	ErrNotPending    = errors.New("approval is no longer pending")
+	ErrExpired       = errors.New("approval has expired")
+	ErrSameApprover  = errors.New("approver must differ from the initiator")
+	ErrWrongMerchant = errors.New("approval belongs to another merchant")
+	ErrMissingActor  = errors.New("approver is required")
+	ErrMissingInitBy = errors.New("initiated_by is required for transfers that need approval")
+)
+
+type Status string
+
+const (
+	StatusPending  Status = "PENDING"
+	StatusApproved Status = "APPROVED"
+	StatusRejected Status = "REJECTED"
+	StatusExpired  Status = "EXPIRED"
+)
+
+// Transfer is a B2C transfer parked until a second person approves it.
+// Merchant credentials are never stored; the approver supplies them again.
+type Transfer struct {
+	ID            string                          `json:"id"`
+	TransactionID string                          `json:"transaction_id"`
+	Merchant      string                          `json:"merchant"`
+	Provider      string                          `json:"provider"`
+	To            string                          `json:"to"`
+	Amount        int                             `json:"amount"`
+	Reason        string                          `json:"reason"`
+	ShortCode     string                          `json:"short_code"`
+	Validation    *kacha.TransferValidateResponse `json:"validation,omitempty"`
+	Status        Status                          `json:"status"`
+	InitiatedBy   string                          `json:"initiated_by"`
+	DecidedBy     string                          `json:"decided_by,omitempty"`
+	Note          string                          `json:"note,omitempty"`
+	CreatedAt     time.Time                       `json:"created_at"`
+	ExpiresAt     time.Time                       `json:"expires_at"`
+	DecidedAt     *time.Time                      `json:"decided_at,omitempty"`
+}
+
+// Policy sets the amount above which transfers need approval. Zero disables
+// approval; merchant entries override the default.
+type Policy struct {
+	Threshold int            `json:"threshold"`
+	Merchants map[string]int `json:"merchants,omitempty"`
+	TTL       string         `json:"ttl,omitempty"`
+}
+
+func (p Policy) ThresholdFor(merchant string) int {
+	if t, ok := p.Merchants[merchant]; ok {
+		return t
+	}
+	return p.Threshold
+}
+
+func (p Policy) ttl() time.Duration {
+	if d, err := time.ParseDuration(p.TTL); err == nil && d > 0 {
+		return d
+	}
+	return DefaultTTL
+}
+
+type state struct {
+	Policy    Policy               `json:"policy"`
+	Transfers map[string]*Transfer `json:"transfers"`
+}
+
+type Store struct {
+	path string
+
+	mu sync.Mutex
+	st state
+}
+
+func NewStore(policy Policy, path string) (*Store, error) {
+	s := &Store{
+		path: path,
+		st:   state{Policy: policy, Transfers: make(map[string]*Transfer)},
+	}
+	if path == "" {
+		return s, nil
+	}
+	if err := store.LoadJSON(path, &s.st); err != nil {
+		return nil, err
+	}
+	if s.st.Transfers == nil {
+		s.st.Transfers = make(map[string]*Transfer)
+	}
+	return s, nil
+}
+
+func (s *Store) Policy() Policy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.st.Policy
+}
+
+func (s *Store) SetPolicy(p Policy) error {
+	if p.Threshold < 0 {
+		return fmt.Errorf("threshold must not be negative")
+	}
+	if p.TTL != "" {
+		if _, err := time.ParseDuration(p.TTL); err != nil {
+			return fmt.Errorf("invalid ttl: %w", err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.st.Policy = p
+	s.persist()
+	return nil
+}
+
+// Required reports whether a transfer of amount by merchant needs approval
+func (s *Store) Required(merchant string, amount int) bool {
+	threshold := s.Policy().ThresholdFor(merchant)
+	return threshold > 0 && amount > threshold
+}
+
+// Park records a transfer awaiting approval
+func (s *Store) Park(t *Transfer) (*Transfer, error) {
+	if t.InitiatedBy == "" {
+		return nil, ErrMissingInitBy
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	t.ID = store.NewID("apr")
+	t.Status = StatusPending
+	t.CreatedAt = now
+	t.ExpiresAt = now.Add(s.st.Policy.ttl())
+
+	stored := *t
+	s.st.Transfers[t.ID] = &stored
+	s.persist()
+	return t, nil
+}
+
+func (s *Store) Get(id string) (*Transfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.st.Transfers[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	out := *t
+	return &out, nil
+}
+
+// Decide approves or rejects a pending transfer on behalf of approver
+func (s *Store) Decide(id, merchant, approver string, approve bool, note string) (*Transfer, error) {
+	if approver == "" {
+		return nil, ErrMissingActor
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.st.Transfers[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if t.Merchant != merchant {
+		return nil, ErrWrongMerchant
+	}
+	if t.Status != StatusPending {
+		return nil, fmt.Errorf("%w: %s", ErrNotPending, t.Status)
+	}
+	now := time.Now()
+	if now.After(t.ExpiresAt) {
+		// left pending for Expire, which also expires the transaction
+		return nil, ErrExpired
+	}
+	if approver == t.InitiatedBy {
+		return nil, ErrSameApprover
+	}
+
+	t.Status = StatusRejected
+	if approve {
+		t.Status = StatusApproved
+	}
+	t.DecidedBy = approver
+	t.DecidedAt = &now
+	t.Note = note
+	s.persist()
+
+	out := *t
+	return &out, nil
+}
+
+// Expire marks pending transfers past their deadline as expired and returns them
+func (s *Store) Expire(now time.Time) []*Transfer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expired []*Transfer
+	for _, t := range s.st.Transfers {
+		if t.Status == StatusPending && now.After(t.ExpiresAt) {
+			t.Status = StatusExpired
+			out := *t
+			expired = append(expired, &out)
+		}
+	}
+	if len(expired) > 0 {
+		s.persist()
+	}
+	return expired
+}
+
+// List returns transfers for merchant (all merchants if empty) with status, newest first
+func (s *Store) List(merchant string, status Status) []*Transfer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []*Transfer
+	for _, t := range s.st.Transfers {
+		if merchant != "" && t.Merchant != merchant {
+			continue
+		}
+		if status != "" && t.Status != status {
+			continue
+		}
+		cp := *t
+		out = append(out, &cp)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
+
+// persist mirrors the store to disk; caller holds s.mu
+func (s *Store) persist() {
+	if s.path == "" {
+		return
+	}
+	if err := store.SaveJSON(s.path, s.st); err != nil {
+		log.Printf("[Approval] failed to persist state: %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"kacha-psp/approval"
+	kacha "kacha-psp/kacha"
+	"kacha-psp/provider"
+	"kacha-psp/response"
+	"kacha-psp/store"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// approvalDecisionRequest is decided by the operator authenticated by their
+// X-Operator-Token; Approver, if given, must name them
+type approvalDecisionRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Approver string `json:"approver,omitempty"`
+	Note     string `json:"note,omitempty"`
+}
+
+func (s *server) handleApproveWithdrawal(c *gin.Context) {
+	var req approvalDecisionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Username == "" || req.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "username and password are required"})
+		return
+	}
+
+	// everything the transfer needs is looked up before the approval is used
+	// up, so a failure leaves it pending
+	pending, err := s.approvals.Get(c.Param("id"))
+	if err != nil || pending.Merchant != req.Username {
+		c.JSON(http.StatusNotFound, gin.H{"error": approval.ErrNotFound.Error()})
+		return
+	}
+	p, err := s.provider(pending.Provider, provider.Credentials{Username: req.Username, Password: req.Password})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	tx, err := s.txs.Get(pending.TransactionID)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	a, ok := s.decide(c, req, true)
+	if !ok {
+		return
+	}
+	s.updateTransaction(a.TransactionID, func(tx *store.Transaction) {
+		tx.Status = store.StatusPending
+		tx.Message = "approved by " + a.DecidedBy
+	})
+	resp, err := s.executeTransfer(p, a.TransactionID, kacha.TransferRequest{
+		Username:    req.Username,
+		Password:    req.Password,
+		To:          a.To,
+		Amount:      a.Amount,
+		Reason:      a.Reason,
+		ShortCode:   a.ShortCode,
+		TraceNumber: tx.TraceNumber,
+	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	tx, _ = s.txs.Get(a.TransactionID)
+	c.JSON(http.StatusOK, s.providerResponse(a.Merchant, response.FormatPSP, resp, true, tx))
+}
+
+func (s *server) handleRejectWithdrawal(c *gin.Context) {
+	var req approvalDecisionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Username == "" || req.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "username and password are required"})
+		return
+	}
+
+	a, ok := s.decide(c, req, false)
+	if !ok {
+		return
+	}
+	s.updateTransaction(a.TransactionID, func(tx *store.Transaction) {
+		tx.Status = store.StatusRejected
+		tx.Message = "rejected by " + a.DecidedBy
+	})
+	c.JSON(http.StatusOK, a)
+}
+
+// decide records the authenticated approver's decision, writing an error
+// response and returning false if the approval cannot be decided
+func (s *server) decide(c *gin.Context, req approvalDecisionRequest, approve bool) (*approval.Transfer, bool) {
+	approver, err := s.actingOperator(c, req.Username, req.Approver)
+	if err != nil {
+		respondError(c, err)
+		return nil, false
+	}
+	if approver == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "approver must authenticate with " + operatorHeader})
+		return nil, false
+	}
+	a, err := s.approvals.Decide(c.Param("id"), req.Username, approver, approve, req.Note)
+	if err != nil {
+		status := http.StatusBadRequest
+		switch {
+		case errors.Is(err, approval.ErrNotFound), errors.Is(err, approval.ErrWrongMerchant):
+			status = http.StatusNotFound
+		case errors.Is(err, approval.ErrSameApprover):
+			status = http.StatusForbidden
+		case errors.Is(err, approval.ErrNotPending):
+			status = http.StatusConflict
+		case errors.Is(err, approval.ErrExpired):
+			status = http.StatusGone
+			s.expireApprovals()
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return a, true
+}
+
+// expireApprovals expires overdue approvals and their transactions
+func (s *server) expireApprovals() {
+	for _, a := range s.approvals.Expire(time.Now()) {
+		log.Printf("Approval %s for transaction %s expired", a.ID, a.TransactionID)
+		s.updateTransaction(a.TransactionID, func(tx *store.Transaction) {
+			tx.Status = store.StatusExpired
+			tx.Message = "approval expired"
+		})
+	}
+}
+
+func (s *server) handleListApprovals(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"approvals": s.approvals.List(c.Query("merchant"), approval.Status(c.Query("status")))})
+}
+
+func (s *server) handleGetApprovalPolicy(c *gin.Context) {
+	c.JSON(http.StatusOK, s.approvals.Policy())
+}
+
+func (s *server) handlePutApprovalPolicy(c *gin.Context) {
+	var policy approval.Policy
+	if err := c.ShouldBindJSON(&policy); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := s.approvals.SetPolicy(policy); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, policy)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"kacha-psp/subscription"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type subscribeRequest struct {
+	PlanID     string     `json:"plan_id"`
+	CustomerID string     `json:"customer_id"`
+	StartAt    *time.Time `json:"start_at,omitempty"`
+}
+
+type cancelSubscriptionRequest struct {
+	AtPeriodEnd bool `json:"at_period_end"`
+}
+
+func (s *server) handleCreatePlan(c *gin.Context) {
+	var plan subscription.Plan
+	if err := c.ShouldBindJSON(&plan); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	plan.Merchant = c.GetString("merchant")
+
+	created, err := s.billing.CreatePlan(&plan)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, created)
+}
+
+func (s *server) handleListPlans(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"plans": s.billing.Plans(c.GetString("merchant"))})
+}
+
+func (s *server) handleGetPlan(c *gin.Context) {
+	plan, err := s.billing.Plan(c.Param("id"), c.GetString("merchant"))
+	if err != nil {
+		respondBillingError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, plan)
+}
+
+func (s *server) handleArchivePlan(c *gin.Context) {
+	plan, err := s.billing.ArchivePlan(c.Param("id"), c.GetString("merchant"))
+	if err != nil {
+		respondBillingError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, plan)
+}
+
+func (s *server) handleCreateCustomer(c *gin.Context) {
+	var customer subscription.Customer
+	if err := c.ShouldBindJSON(&customer); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	customer.Merchant = c.GetString("merchant")
+
+	created, err := s.billing.CreateCustomer(&customer)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, created)
+}
+
+func (s *server) handleListCustomers(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"customers": s.billing.Customers(c.GetString("merchant"))})
+}
+
+func (s *server) handleGetCustomer(c *gin.Context) {
+	customer, err := s.billing.Customer(c.Param("id"), c.GetString("merchant"))
+	if err != nil {
+		respondBillingError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, customer)
+}
+
+func (s *server) handleSubscribe(c *gin.Context) {
+	var req subscribeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.PlanID == "" || req.CustomerID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "plan_id and customer_id are required"})
+		return
+	}
+	if s.cfg.PublicURL == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "subscriptions need PUBLIC_URL for payment callbacks"})
+		return
+	}
+
+	var start time.Time
+	if req.StartAt != nil {
+		start = *req.StartAt
+	}
+	sub, events, err := s.billing.Subscribe(c.GetString("merchant"), req.PlanID, req.CustomerID, start)
+	if err != nil {
+		respondBillingError(c, err)
+		return
+	}
+	s.emitSubscriptionEvents(events)
+	c.JSON(http.StatusCreated, sub)
+}
+
+func (s *server) handleListSubscriptions(c *gin.Context) {
+	subs := s.billing.Subscriptions(c.GetString("merchant"), subscription.Status(c.Query("status")))
+	c.JSON(http.StatusOK, gin.H{"subscriptions": subs})
+}
+
+func (s *server) handleGetSubscription(c *gin.Context) {
+	sub, err := s.billing.Subscription(c.Param("id"), c.GetString("merchant"))
+	if err != nil {
+		respondBillingError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, sub)
+}
+
+func (s *server) handleCancelSubscription(c *gin.Context) {
+	var req cancelSubscriptionRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	sub, events, err := s.billing.Cancel(c.Param("id"), c.GetString("merchant"), req.AtPeriodEnd)
+	if err != nil {
+		respondBillingError(c, err)
+		return
+	}
+	s.emitSubscriptionEvents(events)
+	c.JSON(http.StatusOK, sub)
+}
+
+func (s *server) handleAdminListSubscriptions(c *gin.Context) {
+	subs := s.billing.Subscriptions(c.Query("merchant"), subscription.Status(c.Query("status")))
+	c.JSON(http.StatusOK, gin.H{"subscriptions": subs})
+}
+
+// respondBillingError reports another merchant's records as not found
+func respondBillingError(c *gin.Context, err error) {
+	status := http.StatusBadRequest
+	switch {
+	case errors.Is(err, subscription.ErrNotFound), errors.Is(err, subscription.ErrWrongMerchant):
+		status = http.StatusNotFound
+		msg := strings.Replace(err.Error(), subscription.ErrWrongMerchant.Error(), subscription.ErrNotFound.Error(), 1)
+		c.JSON(status, gin.H{"error": msg})
+		return
+	case errors.Is(err, subscription.ErrFinished), errors.Is(err, subscription.ErrPlanArchived):
+		status = http.StatusConflict
+	}
+	c.JSON(status, gin.H{"error": err.Error()})
+}
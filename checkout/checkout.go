@@ -0,0 +1,254 @@
+package checkout
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"kacha-psp/store"
+)
+
+const DefaultTTL = 30 * time.Minute
+
+var ErrNotFound = errors.New("checkout session not found")
+
+//go:embed templates/*.html
+var templateFS embed.FS
+
+// Templates are the checkout pages, embedded in the binary
+var Templates = template.Must(template.New("").Funcs(template.FuncMap{
+	"birr": func(amount int) string { return strconv.Itoa(amount) + " ETB" },
+}).ParseFS(templateFS, "templates/*.html"))
+
+type Status string
+
+const (
+	StatusOpen    Status = "OPEN"
+	StatusOTPSent Status = "OTP_SENT"
+	// StatusProcessing sessions have an authorized payment awaiting its final status
+	StatusProcessing Status = "PROCESSING"
+	StatusSucceeded  Status = "SUCCEEDED"
+	StatusFailed     Status = "FAILED"
+	StatusCancelled  Status = "CANCELLED"
+	StatusExpired    Status = "EXPIRED"
+)
+
+// Session is one customer's visit to the hosted checkout page. It pays the
+// invoice created with it through the OTP flow.
+type Session struct {
+	ID              string `json:"id"`
+	Merchant        string `json:"merchant"`
+	InvoiceID       string `json:"invoice_id"`
+	SuccessURL      string `json:"success_url"`
+	FailureURL      string `json:"failure_url"`
+	ClientReference string `json:"client_reference,omitempty"`
+	Status          Status `json:"status"`
+
+	Phone string `json:"phone,omitempty"`
+	// PaymentReference is the provider's reference the OTP authorizes
+	PaymentReference string `json:"payment_reference,omitempty"`
+	TransactionID    string `json:"transaction_id,omitempty"`
+	Error            string `json:"error,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Final reports whether the customer has left the checkout for good
+func (s *Session) Final() bool {
+	switch s.Status {
+	case StatusSucceeded, StatusFailed, StatusCancelled, StatusExpired:
+		return true
+	}
+	return false
+}
+
+type state struct {
+	Sessions map[string]*Session `json:"sessions"`
+	// Secrets sign the results handed back to each merchant
+	Secrets map[string]string `json:"secrets"`
+}
+
+type Store struct {
+	path string
+
+	mu sync.Mutex
+	st state
+}
+
+func NewStore(path string) (*Store, error) {
+	s := &Store{path: path}
+	if path != "" {
+		if err := store.LoadJSON(path, &s.st); err != nil {
+			return nil, err
+		}
+	}
+	if s.st.Sessions == nil {
+		s.st.Sessions = make(map[string]*Session)
+	}
+	if s.st.Secrets == nil {
+		s.st.Secrets = make(map[string]string)
+	}
+	return s, nil
+}
+
+// Validate checks the URLs the customer is sent back to
+func (sess *Session) Validate() error {
+	for _, u := range []string{sess.SuccessURL, sess.FailureURL} {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("success_url and failure_url must be absolute http(s) URLs")
+		}
+	}
+	return nil
+}
+
+func (s *Store) Create(sess *Session) (*Session, error) {
+	if err := sess.Validate(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	sess.ID = store.NewID("cs")
+	sess.Status = StatusOpen
+	sess.CreatedAt, sess.UpdatedAt = now, now
+	stored := *sess
+	s.st.Sessions[sess.ID] = &stored
+	s.persist()
+	return sess, nil
+}
+
+// Get returns the merchant's session (any merchant's if empty)
+func (s *Store) Get(id, merchant string) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.st.Sessions[id]
+	if !ok || (merchant != "" && sess.Merchant != merchant) {
+		return nil, ErrNotFound
+	}
+	out := *sess
+	return &out, nil
+}
+
+// Update applies fn to an unfinished session. Finished sessions are returned unchanged.
+func (s *Store) Update(id string, fn func(sess *Session)) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.st.Sessions[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if !sess.Final() {
+		fn(sess)
+		sess.UpdatedAt = time.Now()
+		s.persist()
+	}
+	out := *sess
+	return &out, nil
+}
+
+// Secret returns the merchant's signing secret, creating it on first use
+func (s *Store) Secret(merchant string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if secret, ok := s.st.Secrets[merchant]; ok {
+		return secret, nil
+	}
+	return s.rotate(merchant)
+}
+
+// RotateSecret replaces the merchant's signing secret
+func (s *Store) RotateSecret(merchant string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rotate(merchant)
+}
+
+// rotate stores a new secret for merchant; caller holds s.mu
+func (s *Store) rotate(merchant string) (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate checkout secret: %w", err)
+	}
+	secret := "cksec_" + hex.EncodeToString(b)
+	s.st.Secrets[merchant] = secret
+	s.persist()
+	return secret, nil
+}
+
+// ResultURL returns the success or failure URL with the session's outcome
+// and a signature over it appended to the query
+func (s *Store) ResultURL(sess *Session, amount int) (string, error) {
+	target := sess.FailureURL
+	if sess.Status == StatusSucceeded {
+		target = sess.SuccessURL
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	secret, err := s.Secret(sess.Merchant)
+	if err != nil {
+		return "", err
+	}
+
+	result := url.Values{}
+	result.Set("session_id", sess.ID)
+	result.Set("status", string(sess.Status))
+	result.Set("amount", strconv.Itoa(amount))
+	result.Set("timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	if sess.TransactionID != "" {
+		result.Set("transaction_id", sess.TransactionID)
+	}
+	if sess.ClientReference != "" {
+		result.Set("client_reference", sess.ClientReference)
+	}
+	result.Set("signature", Sign(secret, result))
+
+	q := u.Query()
+	for k, v := range result {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Sign returns the hex HMAC-SHA256, keyed by secret, of the result's
+// parameters other than signature, URL-encoded in key order
+func Sign(secret string, result url.Values) string {
+	unsigned := url.Values{}
+	for k, v := range result {
+		if k != "signature" {
+			unsigned[k] = v
+		}
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned.Encode()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// persist mirrors the store to disk; caller holds s.mu
+func (s *Store) persist() {
+	if s.path == "" {
+		return
+	}
+	if err := store.SaveJSON(s.path, s.st); err != nil {
+		log.Printf("[Checkout] failed to persist state: %v", err)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"fmt"
+	"kacha-psp/checkout"
+	"kacha-psp/invoice"
+	kacha "kacha-psp/kacha"
+	"kacha-psp/store"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type createCheckoutRequest struct {
+	Amount          int    `json:"amount"`
+	Description     string `json:"description"`
+	Phone           string `json:"phone,omitempty"`
+	SuccessURL      string `json:"success_url"`
+	FailureURL      string `json:"failure_url"`
+	ClientReference string `json:"client_reference,omitempty"`
+	ExpiresIn       string `json:"expires_in,omitempty"`
+}
+
+// checkoutPage is the data rendered into the checkout templates
+type checkoutPage struct {
+	SessionID   string
+	Merchant    string
+	Description string
+	Amount      int
+	Phone       string
+	Error       string
+	Message     string
+	// Refresh reloads the page after this many seconds, so the customer
+	// sees the result without JavaScript
+	Refresh int
+}
+
+func (s *server) handleCreateCheckoutSession(c *gin.Context) {
+	var req createCheckoutRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if s.cfg.PublicURL == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "hosted checkout needs PUBLIC_URL"})
+		return
+	}
+
+	sess := &checkout.Session{
+		Merchant:        c.GetString("merchant"),
+		SuccessURL:      req.SuccessURL,
+		FailureURL:      req.FailureURL,
+		ClientReference: req.ClientReference,
+	}
+	if err := sess.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ttl := checkout.DefaultTTL
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid expires_in"})
+			return
+		}
+		ttl = d
+	}
+
+	// The session pays an invoice, which tracks the payment and expiry
+	inv, events, err := s.invoices.Create(&invoice.Invoice{
+		Merchant:    sess.Merchant,
+		Amount:      req.Amount,
+		Description: req.Description,
+		Phone:       req.Phone,
+		ExpiresAt:   time.Now().Add(ttl),
+		Metadata:    map[string]string{"client_reference": req.ClientReference},
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	s.emitInvoiceEvents(events)
+
+	sess.InvoiceID = inv.ID
+	sess, err = s.checkouts.Create(sess)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"session":      sess,
+		"invoice":      s.invoiceView(inv),
+		"checkout_url": fmt.Sprintf("%s/checkout/%s", s.cfg.PublicURL, sess.ID),
+	})
+}
+
+func (s *server) handleGetCheckoutSession(c *gin.Context) {
+	sess, err := s.checkouts.Get(c.Param("id"), c.GetString("merchant"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, sess)
+}
+
+func (s *server) handleGetCheckoutSecret(c *gin.Context) {
+	secret, err := s.checkouts.Secret(c.GetString("merchant"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"secret": secret})
+}
+
+func (s *server) handleRotateCheckoutSecret(c *gin.Context) {
+	secret, err := s.checkouts.RotateSecret(c.GetString("merchant"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"secret": secret})
+}
+
+// handleCheckoutPage shows the step the customer is at
+func (s *server) handleCheckoutPage(c *gin.Context) {
+	sess, inv, ok := s.loadCheckout(c)
+	if !ok {
+		return
+	}
+
+	page := s.checkoutPage(sess, inv)
+	switch sess.Status {
+	case checkout.StatusOTPSent:
+		c.HTML(http.StatusOK, "otp.html", page)
+	case checkout.StatusProcessing:
+		page.Message = "Your payment is being processed."
+		page.Refresh = 3
+		c.HTML(http.StatusOK, "message.html", page)
+	default:
+		c.HTML(http.StatusOK, "phone.html", page)
+	}
+}
+
+// handleCheckoutPay sends the OTP to the phone the customer entered
+func (s *server) handleCheckoutPay(c *gin.Context) {
+	sess, inv, ok := s.loadCheckout(c)
+	if !ok {
+		return
+	}
+	if sess.Status != checkout.StatusOpen {
+		c.Redirect(http.StatusSeeOther, "/checkout/"+sess.ID)
+		return
+	}
+
+	phone := strings.TrimSpace(c.PostForm("phone"))
+	page := s.checkoutPage(sess, inv)
+	page.Phone = phone
+	if phone == "" {
+		page.Error = "Enter your phone number."
+		c.HTML(http.StatusUnprocessableEntity, "phone.html", page)
+		return
+	}
+
+	tx, resp, err := s.payInvoice(inv, store.TypeOTPPayment, phone, 0)
+	if err != nil {
+		log.Printf("[Checkout] payment for %s failed: %v", sess.ID, err)
+		page.Error = "We could not start the payment: " + err.Error()
+		c.HTML(http.StatusUnprocessableEntity, "phone.html", page)
+		return
+	}
+	reference := ""
+	if r, ok := resp.(*kacha.PaymentRequestResponse); ok {
+		reference = r.Reference
+	}
+
+	s.checkouts.Update(sess.ID, func(sess *checkout.Session) {
+		sess.Status = checkout.StatusOTPSent
+		sess.Phone = phone
+		sess.PaymentReference = reference
+		sess.TransactionID = tx.ID
+		sess.Error = ""
+	})
+	c.Redirect(http.StatusSeeOther, "/checkout/"+sess.ID)
+}
+
+// handleCheckoutAuthorize confirms the payment with the OTP the customer entered
+func (s *server) handleCheckoutAuthorize(c *gin.Context) {
+	sess, inv, ok := s.loadCheckout(c)
+	if !ok {
+		return
+	}
+	if sess.Status != checkout.StatusOTPSent {
+		c.Redirect(http.StatusSeeOther, "/checkout/"+sess.ID)
+		return
+	}
+
+	page := s.checkoutPage(sess, inv)
+	otp, err := strconv.Atoi(strings.TrimSpace(c.PostForm("otp")))
+	if err != nil || otp <= 0 {
+		page.Error = "Enter the numeric code you received."
+		c.HTML(http.StatusUnprocessableEntity, "otp.html", page)
+		return
+	}
+
+	if _, err := s.authorizeInvoicePayment(inv, sess.PaymentReference, otp); err != nil {
+		log.Printf("[Checkout] authorization for %s failed: %v", sess.ID, err)
+		page.Error = "The code could not be verified: " + err.Error()
+		c.HTML(http.StatusUnprocessableEntity, "otp.html", page)
+		return
+	}
+
+	s.checkouts.Update(sess.ID, func(sess *checkout.Session) {
+		sess.Status = checkout.StatusProcessing
+	})
+	c.Redirect(http.StatusSeeOther, "/checkout/"+sess.ID)
+}
+
+// handleCheckoutRestart abandons the OTP sent so the customer can use another phone
+func (s *server) handleCheckoutRestart(c *gin.Context) {
+	sess, _, ok := s.loadCheckout(c)
+	if !ok {
+		return
+	}
+	if sess.Status == checkout.StatusOTPSent {
+		s.abandonCheckoutPayment(sess)
+		s.checkouts.Update(sess.ID, func(sess *checkout.Session) {
+			sess.Status = checkout.StatusOpen
+			sess.PaymentReference = ""
+			sess.TransactionID = ""
+		})
+	}
+	c.Redirect(http.StatusSeeOther, "/checkout/"+sess.ID)
+}
+
+func (s *server) handleCheckoutCancel(c *gin.Context) {
+	sess, inv, ok := s.loadCheckout(c)
+	if !ok {
+		return
+	}
+	if sess.Status == checkout.StatusProcessing {
+		c.Redirect(http.StatusSeeOther, "/checkout/"+sess.ID)
+		return
+	}
+	s.abandonCheckoutPayment(sess)
+	// the invoice only exists for this session, so it closes with it
+	if _, events, err := s.invoices.Void(inv.ID, inv.Merchant); err == nil {
+		s.emitInvoiceEvents(events)
+	}
+	s.finishCheckout(c, sess, inv, checkout.StatusCancelled)
+}
+
+// loadCheckout loads the session in the path and its invoice, and brings
+// the session up to date with its payment. Finished sessions redirect the
+// customer back to the merchant and return false.
+func (s *server) loadCheckout(c *gin.Context) (*checkout.Session, *invoice.Invoice, bool) {
+	sess, err := s.checkouts.Get(c.Param("id"), "")
+	if err != nil {
+		c.HTML(http.StatusNotFound, "message.html", checkoutPage{Message: "This checkout link is not valid."})
+		return nil, nil, false
+	}
+	inv, err := s.invoices.Get(sess.InvoiceID, "")
+	if err != nil {
+		c.HTML(http.StatusNotFound, "message.html", checkoutPage{Message: "This checkout link is not valid."})
+		return nil, nil, false
+	}
+
+	status := sess.Status
+	if !sess.Final() && sess.TransactionID != "" {
+		if tx, err := s.txs.Get(sess.TransactionID); err == nil && tx.Status.Final() {
+			status = checkout.StatusFailed
+			if tx.Status == store.StatusSuccess {
+				status = checkout.StatusSucceeded
+			}
+		}
+	}
+	if !sess.Final() && status == sess.Status {
+		switch inv.Status {
+		case invoice.StatusPaid:
+			status = checkout.StatusSucceeded
+		case invoice.StatusExpired, invoice.StatusVoid:
+			status = checkout.StatusExpired
+		}
+	}
+	if status != sess.Status || sess.Final() {
+		s.finishCheckout(c, sess, inv, status)
+		return nil, nil, false
+	}
+	return sess, inv, true
+}
+
+// finishCheckout ends a session with status and redirects the customer to
+// the merchant with the signed result
+func (s *server) finishCheckout(c *gin.Context, sess *checkout.Session, inv *invoice.Invoice, status checkout.Status) {
+	id := sess.ID
+	sess, err := s.checkouts.Update(id, func(sess *checkout.Session) {
+		sess.Status = status
+	})
+	if err == nil {
+		var target string
+		target, err = s.checkouts.ResultURL(sess, inv.Amount)
+		if err == nil {
+			c.Redirect(http.StatusSeeOther, target)
+			return
+		}
+	}
+	log.Printf("[Checkout] failed to finish %s: %v", id, err)
+	c.HTML(http.StatusInternalServerError, "message.html", checkoutPage{Message: "Something went wrong. Please contact the merchant."})
+}
+
+// abandonCheckoutPayment fails a payment the customer walked away from,
+// which releases the invoice amount it held
+func (s *server) abandonCheckoutPayment(sess *checkout.Session) {
+	if sess.TransactionID == "" {
+		return
+	}
+	tx, err := s.txs.Get(sess.TransactionID)
+	if err != nil || tx.Status.Final() {
+		return
+	}
+	s.updateTransaction(tx.ID, func(tx *store.Transaction) {
+		tx.Status = store.StatusFailed
+		tx.Message = "abandoned at checkout"
+	})
+}
+
+func (s *server) checkoutPage(sess *checkout.Session, inv *invoice.Invoice) checkoutPage {
+	phone := sess.Phone
+	if phone == "" {
+		phone = inv.Phone
+	}
+	return checkoutPage{
+		SessionID:   sess.ID,
+		Merchant:    sess.Merchant,
+		Description: inv.Description,
+		Amount:      inv.Due(),
+		Phone:       phone,
+		Error:       sess.Error,
+	}
+}
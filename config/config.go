@@ -3,6 +3,10 @@ package config
 import (
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -10,6 +14,89 @@ import (
 type AppConfig struct {
 	KachaBaseURL string
 	Port         string
+
+	// DataDir holds the gateway's JSON state files; empty keeps state in memory only
+	DataDir string
+	// AdminToken guards the /admin API, which is disabled when empty
+	AdminToken string
+
+	// PaymentProvider names the registered provider used when none is chosen
+	PaymentProvider string
+	// FallbackProviders take transactions matching no routing rule, in order,
+	// when PaymentProvider is unavailable or cannot be reached
+	FallbackProviders  []string
+	EnableFakeProvider bool
+	// Location is used for time-of-day routing rules
+	Location *time.Location
+
+	// QuoteSecret signs the quote tokens returned by /withdrawal/validate
+	QuoteSecret       string
+	QuoteTTL          time.Duration
+	RequireQuoteToken bool
+
+	// Withdrawals above ApprovalThreshold wait for a second approver; 0 disables
+	ApprovalThreshold int
+	ApprovalTTL       time.Duration
+
+	// RiskRulesFile is watched and reloaded when it changes
+	RiskRulesFile string
+
+	// CredentialsKey encrypts merchant credentials kept for scheduled payouts
+	// and subscription billing, which are disabled when empty
+	CredentialsKey string
+
+	// PublicURL is the gateway's externally reachable base URL, used for the
+	// callback URLs of payments the gateway starts itself
+	PublicURL string
+	// SubscriptionChargeTimeout fails a subscription charge whose callback never came
+	SubscriptionChargeTimeout time.Duration
+	// InvoiceClaimTTL frees the amount held for an invoice payment that never settled
+	InvoiceClaimTTL time.Duration
+
+	// Merchant QR codes name the merchant account under QRAccountGUID and
+	// default to QRMerchantCity and QRMerchantCategory
+	QRAccountGUID      string
+	QRMerchantCity     string
+	QRMerchantCategory string
+
+	// Pending payment requests expire after these TTLs; 0 keeps them open
+	OTPPaymentTTL time.Duration
+	PushUSSDTTL   time.Duration
+
+	// Push USSD payments without a callback are polled once PushUSSDPollAfter
+	// old, backing off up to PushUSSDPollMaxInterval between polls, and given
+	// up on at PushUSSDPollMaxAge. A zero PushUSSDPollAfter disables polling.
+	PushUSSDPollAfter       time.Duration
+	PushUSSDPollMaxInterval time.Duration
+	PushUSSDPollMaxAge      time.Duration
+
+	// OTP authorization limits: OTPMaxAttempts failures lock a payment for
+	// OTPLockout, and each OTP sent is valid for OTPTTL
+	OTPMaxAttempts    int
+	OTPLockout        time.Duration
+	OTPTTL            time.Duration
+	OTPMaxResends     int
+	OTPResendInterval time.Duration
+
+	// FloatEnforced makes transfers need enough float unless a merchant's
+	// settings say otherwise
+	FloatEnforced bool
+
+	// Failed split payment legs are retried up to SplitMaxAttempts times, after
+	// SplitRetryDelay doubling with each attempt
+	SplitMaxAttempts int
+	SplitRetryDelay  time.Duration
+
+	// FeesInResponse adds the merchant's fee to PSP responses
+	FeesInResponse bool
+
+	// LedgerSnapshotInterval is how often ledger balances are snapshotted
+	// for point-in-time queries
+	LedgerSnapshotInterval time.Duration
+
+	// Beneficiary name match scores below these thresholds warn or block a payout
+	NameMatchWarnBelow  float64
+	NameMatchBlockBelow float64
 }
 
 func Load() (*AppConfig, error) {
@@ -20,11 +107,157 @@ func Load() (*AppConfig, error) {
 	cfg := &AppConfig{
 		KachaBaseURL: os.Getenv("KACHA_BASE_URL"),
 		Port:         os.Getenv("PORT"),
+
+		DataDir:    os.Getenv("DATA_DIR"),
+		AdminToken: os.Getenv("ADMIN_TOKEN"),
+
+		PaymentProvider:    os.Getenv("PAYMENT_PROVIDER"),
+		FallbackProviders:  getList("FALLBACK_PROVIDERS"),
+		EnableFakeProvider: getBool("ENABLE_FAKE_PROVIDER", false),
+		Location:           getLocation("TIMEZONE", "Africa/Addis_Ababa"),
+
+		QuoteSecret:       os.Getenv("QUOTE_SECRET"),
+		QuoteTTL:          getDuration("QUOTE_TTL", 5*time.Minute),
+		RequireQuoteToken: getBool("REQUIRE_QUOTE_TOKEN", false),
+
+		ApprovalThreshold: getInt("APPROVAL_THRESHOLD", 0),
+		ApprovalTTL:       getDuration("APPROVAL_TTL", 24*time.Hour),
+
+		CredentialsKey: os.Getenv("CREDENTIALS_KEY"),
+
+		PublicURL:                 strings.TrimRight(os.Getenv("PUBLIC_URL"), "/"),
+		SubscriptionChargeTimeout: getDuration("SUBSCRIPTION_CHARGE_TIMEOUT", 15*time.Minute),
+		InvoiceClaimTTL:           getDuration("INVOICE_CLAIM_TTL", 15*time.Minute),
+
+		QRAccountGUID:      getString("QR_ACCOUNT_GUID", "et.kacha.psp"),
+		QRMerchantCity:     getString("QR_MERCHANT_CITY", "Addis Ababa"),
+		QRMerchantCategory: getString("QR_MERCHANT_CATEGORY", "5999"),
+
+		OTPPaymentTTL: getDuration("OTP_PAYMENT_TTL", 30*time.Minute),
+		PushUSSDTTL:   getDuration("PUSH_USSD_TTL", 15*time.Minute),
+
+		PushUSSDPollAfter:       getDuration("PUSH_USSD_POLL_AFTER", 2*time.Minute),
+		PushUSSDPollMaxInterval: getDuration("PUSH_USSD_POLL_MAX_INTERVAL", 30*time.Minute),
+		PushUSSDPollMaxAge:      getDuration("PUSH_USSD_POLL_MAX_AGE", 24*time.Hour),
+
+		OTPMaxAttempts:    getInt("OTP_MAX_ATTEMPTS", 5),
+		OTPLockout:        getDuration("OTP_LOCKOUT", 15*time.Minute),
+		OTPTTL:            getDuration("OTP_TTL", 5*time.Minute),
+		OTPMaxResends:     getInt("OTP_MAX_RESENDS", 3),
+		OTPResendInterval: getDuration("OTP_RESEND_INTERVAL", time.Minute),
+
+		SplitMaxAttempts: getInt("SPLIT_MAX_ATTEMPTS", 5),
+		SplitRetryDelay:  getDuration("SPLIT_RETRY_DELAY", time.Minute),
+
+		FloatEnforced:          getBool("FLOAT_ENFORCED", false),
+		FeesInResponse:         getBool("FEES_IN_RESPONSE", false),
+		LedgerSnapshotInterval: getDuration("LEDGER_SNAPSHOT_INTERVAL", time.Hour),
+
+		NameMatchWarnBelow:  getFloat("NAME_MATCH_WARN_BELOW", 0.85),
+		NameMatchBlockBelow: getFloat("NAME_MATCH_BLOCK_BELOW", 0.70),
 	}
 
 	if cfg.Port == "" {
 		cfg.Port = "8080"
 	}
+	cfg.RiskRulesFile = os.Getenv("RISK_RULES_FILE")
+	if cfg.RiskRulesFile == "" {
+		cfg.RiskRulesFile = cfg.DataPath("risk_rules.json")
+	}
+	if cfg.PaymentProvider == "" {
+		cfg.PaymentProvider = "kacha"
+	}
 
 	return cfg, nil
 }
+
+// DataPath returns the path of a state file in DataDir, or "" if state is kept in memory
+func (c *AppConfig) DataPath(name string) string {
+	if c.DataDir == "" {
+		return ""
+	}
+	return filepath.Join(c.DataDir, name)
+}
+
+func getString(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// getList splits a comma-separated value, dropping empty items
+func getList(key string) []string {
+	var out []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func getBool(key string, fallback bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using %v", key, v, fallback)
+		return fallback
+	}
+	return b
+}
+
+func getInt(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using %d", key, v, fallback)
+		return fallback
+	}
+	return i
+}
+
+func getFloat(key string, fallback float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using %v", key, v, fallback)
+		return fallback
+	}
+	return f
+}
+
+func getDuration(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using %s", key, v, fallback)
+		return fallback
+	}
+	return d
+}
+
+func getLocation(key, fallback string) *time.Location {
+	name := os.Getenv(key)
+	if name == "" {
+		name = fallback
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using UTC+3: %v", key, name, err)
+		return time.FixedZone("EAT", 3*60*60)
+	}
+	return loc
+}
@@ -0,0 +1,228 @@
+// Package emvqr builds and parses EMVCo merchant-presented QR payloads, the
+// format used by EthQR and most national QR payment schemes.
+package emvqr
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrMalformed = errors.New("malformed QR payload")
+	ErrChecksum  = errors.New("QR payload checksum mismatch")
+)
+
+const (
+	CurrencyETB = "230"
+	CountryET   = "ET"
+)
+
+// Top-level data object IDs
+const (
+	tagFormat          = "00"
+	tagInitiation      = "01"
+	tagMerchantAccount = "26"
+	tagCategory        = "52"
+	tagCurrency        = "53"
+	tagAmount          = "54"
+	tagCountry         = "58"
+	tagName            = "59"
+	tagCity            = "60"
+	tagAdditional      = "62"
+	tagCRC             = "63"
+)
+
+// Sub-IDs of the merchant account (26) and additional data (62) templates
+const (
+	subGUID           = "00"
+	subMerchantID     = "01"
+	subBillNumber     = "01"
+	subReferenceLabel = "05"
+)
+
+// Payload is a merchant-presented QR code. Static payloads carry no amount
+// and can be printed; dynamic ones are made for a single payment.
+type Payload struct {
+	Dynamic bool `json:"dynamic"`
+	// AccountGUID names the network the merchant account belongs to
+	AccountGUID string `json:"account_guid"`
+	MerchantID  string `json:"merchant_id"`
+	// Category is the ISO 18245 merchant category code
+	Category string `json:"category"`
+	Currency string `json:"currency"`
+	// Amount is zero when the customer enters it
+	Amount  int    `json:"amount,omitempty"`
+	Country string `json:"country"`
+	Name    string `json:"name"`
+	City    string `json:"city"`
+	// BillNumber identifies the invoice a dynamic payload pays
+	BillNumber string `json:"bill_number,omitempty"`
+	// ReferenceLabel carries the merchant's trace number
+	ReferenceLabel string `json:"reference_label,omitempty"`
+}
+
+// Encode returns the payload string with its CRC. Name and City are cut to
+// the 25 and 15 characters the format allows. Fields are counted in bytes, so
+// only ASCII is accepted.
+func (p *Payload) Encode() (string, error) {
+	if p.AccountGUID == "" || p.MerchantID == "" {
+		return "", fmt.Errorf("%w: merchant account is required", ErrMalformed)
+	}
+	if p.Amount < 0 {
+		return "", fmt.Errorf("%w: negative amount", ErrMalformed)
+	}
+
+	var b strings.Builder
+	initiation := "11"
+	if p.Dynamic {
+		initiation = "12"
+	}
+	fields := []struct{ tag, value string }{
+		{tagFormat, "01"},
+		{tagInitiation, initiation},
+		{tagMerchantAccount, tlv(subGUID, p.AccountGUID) + tlv(subMerchantID, p.MerchantID)},
+		{tagCategory, orDefault(p.Category, "0000")},
+		{tagCurrency, orDefault(p.Currency, CurrencyETB)},
+	}
+	if p.Amount > 0 {
+		fields = append(fields, struct{ tag, value string }{tagAmount, strconv.Itoa(p.Amount)})
+	}
+	fields = append(fields,
+		struct{ tag, value string }{tagCountry, orDefault(p.Country, CountryET)},
+		struct{ tag, value string }{tagName, truncate(orDefault(p.Name, p.MerchantID), 25)},
+		struct{ tag, value string }{tagCity, truncate(p.City, 15)},
+	)
+	var additional string
+	if p.BillNumber != "" {
+		additional += tlv(subBillNumber, p.BillNumber)
+	}
+	if p.ReferenceLabel != "" {
+		additional += tlv(subReferenceLabel, p.ReferenceLabel)
+	}
+	if additional != "" {
+		fields = append(fields, struct{ tag, value string }{tagAdditional, additional})
+	}
+
+	for _, f := range fields {
+		if f.value == "" || len(f.value) > 99 {
+			return "", fmt.Errorf("%w: field %s must be 1-99 characters", ErrMalformed, f.tag)
+		}
+		if !ascii(f.value) {
+			return "", fmt.Errorf("%w: field %s must be printable ASCII", ErrMalformed, f.tag)
+		}
+		b.WriteString(tlv(f.tag, f.value))
+	}
+	b.WriteString(tagCRC + "04")
+	return b.String() + fmt.Sprintf("%04X", CRC16([]byte(b.String()))), nil
+}
+
+// Parse decodes a payload string, checking its CRC
+func Parse(s string) (*Payload, error) {
+	if len(s) < 8 || s[len(s)-8:len(s)-4] != tagCRC+"04" {
+		return nil, fmt.Errorf("%w: missing CRC", ErrMalformed)
+	}
+	if fmt.Sprintf("%04X", CRC16([]byte(s[:len(s)-4]))) != strings.ToUpper(s[len(s)-4:]) {
+		return nil, ErrChecksum
+	}
+
+	top, err := parseTLV(s[:len(s)-8])
+	if err != nil {
+		return nil, err
+	}
+	if top[tagFormat] != "01" {
+		return nil, fmt.Errorf("%w: unsupported format indicator", ErrMalformed)
+	}
+	p := &Payload{
+		Dynamic:  top[tagInitiation] == "12",
+		Category: top[tagCategory],
+		Currency: top[tagCurrency],
+		Country:  top[tagCountry],
+		Name:     top[tagName],
+		City:     top[tagCity],
+	}
+	if v, ok := top[tagAmount]; ok {
+		amount, err := strconv.ParseFloat(v, 64)
+		if err != nil || amount < 0 {
+			return nil, fmt.Errorf("%w: invalid amount", ErrMalformed)
+		}
+		p.Amount = int(amount)
+	}
+	if v, ok := top[tagMerchantAccount]; ok {
+		account, err := parseTLV(v)
+		if err != nil {
+			return nil, err
+		}
+		p.AccountGUID, p.MerchantID = account[subGUID], account[subMerchantID]
+	}
+	if v, ok := top[tagAdditional]; ok {
+		additional, err := parseTLV(v)
+		if err != nil {
+			return nil, err
+		}
+		p.BillNumber, p.ReferenceLabel = additional[subBillNumber], additional[subReferenceLabel]
+	}
+	return p, nil
+}
+
+// CRC16 is the CRC-16/CCITT-FALSE checksum EMVCo payloads end with
+func CRC16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func parseTLV(s string) (map[string]string, error) {
+	out := make(map[string]string)
+	for len(s) > 0 {
+		if len(s) < 4 {
+			return nil, fmt.Errorf("%w: truncated field", ErrMalformed)
+		}
+		n, err := strconv.Atoi(s[2:4])
+		if err != nil || len(s) < 4+n {
+			return nil, fmt.Errorf("%w: bad length for field %s", ErrMalformed, s[:2])
+		}
+		out[s[:2]] = s[4 : 4+n]
+		s = s[4+n:]
+	}
+	return out, nil
+}
+
+func tlv(tag, value string) string {
+	return fmt.Sprintf("%s%02d%s", tag, len(value), value)
+}
+
+func orDefault(v, def string) string {
+	if v == "" {
+		return def
+	}
+	return v
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
+
+// ascii reports whether s is printable ASCII, the character set of the
+// primary template, where a length counts bytes and characters alike
+func ascii(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7E {
+			return false
+		}
+	}
+	return true
+}
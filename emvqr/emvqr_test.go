@@ -0,0 +1,97 @@
+package emvqr
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCRC16(t *testing.T) {
+	tests := []struct {
+		data string
+		want uint16
+	}{
+		// check value of CRC-16/CCITT-FALSE
+		{"123456789", 0x29B1},
+		{"", 0xFFFF},
+		{"A", 0xB915},
+	}
+	for _, tt := range tests {
+		if got := CRC16([]byte(tt.data)); got != tt.want {
+			t.Errorf("CRC16(%q) = %04X, want %04X", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeParseRoundTrip(t *testing.T) {
+	tests := []Payload{
+		{AccountGUID: "et.kacha", MerchantID: "m1", Name: "Abebe Shop", City: "Addis Ababa"},
+		{
+			Dynamic:        true,
+			AccountGUID:    "et.kacha",
+			MerchantID:     "m1",
+			Category:       "5411",
+			Amount:         1250,
+			Name:           "Abebe Shop",
+			City:           "Addis Ababa",
+			BillNumber:     "INV-42",
+			ReferenceLabel: "QR123",
+		},
+	}
+	for _, in := range tests {
+		s, err := in.Encode()
+		if err != nil {
+			t.Fatalf("Encode(%+v): %v", in, err)
+		}
+		out, err := Parse(s)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", s, err)
+		}
+		want := in
+		if want.Category == "" {
+			want.Category = "0000"
+		}
+		want.Currency, want.Country = CurrencyETB, CountryET
+		if *out != want {
+			t.Errorf("Parse(Encode(%+v)) = %+v", in, *out)
+		}
+	}
+}
+
+func TestEncodeTruncates(t *testing.T) {
+	s, err := (&Payload{AccountGUID: "g", MerchantID: "m", Name: strings.Repeat("n", 30), City: strings.Repeat("c", 20)}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Name) != 25 || len(p.City) != 15 {
+		t.Errorf("name %q and city %q not cut to 25 and 15", p.Name, p.City)
+	}
+}
+
+func TestEncodeRejectsNonASCII(t *testing.T) {
+	for _, p := range []Payload{
+		{AccountGUID: "g", MerchantID: "m", Name: "አበበ", City: "Addis"},
+		{AccountGUID: "g", MerchantID: "m", Name: "Abebe", City: "Addis", BillNumber: "ቁ1"},
+	} {
+		if _, err := p.Encode(); !errors.Is(err, ErrMalformed) {
+			t.Errorf("Encode(%+v) = %v, want ErrMalformed", p, err)
+		}
+	}
+}
+
+func TestParseChecksum(t *testing.T) {
+	s, err := (&Payload{AccountGUID: "g", MerchantID: "m", City: "Addis"}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Parse(strings.ToLower(s[:len(s)-4]) + s[len(s)-4:]); !errors.Is(err, ErrChecksum) {
+		t.Errorf("tampered payload: err = %v, want ErrChecksum", err)
+	}
+	if _, err := Parse(s[:len(s)-8]); !errors.Is(err, ErrMalformed) {
+		t.Errorf("payload without CRC: err = %v, want ErrMalformed", err)
+	}
+}
@@ -0,0 +1,478 @@
+package escrow
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"kacha-psp/store"
+)
+
+var (
+	ErrNotFound = errors.New("escrow not found")
+	// ErrState is returned for an action the escrow's status does not allow
+	ErrState = errors.New("escrow does not allow this action")
+)
+
+type Status string
+
+const (
+	StatusAwaitingPayment Status = "AWAITING_PAYMENT"
+	// StatusHeld escrows hold a successful payment until released or refunded
+	StatusHeld Status = "HELD"
+	// StatusDisputed escrows are held without auto-release until resolved
+	StatusDisputed  Status = "DISPUTED"
+	StatusReleasing Status = "RELEASING"
+	StatusReleased  Status = "RELEASED"
+	StatusRefunding Status = "REFUNDING"
+	StatusRefunded  Status = "REFUNDED"
+	// StatusCancelled escrows never held a payment
+	StatusCancelled Status = "CANCELLED"
+)
+
+// Action is a step in an escrow's audit trail
+type Action string
+
+const (
+	ActionCreated       Action = "CREATED"
+	ActionHeld          Action = "HELD"
+	ActionPaymentFailed Action = "PAYMENT_FAILED"
+	ActionCancelled     Action = "CANCELLED"
+	ActionDisputed      Action = "DISPUTED"
+	ActionRelease       Action = "RELEASE_REQUESTED"
+	ActionAutoRelease   Action = "AUTO_RELEASE"
+	ActionReleased      Action = "RELEASED"
+	ActionReleaseFailed Action = "RELEASE_FAILED"
+	ActionRefund        Action = "REFUND_REQUESTED"
+	ActionRefunded      Action = "REFUNDED"
+	ActionRefundFailed  Action = "REFUND_FAILED"
+)
+
+// Events sent to merchant webhooks
+const (
+	EventHeld          = "escrow.held"
+	EventDisputed      = "escrow.disputed"
+	EventReleased      = "escrow.released"
+	EventReleaseFailed = "escrow.release_failed"
+	EventRefunded      = "escrow.refunded"
+	EventRefundFailed  = "escrow.refund_failed"
+	EventCancelled     = "escrow.cancelled"
+)
+
+// SystemActor records actions the gateway took by itself
+const SystemActor = "system"
+
+// Escrow is a payment held for a payee until the merchant releases it to
+// them by B2C transfer, or refunds it to the payer
+type Escrow struct {
+	ID          string `json:"id"`
+	Merchant    string `json:"merchant"`
+	PaymentID   string `json:"payment_id"`
+	TraceNumber string `json:"trace_number"`
+	Payer       string `json:"payer"`
+	Amount      int    `json:"amount"`
+	Payee       string `json:"payee"`
+	ShortCode   string `json:"short_code"`
+	Reason      string `json:"reason,omitempty"`
+	// InitiatedBy is the initiator of releases and refunds that need approval
+	InitiatedBy string `json:"initiated_by,omitempty"`
+	Status      Status `json:"status"`
+	// Disputed is kept while a release or refund is in flight, so a failed
+	// one returns the escrow to DISPUTED rather than HELD
+	Disputed bool `json:"disputed,omitempty"`
+
+	// AutoReleaseAfter starts AutoReleaseAt once the payment is held
+	AutoReleaseAfter string     `json:"auto_release_after,omitempty"`
+	AutoReleaseAt    *time.Time `json:"auto_release_at,omitempty"`
+
+	// TransactionID is the release or refund transfer in flight or done
+	TransactionID string `json:"transaction_id,omitempty"`
+	// Error is why an escrow was not held although its payment was recorded
+	// as successful
+	Error string `json:"error,omitempty"`
+
+	Trail []Entry `json:"trail"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	HeldAt    *time.Time `json:"held_at,omitempty"`
+	ClosedAt  *time.Time `json:"closed_at,omitempty"`
+}
+
+// Entry is one step in an escrow's audit trail
+type Entry struct {
+	At            time.Time `json:"at"`
+	Action        Action    `json:"action"`
+	Actor         string    `json:"actor"`
+	Note          string    `json:"note,omitempty"`
+	Status        Status    `json:"status"`
+	TransactionID string    `json:"transaction_id,omitempty"`
+}
+
+func (e *Escrow) copy() *Escrow {
+	out := *e
+	out.Trail = append([]Entry(nil), e.Trail...)
+	return &out
+}
+
+func (e *Escrow) record(at time.Time, action Action, actor, note, txID string) {
+	e.UpdatedAt = at
+	e.Trail = append(e.Trail, Entry{At: at, Action: action, Actor: actor, Note: note, Status: e.Status, TransactionID: txID})
+}
+
+// held reports whether the escrow holds a payment no release or refund has
+// been started for
+func (e *Escrow) held() bool {
+	return e.Status == StatusHeld || e.Status == StatusDisputed
+}
+
+// Event is a change to report to the merchant
+type Event struct {
+	Type   string
+	Escrow *Escrow
+}
+
+type Store struct {
+	path string
+
+	mu      sync.Mutex
+	escrows map[string]*Escrow
+}
+
+func NewStore(path string) (*Store, error) {
+	s := &Store{
+		path:    path,
+		escrows: make(map[string]*Escrow),
+	}
+	if path == "" {
+		return s, nil
+	}
+	if err := store.LoadJSON(path, &s.escrows); err != nil {
+		return nil, err
+	}
+	if s.escrows == nil {
+		s.escrows = make(map[string]*Escrow)
+	}
+	return s, nil
+}
+
+// Create records an escrow awaiting its payment
+func (s *Store) Create(e *Escrow, actor string) (*Escrow, error) {
+	if e.Amount <= 0 || e.Payee == "" {
+		return nil, fmt.Errorf("amount and payee are required")
+	}
+	if e.AutoReleaseAfter != "" {
+		d, err := time.ParseDuration(e.AutoReleaseAfter)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("auto_release_after must be a positive duration")
+		}
+	}
+	now := time.Now()
+	e.ID = store.NewID("esc")
+	e.Status = StatusAwaitingPayment
+	e.Disputed = false
+	e.AutoReleaseAt, e.HeldAt, e.ClosedAt = nil, nil, nil
+	e.TransactionID, e.Error = "", ""
+	e.Trail = nil
+	e.CreatedAt = now
+	e.record(now, ActionCreated, actor, "", e.PaymentID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := e.copy()
+	s.escrows[e.ID] = stored
+	s.persist()
+	return stored.copy(), nil
+}
+
+// Get returns the merchant's escrow (any merchant's if empty)
+func (s *Store) Get(id, merchant string) (*Escrow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.escrows[id]
+	if !ok || (merchant != "" && e.Merchant != merchant) {
+		return nil, ErrNotFound
+	}
+	return e.copy(), nil
+}
+
+// List returns escrows for merchant (all merchants if empty) with status, newest first
+func (s *Store) List(merchant string, status Status) []*Escrow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := []*Escrow{}
+	for _, e := range s.escrows {
+		if merchant != "" && e.Merchant != merchant {
+			continue
+		}
+		if status != "" && e.Status != status {
+			continue
+		}
+		out = append(out, e.copy())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
+
+// Hold marks an escrow's payment as collected and starts its auto-release
+// timer. An escrow cancelled before its payment succeeded late is held too,
+// as the payer has been charged.
+func (s *Store) Hold(id string, now time.Time) []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.escrows[id]
+	if !ok || (e.Status != StatusAwaitingPayment && e.Status != StatusCancelled) {
+		return nil
+	}
+	e.Status = StatusHeld
+	e.HeldAt = &now
+	e.ClosedAt = nil
+	e.Error = ""
+	if d, err := time.ParseDuration(e.AutoReleaseAfter); err == nil && d > 0 {
+		at := now.Add(d)
+		e.AutoReleaseAt = &at
+	}
+	e.record(now, ActionHeld, SystemActor, "", e.PaymentID)
+	s.persist()
+	return []Event{{EventHeld, e.copy()}}
+}
+
+// Unconfirmed cancels an escrow whose payment the provider did not confirm,
+// so it is not held
+func (s *Store) Unconfirmed(id, reason string, now time.Time) []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.escrows[id]
+	if !ok || (e.Status != StatusAwaitingPayment && e.Status != StatusCancelled) {
+		return nil
+	}
+	e.Error = reason
+	// an escrow cancelled before has been reported already
+	if e.Status == StatusCancelled {
+		e.UpdatedAt = now
+		s.persist()
+		return nil
+	}
+	e.Status = StatusCancelled
+	e.ClosedAt = &now
+	e.record(now, ActionPaymentFailed, SystemActor, reason, e.PaymentID)
+	s.persist()
+	return []Event{{EventCancelled, e.copy()}}
+}
+
+// PaymentFailed cancels an escrow whose payment did not go through
+func (s *Store) PaymentFailed(id, message string, now time.Time) []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.escrows[id]
+	if !ok || e.Status != StatusAwaitingPayment {
+		return nil
+	}
+	e.Status = StatusCancelled
+	e.ClosedAt = &now
+	e.record(now, ActionPaymentFailed, SystemActor, message, e.PaymentID)
+	s.persist()
+	return []Event{{EventCancelled, e.copy()}}
+}
+
+// Cancel withdraws an escrow whose payment has not been made yet
+func (s *Store) Cancel(id, merchant, actor, note string, now time.Time) (*Escrow, []Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, err := s.get(id, merchant)
+	if err != nil {
+		return nil, nil, err
+	}
+	if e.Status != StatusAwaitingPayment {
+		return nil, nil, fmt.Errorf("%w: it is %s", ErrState, e.Status)
+	}
+	e.Status = StatusCancelled
+	e.ClosedAt = &now
+	e.record(now, ActionCancelled, actor, note, "")
+	s.persist()
+	out := e.copy()
+	return out, []Event{{EventCancelled, out}}, nil
+}
+
+// Dispute stops a held escrow from being released automatically until the
+// merchant releases or refunds it
+func (s *Store) Dispute(id, merchant, actor, note string, now time.Time) (*Escrow, []Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, err := s.get(id, merchant)
+	if err != nil {
+		return nil, nil, err
+	}
+	if e.Status != StatusHeld {
+		return nil, nil, fmt.Errorf("%w: it is %s", ErrState, e.Status)
+	}
+	e.Status = StatusDisputed
+	e.Disputed = true
+	e.AutoReleaseAt = nil
+	e.record(now, ActionDisputed, actor, note, "")
+	s.persist()
+	out := e.copy()
+	return out, []Event{{EventDisputed, out}}, nil
+}
+
+// Begin claims a held escrow for a release or a refund, so only one can be
+// in flight, recording txID as its transfer before it is submitted
+func (s *Store) Begin(id, merchant string, action Action, actor, note, txID string, now time.Time) (*Escrow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, err := s.get(id, merchant)
+	if err != nil {
+		return nil, err
+	}
+	if !e.held() {
+		return nil, fmt.Errorf("%w: it is %s", ErrState, e.Status)
+	}
+	switch action {
+	case ActionRelease, ActionAutoRelease:
+		if action == ActionAutoRelease && (e.Status != StatusHeld || e.AutoReleaseAt == nil || now.Before(*e.AutoReleaseAt)) {
+			return nil, fmt.Errorf("%w: it is not due for release", ErrState)
+		}
+		e.Status = StatusReleasing
+	case ActionRefund:
+		e.Status = StatusRefunding
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrState, action)
+	}
+	e.TransactionID = txID
+	e.record(now, action, actor, note, txID)
+	s.persist()
+	return e.copy(), nil
+}
+
+// Outcome is how a release or refund transfer went
+type Outcome int
+
+const (
+	// InFlight transfers are at the provider or awaiting approval
+	InFlight Outcome = iota
+	Succeeded
+	Failed
+)
+
+// Settle records the transfer of a release or refund. A failed one returns
+// the escrow to being held, so it can be released or refunded again. A
+// transfer whose outcome is not known yet is InFlight and keeps the escrow
+// RELEASING or REFUNDING until its status is known.
+func (s *Store) Settle(id, txID string, outcome Outcome, message string, now time.Time) []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.escrows[id]
+	if !ok || (e.Status != StatusReleasing && e.Status != StatusRefunding) {
+		return nil
+	}
+	if txID != "" {
+		e.TransactionID = txID
+	}
+	releasing := e.Status == StatusReleasing
+	var action Action
+	var event string
+	switch {
+	case outcome == InFlight:
+		s.persist()
+		return nil
+	case outcome == Succeeded && releasing:
+		e.Status, action, event = StatusReleased, ActionReleased, EventReleased
+	case outcome == Succeeded:
+		e.Status, action, event = StatusRefunded, ActionRefunded, EventRefunded
+	case releasing:
+		action, event = ActionReleaseFailed, EventReleaseFailed
+	default:
+		action, event = ActionRefundFailed, EventRefundFailed
+	}
+	if outcome == Succeeded {
+		e.ClosedAt = &now
+		e.AutoReleaseAt = nil
+	} else {
+		e.Status = StatusHeld
+		if e.Disputed {
+			e.Status = StatusDisputed
+		}
+		// a failed automatic release is not retried on its own
+		if e.AutoReleaseAt != nil && !now.Before(*e.AutoReleaseAt) {
+			e.AutoReleaseAt = nil
+		}
+	}
+	e.record(now, action, SystemActor, message, e.TransactionID)
+	s.persist()
+	return []Event{{event, e.copy()}}
+}
+
+// ByTransaction finds the escrow a release or refund transfer is for
+func (s *Store) ByTransaction(txID string) (*Escrow, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range s.escrows {
+		if e.TransactionID == txID {
+			return e.copy(), true
+		}
+	}
+	return nil, false
+}
+
+// Stuck lists escrows releasing or refunding since before, e.g. because a
+// restart cut their transfer short
+func (s *Store) Stuck(before time.Time) []*Escrow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []*Escrow
+	for _, e := range s.escrows {
+		if (e.Status == StatusReleasing || e.Status == StatusRefunding) && e.UpdatedAt.Before(before) {
+			out = append(out, e.copy())
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// DueForRelease lists held escrows whose auto-release time has come
+func (s *Store) DueForRelease(now time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []string
+	for _, e := range s.escrows {
+		if e.Status == StatusHeld && e.AutoReleaseAt != nil && !now.Before(*e.AutoReleaseAt) {
+			out = append(out, e.ID)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// get returns the merchant's stored escrow; caller holds s.mu
+func (s *Store) get(id, merchant string) (*Escrow, error) {
+	e, ok := s.escrows[id]
+	if !ok || (merchant != "" && e.Merchant != merchant) {
+		return nil, ErrNotFound
+	}
+	return e, nil
+}
+
+// persist mirrors the store to disk; caller holds s.mu
+func (s *Store) persist() {
+	if s.path == "" {
+		return
+	}
+	if err := store.SaveJSON(s.path, s.escrows); err != nil {
+		log.Printf("[Escrow] failed to persist state: %v", err)
+	}
+}
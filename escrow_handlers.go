@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"kacha-psp/escrow"
+	"kacha-psp/response"
+	"kacha-psp/store"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type createEscrowRequest struct {
+	Phone       string `json:"phone" binding:"required"`
+	Amount      int    `json:"amount" binding:"required,gt=0"`
+	TraceNumber string `json:"trace_number" binding:"required"`
+	Reason      string `json:"reason"`
+	Payee       string `json:"payee" binding:"required"`
+	ShortCode   string `json:"short_code" binding:"required"`
+	// AutoReleaseAfter releases the escrow this long after the payment is held
+	AutoReleaseAfter string `json:"auto_release_after"`
+	// InitiatedBy is required when a release or refund needs approval, and
+	// is the operator authenticated by X-Operator-Token
+	InitiatedBy string `json:"initiated_by"`
+}
+
+// escrowActionRequest names who took an action, for the audit trail; it
+// defaults to the merchant
+type escrowActionRequest struct {
+	Actor string `json:"actor"`
+	Note  string `json:"note"`
+}
+
+// handleCreateEscrow requests a push USSD payment to be held for a payee
+func (s *server) handleCreateEscrow(c *gin.Context) {
+	var req createEscrowRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	initiatedBy, err := s.actingOperator(c, c.GetString("merchant"), req.InitiatedBy)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	e, tx, resp, err := s.startEscrow(&escrow.Escrow{
+		Merchant:         c.GetString("merchant"),
+		TraceNumber:      req.TraceNumber,
+		Payer:            req.Phone,
+		Amount:           req.Amount,
+		Payee:            req.Payee,
+		ShortCode:        req.ShortCode,
+		Reason:           req.Reason,
+		InitiatedBy:      initiatedBy,
+		AutoReleaseAfter: req.AutoReleaseAfter,
+	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"escrow":  e,
+		"payment": s.providerResponse(e.Merchant, response.FormatPSP, resp, true, tx),
+	})
+}
+
+func (s *server) handleListEscrows(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"escrows": s.escrows.List(c.GetString("merchant"), escrow.Status(c.Query("status")))})
+}
+
+func (s *server) handleGetEscrow(c *gin.Context) {
+	e, err := s.escrows.Get(c.Param("id"), c.GetString("merchant"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, e)
+}
+
+// handleReleaseEscrow pays a held or disputed escrow to its payee
+func (s *server) handleReleaseEscrow(c *gin.Context) {
+	req, ok := bindEscrowAction(c)
+	if !ok {
+		return
+	}
+	e, err := s.releaseEscrow(c.Param("id"), c.GetString("merchant"), escrow.ActionRelease, req.Actor, req.Note)
+	respondEscrow(c, e, err)
+}
+
+// handleDisputeEscrow holds an escrow until the merchant releases or refunds
+// it, stopping its auto-release
+func (s *server) handleDisputeEscrow(c *gin.Context) {
+	req, ok := bindEscrowAction(c)
+	if !ok {
+		return
+	}
+	e, events, err := s.escrows.Dispute(c.Param("id"), c.GetString("merchant"), req.Actor, req.Note, time.Now())
+	s.emitEscrowEvents(events)
+	respondEscrow(c, e, err)
+}
+
+// handleRefundEscrow returns a held or disputed escrow's payment to the payer
+func (s *server) handleRefundEscrow(c *gin.Context) {
+	req, ok := bindEscrowAction(c)
+	if !ok {
+		return
+	}
+	e, err := s.refundEscrow(c.Param("id"), c.GetString("merchant"), req.Actor, req.Note)
+	respondEscrow(c, e, err)
+}
+
+// handleCancelEscrow withdraws an escrow whose payment has not been made, or
+// refunds one that holds a payment
+func (s *server) handleCancelEscrow(c *gin.Context) {
+	req, ok := bindEscrowAction(c)
+	if !ok {
+		return
+	}
+	id, merchant := c.Param("id"), c.GetString("merchant")
+	e, events, err := s.escrows.Cancel(id, merchant, req.Actor, req.Note, time.Now())
+	if errors.Is(err, escrow.ErrState) {
+		e, err = s.refundEscrow(id, merchant, req.Actor, req.Note)
+		respondEscrow(c, e, err)
+		return
+	}
+	if err != nil {
+		respondEscrow(c, nil, err)
+		return
+	}
+	s.emitEscrowEvents(events)
+	// a payment already made is held by its callback and can then be refunded
+	s.closePending(e.PaymentID, store.StatusCancelled, "escrow cancelled")
+	c.JSON(http.StatusOK, e)
+}
+
+func (s *server) handleAdminListEscrows(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"escrows": s.escrows.List(c.Query("merchant"), escrow.Status(c.Query("status")))})
+}
+
+func (s *server) handleAdminGetEscrow(c *gin.Context) {
+	e, err := s.escrows.Get(c.Param("id"), "")
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, e)
+}
+
+func bindEscrowAction(c *gin.Context) (escrowActionRequest, bool) {
+	var req escrowActionRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return req, false
+		}
+	}
+	if req.Actor == "" {
+		req.Actor = c.GetString("merchant")
+	}
+	return req, true
+}
+
+// respondEscrow reports an escrow action. A release or refund whose transfer
+// failed leaves the escrow held, which is included with the error.
+func respondEscrow(c *gin.Context, e *escrow.Escrow, err error) {
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, e)
+	case errors.Is(err, escrow.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, escrow.ErrState):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case e != nil:
+		status, body := http.StatusBadGateway, gin.H{"error": err.Error()}
+		var apiErr *apiError
+		if errors.As(err, &apiErr) {
+			status = apiErr.status
+			for k, v := range apiErr.details {
+				body[k] = v
+			}
+		}
+		body["escrow"] = e
+		c.JSON(status, body)
+	default:
+		respondError(c, err)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"kacha-psp/escrow"
+	kacha "kacha-psp/kacha"
+	"kacha-psp/provider"
+	"kacha-psp/routing"
+	"kacha-psp/store"
+	"log"
+	"net/http"
+	"time"
+)
+
+const sourceEscrow = "ESCROW"
+
+// startEscrow records an escrow and requests its payment by push USSD. The
+// payment is held once it succeeds.
+func (s *server) startEscrow(e *escrow.Escrow) (*escrow.Escrow, *store.Transaction, *kacha.PushUSSDResponse, error) {
+	if s.cfg.PublicURL == "" {
+		return nil, nil, nil, newAPIError(http.StatusServiceUnavailable, "escrow payments need PUBLIC_URL for callbacks", nil)
+	}
+	creds, err := s.keyring.Credentials(e.Merchant)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	e.PaymentID = store.NewID("txn")
+	e, err = s.escrows.Create(e, e.Merchant)
+	if err != nil {
+		return nil, nil, nil, newAPIError(http.StatusBadRequest, err.Error(), nil)
+	}
+	reason := e.Reason
+	if reason == "" {
+		reason = "payment " + e.TraceNumber
+	}
+	tx, resp, err := s.requestPushUSSD(&store.Transaction{
+		ID:          e.PaymentID,
+		Type:        store.TypePushUSSD,
+		Merchant:    e.Merchant,
+		TraceNumber: e.TraceNumber,
+		Phone:       e.Payer,
+		Amount:      e.Amount,
+		Source:      sourceEscrow,
+		SourceID:    e.ID,
+	}, creds, kacha.PushUSSDRequest{
+		Phone:       e.Payer,
+		Amount:      e.Amount,
+		TraceNumber: e.TraceNumber,
+		Reason:      reason,
+	})
+	if err != nil {
+		// payments stopped before reaching the provider never settle
+		s.emitEscrowEvents(s.escrows.PaymentFailed(e.ID, err.Error(), time.Now()))
+		return nil, nil, nil, err
+	}
+	return e, tx, resp, nil
+}
+
+// escrowStuckAfter is how long an escrow may be releasing or refunding before
+// its transfer is looked into, e.g. after a restart cut it short
+const escrowStuckAfter = 10 * time.Minute
+
+// escrowSettled holds an escrow's payment once it succeeds, or cancels the
+// escrow, and records how a release transfer ended
+func (s *server) escrowSettled(tx *store.Transaction) {
+	if tx.Type == store.TypeTransfer {
+		s.escrowTransferSettled(tx)
+		return
+	}
+	if tx.Status != store.StatusSuccess && tx.LateStatus != store.StatusSuccess {
+		s.emitEscrowEvents(s.escrows.PaymentFailed(tx.SourceID, tx.Message, time.Now()))
+		return
+	}
+	s.holdEscrow(tx)
+}
+
+// holdEscrow holds an escrow's payment once the provider confirms it, as a
+// release pays the money out again. Payments the provider cannot confirm yet
+// are retried by holdPaidEscrows.
+func (s *server) holdEscrow(payment *store.Transaction) {
+	status, err := s.confirmPayment(payment)
+	switch {
+	case err != nil:
+		log.Printf("[Escrow] cannot confirm payment %s of %s yet: %v", payment.ID, payment.SourceID, err)
+		return
+	case !status.Final():
+		log.Printf("[Escrow] payment %s of %s is still %s at the provider", payment.ID, payment.SourceID, status)
+		return
+	case status != store.StatusSuccess:
+		log.Printf("[Escrow] ALERT: payment %s of %s was recorded as paid but the provider reports it %s; not holding it",
+			payment.ID, payment.SourceID, status)
+		s.emitEscrowEvents(s.escrows.Unconfirmed(payment.SourceID, "provider reports the payment "+string(status), time.Now()))
+		return
+	}
+	s.emitEscrowEvents(s.escrows.Hold(payment.SourceID, time.Now()))
+}
+
+// holdPaidEscrows holds escrows whose payment succeeded but could not be
+// confirmed with the provider when it did
+func (s *server) holdPaidEscrows() {
+	escrows := s.escrows.List("", escrow.StatusAwaitingPayment)
+	escrows = append(escrows, s.escrows.List("", escrow.StatusCancelled)...)
+	for _, e := range escrows {
+		if e.Error != "" {
+			continue
+		}
+		payment, err := s.txs.Get(e.PaymentID)
+		if err != nil || (payment.Status != store.StatusSuccess && payment.LateStatus != store.StatusSuccess) {
+			continue
+		}
+		s.holdEscrow(payment)
+	}
+}
+
+// escrowTransferSettled records a release or refund transfer that settled
+// after it was submitted, e.g. once it was approved or its provider result
+// came in, including transfers whose outcome was unknown when they were
+// submitted. Transfers settling while being submitted are recorded by
+// finishEscrowTransfer.
+func (s *server) escrowTransferSettled(tx *store.Transaction) {
+	e, ok := s.escrows.ByTransaction(tx.ID)
+	if !ok {
+		return
+	}
+	outcome, message := escrowOutcome(tx)
+	s.emitEscrowEvents(s.escrows.Settle(e.ID, tx.ID, outcome, message, time.Now()))
+}
+
+// releaseEscrow pays a held escrow to its payee from the provider that took
+// the payment, through the usual risk, limit, float and approval checks
+func (s *server) releaseEscrow(id, merchant string, action escrow.Action, actor, note string) (*escrow.Escrow, error) {
+	e, err := s.escrows.Begin(id, merchant, action, actor, note, store.NewID("txn"), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	payment, creds, err := s.escrowPayment(e)
+	if err != nil {
+		return s.finishEscrowTransfer(e.ID, nil, err)
+	}
+	p, err := s.provider(payment.Provider, creds)
+	if err != nil {
+		return s.finishEscrowTransfer(e.ID, nil, err)
+	}
+	reason := e.Reason
+	if reason == "" {
+		reason = "release of escrow " + e.TraceNumber
+	}
+	outcome, err := s.submitTransfer(transferSubmission{
+		Request: kacha.TransferRequest{
+			Username:  creds.Username,
+			Password:  creds.Password,
+			To:        e.Payee,
+			Amount:    e.Amount,
+			Reason:    reason,
+			ShortCode: e.ShortCode,
+		},
+		Provider:    p,
+		Decision:    routing.Decision{Provider: p.Name(), Reason: "escrow release via payment provider"},
+		Tx:          &store.Transaction{ID: e.TransactionID, Source: sourceEscrow, SourceID: e.ID},
+		InitiatedBy: e.InitiatedBy,
+	})
+	return s.finishEscrowTransfer(e.ID, outcome, err)
+}
+
+// refundEscrow returns a held escrow's payment to the payer
+func (s *server) refundEscrow(id, merchant, actor, note string) (*escrow.Escrow, error) {
+	e, err := s.escrows.Begin(id, merchant, escrow.ActionRefund, actor, note, store.NewID("txn"), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	payment, creds, err := s.escrowPayment(e)
+	if err != nil {
+		return s.finishEscrowTransfer(e.ID, nil, err)
+	}
+	outcome, err := s.refundPayment(refundRequest{
+		Creds:         creds,
+		Payment:       payment,
+		Amount:        e.Amount,
+		Reason:        "refund of escrow " + e.TraceNumber,
+		ShortCode:     e.ShortCode,
+		InitiatedBy:   e.InitiatedBy,
+		TransactionID: e.TransactionID,
+	})
+	return s.finishEscrowTransfer(e.ID, outcome, err)
+}
+
+func (s *server) escrowPayment(e *escrow.Escrow) (*store.Transaction, provider.Credentials, error) {
+	payment, err := s.txs.Get(e.PaymentID)
+	if err != nil {
+		return nil, provider.Credentials{}, err
+	}
+	creds, err := s.keyring.Credentials(e.Merchant)
+	if err != nil {
+		return nil, provider.Credentials{}, err
+	}
+	return payment, creds, nil
+}
+
+// finishEscrowTransfer records the submitted release or refund transfer of
+// an escrow, returning the escrow and err. A transfer whose outcome is unknown
+// keeps the escrow releasing or refunding until the poller learns its status,
+// so it is not paid twice.
+func (s *server) finishEscrowTransfer(id string, outcome *transferOutcome, err error) (*escrow.Escrow, error) {
+	switch {
+	case errors.Is(err, errOutcomeUnknown):
+		log.Printf("[Escrow] transfer for %s has an unknown outcome; awaiting its status: %v", id, err)
+		s.emitEscrowEvents(s.escrows.Settle(id, "", escrow.InFlight, "", time.Now()))
+	case err != nil:
+		log.Printf("[Escrow] transfer for %s failed: %v", id, err)
+		s.emitEscrowEvents(s.escrows.Settle(id, "", escrow.Failed, err.Error(), time.Now()))
+	default:
+		result, message := escrowOutcome(outcome.Tx)
+		s.emitEscrowEvents(s.escrows.Settle(id, outcome.Tx.ID, result, message, time.Now()))
+	}
+	e, getErr := s.escrows.Get(id, "")
+	if getErr != nil {
+		return nil, getErr
+	}
+	return e, err
+}
+
+func escrowOutcome(tx *store.Transaction) (escrow.Outcome, string) {
+	switch tx.Status {
+	case store.StatusSuccess:
+		return escrow.Succeeded, ""
+	case store.StatusPending, store.StatusAwaitingApproval:
+		return escrow.InFlight, ""
+	}
+	return escrow.Failed, tx.Message
+}
+
+// settleStuckEscrow records a release or refund left in flight from its
+// transaction. One whose transaction was never recorded was never sent and
+// is failed, returning the escrow to being held.
+func (s *server) settleStuckEscrow(e *escrow.Escrow) {
+	outcome, message := escrow.Failed, "transfer was interrupted before it was sent"
+	if tx, err := s.txs.Get(e.TransactionID); err == nil {
+		outcome, message = escrowOutcome(tx)
+	}
+	if outcome == escrow.InFlight {
+		// the poller or an approval settles it
+		return
+	}
+	log.Printf("[Escrow] %s was left %s; settling its transfer %s", e.ID, e.Status, e.TransactionID)
+	s.emitEscrowEvents(s.escrows.Settle(e.ID, e.TransactionID, outcome, message, time.Now()))
+}
+
+// releaseDueEscrows holds escrows whose payment is still to be confirmed,
+// settles releases and refunds cut short and releases held escrows whose
+// auto-release time has come
+func (s *server) releaseDueEscrows() {
+	s.holdPaidEscrows()
+	for _, e := range s.escrows.Stuck(time.Now().Add(-escrowStuckAfter)) {
+		s.settleStuckEscrow(e)
+	}
+	for _, id := range s.escrows.DueForRelease(time.Now()) {
+		if _, err := s.releaseEscrow(id, "", escrow.ActionAutoRelease, escrow.SystemActor, "auto-release"); err != nil {
+			log.Printf("[Escrow] ALERT: auto-release of %s failed: %v", id, err)
+		}
+	}
+}
+
+func (s *server) emitEscrowEvents(events []escrow.Event) {
+	for _, e := range events {
+		log.Printf("[Escrow] %s %s", e.Type, e.Escrow.ID)
+		s.webhooks.Send(e.Escrow.Merchant, e.Type, e.Escrow)
+	}
+}
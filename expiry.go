@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"kacha-psp/store"
+	"log"
+	"time"
+)
+
+// Events sent to merchant webhooks about their payment requests
+const (
+	eventTransactionExpired   = "transaction.expired"
+	eventTransactionCancelled = "transaction.cancelled"
+	// eventTransactionLate reports a provider result for a transaction the
+	// gateway had already expired or cancelled, usually a payment to refund
+	eventTransactionLate = "transaction.late_result"
+)
+
+var errNotPending = errors.New("transaction is no longer pending")
+
+// expireTransactions expires payment requests that got no final status
+// within their type's TTL
+func (s *server) expireTransactions() {
+	now := time.Now()
+	for _, tx := range s.txs.List(store.Filter{Status: store.StatusPending}) {
+		ttl := s.pendingTTL(tx.Type)
+		if ttl <= 0 || now.Sub(tx.CreatedAt) < ttl {
+			continue
+		}
+		if _, err := s.closePending(tx.ID, store.StatusExpired, "no final status within "+ttl.String()); err == nil {
+			log.Printf("Expired %s %s after %s", tx.Type, tx.ID, ttl)
+		}
+	}
+}
+
+func (s *server) pendingTTL(t store.Type) time.Duration {
+	switch t {
+	case store.TypeOTPPayment:
+		return s.cfg.OTPPaymentTTL
+	case store.TypePushUSSD:
+		return s.cfg.PushUSSDTTL
+	}
+	// transfers may have moved money and are never expired blindly
+	return 0
+}
+
+// closePending moves a pending transaction to EXPIRED or CANCELLED and tells
+// the merchant. It fails with errNotPending if the transaction settled first.
+func (s *server) closePending(id string, status store.Status, message string) (*store.Transaction, error) {
+	tx, err := s.txs.Update(id, func(tx *store.Transaction) error {
+		if tx.Status != store.StatusPending {
+			return errNotPending
+		}
+		tx.Status = status
+		tx.Message = message
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.transactionUpdated(tx)
+
+	event := eventTransactionExpired
+	if status == store.StatusCancelled {
+		event = eventTransactionCancelled
+	}
+	s.webhooks.Send(tx.Merchant, event, tx)
+	return tx, nil
+}
+
+// recordProviderResult applies a result reported by a provider. Results for
+// transactions already expired or cancelled are kept as LateStatus instead,
+// since the gateway and the merchant have moved on, and the merchant is told.
+// A transaction with a final result keeps it; a different result reported
+// for it is logged as an alert.
+func (s *server) recordProviderResult(id string, fn func(tx *store.Transaction)) {
+	late := false
+	var conflict store.Status
+	tx, err := s.txs.Update(id, func(tx *store.Transaction) error {
+		if !tx.Status.Final() {
+			fn(tx)
+			return nil
+		}
+		result := *tx
+		fn(&result)
+		if tx.Status != store.StatusExpired && tx.Status != store.StatusCancelled {
+			if result.Status.Final() && result.Status != tx.Status {
+				conflict = result.Status
+			}
+			return errNotPending
+		}
+		if !result.Status.Final() || result.Status == tx.Status || result.Status == tx.LateStatus {
+			return errNotPending
+		}
+		now := time.Now()
+		late = true
+		tx.LateStatus = result.Status
+		tx.LateAt = &now
+		if tx.ProviderTxID == "" {
+			tx.ProviderTxID = result.ProviderTxID
+		}
+		return nil
+	})
+	switch {
+	case conflict != "":
+		log.Printf("ALERT: provider reports %s for transaction %s, which is final; keeping its result", conflict, id)
+		return
+	case errors.Is(err, errNotPending):
+		return
+	case err != nil:
+		log.Printf("Failed to update transaction %s: %v", id, err)
+		return
+	case late:
+		log.Printf("Late %s result for %s transaction %s", tx.LateStatus, tx.Status, tx.ID)
+		s.recordInLedger(tx)
+		if tx.LateStatus == store.StatusSuccess {
+			s.paidLate(tx)
+		}
+		s.webhooks.Send(tx.Merchant, eventTransactionLate, tx)
+		return
+	}
+	s.transactionUpdated(tx)
+}
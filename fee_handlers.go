@@ -0,0 +1,98 @@
+package main
+
+import (
+	"kacha-psp/fees"
+	kacha "kacha-psp/kacha"
+	"kacha-psp/store"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// chargeFee records on a transaction about to be sent the fee its merchant
+// is charged for it
+func (s *server) chargeFee(tx *store.Transaction) {
+	q := s.fees.Calculate(tx.Merchant, string(tx.Type), tx.Amount)
+	tx.Fee, tx.FeeScheduleID = q.Fee, q.ScheduleID
+}
+
+// withFee adds a transaction's fee to a PSP response when configured to
+func (s *server) withFee(resp kacha.PSPResponse, tx *store.Transaction) kacha.PSPResponse {
+	if s.cfg.FeesInResponse && tx != nil {
+		fee := tx.Fee
+		resp.Fee = &fee
+	}
+	return resp
+}
+
+func (s *server) handleGetFeeSchedules(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"schedules": s.fees.Schedules()})
+}
+
+func (s *server) handlePutFeeSchedules(c *gin.Context) {
+	var all []fees.Schedule
+	if err := c.ShouldBindJSON(&all); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := s.fees.SetSchedules(all); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"schedules": s.fees.Schedules()})
+}
+
+func (s *server) handleUpsertFeeSchedule(c *gin.Context) {
+	var schedule fees.Schedule
+	if err := c.ShouldBindJSON(&schedule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if id := c.Param("id"); id != "" {
+		schedule.ID = id
+	}
+	if err := s.fees.Upsert(schedule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, schedule)
+}
+
+func (s *server) handleDeleteFeeSchedule(c *gin.Context) {
+	if !s.fees.Delete(c.Param("id")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "fee schedule not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// handleMerchantFeePreview tells a merchant what an operation would cost it
+func (s *server) handleMerchantFeePreview(c *gin.Context) {
+	s.previewFee(c, c.GetString("merchant"))
+}
+
+func (s *server) handleFeePreview(c *gin.Context) {
+	merchant := c.Query("merchant")
+	if merchant == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "merchant is required"})
+		return
+	}
+	s.previewFee(c, merchant)
+}
+
+func (s *server) previewFee(c *gin.Context, merchant string) {
+	operation := store.Type(c.Query("operation"))
+	switch operation {
+	case store.TypeOTPPayment, store.TypePushUSSD, store.TypeTransfer:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "operation must be OTP_PAYMENT, PUSH_USSD or TRANSFER"})
+		return
+	}
+	amount, err := strconv.Atoi(c.Query("amount"))
+	if err != nil || amount <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "amount must be a positive whole number"})
+		return
+	}
+	c.JSON(http.StatusOK, s.fees.Calculate(merchant, string(operation), amount))
+}
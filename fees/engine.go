@@ -0,0 +1,118 @@
+package fees
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"kacha-psp/store"
+)
+
+// Engine holds the fee schedules and computes the fee for a transaction
+type Engine struct {
+	path string
+
+	mu        sync.Mutex
+	schedules []Schedule
+}
+
+func NewEngine(path string) (*Engine, error) {
+	e := &Engine{path: path}
+	if path == "" {
+		return e, nil
+	}
+	if err := store.LoadJSON(path, &e.schedules); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *Engine) Schedules() []Schedule {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Schedule{}, e.schedules...)
+}
+
+// SetSchedules validates and replaces all schedules
+func (e *Engine) SetSchedules(schedules []Schedule) error {
+	seen := make(map[string]bool)
+	for _, s := range schedules {
+		if err := s.Validate(); err != nil {
+			return err
+		}
+		if seen[s.ID] {
+			return fmt.Errorf("duplicate fee schedule id %s", s.ID)
+		}
+		seen[s.ID] = true
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.schedules = append([]Schedule(nil), schedules...)
+	e.persist()
+	return nil
+}
+
+// Upsert adds a schedule or replaces the one with the same id
+func (e *Engine) Upsert(schedule Schedule) error {
+	if err := schedule.Validate(); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i, s := range e.schedules {
+		if s.ID == schedule.ID {
+			e.schedules[i] = schedule
+			e.persist()
+			return nil
+		}
+	}
+	e.schedules = append(e.schedules, schedule)
+	e.persist()
+	return nil
+}
+
+func (e *Engine) Delete(id string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i, s := range e.schedules {
+		if s.ID == id {
+			e.schedules = append(e.schedules[:i], e.schedules[i+1:]...)
+			e.persist()
+			return true
+		}
+	}
+	return false
+}
+
+// Calculate returns the fee for a transaction under the most specific
+// schedule that applies to it; with no schedule the fee is zero. Among equally
+// specific schedules the first one wins.
+func (e *Engine) Calculate(merchant, operation string, amount int) Quote {
+	q := Quote{Merchant: merchant, Operation: operation, Amount: amount}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var best *Schedule
+	for i := range e.schedules {
+		s := &e.schedules[i]
+		if s.appliesTo(merchant, operation) && (best == nil || s.specificity() > best.specificity()) {
+			best = s
+		}
+	}
+	if best != nil {
+		q.Fee = best.Fee(amount)
+		q.ScheduleID = best.ID
+	}
+	return q
+}
+
+func (e *Engine) persist() {
+	if e.path == "" {
+		return
+	}
+	if err := store.SaveJSON(e.path, e.schedules); err != nil {
+		log.Printf("[Fees] failed to persist schedules: %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package fees
+
+import (
+	"fmt"
+	"math"
+)
+
+type Type string
+
+const (
+	TypeFlat       Type = "FLAT"
+	TypePercentage Type = "PERCENTAGE"
+	TypeTiered     Type = "TIERED"
+)
+
+// Tier is the fee for amounts up to UpTo; the last tier may leave UpTo 0 to
+// cover everything above the previous one
+type Tier struct {
+	UpTo    int     `json:"up_to,omitempty"`
+	Flat    int     `json:"flat,omitempty"`
+	Percent float64 `json:"percent,omitempty"`
+}
+
+// Schedule is how a merchant is charged for an operation. An empty Merchant
+// or Operation matches any; the most specific schedule applies. Min and Max
+// cap the computed fee; zero leaves it uncapped.
+type Schedule struct {
+	ID        string `json:"id"`
+	Merchant  string `json:"merchant,omitempty"`
+	Operation string `json:"operation,omitempty"`
+	Type      Type   `json:"type"`
+
+	Flat    int     `json:"flat,omitempty"`
+	Percent float64 `json:"percent,omitempty"`
+	Tiers   []Tier  `json:"tiers,omitempty"`
+
+	Min int `json:"min,omitempty"`
+	Max int `json:"max,omitempty"`
+}
+
+func (s Schedule) Validate() error {
+	if s.ID == "" {
+		return fmt.Errorf("fee schedule id is required")
+	}
+	if s.Flat < 0 || s.Percent < 0 || s.Min < 0 || s.Max < 0 {
+		return fmt.Errorf("fee schedule %s: values must not be negative", s.ID)
+	}
+	if s.Max > 0 && s.Min > s.Max {
+		return fmt.Errorf("fee schedule %s: min is greater than max", s.ID)
+	}
+	switch s.Type {
+	case TypeFlat, TypePercentage:
+	case TypeTiered:
+		if len(s.Tiers) == 0 {
+			return fmt.Errorf("fee schedule %s: tiers are required", s.ID)
+		}
+		for i, t := range s.Tiers {
+			if t.Flat < 0 || t.Percent < 0 || t.UpTo < 0 {
+				return fmt.Errorf("fee schedule %s: tier values must not be negative", s.ID)
+			}
+			last := i == len(s.Tiers)-1
+			if t.UpTo == 0 && !last {
+				return fmt.Errorf("fee schedule %s: only the last tier may leave up_to open", s.ID)
+			}
+			if i > 0 && t.UpTo != 0 && t.UpTo <= s.Tiers[i-1].UpTo {
+				return fmt.Errorf("fee schedule %s: tiers must be in increasing up_to order", s.ID)
+			}
+		}
+	default:
+		return fmt.Errorf("fee schedule %s: type must be FLAT, PERCENTAGE or TIERED", s.ID)
+	}
+	return nil
+}
+
+func (s Schedule) appliesTo(merchant, operation string) bool {
+	return (s.Merchant == "" || s.Merchant == merchant) && (s.Operation == "" || s.Operation == operation)
+}
+
+// specificity ranks matching schedules: merchant beats operation beats default
+func (s Schedule) specificity() int {
+	n := 0
+	if s.Merchant != "" {
+		n += 2
+	}
+	if s.Operation != "" {
+		n++
+	}
+	return n
+}
+
+// Fee computes the schedule's fee for amount, rounded to the nearest unit
+func (s Schedule) Fee(amount int) int {
+	var fee int
+	switch s.Type {
+	case TypeFlat:
+		fee = s.Flat
+	case TypePercentage:
+		fee = s.Flat + percentOf(amount, s.Percent)
+	case TypeTiered:
+		t := s.Tiers[len(s.Tiers)-1]
+		for _, tier := range s.Tiers {
+			if tier.UpTo == 0 || amount <= tier.UpTo {
+				t = tier
+				break
+			}
+		}
+		fee = t.Flat + percentOf(amount, t.Percent)
+	}
+	if fee < s.Min {
+		fee = s.Min
+	}
+	if s.Max > 0 && fee > s.Max {
+		fee = s.Max
+	}
+	return fee
+}
+
+func percentOf(amount int, percent float64) int {
+	return int(math.Round(float64(amount) * percent / 100))
+}
+
+// Quote is the fee charged for a transaction
+type Quote struct {
+	Merchant   string `json:"merchant"`
+	Operation  string `json:"operation"`
+	Amount     int    `json:"amount"`
+	Fee        int    `json:"fee"`
+	ScheduleID string `json:"schedule_id,omitempty"`
+}
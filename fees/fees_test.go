@@ -0,0 +1,100 @@
+package fees
+
+import (
+	"testing"
+
+	"kacha-psp/store"
+)
+
+func TestFee(t *testing.T) {
+	tiered := Schedule{ID: "t", Type: TypeTiered, Tiers: []Tier{
+		{UpTo: 1000, Flat: 5},
+		{UpTo: 10000, Percent: 1},
+		{Flat: 50, Percent: 0.5},
+	}}
+	tests := []struct {
+		name     string
+		schedule Schedule
+		amount   int
+		want     int
+	}{
+		{"flat", Schedule{Type: TypeFlat, Flat: 7}, 12345, 7},
+		{"percentage", Schedule{Type: TypePercentage, Percent: 1.5}, 1000, 15},
+		{"percentage plus flat", Schedule{Type: TypePercentage, Flat: 2, Percent: 1.5}, 1000, 17},
+		// 0.5% of 101 is 0.505 and of 99 is 0.495
+		{"percentage rounds up from half", Schedule{Type: TypePercentage, Percent: 0.5}, 101, 1},
+		{"percentage rounds down below half", Schedule{Type: TypePercentage, Percent: 0.5}, 99, 0},
+		{"minimum", Schedule{Type: TypePercentage, Percent: 1, Min: 10}, 500, 10},
+		{"maximum", Schedule{Type: TypePercentage, Percent: 1, Max: 100}, 50000, 100},
+		{"first tier", tiered, 1, 5},
+		{"tier bound is inclusive", tiered, 1000, 5},
+		{"second tier", tiered, 1001, 10},
+		{"open last tier", tiered, 20000, 150},
+		{"above closed tiers uses the last", Schedule{Type: TypeTiered, Tiers: []Tier{{UpTo: 100, Flat: 1}, {UpTo: 200, Flat: 2}}}, 500, 2},
+	}
+	for _, tt := range tests {
+		if got := tt.schedule.Fee(tt.amount); got != tt.want {
+			t.Errorf("%s: Fee(%d) = %d, want %d", tt.name, tt.amount, got, tt.want)
+		}
+	}
+}
+
+func TestCalculate(t *testing.T) {
+	e, err := NewEngine("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.SetSchedules([]Schedule{
+		{ID: "default", Type: TypeFlat, Flat: 1},
+		{ID: "transfers", Operation: string(store.TypeTransfer), Type: TypeFlat, Flat: 2},
+		{ID: "m1", Merchant: "m1", Type: TypeFlat, Flat: 3},
+		{ID: "m1-transfers", Merchant: "m1", Operation: string(store.TypeTransfer), Type: TypeFlat, Flat: 4},
+		{ID: "m1-transfers-again", Merchant: "m1", Operation: string(store.TypeTransfer), Type: TypeFlat, Flat: 5},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		merchant  string
+		operation store.Type
+		want      string
+	}{
+		{"m2", store.TypeOTPPayment, "default"},
+		{"m2", store.TypeTransfer, "transfers"},
+		{"m1", store.TypePushUSSD, "m1"},
+		// the first of equally specific schedules wins
+		{"m1", store.TypeTransfer, "m1-transfers"},
+	}
+	for _, tt := range tests {
+		if q := e.Calculate(tt.merchant, string(tt.operation), 1000); q.ScheduleID != tt.want {
+			t.Errorf("Calculate(%s, %s) used %q, want %q", tt.merchant, tt.operation, q.ScheduleID, tt.want)
+		}
+	}
+
+	if err := e.SetSchedules(nil); err != nil {
+		t.Fatal(err)
+	}
+	if q := e.Calculate("m1", string(store.TypeTransfer), 1000); q.Fee != 0 || q.ScheduleID != "" {
+		t.Errorf("Calculate without schedules = %+v, want no fee", q)
+	}
+}
+
+func TestValidateRejects(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule Schedule
+	}{
+		{"no id", Schedule{Type: TypeFlat}},
+		{"unknown type", Schedule{ID: "a", Type: "BANDED"}},
+		{"negative", Schedule{ID: "a", Type: TypeFlat, Flat: -1}},
+		{"min over max", Schedule{ID: "a", Type: TypeFlat, Min: 10, Max: 5}},
+		{"no tiers", Schedule{ID: "a", Type: TypeTiered}},
+		{"open tier not last", Schedule{ID: "a", Type: TypeTiered, Tiers: []Tier{{Flat: 1}, {UpTo: 100, Flat: 2}}}},
+		{"tiers out of order", Schedule{ID: "a", Type: TypeTiered, Tiers: []Tier{{UpTo: 200}, {UpTo: 100}}}},
+	}
+	for _, tt := range tests {
+		if err := tt.schedule.Validate(); err == nil {
+			t.Errorf("%s: Validate = nil, want an error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+// Package float holds merchants' payout funds against their share of the
+// provider account. A merchant's float is its ledger balance; transfers
+// reserve from it so concurrent payouts cannot overdraw it.
+package float
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"kacha-psp/store"
+)
+
+var ErrInsufficient = errors.New("insufficient float")
+
+// InsufficientError is ErrInsufficient with the amounts involved
+type InsufficientError struct {
+	Merchant  string `json:"merchant"`
+	Amount    int    `json:"amount"`
+	Available int    `json:"available"`
+}
+
+func (e *InsufficientError) Error() string {
+	return fmt.Sprintf("%v: %s has %d available for a transfer of %d", ErrInsufficient, e.Merchant, e.Available, e.Amount)
+}
+
+func (e *InsufficientError) Unwrap() error { return ErrInsufficient }
+
+// Settings are a merchant's float rules
+type Settings struct {
+	// Enforced overrides the default of whether transfers must be covered
+	Enforced *bool `json:"enforced,omitempty"`
+	// LowBalance raises an alert when available float drops below it; 0 never alerts
+	LowBalance int `json:"low_balance_threshold,omitempty"`
+	// LowSince is when available float dropped below LowBalance
+	LowSince *time.Time `json:"low_since,omitempty"`
+}
+
+// Reservation is float held for a transfer until it settles
+type Reservation struct {
+	ID            string    `json:"id"`
+	Merchant      string    `json:"merchant"`
+	TransactionID string    `json:"transaction_id,omitempty"`
+	Amount        int       `json:"amount"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type state struct {
+	Settings     map[string]*Settings    `json:"settings"`
+	Reservations map[string]*Reservation `json:"reservations"`
+}
+
+type Store struct {
+	path            string
+	enforcedDefault bool
+
+	mu sync.Mutex
+	st state
+}
+
+func NewStore(enforcedDefault bool, path string) (*Store, error) {
+	s := &Store{
+		path:            path,
+		enforcedDefault: enforcedDefault,
+		st: state{
+			Settings:     make(map[string]*Settings),
+			Reservations: make(map[string]*Reservation),
+		},
+	}
+	if path == "" {
+		return s, nil
+	}
+	if err := store.LoadJSON(path, &s.st); err != nil {
+		return nil, err
+	}
+	if s.st.Settings == nil {
+		s.st.Settings = make(map[string]*Settings)
+	}
+	if s.st.Reservations == nil {
+		s.st.Reservations = make(map[string]*Reservation)
+	}
+	return s, nil
+}
+
+// Enforced reports whether the merchant's transfers must be covered by float
+func (s *Store) Enforced(merchant string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enforced(merchant)
+}
+
+func (s *Store) enforced(merchant string) bool {
+	if st, ok := s.st.Settings[merchant]; ok && st.Enforced != nil {
+		return *st.Enforced
+	}
+	return s.enforcedDefault
+}
+
+// Reserve holds amount of the merchant's float. balance is read under the
+// store's lock, so it must not change except through Capture.
+func (s *Store) Reserve(merchant string, amount int, balance func() int, now time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	available := balance() - s.reserved(merchant)
+	if amount > available {
+		return "", &InsufficientError{Merchant: merchant, Amount: amount, Available: available}
+	}
+	r := &Reservation{ID: store.NewID("flt"), Merchant: merchant, Amount: amount, CreatedAt: now}
+	s.st.Reservations[r.ID] = r
+	s.persist()
+	return r.ID, nil
+}
+
+// Attach records the transaction a reservation is for
+func (s *Store) Attach(id, transactionID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r, ok := s.st.Reservations[id]; ok {
+		r.TransactionID = transactionID
+		s.persist()
+	}
+}
+
+// Capture ends a reservation once its transfer succeeded. post records the
+// transfer against the balance, under the store's lock so no reservation can
+// see the balance before the transfer is taken out of it while the hold is
+// already gone.
+func (s *Store) Capture(id string, post func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	post()
+	if _, ok := s.st.Reservations[id]; ok {
+		delete(s.st.Reservations, id)
+		s.persist()
+	}
+}
+
+// Adjust runs post, which changes balances outside of a transfer, under the
+// store's lock
+func (s *Store) Adjust(post func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	post()
+}
+
+// Release ends a reservation of a transfer that did not go through
+func (s *Store) Release(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.st.Reservations[id]; ok {
+		delete(s.st.Reservations, id)
+		s.persist()
+	}
+}
+
+// Reserved is the merchant's float held by transfers in flight
+func (s *Store) Reserved(merchant string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reserved(merchant)
+}
+
+func (s *Store) reserved(merchant string) int {
+	total := 0
+	for _, r := range s.st.Reservations {
+		if r.Merchant == merchant {
+			total += r.Amount
+		}
+	}
+	return total
+}
+
+// Reservations lists the merchant's reservations (all if empty), oldest first
+func (s *Store) Reservations(merchant string) []Reservation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := []Reservation{}
+	for _, r := range s.st.Reservations {
+		if merchant == "" || r.Merchant == merchant {
+			out = append(out, *r)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
+// Settings returns the merchant's settings with Enforced resolved
+func (s *Store) Settings(merchant string) Settings {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out Settings
+	if st, ok := s.st.Settings[merchant]; ok {
+		out = *st
+	}
+	enforced := s.enforced(merchant)
+	out.Enforced = &enforced
+	return out
+}
+
+// Configure changes the merchant's settings; nil fields are left as they are
+func (s *Store) Configure(merchant string, enforced *bool, lowBalance *int) Settings {
+	s.mu.Lock()
+	st := s.settings(merchant)
+	if enforced != nil {
+		st.Enforced = enforced
+	}
+	if lowBalance != nil {
+		st.LowBalance = max(*lowBalance, 0)
+	}
+	s.persist()
+	s.mu.Unlock()
+	return s.Settings(merchant)
+}
+
+// Merchants lists merchants with settings or reservations
+func (s *Store) Merchants() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := make(map[string]bool)
+	for m := range s.st.Settings {
+		seen[m] = true
+	}
+	for _, r := range s.st.Reservations {
+		seen[r.Merchant] = true
+	}
+	out := make([]string, 0, len(seen))
+	for m := range seen {
+		out = append(out, m)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// CheckLow compares available float with the merchant's threshold. It
+// reports true once when float drops below it, and again only after float
+// has recovered.
+func (s *Store) CheckLow(merchant string, available int, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.st.Settings[merchant]
+	if !ok || st.LowBalance == 0 {
+		return false
+	}
+	low := available < st.LowBalance
+	switch {
+	case low && st.LowSince == nil:
+		st.LowSince = &now
+		s.persist()
+		return true
+	case !low && st.LowSince != nil:
+		st.LowSince = nil
+		s.persist()
+	}
+	return false
+}
+
+// settings returns the merchant's stored settings, creating them; caller holds s.mu
+func (s *Store) settings(merchant string) *Settings {
+	st, ok := s.st.Settings[merchant]
+	if !ok {
+		st = &Settings{}
+		s.st.Settings[merchant] = st
+	}
+	return st
+}
+
+// persist mirrors the store to disk; caller holds s.mu
+func (s *Store) persist() {
+	if s.path == "" {
+		return
+	}
+	if err := store.SaveJSON(s.path, s.st); err != nil {
+		log.Printf("[Float] failed to persist: %v", err)
+	}
+}
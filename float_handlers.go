@@ -0,0 +1,141 @@
+package main
+
+import (
+	"kacha-psp/ledger"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// configureFloatRequest changes a merchant's float settings; omitted fields
+// are left as they are
+type configureFloatRequest struct {
+	Enforced   *bool `json:"enforced"`
+	LowBalance *int  `json:"low_balance_threshold"`
+}
+
+// floatTopUpRequest records money a merchant paid into the provider account
+type floatTopUpRequest struct {
+	Amount   int    `json:"amount" binding:"required,gt=0"`
+	Provider string `json:"provider"`
+	// Reference identifies the deposit; a top-up is recorded once per reference
+	Reference string `json:"reference"`
+	Note      string `json:"note"`
+}
+
+// floatAdjustmentRequest corrects a merchant's float by a signed amount
+type floatAdjustmentRequest struct {
+	Amount int    `json:"amount" binding:"required"`
+	Reason string `json:"reason" binding:"required"`
+	Author string `json:"author" binding:"required"`
+}
+
+func (s *server) handleMerchantFloat(c *gin.Context) {
+	c.JSON(http.StatusOK, s.floatView(c.GetString("merchant")))
+}
+
+func (s *server) handleListFloats(c *gin.Context) {
+	floats := []floatView{}
+	for _, m := range s.floatMerchants() {
+		floats = append(floats, s.floatView(m))
+	}
+	c.JSON(http.StatusOK, gin.H{"floats": floats})
+}
+
+// handleFloatAlerts lists merchants whose available float is below their threshold
+func (s *server) handleFloatAlerts(c *gin.Context) {
+	alerts := []floatView{}
+	for _, m := range s.floats.Merchants() {
+		if v := s.floatView(m); v.Settings.LowSince != nil {
+			alerts = append(alerts, v)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"alerts": alerts})
+}
+
+func (s *server) handleGetFloat(c *gin.Context) {
+	merchant := c.Param("merchant")
+	c.JSON(http.StatusOK, gin.H{
+		"float":        s.floatView(merchant),
+		"reservations": s.floats.Reservations(merchant),
+	})
+}
+
+func (s *server) handleConfigureFloat(c *gin.Context) {
+	var req configureFloatRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	merchant := c.Param("merchant")
+	s.floats.Configure(merchant, req.Enforced, req.LowBalance)
+	s.checkFloat(merchant)
+	c.JSON(http.StatusOK, s.floatView(merchant))
+}
+
+// handleFloatTopUp records a merchant's deposit into the provider account,
+// crediting its float
+func (s *server) handleFloatTopUp(c *gin.Context) {
+	var req floatTopUpRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	merchant := c.Param("merchant")
+	providerName := req.Provider
+	if providerName == "" {
+		providerName = s.providers.Default()
+	}
+	if !s.providers.Has(providerName) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown provider: " + providerName})
+		return
+	}
+	entry := ledger.Entry{
+		Kind:        ledger.KindTopUp,
+		Merchant:    merchant,
+		Description: "top-up",
+		Postings:    ledger.Move(ledger.ProviderAccount(providerName), ledger.MerchantAccount(merchant), req.Amount),
+	}
+	if req.Reference != "" {
+		entry.Key = "topup:" + merchant + ":" + req.Reference
+		entry.Description += " " + req.Reference
+	}
+	if req.Note != "" {
+		entry.Description += ": " + req.Note
+	}
+	s.respondFloatEntry(c, entry)
+}
+
+// handleFloatAdjustment corrects a merchant's float against the adjustments
+// account, e.g. after a reconciliation exception
+func (s *server) handleFloatAdjustment(c *gin.Context) {
+	var req floatAdjustmentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	merchant := ledger.MerchantAccount(c.Param("merchant"))
+	postings := ledger.Move(ledger.AdjustmentAccount, merchant, req.Amount)
+	if req.Amount < 0 {
+		postings = ledger.Move(merchant, ledger.AdjustmentAccount, -req.Amount)
+	}
+	s.respondFloatEntry(c, ledger.Entry{
+		Kind:        ledger.KindAdjustment,
+		Merchant:    c.Param("merchant"),
+		Description: "adjustment by " + req.Author + ": " + req.Reason,
+		Postings:    postings,
+	})
+}
+
+func (s *server) respondFloatEntry(c *gin.Context, e ledger.Entry) {
+	entry, posted, err := s.postFloat(e)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	status := http.StatusCreated
+	if !posted {
+		status = http.StatusOK
+	}
+	c.JSON(status, gin.H{"entry": entry, "float": s.floatView(e.Merchant)})
+}
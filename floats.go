@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"kacha-psp/float"
+	"kacha-psp/ledger"
+	"kacha-psp/store"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// eventFloatLow tells a merchant its available float dropped below its threshold
+const eventFloatLow = "float.low_balance"
+
+// floatView is a merchant's float as reported by the API
+type floatView struct {
+	Merchant  string         `json:"merchant"`
+	Balance   int            `json:"balance"`
+	Reserved  int            `json:"reserved"`
+	Available int            `json:"available"`
+	Settings  float.Settings `json:"settings"`
+}
+
+// floatBalance is the merchant's float before reservations: its ledger balance
+func (s *server) floatBalance(merchant string) int {
+	return s.ledger.Balance(ledger.MerchantAccount(merchant), time.Time{}).Balance
+}
+
+func (s *server) floatView(merchant string) floatView {
+	v := floatView{
+		Merchant: merchant,
+		Balance:  s.floatBalance(merchant),
+		Reserved: s.floats.Reserved(merchant),
+		Settings: s.floats.Settings(merchant),
+	}
+	v.Available = v.Balance - v.Reserved
+	return v
+}
+
+// reserveFloat holds a transfer's amount and fee of the merchant's float, failing if
+// the merchant has too little. Merchants whose float is not enforced are let
+// through without a reservation.
+func (s *server) reserveFloat(tx *store.Transaction) error {
+	if !s.floats.Enforced(tx.Merchant) {
+		return nil
+	}
+	id, err := s.floats.Reserve(tx.Merchant, tx.Amount+tx.Fee, func() int { return s.floatBalance(tx.Merchant) }, time.Now())
+	if err != nil {
+		var short *float.InsufficientError
+		if errors.As(err, &short) {
+			log.Printf("Rejected %s for %s: %v", tx.Type, tx.Merchant, err)
+			return newAPIError(http.StatusUnprocessableEntity, err.Error(), gin.H{"float": short})
+		}
+		return err
+	}
+	tx.FloatReservation = id
+	s.checkFloat(tx.Merchant)
+	return nil
+}
+
+// checkFloat raises an alert when the merchant's available float has dropped
+// below its threshold
+func (s *server) checkFloat(merchant string) {
+	v := s.floatView(merchant)
+	if !s.floats.CheckLow(merchant, v.Available, time.Now()) {
+		return
+	}
+	log.Printf("[Float] ALERT: %s has %d available, below its threshold of %d", merchant, v.Available, v.Settings.LowBalance)
+	s.webhooks.Send(merchant, eventFloatLow, v)
+}
+
+func (s *server) checkFloats() {
+	for _, m := range s.floats.Merchants() {
+		s.checkFloat(m)
+	}
+}
+
+// floatMerchants lists merchants with float settings or a ledger balance
+func (s *server) floatMerchants() []string {
+	seen := make(map[string]bool)
+	out := []string{}
+	for _, m := range s.floats.Merchants() {
+		seen[m] = true
+		out = append(out, m)
+	}
+	for _, b := range s.ledger.Balances("merchant:", time.Time{}) {
+		if m, ok := ledger.MerchantOf(b.Account); ok && !seen[m] {
+			seen[m] = true
+			out = append(out, m)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// postFloat posts a top-up or adjustment of a merchant's float. Entries with
+// a key are posted once; posted reports whether this call posted it.
+func (s *server) postFloat(e ledger.Entry) (entry *ledger.Entry, posted bool, err error) {
+	s.floats.Adjust(func() {
+		entry, posted, err = s.ledger.Post(e, time.Now())
+	})
+	if err == nil {
+		s.checkFloat(e.Merchant)
+	}
+	return entry, posted, err
+}
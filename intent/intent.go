@@ -0,0 +1,343 @@
+package intent
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"kacha-psp/store"
+)
+
+var (
+	ErrNotFound = errors.New("payment intent not found")
+	// ErrState is returned for an action the intent's status does not allow
+	ErrState = errors.New("payment intent does not allow this action")
+)
+
+// Status is where a payment intent is, whichever flow pays it
+type Status string
+
+const (
+	// StatusRequiresConfirmation waits for the merchant to confirm the intent
+	// with a method, again after an attempt failed
+	StatusRequiresConfirmation Status = "REQUIRES_CONFIRMATION"
+	// StatusRequiresAuthorization waits for the OTP sent to the customer
+	StatusRequiresAuthorization Status = "REQUIRES_AUTHORIZATION"
+	// StatusProcessing waits for the provider's result, e.g. while the
+	// customer answers a push USSD prompt
+	StatusProcessing Status = "PROCESSING"
+	StatusSucceeded  Status = "SUCCEEDED"
+	StatusCancelled  Status = "CANCELLED"
+)
+
+func (s Status) Final() bool {
+	return s == StatusSucceeded || s == StatusCancelled
+}
+
+// Method is the Kacha flow that pays an intent
+type Method string
+
+const (
+	MethodOTP      Method = "OTP"
+	MethodPushUSSD Method = "PUSH_USSD"
+)
+
+func (m Method) Valid() bool {
+	return m == MethodOTP || m == MethodPushUSSD
+}
+
+// Next actions, telling the merchant what the customer has to do
+const (
+	ActionAuthorizeOTP   = "AUTHORIZE_OTP"
+	ActionApproveOnPhone = "APPROVE_ON_PHONE"
+)
+
+// Events sent to merchant webhooks
+const (
+	EventSucceeded     = "payment_intent.succeeded"
+	EventPaymentFailed = "payment_intent.payment_failed"
+	EventCancelled     = "payment_intent.cancelled"
+)
+
+// Intent is a payment a merchant wants from a customer, tracked the same way
+// whether it is paid by OTP or push USSD
+type Intent struct {
+	ID              string            `json:"id"`
+	Merchant        string            `json:"merchant"`
+	Amount          int               `json:"amount"`
+	Phone           string            `json:"phone"`
+	Description     string            `json:"description"`
+	ClientReference string            `json:"client_reference,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+	Status          Status            `json:"status"`
+	// Method and TransactionID are those of the latest attempt
+	Method        Method `json:"method,omitempty"`
+	TransactionID string `json:"transaction_id,omitempty"`
+	NextAction    string `json:"next_action,omitempty"`
+	LastError     string `json:"last_error,omitempty"`
+	// Attempts are the transactions the intent was confirmed with
+	Attempts []Attempt `json:"attempts,omitempty"`
+
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	SucceededAt *time.Time `json:"succeeded_at,omitempty"`
+	CancelledAt *time.Time `json:"cancelled_at,omitempty"`
+}
+
+// Attempt is one confirmation of an intent
+type Attempt struct {
+	TransactionID string     `json:"transaction_id"`
+	Method        Method     `json:"method"`
+	Succeeded     bool       `json:"succeeded"`
+	Error         string     `json:"error,omitempty"`
+	At            time.Time  `json:"at"`
+	SettledAt     *time.Time `json:"settled_at,omitempty"`
+}
+
+func (pi *Intent) copy() *Intent {
+	out := *pi
+	out.Attempts = append([]Attempt(nil), pi.Attempts...)
+	return &out
+}
+
+func (pi *Intent) attempt(txID string) *Attempt {
+	for i := range pi.Attempts {
+		if pi.Attempts[i].TransactionID == txID {
+			return &pi.Attempts[i]
+		}
+	}
+	return nil
+}
+
+// Event is a change to report to the merchant
+type Event struct {
+	Type   string
+	Intent *Intent
+}
+
+type Store struct {
+	path string
+
+	mu      sync.Mutex
+	intents map[string]*Intent
+}
+
+func NewStore(path string) (*Store, error) {
+	s := &Store{
+		path:    path,
+		intents: make(map[string]*Intent),
+	}
+	if path == "" {
+		return s, nil
+	}
+	if err := store.LoadJSON(path, &s.intents); err != nil {
+		return nil, err
+	}
+	if s.intents == nil {
+		s.intents = make(map[string]*Intent)
+	}
+	return s, nil
+}
+
+// Create records an intent awaiting confirmation
+func (s *Store) Create(pi *Intent) (*Intent, error) {
+	if pi.Amount <= 0 || pi.Phone == "" {
+		return nil, fmt.Errorf("amount and phone are required")
+	}
+	now := time.Now()
+	pi.ID = store.NewID("pi")
+	pi.Status = StatusRequiresConfirmation
+	pi.Method, pi.TransactionID, pi.NextAction, pi.LastError = "", "", "", ""
+	pi.Attempts = nil
+	pi.SucceededAt, pi.CancelledAt = nil, nil
+	pi.CreatedAt = now
+	pi.UpdatedAt = now
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := pi.copy()
+	s.intents[pi.ID] = stored
+	s.persist()
+	return stored.copy(), nil
+}
+
+// Get returns the merchant's intent (any merchant's if empty)
+func (s *Store) Get(id, merchant string) (*Intent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pi, err := s.get(id, merchant)
+	if err != nil {
+		return nil, err
+	}
+	return pi.copy(), nil
+}
+
+// List returns the merchant's intents (all if empty), newest first
+func (s *Store) List(merchant string, status Status) []*Intent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := []*Intent{}
+	for _, pi := range s.intents {
+		if merchant != "" && pi.Merchant != merchant {
+			continue
+		}
+		if status != "" && pi.Status != status {
+			continue
+		}
+		out = append(out, pi.copy())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
+
+// Confirm claims an intent for a payment attempt by method, recorded as the
+// transaction txID, so only one attempt is in flight at a time
+func (s *Store) Confirm(id, merchant string, method Method, txID string, now time.Time) (*Intent, error) {
+	if !method.Valid() {
+		return nil, fmt.Errorf("method must be %s or %s", MethodPushUSSD, MethodOTP)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pi, err := s.get(id, merchant)
+	if err != nil {
+		return nil, err
+	}
+	if pi.Status != StatusRequiresConfirmation {
+		return nil, fmt.Errorf("%w: it is %s", ErrState, pi.Status)
+	}
+	pi.Status = StatusProcessing
+	pi.Method = method
+	pi.TransactionID = txID
+	pi.NextAction = ""
+	pi.LastError = ""
+	pi.Attempts = append(pi.Attempts, Attempt{TransactionID: txID, Method: method, At: now})
+	pi.UpdatedAt = now
+	s.persist()
+	return pi.copy(), nil
+}
+
+// Started records that the provider accepted the attempt txID and the
+// customer now has to authorize it
+func (s *Store) Started(id, txID string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pi, ok := s.intents[id]
+	if !ok || pi.TransactionID != txID || pi.Status != StatusProcessing {
+		// it settled first
+		return
+	}
+	switch pi.Method {
+	case MethodOTP:
+		pi.Status = StatusRequiresAuthorization
+		pi.NextAction = ActionAuthorizeOTP
+	case MethodPushUSSD:
+		pi.NextAction = ActionApproveOnPhone
+	}
+	pi.UpdatedAt = now
+	s.persist()
+}
+
+// Authorized records that the OTP of the attempt txID was accepted and the
+// provider's result is awaited
+func (s *Store) Authorized(id, txID string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pi, ok := s.intents[id]
+	if !ok || pi.TransactionID != txID || pi.Status != StatusRequiresAuthorization {
+		return
+	}
+	pi.Status = StatusProcessing
+	pi.NextAction = ""
+	pi.UpdatedAt = now
+	s.persist()
+}
+
+// Settle records how the attempt txID ended. A failed attempt returns the
+// intent for confirmation, so the merchant can try again. A successful one
+// always succeeds the intent, even a cancelled one, as the customer paid.
+func (s *Store) Settle(id, txID string, succeeded bool, message string, now time.Time) []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pi, ok := s.intents[id]
+	if !ok {
+		return nil
+	}
+	a := pi.attempt(txID)
+	// only a late success changes a settled attempt
+	if a == nil || (a.SettledAt != nil && (a.Succeeded || !succeeded)) {
+		return nil
+	}
+	a.Succeeded = succeeded
+	a.Error = message
+	a.SettledAt = &now
+	pi.UpdatedAt = now
+
+	var events []Event
+	switch {
+	case succeeded && pi.Status != StatusSucceeded:
+		pi.Status = StatusSucceeded
+		pi.Method = a.Method
+		pi.TransactionID = txID
+		pi.NextAction = ""
+		pi.LastError = ""
+		pi.SucceededAt = &now
+		pi.CancelledAt = nil
+		events = []Event{{EventSucceeded, pi.copy()}}
+	case !succeeded && pi.TransactionID == txID && !pi.Status.Final():
+		pi.Status = StatusRequiresConfirmation
+		pi.NextAction = ""
+		pi.LastError = message
+		events = []Event{{EventPaymentFailed, pi.copy()}}
+	}
+	s.persist()
+	return events
+}
+
+// Cancel withdraws an intent that has not succeeded. The caller closes the
+// attempt in flight, if any.
+func (s *Store) Cancel(id, merchant string, now time.Time) (*Intent, []Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pi, err := s.get(id, merchant)
+	if err != nil {
+		return nil, nil, err
+	}
+	if pi.Status.Final() {
+		return nil, nil, fmt.Errorf("%w: it is %s", ErrState, pi.Status)
+	}
+	pi.Status = StatusCancelled
+	pi.NextAction = ""
+	pi.CancelledAt = &now
+	pi.UpdatedAt = now
+	s.persist()
+	out := pi.copy()
+	return out, []Event{{EventCancelled, out}}, nil
+}
+
+// get returns the merchant's stored intent; caller holds s.mu
+func (s *Store) get(id, merchant string) (*Intent, error) {
+	pi, ok := s.intents[id]
+	if !ok || (merchant != "" && pi.Merchant != merchant) {
+		return nil, ErrNotFound
+	}
+	return pi, nil
+}
+
+// persist mirrors the store to disk; caller holds s.mu
+func (s *Store) persist() {
+	if s.path == "" {
+		return
+	}
+	if err := store.SaveJSON(s.path, s.intents); err != nil {
+		log.Printf("[Intent] failed to persist state: %v", err)
+	}
+}
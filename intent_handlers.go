@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"kacha-psp/intent"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type createIntentRequest struct {
+	Amount          int               `json:"amount" binding:"required,gt=0"`
+	Phone           string            `json:"phone" binding:"required"`
+	Description     string            `json:"description"`
+	ClientReference string            `json:"client_reference,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+}
+
+type confirmIntentRequest struct {
+	// Method is PUSH_USSD or OTP
+	Method intent.Method `json:"method" binding:"required"`
+}
+
+type authorizeIntentRequest struct {
+	OTP int `json:"otp" binding:"required"`
+}
+
+func (s *server) handleCreateIntent(c *gin.Context) {
+	var req createIntentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	pi, err := s.intents.Create(&intent.Intent{
+		Merchant:        c.GetString("merchant"),
+		Amount:          req.Amount,
+		Phone:           req.Phone,
+		Description:     req.Description,
+		ClientReference: req.ClientReference,
+		Metadata:        req.Metadata,
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, pi)
+}
+
+func (s *server) handleListIntents(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"intents": s.intents.List(c.GetString("merchant"), intent.Status(c.Query("status")))})
+}
+
+func (s *server) handleGetIntent(c *gin.Context) {
+	pi, err := s.intents.Get(c.Param("id"), c.GetString("merchant"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, pi)
+}
+
+// handleConfirmIntent starts paying an intent by the method given
+func (s *server) handleConfirmIntent(c *gin.Context) {
+	var req confirmIntentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !req.Method.Valid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "method must be PUSH_USSD or OTP"})
+		return
+	}
+	pi, err := s.confirmIntent(c.Param("id"), c.GetString("merchant"), req.Method)
+	respondIntent(c, pi, err)
+}
+
+// handleAuthorizeIntent completes an OTP attempt with the customer's code
+func (s *server) handleAuthorizeIntent(c *gin.Context) {
+	var req authorizeIntentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	pi, err := s.authorizeIntent(c.Param("id"), c.GetString("merchant"), req.OTP)
+	respondIntent(c, pi, err)
+}
+
+func (s *server) handleResendIntentOTP(c *gin.Context) {
+	pi, err := s.resendIntentOTP(c.Param("id"), c.GetString("merchant"))
+	respondIntent(c, pi, err)
+}
+
+func (s *server) handleCancelIntent(c *gin.Context) {
+	pi, err := s.cancelIntent(c.Param("id"), c.GetString("merchant"))
+	respondIntent(c, pi, err)
+}
+
+func (s *server) handleAdminListIntents(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"intents": s.intents.List(c.Query("merchant"), intent.Status(c.Query("status")))})
+}
+
+func (s *server) handleAdminGetIntent(c *gin.Context) {
+	pi, err := s.intents.Get(c.Param("id"), "")
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, pi)
+}
+
+// respondIntent reports an intent action. Failed attempts include the intent
+// with the error, so the response has the same shape whichever flow ran.
+func respondIntent(c *gin.Context, pi *intent.Intent, err error) {
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, pi)
+	case errors.Is(err, intent.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, intent.ErrState):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case pi != nil:
+		status, body := http.StatusBadGateway, gin.H{"error": err.Error()}
+		var apiErr *apiError
+		if errors.As(err, &apiErr) {
+			status = apiErr.status
+			for k, v := range apiErr.details {
+				body[k] = v
+			}
+		}
+		body["intent"] = pi
+		c.JSON(status, body)
+	default:
+		respondError(c, err)
+	}
+}
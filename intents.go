@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"kacha-psp/intent"
+	kacha "kacha-psp/kacha"
+	"kacha-psp/provider"
+	"kacha-psp/store"
+	"log"
+	"net/http"
+	"time"
+)
+
+const sourceIntent = "INTENT"
+
+// confirmIntent pays an intent by method. Each attempt is a transaction of
+// its own, with a trace number of its own, so a late result of an earlier
+// attempt is told apart.
+func (s *server) confirmIntent(id, merchant string, method intent.Method) (*intent.Intent, error) {
+	if method == intent.MethodPushUSSD && s.cfg.PublicURL == "" {
+		return nil, newAPIError(http.StatusServiceUnavailable, "push USSD payments need PUBLIC_URL for callbacks", nil)
+	}
+	creds, err := s.keyring.Credentials(merchant)
+	if err != nil {
+		return nil, err
+	}
+
+	txID := store.NewID("txn")
+	pi, err := s.intents.Confirm(id, merchant, method, txID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	tx := &store.Transaction{
+		ID:          txID,
+		Merchant:    pi.Merchant,
+		TraceNumber: store.NewID("PI"),
+		Phone:       pi.Phone,
+		Amount:      pi.Amount,
+		Source:      sourceIntent,
+		SourceID:    pi.ID,
+	}
+	switch method {
+	case intent.MethodPushUSSD:
+		tx.Type = store.TypePushUSSD
+		_, _, err = s.requestPushUSSD(tx, creds, kacha.PushUSSDRequest{
+			Phone:       pi.Phone,
+			Amount:      pi.Amount,
+			TraceNumber: tx.TraceNumber,
+			Reason:      pi.Description,
+		})
+	default:
+		tx.Type = store.TypeOTPPayment
+		_, _, err = s.requestPayment(tx, kacha.PaymentRequest{
+			Username:    creds.Username,
+			Password:    creds.Password,
+			Phone:       pi.Phone,
+			Amount:      pi.Amount,
+			TraceNumber: tx.TraceNumber,
+			Reason:      pi.Description,
+		})
+	}
+	if err != nil {
+		// attempts stopped before reaching the provider never settle
+		s.emitIntentEvents(s.intents.Settle(pi.ID, txID, false, err.Error(), time.Now()))
+		return s.currentIntent(pi.ID, err)
+	}
+	s.intents.Started(pi.ID, txID, time.Now())
+	return s.currentIntent(pi.ID, nil)
+}
+
+// authorizeIntent confirms an intent's OTP attempt with the code the
+// customer received
+func (s *server) authorizeIntent(id, merchant string, otp int) (*intent.Intent, error) {
+	tx, creds, err := s.intentAttempt(id, merchant)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.authorizePayment(kacha.PaymentAuthorizeRequest{
+		Username:  creds.Username,
+		Password:  creds.Password,
+		Reference: tx.Reference,
+		OTP:       otp,
+	})
+	if err != nil {
+		return s.currentIntent(id, err)
+	}
+	if !providerStatus(resp.Status, resp.Success).Final() {
+		s.intents.Authorized(id, tx.ID, time.Now())
+	}
+	return s.currentIntent(id, nil)
+}
+
+// resendIntentOTP sends the customer a new OTP for an intent's OTP attempt
+func (s *server) resendIntentOTP(id, merchant string) (*intent.Intent, error) {
+	tx, creds, err := s.intentAttempt(id, merchant)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.resendOTP(creds, tx.Reference); err != nil {
+		return nil, err
+	}
+	return s.currentIntent(id, nil)
+}
+
+// intentAttempt returns the OTP attempt an intent waits to have authorized
+func (s *server) intentAttempt(id, merchant string) (*store.Transaction, provider.Credentials, error) {
+	pi, err := s.intents.Get(id, merchant)
+	if err != nil {
+		return nil, provider.Credentials{}, err
+	}
+	if pi.Status != intent.StatusRequiresAuthorization {
+		return nil, provider.Credentials{}, newAPIError(http.StatusConflict, "payment intent is "+string(pi.Status)+", not awaiting an OTP", nil)
+	}
+	tx, err := s.txs.Get(pi.TransactionID)
+	if err != nil {
+		return nil, provider.Credentials{}, err
+	}
+	creds, err := s.keyring.Credentials(pi.Merchant)
+	if err != nil {
+		return nil, provider.Credentials{}, err
+	}
+	return tx, creds, nil
+}
+
+// cancelIntent withdraws an intent and closes its attempt in flight. A push
+// USSD prompt may still be answered; the intent then succeeds late.
+func (s *server) cancelIntent(id, merchant string) (*intent.Intent, error) {
+	pi, events, err := s.intents.Cancel(id, merchant, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	s.emitIntentEvents(events)
+	if pi.TransactionID != "" {
+		if _, err := s.closePending(pi.TransactionID, store.StatusCancelled, "payment intent cancelled"); err != nil && !errors.Is(err, errNotPending) {
+			log.Printf("[Intent] failed to cancel payment %s of %s: %v", pi.TransactionID, pi.ID, err)
+		}
+	}
+	return s.currentIntent(id, nil)
+}
+
+// intentSettled records how an attempt to pay an intent ended, including a
+// success reported late
+func (s *server) intentSettled(tx *store.Transaction) {
+	succeeded := tx.Status == store.StatusSuccess || tx.LateStatus == store.StatusSuccess
+	message := ""
+	if !succeeded {
+		message = tx.Message
+	}
+	s.emitIntentEvents(s.intents.Settle(tx.SourceID, tx.ID, succeeded, message, time.Now()))
+}
+
+// currentIntent returns the intent as it is now, with err
+func (s *server) currentIntent(id string, err error) (*intent.Intent, error) {
+	pi, getErr := s.intents.Get(id, "")
+	if getErr != nil {
+		return nil, getErr
+	}
+	return pi, err
+}
+
+func (s *server) emitIntentEvents(events []intent.Event) {
+	for _, e := range events {
+		log.Printf("[Intent] %s %s", e.Type, e.Intent.ID)
+		s.webhooks.Send(e.Intent.Merchant, e.Type, e.Intent)
+	}
+}
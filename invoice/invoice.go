@@ -0,0 +1,392 @@
+package invoice
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"kacha-psp/store"
+)
+
+const DefaultTTL = 7 * 24 * time.Hour
+
+var (
+	ErrNotFound = errors.New("invoice not found")
+	ErrNotOpen  = errors.New("invoice is not open for payment")
+	// ErrAmount is returned for a payment that is more than is due, or less
+	// than the full amount on an invoice that does not accept part payments
+	ErrAmount = errors.New("invalid payment amount")
+	// ErrStalePayment is returned for the outcome of a payment already applied
+	ErrStalePayment = errors.New("payment already applied")
+)
+
+type Status string
+
+const (
+	StatusOpen          Status = "OPEN"
+	StatusPartiallyPaid Status = "PARTIALLY_PAID"
+	StatusPaid          Status = "PAID"
+	StatusExpired       Status = "EXPIRED"
+	StatusVoid          Status = "VOID"
+)
+
+// Events sent to merchant webhooks
+const (
+	EventCreated       = "invoice.created"
+	EventPartiallyPaid = "invoice.partially_paid"
+	EventPaid          = "invoice.paid"
+	EventPaymentFailed = "invoice.payment_failed"
+	EventExpired       = "invoice.expired"
+	EventVoided        = "invoice.voided"
+)
+
+// Invoice is an amount a merchant asks a customer to pay. Customers pay it by
+// its Reference, which is short enough to read out but hard to guess.
+type Invoice struct {
+	ID           string            `json:"id"`
+	Merchant     string            `json:"merchant"`
+	Reference    string            `json:"reference"`
+	Amount       int               `json:"amount"`
+	AmountPaid   int               `json:"amount_paid"`
+	Description  string            `json:"description"`
+	Phone        string            `json:"phone,omitempty"`
+	AllowPartial bool              `json:"allow_partial,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	Status       Status            `json:"status"`
+	Payments     []Payment         `json:"payments,omitempty"`
+	// Pending holds amounts of payments in flight, by transaction ID, so
+	// concurrent payments cannot exceed the amount due
+	Pending map[string]Claim `json:"pending,omitempty"`
+
+	ExpiresAt time.Time  `json:"expires_at"`
+	PaidAt    *time.Time `json:"paid_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// Claim is an amount held for a payment in flight
+type Claim struct {
+	Amount int       `json:"amount"`
+	At     time.Time `json:"at"`
+}
+
+// Payment is a settled payment attempt against an invoice
+type Payment struct {
+	TransactionID string    `json:"transaction_id"`
+	Method        string    `json:"method"`
+	Phone         string    `json:"phone"`
+	Amount        int       `json:"amount"`
+	Paid          bool      `json:"paid"`
+	Error         string    `json:"error,omitempty"`
+	At            time.Time `json:"at"`
+}
+
+// Due is the amount still to pay, not counting payments in flight
+func (inv *Invoice) Due() int {
+	return max(inv.Amount-inv.AmountPaid, 0)
+}
+
+func (inv *Invoice) payable() bool {
+	return inv.Status == StatusOpen || inv.Status == StatusPartiallyPaid
+}
+
+func (inv *Invoice) pending() int {
+	total := 0
+	for _, c := range inv.Pending {
+		total += c.Amount
+	}
+	return total
+}
+
+func (inv *Invoice) copy() *Invoice {
+	out := *inv
+	out.Pending = make(map[string]Claim, len(inv.Pending))
+	for k, v := range inv.Pending {
+		out.Pending[k] = v
+	}
+	out.Payments = append([]Payment(nil), inv.Payments...)
+	return &out
+}
+
+// Event is a change to report to the merchant
+type Event struct {
+	Type    string
+	Invoice *Invoice
+}
+
+type Store struct {
+	path string
+
+	mu       sync.Mutex
+	invoices map[string]*Invoice
+}
+
+func NewStore(path string) (*Store, error) {
+	s := &Store{
+		path:     path,
+		invoices: make(map[string]*Invoice),
+	}
+	if path == "" {
+		return s, nil
+	}
+	if err := store.LoadJSON(path, &s.invoices); err != nil {
+		return nil, err
+	}
+	if s.invoices == nil {
+		s.invoices = make(map[string]*Invoice)
+	}
+	return s, nil
+}
+
+// Create opens an invoice. Without ExpiresAt it expires after DefaultTTL.
+func (s *Store) Create(inv *Invoice) (*Invoice, []Event, error) {
+	if inv.Amount <= 0 || inv.Description == "" {
+		return nil, nil, fmt.Errorf("amount and description are required")
+	}
+	now := time.Now()
+	if inv.ExpiresAt.IsZero() {
+		inv.ExpiresAt = now.Add(DefaultTTL)
+	}
+	if !inv.ExpiresAt.After(now) {
+		return nil, nil, fmt.Errorf("expires_at must be in the future")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ref, err := s.newReference()
+	if err != nil {
+		return nil, nil, err
+	}
+	inv.ID = store.NewID("inv")
+	inv.Reference = ref
+	inv.AmountPaid = 0
+	inv.Status = StatusOpen
+	inv.Payments, inv.Pending, inv.PaidAt = nil, nil, nil
+	inv.CreatedAt, inv.UpdatedAt = now, now
+
+	stored := inv.copy()
+	s.invoices[inv.ID] = stored
+	s.persist()
+	out := stored.copy()
+	return out, []Event{{EventCreated, out}}, nil
+}
+
+// Get returns the merchant's invoice (any merchant's if empty)
+func (s *Store) Get(id, merchant string) (*Invoice, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inv, ok := s.invoices[id]
+	if !ok || (merchant != "" && inv.Merchant != merchant) {
+		return nil, ErrNotFound
+	}
+	return inv.copy(), nil
+}
+
+func (s *Store) ByReference(ref string) (*Invoice, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, inv := range s.invoices {
+		if inv.Reference == ref {
+			return inv.copy(), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// List returns invoices for merchant (all merchants if empty) with status, newest first
+func (s *Store) List(merchant string, status Status) []*Invoice {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := []*Invoice{}
+	for _, inv := range s.invoices {
+		if merchant != "" && inv.Merchant != merchant {
+			continue
+		}
+		if status != "" && inv.Status != status {
+			continue
+		}
+		out = append(out, inv.copy())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
+
+// Claim holds amount of an invoice for the payment txID. An amount of zero
+// claims everything still due.
+func (s *Store) Claim(id, txID string, amount int, at time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inv, ok := s.invoices[id]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	if !inv.payable() || !at.Before(inv.ExpiresAt) {
+		return 0, ErrNotOpen
+	}
+
+	available := inv.Due() - inv.pending()
+	if amount == 0 {
+		amount = available
+	}
+	switch {
+	case available <= 0:
+		return 0, fmt.Errorf("%w: a payment for the rest of the invoice is already in progress", ErrAmount)
+	case amount <= 0 || amount > available:
+		return 0, fmt.Errorf("%w: at most %d can be paid", ErrAmount, available)
+	case amount < available && !inv.AllowPartial:
+		return 0, fmt.Errorf("%w: invoice must be paid in full (%d)", ErrAmount, available)
+	}
+
+	if inv.Pending == nil {
+		inv.Pending = make(map[string]Claim)
+	}
+	inv.Pending[txID] = Claim{Amount: amount, At: at}
+	inv.UpdatedAt = at
+	s.persist()
+	return amount, nil
+}
+
+// Release drops the claim of a payment that never started
+func (s *Store) Release(id, txID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if inv, ok := s.invoices[id]; ok {
+		delete(inv.Pending, txID)
+		s.persist()
+	}
+}
+
+// ApplyPayment records the outcome of payment txID. Successful payments are
+// credited even if their claim was released or the invoice has expired since,
+// as the customer has paid. A failed payment may still be reported paid, when
+// the provider's result arrived after the gateway gave up on it.
+func (s *Store) ApplyPayment(id string, p Payment) (*Invoice, []Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inv, ok := s.invoices[id]
+	if !ok {
+		return nil, nil, ErrNotFound
+	}
+	i := slices.IndexFunc(inv.Payments, func(existing Payment) bool { return existing.TransactionID == p.TransactionID })
+	if i >= 0 && (inv.Payments[i].Paid || !p.Paid) {
+		return nil, nil, ErrStalePayment
+	}
+
+	delete(inv.Pending, p.TransactionID)
+	if i >= 0 {
+		inv.Payments[i] = p
+	} else {
+		inv.Payments = append(inv.Payments, p)
+	}
+	inv.UpdatedAt = p.At
+
+	var events []Event
+	if !p.Paid {
+		events = append(events, Event{EventPaymentFailed, inv.copy()})
+	} else {
+		inv.AmountPaid += p.Amount
+		if inv.AmountPaid >= inv.Amount {
+			inv.Status = StatusPaid
+			inv.PaidAt = &p.At
+			events = append(events, Event{EventPaid, inv.copy()})
+		} else {
+			if inv.Status == StatusOpen {
+				inv.Status = StatusPartiallyPaid
+			}
+			events = append(events, Event{EventPartiallyPaid, inv.copy()})
+		}
+	}
+	s.persist()
+	return inv.copy(), events, nil
+}
+
+// Void cancels an invoice that has not been paid in full
+func (s *Store) Void(id, merchant string) (*Invoice, []Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inv, ok := s.invoices[id]
+	if !ok || inv.Merchant != merchant {
+		return nil, nil, ErrNotFound
+	}
+	if !inv.payable() {
+		return nil, nil, ErrNotOpen
+	}
+	inv.Status = StatusVoid
+	inv.UpdatedAt = time.Now()
+	s.persist()
+	out := inv.copy()
+	return out, []Event{{EventVoided, out}}, nil
+}
+
+// Expire closes unpaid invoices past their expiry and drops claims older
+// than claimTTL, whose payments were most likely abandoned
+func (s *Store) Expire(now time.Time, claimTTL time.Duration) []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var events []Event
+	changed := false
+	for _, inv := range s.invoices {
+		for txID, c := range inv.Pending {
+			if now.Sub(c.At) > claimTTL {
+				delete(inv.Pending, txID)
+				changed = true
+			}
+		}
+		if inv.payable() && !now.Before(inv.ExpiresAt) {
+			inv.Status = StatusExpired
+			inv.UpdatedAt = now
+			changed = true
+			events = append(events, Event{EventExpired, inv.copy()})
+		}
+	}
+	if changed {
+		s.persist()
+	}
+	return events
+}
+
+// newReference returns an unused reference; caller holds s.mu
+func (s *Store) newReference() (string, error) {
+	for {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return "", fmt.Errorf("failed to generate invoice reference: %w", err)
+		}
+		ref := base32.StdEncoding.EncodeToString(b)
+		taken := false
+		for _, inv := range s.invoices {
+			if inv.Reference == ref {
+				taken = true
+				break
+			}
+		}
+		if !taken {
+			return ref, nil
+		}
+	}
+}
+
+// persist mirrors the store to disk; caller holds s.mu
+func (s *Store) persist() {
+	if s.path == "" {
+		return
+	}
+	if err := store.SaveJSON(s.path, s.invoices); err != nil {
+		log.Printf("[Invoice] failed to persist state: %v", err)
+	}
+}
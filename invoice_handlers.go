@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"kacha-psp/invoice"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type createInvoiceRequest struct {
+	Amount       int               `json:"amount"`
+	Description  string            `json:"description"`
+	Phone        string            `json:"phone,omitempty"`
+	AllowPartial bool              `json:"allow_partial,omitempty"`
+	ExpiresAt    *time.Time        `json:"expires_at,omitempty"`
+	ExpiresIn    string            `json:"expires_in,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+type payInvoiceRequest struct {
+	// Method is PUSH_USSD (the default) or OTP
+	Method string `json:"method,omitempty"`
+	Phone  string `json:"phone"`
+	// Amount defaults to everything still due
+	Amount int `json:"amount,omitempty"`
+}
+
+type authorizeInvoiceRequest struct {
+	Reference string `json:"reference"`
+	OTP       int    `json:"otp"`
+}
+
+// publicInvoice is what anyone holding an invoice reference may see
+type publicInvoice struct {
+	Reference    string         `json:"reference"`
+	Merchant     string         `json:"merchant"`
+	Description  string         `json:"description"`
+	Amount       int            `json:"amount"`
+	AmountPaid   int            `json:"amount_paid"`
+	AmountDue    int            `json:"amount_due"`
+	AllowPartial bool           `json:"allow_partial,omitempty"`
+	Status       invoice.Status `json:"status"`
+	ExpiresAt    time.Time      `json:"expires_at"`
+}
+
+func (s *server) handleCreateInvoice(c *gin.Context) {
+	var req createInvoiceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	inv := &invoice.Invoice{
+		Merchant:     c.GetString("merchant"),
+		Amount:       req.Amount,
+		Description:  req.Description,
+		Phone:        req.Phone,
+		AllowPartial: req.AllowPartial,
+		Metadata:     req.Metadata,
+	}
+	switch {
+	case req.ExpiresAt != nil:
+		inv.ExpiresAt = *req.ExpiresAt
+	case req.ExpiresIn != "":
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid expires_in: " + err.Error()})
+			return
+		}
+		inv.ExpiresAt = time.Now().Add(d)
+	}
+
+	created, events, err := s.invoices.Create(inv)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	s.emitInvoiceEvents(events)
+	c.JSON(http.StatusCreated, s.invoiceView(created))
+}
+
+func (s *server) handleListInvoices(c *gin.Context) {
+	views := []invoiceView{}
+	for _, inv := range s.invoices.List(c.GetString("merchant"), invoice.Status(c.Query("status"))) {
+		views = append(views, s.invoiceView(inv))
+	}
+	c.JSON(http.StatusOK, gin.H{"invoices": views})
+}
+
+func (s *server) handleGetInvoice(c *gin.Context) {
+	inv, err := s.invoices.Get(c.Param("id"), c.GetString("merchant"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, s.invoiceView(inv))
+}
+
+func (s *server) handleVoidInvoice(c *gin.Context) {
+	inv, events, err := s.invoices.Void(c.Param("id"), c.GetString("merchant"))
+	if err != nil {
+		respondInvoiceError(c, err)
+		return
+	}
+	s.emitInvoiceEvents(events)
+	c.JSON(http.StatusOK, s.invoiceView(inv))
+}
+
+func (s *server) handleAdminListInvoices(c *gin.Context) {
+	views := []invoiceView{}
+	for _, inv := range s.invoices.List(c.Query("merchant"), invoice.Status(c.Query("status"))) {
+		views = append(views, s.invoiceView(inv))
+	}
+	c.JSON(http.StatusOK, gin.H{"invoices": views})
+}
+
+func (s *server) handleGetPublicInvoice(c *gin.Context) {
+	inv, err := s.invoices.ByReference(c.Param("reference"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, toPublicInvoice(inv))
+}
+
+func (s *server) handlePayInvoice(c *gin.Context) {
+	var req payInvoiceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	inv, err := s.invoices.ByReference(c.Param("reference"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Phone == "" {
+		req.Phone = inv.Phone
+	}
+	if req.Phone == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "phone is required"})
+		return
+	}
+
+	method, err := s.invoicePaymentMethod(req.Method)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	tx, resp, err := s.payInvoice(inv, method, req.Phone, req.Amount)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"transaction_id": tx.ID,
+		"amount":         tx.Amount,
+		"method":         method,
+		"payment":        resp,
+	})
+}
+
+func (s *server) handleAuthorizeInvoicePayment(c *gin.Context) {
+	var req authorizeInvoiceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Reference == "" || req.OTP == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "reference and otp are required"})
+		return
+	}
+	inv, err := s.invoices.ByReference(c.Param("reference"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp, err := s.authorizeInvoicePayment(inv, req.Reference, req.OTP)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func toPublicInvoice(inv *invoice.Invoice) publicInvoice {
+	return publicInvoice{
+		Reference:    inv.Reference,
+		Merchant:     inv.Merchant,
+		Description:  inv.Description,
+		Amount:       inv.Amount,
+		AmountPaid:   inv.AmountPaid,
+		AmountDue:    inv.Due(),
+		AllowPartial: inv.AllowPartial,
+		Status:       inv.Status,
+		ExpiresAt:    inv.ExpiresAt,
+	}
+}
+
+func respondInvoiceError(c *gin.Context, err error) {
+	status := http.StatusBadRequest
+	switch {
+	case errors.Is(err, invoice.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, invoice.ErrNotOpen):
+		status = http.StatusConflict
+	}
+	c.JSON(status, gin.H{"error": err.Error()})
+}
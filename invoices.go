@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"kacha-psp/invoice"
+	kacha "kacha-psp/kacha"
+	"kacha-psp/store"
+	"log"
+	"net/http"
+	"time"
+)
+
+const sourceInvoice = "INVOICE"
+
+// payInvoice starts a customer payment of amount (zero for all that is due)
+// against an invoice, by push USSD or OTP. An invoice issued to a phone is
+// only paid from that phone.
+func (s *server) payInvoice(inv *invoice.Invoice, method store.Type, phone string, amount int) (*store.Transaction, any, error) {
+	if inv.Phone != "" && phone != inv.Phone {
+		return nil, nil, newAPIError(http.StatusUnprocessableEntity, "invoice must be paid from the phone it was issued to", nil)
+	}
+	creds, err := s.keyring.Credentials(inv.Merchant)
+	if err != nil {
+		return nil, nil, newAPIError(http.StatusServiceUnavailable, "invoice cannot be paid online", nil)
+	}
+
+	tx := &store.Transaction{
+		ID:          store.NewID("txn"),
+		Type:        method,
+		Merchant:    inv.Merchant,
+		TraceNumber: store.NewID("INV"),
+		Phone:       phone,
+		Source:      sourceInvoice,
+		SourceID:    inv.ID,
+	}
+	tx.Amount, err = s.invoices.Claim(inv.ID, tx.ID, amount, time.Now())
+	if err != nil {
+		status := http.StatusConflict
+		if errors.Is(err, invoice.ErrAmount) {
+			status = http.StatusUnprocessableEntity
+		}
+		return nil, nil, newAPIError(status, err.Error(), nil)
+	}
+
+	txID := tx.ID
+	var resp any
+	switch method {
+	case store.TypePushUSSD:
+		tx, resp, err = s.requestPushUSSD(tx, creds, kacha.PushUSSDRequest{
+			Phone:       phone,
+			Amount:      tx.Amount,
+			TraceNumber: tx.TraceNumber,
+			Reason:      inv.Description,
+		})
+	default:
+		tx, resp, err = s.requestPayment(tx, kacha.PaymentRequest{
+			Username:    creds.Username,
+			Password:    creds.Password,
+			Phone:       phone,
+			Amount:      tx.Amount,
+			TraceNumber: tx.TraceNumber,
+			Reason:      inv.Description,
+		})
+	}
+	if err != nil {
+		// payments stopped before reaching the provider never settle
+		s.invoices.Release(inv.ID, txID)
+		return nil, nil, err
+	}
+	return tx, resp, nil
+}
+
+// invoicePaymentMethod maps the method a customer chose to a transaction type
+func (s *server) invoicePaymentMethod(method string) (store.Type, error) {
+	switch method {
+	case "", "PUSH_USSD":
+		if s.cfg.PublicURL == "" {
+			return "", newAPIError(http.StatusServiceUnavailable, "push USSD payments need PUBLIC_URL for callbacks", nil)
+		}
+		return store.TypePushUSSD, nil
+	case "OTP":
+		return store.TypeOTPPayment, nil
+	}
+	return "", newAPIError(http.StatusBadRequest, "method must be PUSH_USSD or OTP", nil)
+}
+
+// authorizeInvoicePayment confirms an OTP payment started by payInvoice
+func (s *server) authorizeInvoicePayment(inv *invoice.Invoice, reference string, otp int) (*kacha.PaymentAuthorizeResponse, error) {
+	tx, err := s.txs.FindByReference(reference)
+	if err != nil || tx.Source != sourceInvoice || tx.SourceID != inv.ID {
+		return nil, newAPIError(http.StatusNotFound, "payment not found for invoice", nil)
+	}
+	creds, err := s.keyring.Credentials(inv.Merchant)
+	if err != nil {
+		return nil, newAPIError(http.StatusServiceUnavailable, "invoice cannot be paid online", nil)
+	}
+	return s.authorizePayment(kacha.PaymentAuthorizeRequest{
+		Username:  creds.Username,
+		Password:  creds.Password,
+		Reference: reference,
+		OTP:       otp,
+	})
+}
+
+// invoiceSettled applies a settled payment to its invoice
+func (s *server) invoiceSettled(tx *store.Transaction) {
+	p := invoice.Payment{
+		TransactionID: tx.ID,
+		Method:        string(tx.Type),
+		Phone:         tx.Phone,
+		Amount:        tx.Amount,
+		Paid:          tx.Status == store.StatusSuccess || tx.LateStatus == store.StatusSuccess,
+		At:            time.Now(),
+	}
+	if !p.Paid {
+		p.Error = tx.Message
+	}
+	_, events, err := s.invoices.ApplyPayment(tx.SourceID, p)
+	if err != nil {
+		if !errors.Is(err, invoice.ErrStalePayment) {
+			log.Printf("[Invoice] failed to apply payment %s to %s: %v", tx.ID, tx.SourceID, err)
+		}
+		return
+	}
+	s.emitInvoiceEvents(events)
+}
+
+// expireInvoices closes overdue invoices and drops abandoned payment claims
+func (s *server) expireInvoices() {
+	s.emitInvoiceEvents(s.invoices.Expire(time.Now(), s.cfg.InvoiceClaimTTL))
+}
+
+func (s *server) emitInvoiceEvents(events []invoice.Event) {
+	for _, e := range events {
+		log.Printf("[Invoice] %s %s", e.Type, e.Invoice.ID)
+		s.webhooks.Send(e.Invoice.Merchant, e.Type, s.invoiceView(e.Invoice))
+	}
+}
+
+// invoiceView is an invoice as shown to its merchant
+type invoiceView struct {
+	*invoice.Invoice
+	AmountDue  int    `json:"amount_due"`
+	PaymentURL string `json:"payment_url,omitempty"`
+}
+
+func (s *server) invoiceView(inv *invoice.Invoice) invoiceView {
+	return invoiceView{Invoice: inv, AmountDue: inv.Due(), PaymentURL: s.paymentURL(inv)}
+}
+
+// paymentURL is the link a merchant sends the customer to pay an invoice
+func (s *server) paymentURL(inv *invoice.Invoice) string {
+	if s.cfg.PublicURL == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/i/%s", s.cfg.PublicURL, inv.Reference)
+}
@@ -0,0 +1,34 @@
+package kacha
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// GetBalance returns the balance of the business account the client is authenticated as
+func (c *Client) GetBalance() (*BalanceResponse, error) {
+	var response BalanceResponse
+	var errorResp ErrorResponse
+
+	log.Printf("[Kacha] GetBalance -> endpoint=%s", BalanceEndpoint)
+
+	resp, err := c.httpClient.R().
+		SetResult(&response).
+		SetError(&errorResp).
+		Get(BalanceEndpoint)
+
+	if err != nil {
+		log.Printf("[Kacha] GetBalance error: %v", err)
+		return nil, fmt.Errorf("failed to get balance: %w", err)
+	}
+
+	log.Printf("[Kacha] GetBalance <- status=%d response=%+v errorResponse=%+v",
+		resp.StatusCode(), response, errorResp)
+
+	if resp.StatusCode() != http.StatusOK {
+		return nil, &StatusError{Op: "balance inquiry", StatusCode: resp.StatusCode(), Details: errorResp.Error}
+	}
+
+	return &response, nil
+}
@@ -0,0 +1,18 @@
+package kacha
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ParseCallback decodes an asynchronous notification posted by Kacha to the callback URL
+func (c *Client) ParseCallback(body []byte) (*CallbackNotification, error) {
+	var notification CallbackNotification
+	if err := json.Unmarshal(body, &notification); err != nil {
+		return nil, fmt.Errorf("invalid callback payload: %w", err)
+	}
+	if notification.TraceNumber == "" && notification.Reference == "" {
+		return nil, fmt.Errorf("callback is missing trace_number and reference")
+	}
+	return &notification, nil
+}
@@ -15,6 +15,8 @@ const (
 	PushUSSDEndpoint           = "/orgs/payment/request/push_ussd"
 	TransferValidateEndpoint   = "/orgs/transfer/validate"
 	TransferEndpoint           = "/orgs/transfer"
+	TransactionStatusEndpoint  = "/orgs/transaction/status"
+	BalanceEndpoint            = "/orgs/account/balance"
 )
 
 type Client struct {
@@ -47,6 +49,11 @@ func NewClientWithBaseURL(username, password, baseURL string) *Client {
 	}
 }
 
+// Name identifies this client as a payment provider
+func (c *Client) Name() string {
+	return "kacha"
+}
+
 func (c *Client) SetDebug(debug bool) {
 	c.httpClient.SetDebug(debug)
 }
@@ -0,0 +1,21 @@
+package kacha
+
+import "fmt"
+
+// StatusError is an error status Kacha answered a request with. Kacha did
+// not carry out a request it answered with a 4xx status; after a 5xx it may
+// have.
+type StatusError struct {
+	// Op names the request, e.g. "transfer"
+	Op         string
+	StatusCode int
+	Details    *ErrorDetails
+}
+
+func (e *StatusError) Error() string {
+	if e.Details != nil {
+		return fmt.Sprintf("%s failed: %s (status_code: %s, detail: %s)",
+			e.Op, e.Details.Message, e.Details.StatusCode, e.Details.Detail)
+	}
+	return fmt.Sprintf("%s failed with status code: %d", e.Op, e.StatusCode)
+}
@@ -30,14 +30,7 @@ func (c *Client) RequestPayment(req PaymentRequest) (*PaymentRequestResponse, er
 		resp.StatusCode(), response, errorResp)
 
 	if resp.StatusCode() != http.StatusOK && resp.StatusCode() != http.StatusCreated {
-		if errorResp.Error != nil {
-			return nil, fmt.Errorf("payment request failed: %s (status_code: %s, detail: %s)",
-				errorResp.Error.Message,
-				errorResp.Error.StatusCode,
-				errorResp.Error.Detail,
-			)
-		}
-		return nil, fmt.Errorf("payment request failed with status code: %d", resp.StatusCode())
+		return nil, &StatusError{Op: "payment request", StatusCode: resp.StatusCode(), Details: errorResp.Error}
 	}
 
 	return &response, nil
@@ -48,8 +41,8 @@ func (c *Client) AuthorizePayment(req PaymentAuthorizeRequest) (*PaymentAuthoriz
 	var response PaymentAuthorizeResponse
 	var errorResp ErrorResponse
 
-	jsonData, _ := json.Marshal(req)
-	log.Printf("[Kacha] AuthorizePayment -> endpoint=%s payload(JSON)=%s", PaymentAuthorizeEndpoint, string(jsonData))
+	// the OTP and password are never logged
+	log.Printf("[Kacha] AuthorizePayment -> endpoint=%s username=%s reference=%s", PaymentAuthorizeEndpoint, req.Username, req.Reference)
 
 	resp, err := c.httpClient.R().
 		SetBody(req).
@@ -66,14 +59,7 @@ func (c *Client) AuthorizePayment(req PaymentAuthorizeRequest) (*PaymentAuthoriz
 		resp.StatusCode(), response, errorResp)
 
 	if resp.StatusCode() != http.StatusOK && resp.StatusCode() != http.StatusCreated {
-		if errorResp.Error != nil {
-			return nil, fmt.Errorf("payment authorization failed: %s (status_code: %s, detail: %s)",
-				errorResp.Error.Message,
-				errorResp.Error.StatusCode,
-				errorResp.Error.Detail,
-			)
-		}
-		return nil, fmt.Errorf("payment authorization failed with status code: %d", resp.StatusCode())
+		return nil, &StatusError{Op: "payment authorization", StatusCode: resp.StatusCode(), Details: errorResp.Error}
 	}
 
 	return &response, nil
@@ -102,14 +88,7 @@ func (c *Client) RequestPushUSSD(req PushUSSDRequest) (*PushUSSDResponse, error)
 		resp.StatusCode(), response, errorResp)
 
 	if resp.StatusCode() != http.StatusOK && resp.StatusCode() != http.StatusCreated {
-		if errorResp.Error != nil {
-			return nil, fmt.Errorf("push USSD payment failed: %s (status_code: %s, detail: %s)",
-				errorResp.Error.Message,
-				errorResp.Error.StatusCode,
-				errorResp.Error.Detail,
-			)
-		}
-		return nil, fmt.Errorf("push USSD payment failed with status code: %d", resp.StatusCode())
+		return nil, &StatusError{Op: "push USSD payment", StatusCode: resp.StatusCode(), Details: errorResp.Error}
 	}
 
 	return &response, nil
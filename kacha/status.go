@@ -0,0 +1,35 @@
+package kacha
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// QueryTransaction looks up the status of a transaction by trace number or reference
+func (c *Client) QueryTransaction(req TransactionQueryRequest) (*TransactionQueryResponse, error) {
+	var response TransactionQueryResponse
+	var errorResp ErrorResponse
+
+	log.Printf("[Kacha] QueryTransaction -> endpoint=%s payload=%+v", TransactionStatusEndpoint, req)
+
+	resp, err := c.httpClient.R().
+		SetBody(req).
+		SetResult(&response).
+		SetError(&errorResp).
+		Post(TransactionStatusEndpoint)
+
+	if err != nil {
+		log.Printf("[Kacha] QueryTransaction error: %v", err)
+		return nil, fmt.Errorf("failed to query transaction: %w", err)
+	}
+
+	log.Printf("[Kacha] QueryTransaction <- status=%d response=%+v errorResponse=%+v",
+		resp.StatusCode(), response, errorResp)
+
+	if resp.StatusCode() != http.StatusOK {
+		return nil, &StatusError{Op: "transaction query", StatusCode: resp.StatusCode(), Details: errorResp.Error}
+	}
+
+	return &response, nil
+}
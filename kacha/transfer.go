@@ -31,14 +31,7 @@ func (c *Client) ValidateTransfer(req TransferRequest) (*TransferValidateRespons
 		resp.StatusCode(), response, errorResp)
 
 	if resp.StatusCode() != http.StatusOK {
-		if errorResp.Error != nil {
-			return nil, fmt.Errorf("transfer validation failed: %s (status_code: %s, detail: %s)",
-				errorResp.Error.Message,
-				errorResp.Error.StatusCode,
-				errorResp.Error.Detail,
-			)
-		}
-		return nil, fmt.Errorf("transfer validation failed with status code: %d", resp.StatusCode())
+		return nil, &StatusError{Op: "transfer validation", StatusCode: resp.StatusCode(), Details: errorResp.Error}
 	}
 
 	return &response, nil
@@ -67,14 +60,7 @@ func (c *Client) Transfer(req TransferRequest) (*TransferResponse, error) {
 		resp.StatusCode(), response, errorResp)
 
 	if resp.StatusCode() != http.StatusOK && resp.StatusCode() != http.StatusCreated {
-		if errorResp.Error != nil {
-			return nil, fmt.Errorf("transfer failed: %s (status_code: %s, detail: %s)",
-				errorResp.Error.Message,
-				errorResp.Error.StatusCode,
-				errorResp.Error.Detail,
-			)
-		}
-		return nil, fmt.Errorf("transfer failed with status code: %d", resp.StatusCode())
+		return nil, &StatusError{Op: "transfer", StatusCode: resp.StatusCode(), Details: errorResp.Error}
 	}
 
 	return &response, nil
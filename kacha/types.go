@@ -78,6 +78,24 @@ type TransferRequest struct {
 	Amount    int    `json:"amount" validate:"required,min=1"`
 	Reason    string `json:"reason" validate:"required"`
 	ShortCode string `json:"short_code" validate:"required"`
+	// TraceNumber is the gateway's reference for the transfer, by which its
+	// status can be queried when the answer to it is lost
+	TraceNumber string `json:"trace_number,omitempty"`
+}
+
+// Full transfer request received by your PSP API; QuoteToken binds it to a prior validation
+type PSPTransferRequest struct {
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	To         string `json:"to"`
+	Amount     int    `json:"amount"`
+	Reason     string `json:"reason"`
+	ShortCode  string `json:"short_code"`
+	QuoteToken string `json:"quote_token,omitempty"`
+	// ExpectedName is the intended beneficiary, checked against the account holder name
+	ExpectedName string `json:"expected_name,omitempty"`
+	// InitiatedBy identifies the person requesting a transfer that needs approval
+	InitiatedBy string `json:"initiated_by,omitempty"`
 }
 
 type TransferValidateResponse struct {
@@ -91,6 +109,13 @@ type TransferValidateResponse struct {
 	CustomerInfo *CustomerInfo `json:"customer_info,omitempty"`
 }
 
+// Validation result returned by your PSP API, with a quote token for /withdrawal
+type PSPTransferValidateResponse struct {
+	*TransferValidateResponse
+	QuoteToken     string `json:"quote_token,omitempty"`
+	QuoteExpiresAt int64  `json:"quote_expires_at,omitempty"`
+}
+
 type CustomerInfo struct {
 	Phone     string `json:"phone,omitempty"`
 	Name      string `json:"name,omitempty"`
@@ -107,6 +132,34 @@ type TransferResponse struct {
 	Reference     string `json:"reference,omitempty"`
 }
 
+type TransactionQueryRequest struct {
+	TraceNumber string `json:"trace_number,omitempty"`
+	Reference   string `json:"reference,omitempty"`
+}
+
+type TransactionQueryResponse struct {
+	Success       bool   `json:"success,omitempty"`
+	Status        string `json:"status,omitempty"`
+	Message       string `json:"message,omitempty"`
+	TraceNumber   string `json:"trace_number,omitempty"`
+	Reference     string `json:"reference,omitempty"`
+	TransactionID string `json:"transaction_id,omitempty"`
+	Amount        int    `json:"amount,omitempty"`
+	Phone         string `json:"phone,omitempty"`
+	Timestamp     string `json:"timestamp,omitempty"`
+}
+
+type BalanceResponse struct {
+	Success          bool   `json:"success,omitempty"`
+	Message          string `json:"message,omitempty"`
+	AccountName      string `json:"account_name,omitempty"`
+	AccountNumber    string `json:"account_number,omitempty"`
+	Currency         string `json:"currency,omitempty"`
+	Balance          int    `json:"balance"`
+	AvailableBalance int    `json:"available_balance"`
+	Timestamp        string `json:"timestamp,omitempty"`
+}
+
 type PSPResponse struct {
 	ReferenceID string `json:"referenceId"`
 	Status      string `json:"status"`
@@ -114,6 +167,8 @@ type PSPResponse struct {
 	PSPTxID     string `json:"pspTxId"`
 	PSPData     string `json:"pspData"`
 	Signature   string `json:"signature"`
+	// Fee charged to the merchant, when the gateway is set to report it
+	Fee *int `json:"fee,omitempty"`
 }
 
 type ErrorDetails struct {
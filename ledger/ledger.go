@@ -0,0 +1,453 @@
+// Package ledger is the gateway's double-entry book of merchant balances.
+// Entries are append-only; a correction is a new entry, never an edit.
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"kacha-psp/store"
+)
+
+var (
+	ErrUnbalanced = errors.New("entry debits and credits differ")
+	ErrInvalid    = errors.New("invalid entry")
+)
+
+// Kind is what an entry records
+type Kind string
+
+const (
+	KindCollection Kind = "COLLECTION"
+	KindPayout     Kind = "PAYOUT"
+	KindRefund     Kind = "REFUND"
+	KindFee        Kind = "FEE"
+	KindTopUp      Kind = "TOPUP"
+	KindAdjustment Kind = "ADJUSTMENT"
+)
+
+const (
+	// FeeAccount collects the fees charged to merchants
+	FeeAccount = "gateway:fees"
+	// AdjustmentAccount is the other side of manual corrections of merchant balances
+	AdjustmentAccount = "gateway:adjustments"
+)
+
+// MerchantAccount holds what the gateway owes a merchant: collections less
+// payouts, refunds and fees
+func MerchantAccount(merchant string) string {
+	return "merchant:" + merchant + ":balance"
+}
+
+// MerchantOf returns the merchant whose balance account is named
+func MerchantOf(account string) (string, bool) {
+	rest, ok := strings.CutPrefix(account, "merchant:")
+	if !ok {
+		return "", false
+	}
+	return strings.CutSuffix(rest, ":balance")
+}
+
+// ProviderAccount holds the money the gateway's merchants have at a provider
+func ProviderAccount(provider string) string {
+	return "provider:" + provider + ":clearing"
+}
+
+// creditNormal reports whether an account's balance grows with credits.
+// Provider accounts are assets; merchant and gateway accounts are not.
+func creditNormal(account string) bool {
+	return !strings.HasPrefix(account, "provider:")
+}
+
+// Posting is one side of an entry; exactly one of Debit and Credit is set
+type Posting struct {
+	Account string `json:"account"`
+	Debit   int    `json:"debit,omitempty"`
+	Credit  int    `json:"credit,omitempty"`
+}
+
+// Move debits one account and credits another with amount
+func Move(debit, credit string, amount int) []Posting {
+	return []Posting{{Account: debit, Debit: amount}, {Account: credit, Credit: amount}}
+}
+
+// Entry is a balanced journal entry
+type Entry struct {
+	ID   string `json:"id"`
+	Seq  int64  `json:"seq"`
+	Kind Kind   `json:"kind"`
+	// Key makes posting idempotent: an entry with a key already posted is
+	// not posted again
+	Key           string `json:"key,omitempty"`
+	Merchant      string `json:"merchant,omitempty"`
+	TransactionID string `json:"transaction_id,omitempty"`
+	// RelatedID is another transaction the entry concerns, e.g. the payment a
+	// refund returns
+	RelatedID   string    `json:"related_id,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Postings    []Posting `json:"postings"`
+	At          time.Time `json:"at"`
+}
+
+func (e *Entry) validate() error {
+	if len(e.Postings) < 2 {
+		return fmt.Errorf("%w: an entry needs at least two postings", ErrInvalid)
+	}
+	debits, credits := 0, 0
+	for _, p := range e.Postings {
+		if p.Account == "" || p.Debit < 0 || p.Credit < 0 || (p.Debit == 0) == (p.Credit == 0) {
+			return fmt.Errorf("%w: posting %+v", ErrInvalid, p)
+		}
+		debits += p.Debit
+		credits += p.Credit
+	}
+	if debits != credits {
+		return fmt.Errorf("%w: debits %d, credits %d", ErrUnbalanced, debits, credits)
+	}
+	return nil
+}
+
+// Balance is an account's totals at a point in time
+type Balance struct {
+	Account string `json:"account"`
+	Debits  int    `json:"debits"`
+	Credits int    `json:"credits"`
+	// Balance is on the account's normal side: credits less debits for
+	// merchant and gateway accounts, debits less credits for provider accounts
+	Balance int `json:"balance"`
+}
+
+func (b *Balance) add(p Posting) {
+	b.Debits += p.Debit
+	b.Credits += p.Credit
+	if creditNormal(b.Account) {
+		b.Balance = b.Credits - b.Debits
+	} else {
+		b.Balance = b.Debits - b.Credits
+	}
+}
+
+// Snapshot is every account's balance after entry Seq
+type Snapshot struct {
+	ID       string              `json:"id"`
+	Seq      int64               `json:"seq"`
+	At       time.Time           `json:"at"`
+	Balances map[string]*Balance `json:"balances"`
+}
+
+// Filter selects entries; zero fields match everything
+type Filter struct {
+	Account       string
+	Merchant      string
+	TransactionID string
+	Kind          Kind
+	From, To      time.Time
+	Limit         int
+}
+
+func (f Filter) match(e *Entry) bool {
+	switch {
+	case f.Merchant != "" && e.Merchant != f.Merchant:
+		return false
+	case f.TransactionID != "" && e.TransactionID != f.TransactionID && e.RelatedID != f.TransactionID:
+		return false
+	case f.Kind != "" && e.Kind != f.Kind:
+		return false
+	case !f.From.IsZero() && e.At.Before(f.From):
+		return false
+	case !f.To.IsZero() && e.At.After(f.To):
+		return false
+	}
+	if f.Account == "" {
+		return true
+	}
+	for _, p := range e.Postings {
+		if p.Account == f.Account {
+			return true
+		}
+	}
+	return false
+}
+
+type ledgerFile struct {
+	Entries   []*Entry    `json:"entries"`
+	Snapshots []*Snapshot `json:"snapshots"`
+}
+
+type Ledger struct {
+	path string
+
+	mu        sync.RWMutex
+	entries   []*Entry
+	snapshots []*Snapshot
+	keys      map[string]*Entry
+	balances  map[string]*Balance
+}
+
+func New(path string) (*Ledger, error) {
+	l := &Ledger{
+		path:     path,
+		keys:     make(map[string]*Entry),
+		balances: make(map[string]*Balance),
+	}
+	if path == "" {
+		return l, nil
+	}
+	var f ledgerFile
+	if err := store.LoadJSON(path, &f); err != nil {
+		return nil, err
+	}
+	l.entries, l.snapshots = f.Entries, f.Snapshots
+	for _, e := range l.entries {
+		if e.Key != "" {
+			l.keys[e.Key] = e
+		}
+		l.apply(l.balances, e)
+	}
+	return l, nil
+}
+
+// Post appends a balanced entry dated now, or returns the entry already
+// posted with the same key
+func (l *Ledger) Post(e Entry, now time.Time) (*Entry, bool, error) {
+	if err := e.validate(); err != nil {
+		return nil, false, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if existing, ok := l.keys[e.Key]; ok && e.Key != "" {
+		return existing.copy(), false, nil
+	}
+	e.ID = store.NewID("je")
+	e.Seq = int64(len(l.entries)) + 1
+	if e.At.IsZero() || e.At.After(now) {
+		e.At = now
+	}
+	// entries are kept in date order, and after the last snapshot, for
+	// point-in-time balances
+	if n := len(l.entries); n > 0 && e.At.Before(l.entries[n-1].At) {
+		e.At = l.entries[n-1].At
+	}
+	if n := len(l.snapshots); n > 0 && e.At.Before(l.snapshots[n-1].At) {
+		e.At = l.snapshots[n-1].At
+	}
+	e.Postings = append([]Posting(nil), e.Postings...)
+	l.entries = append(l.entries, &e)
+	if e.Key != "" {
+		l.keys[e.Key] = &e
+	}
+	l.apply(l.balances, &e)
+	l.persist()
+	return e.copy(), true, nil
+}
+
+func (e *Entry) copy() *Entry {
+	out := *e
+	out.Postings = append([]Posting(nil), e.Postings...)
+	return &out
+}
+
+func (l *Ledger) apply(balances map[string]*Balance, e *Entry) {
+	for _, p := range e.Postings {
+		b, ok := balances[p.Account]
+		if !ok {
+			b = &Balance{Account: p.Account}
+			balances[p.Account] = b
+		}
+		b.add(p)
+	}
+}
+
+// Balances returns the balances of accounts with the given prefix (all if
+// empty) as of at, or now if at is zero. Past balances start from the
+// latest snapshot before at.
+func (l *Ledger) Balances(prefix string, at time.Time) []Balance {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	source := l.balances
+	if !at.IsZero() {
+		source = l.balancesAt(at)
+	}
+	out := []Balance{}
+	for account, b := range source {
+		if strings.HasPrefix(account, prefix) {
+			out = append(out, *b)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Account < out[j].Account })
+	return out
+}
+
+// Balance returns one account's balance as of at, or now if at is zero
+func (l *Ledger) Balance(account string, at time.Time) Balance {
+	for _, b := range l.Balances(account, at) {
+		if b.Account == account {
+			return b
+		}
+	}
+	return Balance{Account: account}
+}
+
+// balancesAt replays entries up to at; caller holds l.mu
+func (l *Ledger) balancesAt(at time.Time) map[string]*Balance {
+	balances := make(map[string]*Balance)
+	var seq int64
+	for i := len(l.snapshots) - 1; i >= 0; i-- {
+		if snap := l.snapshots[i]; !snap.At.After(at) {
+			for account, b := range snap.Balances {
+				c := *b
+				balances[account] = &c
+			}
+			seq = snap.Seq
+			break
+		}
+	}
+	for _, e := range l.entries[seq:] {
+		if e.At.After(at) {
+			break
+		}
+		l.apply(balances, e)
+	}
+	return balances
+}
+
+// Entries returns the entries matching f, newest first
+func (l *Ledger) Entries(f Filter) []*Entry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	out := []*Entry{}
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		if e := l.entries[i]; f.match(e) {
+			out = append(out, e.copy())
+			if f.Limit > 0 && len(out) == f.Limit {
+				break
+			}
+		}
+	}
+	return out
+}
+
+// Empty reports whether nothing has been posted yet
+func (l *Ledger) Empty() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.entries) == 0
+}
+
+// Snapshot records every account's current balance
+func (l *Ledger) Snapshot(now time.Time) *Snapshot {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	seq := int64(len(l.entries))
+	if n := len(l.snapshots); n > 0 && l.snapshots[n-1].Seq == seq {
+		return l.snapshots[n-1]
+	}
+	at := now
+	if seq > 0 && l.entries[seq-1].At.After(at) {
+		at = l.entries[seq-1].At
+	}
+	snap := &Snapshot{ID: store.NewID("snap"), Seq: seq, At: at, Balances: make(map[string]*Balance)}
+	for account, b := range l.balances {
+		c := *b
+		snap.Balances[account] = &c
+	}
+	l.snapshots = append(l.snapshots, snap)
+	l.persist()
+	return snap
+}
+
+// Snapshots lists the snapshots without their balances, newest first
+func (l *Ledger) Snapshots() []Snapshot {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	out := []Snapshot{}
+	for i := len(l.snapshots) - 1; i >= 0; i-- {
+		s := *l.snapshots[i]
+		s.Balances = nil
+		out = append(out, s)
+	}
+	return out
+}
+
+// CheckResult is the outcome of verifying the ledger's invariants
+type CheckResult struct {
+	OK      bool     `json:"ok"`
+	Entries int      `json:"entries"`
+	Debits  int      `json:"debits"`
+	Credits int      `json:"credits"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// Check verifies that every entry balances, that total debits equal total
+// credits, and that the running balances and snapshots match a replay of
+// the entries
+func (l *Ledger) Check() CheckResult {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	r := CheckResult{Entries: len(l.entries)}
+	replay := make(map[string]*Balance)
+	snaps := l.snapshots
+	for i, e := range l.entries {
+		if err := e.validate(); err != nil {
+			r.Errors = append(r.Errors, fmt.Sprintf("entry %s: %v", e.ID, err))
+		}
+		if e.Seq != int64(i)+1 {
+			r.Errors = append(r.Errors, fmt.Sprintf("entry %s: sequence %d, expected %d", e.ID, e.Seq, i+1))
+		}
+		for _, p := range e.Postings {
+			r.Debits += p.Debit
+			r.Credits += p.Credit
+		}
+		l.apply(replay, e)
+		for len(snaps) > 0 && snaps[0].Seq <= e.Seq {
+			if snaps[0].Seq == e.Seq {
+				r.Errors = append(r.Errors, compare("snapshot "+snaps[0].ID, snaps[0].Balances, replay)...)
+			}
+			snaps = snaps[1:]
+		}
+	}
+	if r.Debits != r.Credits {
+		r.Errors = append(r.Errors, fmt.Sprintf("total debits %d differ from total credits %d", r.Debits, r.Credits))
+	}
+	r.Errors = append(r.Errors, compare("running balances", l.balances, replay)...)
+	r.OK = len(r.Errors) == 0
+	return r
+}
+
+func compare(what string, got, want map[string]*Balance) []string {
+	var errs []string
+	for account, w := range want {
+		if g, ok := got[account]; !ok || *g != *w {
+			errs = append(errs, fmt.Sprintf("%s: %s does not match the entries", what, account))
+		}
+	}
+	for account := range got {
+		if _, ok := want[account]; !ok {
+			errs = append(errs, fmt.Sprintf("%s: %s has no entries", what, account))
+		}
+	}
+	sort.Strings(errs)
+	return errs
+}
+
+// persist mirrors the ledger to disk; caller holds l.mu
+func (l *Ledger) persist() {
+	if l.path == "" {
+		return
+	}
+	if err := store.SaveJSON(l.path, ledgerFile{Entries: l.entries, Snapshots: l.snapshots}); err != nil {
+		log.Printf("[Ledger] failed to persist: %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package ledger
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC)
+
+// book posts a collection, a fee and a payout for m1 with a snapshot
+// between the fee and the payout
+func book(t *testing.T, path string) *Ledger {
+	t.Helper()
+	l, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []Entry{
+		{Kind: KindCollection, Key: "tx1", Merchant: "m1", Postings: Move(ProviderAccount("kacha"), MerchantAccount("m1"), 1000)},
+		{Kind: KindFee, Key: "tx1:fee", Merchant: "m1", Postings: Move(MerchantAccount("m1"), FeeAccount, 15)},
+		{Kind: KindPayout, Key: "tx2", Merchant: "m1", Postings: Move(MerchantAccount("m1"), ProviderAccount("kacha"), 400)},
+	}
+	for i, e := range entries {
+		if _, _, err := l.Post(e, start.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 {
+			l.Snapshot(start.Add(90 * time.Second))
+		}
+	}
+	return l
+}
+
+func TestCheck(t *testing.T) {
+	l := book(t, "")
+	r := l.Check()
+	if !r.OK || r.Entries != 3 || r.Debits != 1415 || r.Credits != 1415 {
+		t.Fatalf("Check = %+v, want OK with 3 entries of 1415", r)
+	}
+	if b := l.Balance(MerchantAccount("m1"), time.Time{}); b.Balance != 585 {
+		t.Errorf("merchant balance = %d, want 585", b.Balance)
+	}
+	if b := l.Balance(MerchantAccount("m1"), start.Add(90*time.Second)); b.Balance != 985 {
+		t.Errorf("merchant balance at the snapshot = %d, want 985", b.Balance)
+	}
+}
+
+func TestCheckAfterReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.json")
+	book(t, path)
+
+	l, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := l.Check(); !r.OK {
+		t.Errorf("Check after reload = %+v, want OK", r)
+	}
+}
+
+func TestCheckFindsCorruption(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(l *Ledger)
+		want    string
+	}{
+		{"unbalanced entry", func(l *Ledger) { l.entries[0].Postings[1].Credit = 900 }, "debits 1000, credits 900"},
+		{"sequence gap", func(l *Ledger) { l.entries[2].Seq = 4 }, "sequence 4, expected 3"},
+		{"running balance", func(l *Ledger) { l.balances[FeeAccount].Credits++ }, "running balances: gateway:fees does not match"},
+		{"unknown account", func(l *Ledger) { l.balances["gateway:other"] = &Balance{Account: "gateway:other"} }, "gateway:other has no entries"},
+		{"snapshot", func(l *Ledger) { l.snapshots[0].Balances[MerchantAccount("m1")].Balance = 1000 }, "merchant:m1:balance does not match"},
+	}
+	for _, tt := range tests {
+		l := book(t, "")
+		tt.corrupt(l)
+		r := l.Check()
+		if r.OK || !strings.Contains(strings.Join(r.Errors, "\n"), tt.want) {
+			t.Errorf("%s: Check = %+v, want an error containing %q", tt.name, r, tt.want)
+		}
+	}
+}
+
+func TestPost(t *testing.T) {
+	l := book(t, "")
+
+	// a key already posted returns the first entry
+	e, posted, err := l.Post(Entry{Kind: KindCollection, Key: "tx1", Postings: Move(ProviderAccount("kacha"), MerchantAccount("m1"), 5)}, start.Add(time.Hour))
+	if err != nil || posted || e.Postings[0].Debit != 1000 {
+		t.Errorf("Post with a used key = %+v, %v, %v, want the first entry", e, posted, err)
+	}
+
+	// entries are not dated before the last entry
+	e, _, err = l.Post(Entry{Kind: KindCollection, Key: "tx3", Postings: Move(ProviderAccount("kacha"), MerchantAccount("m1"), 5), At: start}, start.Add(time.Hour))
+	if err != nil || !e.At.Equal(start.Add(2*time.Minute)) {
+		t.Errorf("Post backdated = %v, %v, want dated after the last entry", e.At, err)
+	}
+
+	unbalanced := Entry{Kind: KindPayout, Postings: []Posting{{Account: "a", Debit: 5}, {Account: "b", Credit: 4}}}
+	if _, _, err := l.Post(unbalanced, start); !errors.Is(err, ErrUnbalanced) {
+		t.Errorf("Post unbalanced = %v, want ErrUnbalanced", err)
+	}
+	onesided := Entry{Kind: KindPayout, Postings: []Posting{{Account: "a", Debit: 5, Credit: 5}, {Account: "b"}}}
+	if _, _, err := l.Post(onesided, start); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Post with both sides set = %v, want ErrInvalid", err)
+	}
+	if r := l.Check(); !r.OK {
+		t.Errorf("Check = %+v, want OK", r)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"kacha-psp/ledger"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handleMerchantBalance returns the merchant's ledger balance, now or at the
+// time given by the at parameter
+func (s *server) handleMerchantBalance(c *gin.Context) {
+	at, ok := timeParam(c, "at")
+	if !ok {
+		return
+	}
+	merchant := c.GetString("merchant")
+	c.JSON(http.StatusOK, gin.H{
+		"merchant": merchant,
+		"at":       asOf(at),
+		"balance":  s.ledger.Balance(ledger.MerchantAccount(merchant), at),
+	})
+}
+
+func (s *server) handleMerchantLedgerEntries(c *gin.Context) {
+	f, ok := ledgerFilter(c)
+	if !ok {
+		return
+	}
+	f.Merchant = c.GetString("merchant")
+	c.JSON(http.StatusOK, gin.H{"entries": s.ledger.Entries(f)})
+}
+
+func (s *server) handleLedgerBalances(c *gin.Context) {
+	at, ok := timeParam(c, "at")
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"at": asOf(at), "balances": s.ledger.Balances(c.Query("prefix"), at)})
+}
+
+func (s *server) handleLedgerEntries(c *gin.Context) {
+	f, ok := ledgerFilter(c)
+	if !ok {
+		return
+	}
+	f.Account = c.Query("account")
+	f.Merchant = c.Query("merchant")
+	c.JSON(http.StatusOK, gin.H{"entries": s.ledger.Entries(f)})
+}
+
+func (s *server) handleLedgerCheck(c *gin.Context) {
+	r := s.ledger.Check()
+	status := http.StatusOK
+	if !r.OK {
+		status = http.StatusConflict
+	}
+	c.JSON(status, r)
+}
+
+func (s *server) handleListLedgerSnapshots(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"snapshots": s.ledger.Snapshots()})
+}
+
+func (s *server) handleLedgerSnapshot(c *gin.Context) {
+	c.JSON(http.StatusCreated, s.ledger.Snapshot(time.Now()))
+}
+
+func ledgerFilter(c *gin.Context) (ledger.Filter, bool) {
+	f := ledger.Filter{
+		TransactionID: c.Query("transaction_id"),
+		Kind:          ledger.Kind(c.Query("kind")),
+	}
+	var ok bool
+	if f.From, ok = timeParam(c, "from"); !ok {
+		return f, false
+	}
+	if f.To, ok = timeParam(c, "to"); !ok {
+		return f, false
+	}
+	f.Limit, _ = strconv.Atoi(c.DefaultQuery("limit", "100"))
+	return f, true
+}
+
+// timeParam reads an optional RFC 3339 query parameter, responding 400 if it
+// is malformed
+func timeParam(c *gin.Context, name string) (time.Time, bool) {
+	v := c.Query(name)
+	if v == "" {
+		return time.Time{}, true
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + name + ": " + err.Error()})
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// asOf is the time a balance query answers for; zero means now
+func asOf(at time.Time) time.Time {
+	if at.IsZero() {
+		return time.Now()
+	}
+	return at
+}
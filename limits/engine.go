@@ -0,0 +1,292 @@
+package limits
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"kacha-psp/store"
+)
+
+// Check is a transaction about to be sent to a provider
+type Check struct {
+	Merchant  string
+	Operation string
+	Phone     string
+	ShortCode string
+	Amount    int
+	At        time.Time
+}
+
+type Usage struct {
+	Amount int `json:"amount"`
+	Count  int `json:"count"`
+}
+
+// reservation is usage held by one transaction until it is released
+type reservation struct {
+	Keys   []string  `json:"keys"`
+	Amount int       `json:"amount"`
+	At     time.Time `json:"at"`
+}
+
+type state struct {
+	Limits       []Limit                 `json:"limits"`
+	Usage        map[string]Usage        `json:"usage"`
+	Reservations map[string]*reservation `json:"reservations"`
+}
+
+// Engine evaluates limits and tracks usage. Reserve checks every applicable
+// limit and records the usage in one step, so concurrent requests cannot
+// both squeeze under the same cap.
+type Engine struct {
+	location *time.Location
+	path     string
+
+	mu sync.Mutex
+	st state
+}
+
+func NewEngine(location *time.Location, path string) (*Engine, error) {
+	e := &Engine{
+		location: location,
+		path:     path,
+		st: state{
+			Usage:        make(map[string]Usage),
+			Reservations: make(map[string]*reservation),
+		},
+	}
+	if path == "" {
+		return e, nil
+	}
+	if err := store.LoadJSON(path, &e.st); err != nil {
+		return nil, err
+	}
+	if e.st.Usage == nil {
+		e.st.Usage = make(map[string]Usage)
+	}
+	if e.st.Reservations == nil {
+		e.st.Reservations = make(map[string]*reservation)
+	}
+	return e, nil
+}
+
+func (e *Engine) Limits() []Limit {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Limit(nil), e.st.Limits...)
+}
+
+// SetLimits validates and replaces all limits
+func (e *Engine) SetLimits(limits []Limit) error {
+	seen := make(map[string]bool)
+	for _, l := range limits {
+		if err := l.Validate(); err != nil {
+			return err
+		}
+		if seen[l.ID] {
+			return fmt.Errorf("duplicate limit id %s", l.ID)
+		}
+		seen[l.ID] = true
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.st.Limits = append([]Limit(nil), limits...)
+	e.persist()
+	return nil
+}
+
+// Upsert adds a limit or replaces the one with the same id
+func (e *Engine) Upsert(limit Limit) error {
+	if err := limit.Validate(); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i, l := range e.st.Limits {
+		if l.ID == limit.ID {
+			e.st.Limits[i] = limit
+			e.persist()
+			return nil
+		}
+	}
+	e.st.Limits = append(e.st.Limits, limit)
+	e.persist()
+	return nil
+}
+
+func (e *Engine) Delete(id string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i, l := range e.st.Limits {
+		if l.ID == id {
+			e.st.Limits = append(e.st.Limits[:i], e.st.Limits[i+1:]...)
+			e.persist()
+			return true
+		}
+	}
+	return false
+}
+
+// Reserve checks c against every applicable limit and, if none is exceeded,
+// records its usage under a reservation id. Release the reservation if the
+// transaction does not go through. The error is an *ExceededError when a
+// limit would be broken.
+func (e *Engine) Reserve(c Check) (string, error) {
+	if c.At.IsZero() {
+		c.At = time.Now()
+	}
+	day, month := e.periods(c.At)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var keys []string
+	for _, l := range e.st.Limits {
+		if !l.appliesTo(c) {
+			continue
+		}
+		value := l.scopeValue(c)
+		exceeded := func(reason string, args ...interface{}) error {
+			return &ExceededError{LimitID: l.ID, Scope: l.Scope, Value: value, Reason: fmt.Sprintf(reason, args...)}
+		}
+
+		if l.MinAmount > 0 && c.Amount < l.MinAmount {
+			return "", exceeded("amount %d is below the minimum of %d", c.Amount, l.MinAmount)
+		}
+		if l.MaxAmount > 0 && c.Amount > l.MaxAmount {
+			return "", exceeded("amount %d is above the maximum of %d", c.Amount, l.MaxAmount)
+		}
+
+		dayKey := usageKey(l.ID, value, day)
+		used := e.st.Usage[dayKey]
+		if l.DailyAmount > 0 && used.Amount+c.Amount > l.DailyAmount {
+			return "", exceeded("daily total would be %d, limit is %d", used.Amount+c.Amount, l.DailyAmount)
+		}
+		if l.DailyCount > 0 && used.Count+1 > l.DailyCount {
+			return "", exceeded("daily count limit of %d reached", l.DailyCount)
+		}
+
+		monthKey := usageKey(l.ID, value, month)
+		used = e.st.Usage[monthKey]
+		if l.MonthlyAmount > 0 && used.Amount+c.Amount > l.MonthlyAmount {
+			return "", exceeded("monthly total would be %d, limit is %d", used.Amount+c.Amount, l.MonthlyAmount)
+		}
+		if l.MonthlyCount > 0 && used.Count+1 > l.MonthlyCount {
+			return "", exceeded("monthly count limit of %d reached", l.MonthlyCount)
+		}
+
+		if l.DailyAmount > 0 || l.DailyCount > 0 {
+			keys = append(keys, dayKey)
+		}
+		if l.MonthlyAmount > 0 || l.MonthlyCount > 0 {
+			keys = append(keys, monthKey)
+		}
+	}
+
+	for _, key := range keys {
+		u := e.st.Usage[key]
+		u.Amount += c.Amount
+		u.Count++
+		e.st.Usage[key] = u
+	}
+
+	id := store.NewID("lim")
+	e.st.Reservations[id] = &reservation{Keys: keys, Amount: c.Amount, At: c.At}
+	e.prune(c.At)
+	e.persist()
+	return id, nil
+}
+
+// Commit keeps the usage of a reservation that went through
+func (e *Engine) Commit(id string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.st.Reservations[id]; ok {
+		delete(e.st.Reservations, id)
+		e.persist()
+	}
+}
+
+// Release gives back the usage held by a reservation
+func (e *Engine) Release(id string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	r, ok := e.st.Reservations[id]
+	if !ok {
+		return
+	}
+	for _, key := range r.Keys {
+		u, ok := e.st.Usage[key]
+		if !ok {
+			continue
+		}
+		u.Amount -= r.Amount
+		u.Count--
+		if u.Count <= 0 {
+			delete(e.st.Usage, key)
+		} else {
+			e.st.Usage[key] = u
+		}
+	}
+	delete(e.st.Reservations, id)
+	e.persist()
+}
+
+// Usage returns current period usage for each limit that tracks value
+func (e *Engine) Usage(value string) map[string]Usage {
+	day, month := e.periods(time.Now())
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	out := make(map[string]Usage)
+	for _, l := range e.st.Limits {
+		for _, period := range []string{day, month} {
+			key := usageKey(l.ID, value, period)
+			if u, ok := e.st.Usage[key]; ok {
+				out[key] = u
+			}
+		}
+	}
+	return out
+}
+
+func (e *Engine) periods(t time.Time) (string, string) {
+	t = t.In(e.location)
+	return t.Format("D2006-01-02"), t.Format("M2006-01")
+}
+
+// prune drops usage from earlier periods and stale reservations; caller holds e.mu
+func (e *Engine) prune(now time.Time) {
+	day, month := e.periods(now)
+	for key := range e.st.Usage {
+		period := key[strings.LastIndex(key, "|")+1:]
+		if period != day && period != month {
+			delete(e.st.Usage, key)
+		}
+	}
+	for id, r := range e.st.Reservations {
+		if now.Sub(r.At) > 31*24*time.Hour {
+			delete(e.st.Reservations, id)
+		}
+	}
+}
+
+// persist mirrors the engine state to disk; caller holds e.mu
+func (e *Engine) persist() {
+	if e.path == "" {
+		return
+	}
+	if err := store.SaveJSON(e.path, e.st); err != nil {
+		log.Printf("[Limits] failed to persist state: %v", err)
+	}
+}
+
+func usageKey(limitID, value, period string) string {
+	return limitID + "|" + value + "|" + period
+}
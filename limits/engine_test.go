@@ -0,0 +1,174 @@
+package limits
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"kacha-psp/store"
+)
+
+var at = time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+
+func newEngine(t *testing.T, path string, limits ...Limit) *Engine {
+	t.Helper()
+	e, err := NewEngine(time.UTC, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits != nil {
+		if err := e.SetLimits(limits); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return e
+}
+
+func withdrawal(amount int) Check {
+	return Check{Merchant: "m1", Operation: string(store.TypeTransfer), Phone: "0911000000", Amount: amount, At: at}
+}
+
+// used returns the limit's usage by value in the day of at
+func used(e *Engine, limitID, value string) Usage {
+	day, _ := e.periods(at)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.st.Usage[usageKey(limitID, value, day)]
+}
+
+func exceeded(t *testing.T, err error, limitID string) {
+	t.Helper()
+	var ex *ExceededError
+	if !errors.As(err, &ex) || ex.LimitID != limitID {
+		t.Errorf("Reserve = %v, want limit %s exceeded", err, limitID)
+	}
+}
+
+func TestReserveDailyAmount(t *testing.T) {
+	e := newEngine(t, "", Limit{ID: "daily", Scope: ScopeMerchant, DailyAmount: 1000})
+
+	first, err := e.Reserve(withdrawal(600))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Reserve(withdrawal(400)); err != nil {
+		t.Fatalf("Reserve up to the limit: %v", err)
+	}
+	_, err = e.Reserve(withdrawal(1))
+	exceeded(t, err, "daily")
+	if u := used(e, "daily", "m1"); u != (Usage{Amount: 1000, Count: 2}) {
+		t.Errorf("usage = %+v, want 1000 in 2", u)
+	}
+
+	// a released reservation gives its usage back
+	e.Release(first)
+	if u := used(e, "daily", "m1"); u != (Usage{Amount: 400, Count: 1}) {
+		t.Errorf("usage after Release = %+v, want 400 in 1", u)
+	}
+	if _, err := e.Reserve(withdrawal(600)); err != nil {
+		t.Errorf("Reserve after Release: %v", err)
+	}
+}
+
+func TestCommitKeepsUsage(t *testing.T) {
+	e := newEngine(t, "", Limit{ID: "count", Scope: ScopePhone, DailyCount: 1})
+
+	id, err := e.Reserve(withdrawal(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Commit(id)
+	// a committed reservation can no longer be released
+	e.Release(id)
+	if u := used(e, "count", "0911000000"); u != (Usage{Amount: 100, Count: 1}) {
+		t.Errorf("usage after Commit and Release = %+v, want 100 in 1", u)
+	}
+	_, err = e.Reserve(withdrawal(100))
+	exceeded(t, err, "count")
+
+	// another phone is counted separately
+	other := withdrawal(100)
+	other.Phone = "0922000000"
+	if _, err := e.Reserve(other); err != nil {
+		t.Errorf("Reserve for another phone: %v", err)
+	}
+}
+
+func TestReserveChecksEveryLimit(t *testing.T) {
+	e := newEngine(t, "",
+		Limit{ID: "bounds", Scope: ScopeMerchant, MinAmount: 10, MaxAmount: 500},
+		Limit{ID: "monthly", Scope: ScopeMerchant, Operation: string(store.TypeTransfer), MonthlyAmount: 700},
+		Limit{ID: "other-merchant", Scope: ScopeMerchant, Merchant: "m2", MaxAmount: 1},
+		Limit{ID: "short-code", Scope: ScopeShortCode, MaxAmount: 1},
+	)
+	tests := []struct {
+		name   string
+		amount int
+		want   string
+	}{
+		{"below minimum", 5, "bounds"},
+		{"above maximum", 501, "bounds"},
+		{"within", 500, ""},
+		{"over the month", 201, "monthly"},
+		{"rest of the month", 200, ""},
+	}
+	for _, tt := range tests {
+		_, err := e.Reserve(withdrawal(tt.amount))
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%s: Reserve = %v, want no error", tt.name, err)
+			}
+			continue
+		}
+		var ex *ExceededError
+		if !errors.As(err, &ex) || ex.LimitID != tt.want {
+			t.Errorf("%s: Reserve = %v, want limit %s exceeded", tt.name, err, tt.want)
+		}
+	}
+
+	// a refused reservation holds nothing
+	day, month := e.periods(at)
+	if u := e.st.Usage[usageKey("monthly", "m1", month)]; u != (Usage{Amount: 700, Count: 2}) {
+		t.Errorf("monthly usage = %+v, want 700 in 2", u)
+	}
+	if _, ok := e.st.Usage[usageKey("bounds", "m1", day)]; ok {
+		t.Errorf("per-transaction bounds tracked usage")
+	}
+}
+
+func TestReservationsPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limits.json")
+	e := newEngine(t, path, Limit{ID: "daily", Scope: ScopeMerchant, DailyAmount: 1000})
+	id, err := e.Reserve(withdrawal(600))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newEngine(t, path)
+	_, err = restarted.Reserve(withdrawal(500))
+	exceeded(t, err, "daily")
+	restarted.Release(id)
+	if _, err := restarted.Reserve(withdrawal(500)); err != nil {
+		t.Errorf("Reserve after releasing across a restart: %v", err)
+	}
+}
+
+func TestSetLimitsRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits []Limit
+	}{
+		{"no id", []Limit{{Scope: ScopeMerchant}}},
+		{"unknown scope", []Limit{{ID: "a", Scope: "COUNTRY"}}},
+		{"negative", []Limit{{ID: "a", Scope: ScopeMerchant, DailyAmount: -1}}},
+		{"min over max", []Limit{{ID: "a", Scope: ScopeMerchant, MinAmount: 10, MaxAmount: 5}}},
+		{"duplicate id", []Limit{{ID: "a", Scope: ScopeMerchant}, {ID: "a", Scope: ScopePhone}}},
+	}
+	e := newEngine(t, "")
+	for _, tt := range tests {
+		if err := e.SetLimits(tt.limits); err == nil {
+			t.Errorf("%s: SetLimits = nil, want an error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package limits
+
+import (
+	"fmt"
+)
+
+type Scope string
+
+const (
+	ScopeMerchant  Scope = "MERCHANT"
+	ScopePhone     Scope = "PHONE"
+	ScopeShortCode Scope = "SHORT_CODE"
+)
+
+// Limit caps transactions it applies to. Per-transaction bounds are checked
+// on each amount; period totals and counts are tracked per scope value, so a
+// PHONE limit counts each phone separately. Zero values are unlimited.
+type Limit struct {
+	ID    string `json:"id"`
+	Scope Scope  `json:"scope"`
+	// Merchant and Operation restrict which transactions the limit applies to
+	Merchant  string `json:"merchant,omitempty"`
+	Operation string `json:"operation,omitempty"`
+
+	MinAmount int `json:"min_amount,omitempty"`
+	MaxAmount int `json:"max_amount,omitempty"`
+
+	DailyAmount   int `json:"daily_amount,omitempty"`
+	DailyCount    int `json:"daily_count,omitempty"`
+	MonthlyAmount int `json:"monthly_amount,omitempty"`
+	MonthlyCount  int `json:"monthly_count,omitempty"`
+}
+
+func (l Limit) Validate() error {
+	if l.ID == "" {
+		return fmt.Errorf("limit id is required")
+	}
+	switch l.Scope {
+	case ScopeMerchant, ScopePhone, ScopeShortCode:
+	default:
+		return fmt.Errorf("limit %s: scope must be MERCHANT, PHONE or SHORT_CODE", l.ID)
+	}
+	if l.MinAmount < 0 || l.MaxAmount < 0 || l.DailyAmount < 0 || l.DailyCount < 0 ||
+		l.MonthlyAmount < 0 || l.MonthlyCount < 0 {
+		return fmt.Errorf("limit %s: values must not be negative", l.ID)
+	}
+	if l.MaxAmount > 0 && l.MinAmount > l.MaxAmount {
+		return fmt.Errorf("limit %s: min_amount is greater than max_amount", l.ID)
+	}
+	return nil
+}
+
+func (l Limit) appliesTo(c Check) bool {
+	if l.Merchant != "" && l.Merchant != c.Merchant {
+		return false
+	}
+	if l.Operation != "" && l.Operation != c.Operation {
+		return false
+	}
+	return l.scopeValue(c) != ""
+}
+
+func (l Limit) scopeValue(c Check) string {
+	switch l.Scope {
+	case ScopeMerchant:
+		return c.Merchant
+	case ScopePhone:
+		return c.Phone
+	case ScopeShortCode:
+		return c.ShortCode
+	}
+	return ""
+}
+
+// ExceededError reports which limit a transaction would break
+type ExceededError struct {
+	LimitID string `json:"limit_id"`
+	Scope   Scope  `json:"scope"`
+	Value   string `json:"value"`
+	Reason  string `json:"reason"`
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("limit %s exceeded for %s %s: %s", e.LimitID, e.Scope, e.Value, e.Reason)
+}
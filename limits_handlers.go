@@ -0,0 +1,59 @@
+package main
+
+import (
+	"kacha-psp/limits"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (s *server) handleGetLimits(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"limits": s.limits.Limits()})
+}
+
+func (s *server) handlePutLimits(c *gin.Context) {
+	var all []limits.Limit
+	if err := c.ShouldBindJSON(&all); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := s.limits.SetLimits(all); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"limits": s.limits.Limits()})
+}
+
+func (s *server) handleUpsertLimit(c *gin.Context) {
+	var limit limits.Limit
+	if err := c.ShouldBindJSON(&limit); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if id := c.Param("id"); id != "" {
+		limit.ID = id
+	}
+	if err := s.limits.Upsert(limit); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, limit)
+}
+
+func (s *server) handleDeleteLimit(c *gin.Context) {
+	if !s.limits.Delete(c.Param("id")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "limit not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// handleLimitUsage reports current daily and monthly usage for a merchant, phone or short code
+func (s *server) handleLimitUsage(c *gin.Context) {
+	value := c.Query("value")
+	if value == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "value is required"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"value": value, "usage": s.limits.Usage(value)})
+}
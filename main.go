@@ -1,11 +1,35 @@
 package main
 
 import (
+	"crypto/rand"
+	"kacha-psp/approval"
+	"kacha-psp/checkout"
 	"kacha-psp/config"
-	kacha "kacha-psp/kacha"
-	"kacha-psp/utils"
+	"kacha-psp/escrow"
+	"kacha-psp/fees"
+	"kacha-psp/float"
+	"kacha-psp/intent"
+	"kacha-psp/invoice"
+	"kacha-psp/ledger"
+	"kacha-psp/limits"
+	"kacha-psp/namematch"
+	"kacha-psp/operator"
+	"kacha-psp/otp"
+	"kacha-psp/provider"
+	"kacha-psp/quote"
+	"kacha-psp/reconcile"
+	"kacha-psp/response"
+	"kacha-psp/risk"
+	"kacha-psp/routing"
+	"kacha-psp/schedule"
+	"kacha-psp/split"
+	"kacha-psp/store"
+	"kacha-psp/subscription"
+	"kacha-psp/vault"
+	"kacha-psp/webhook"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -16,165 +40,353 @@ func main() {
 		log.Fatal(err)
 	}
 
-	r := gin.Default()
-
-	r.GET("/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{"status": "ok"})
-	})
-
-	r.POST("/otp/pay", func(c *gin.Context) {
-		var req kacha.PaymentRequest
-		if err := c.ShouldBindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
+	quoteSecret := []byte(cfg.QuoteSecret)
+	if len(quoteSecret) == 0 {
+		log.Printf("QUOTE_SECRET not set, generating an ephemeral secret; quote tokens will not survive restarts")
+		quoteSecret = make([]byte, 32)
+		if _, err := rand.Read(quoteSecret); err != nil {
+			log.Fatal(err)
 		}
+	}
 
-		if req.Username == "" || req.Password == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "username and password are required"})
-			return
-		}
-		if req.Phone == "" || req.Amount <= 0 || req.TraceNumber == "" || req.Reason == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "phone, amount, trace_number, and reason are required"})
-			return
-		}
+	providers := provider.NewRegistry(cfg.PaymentProvider)
+	providers.Register("kacha", provider.KachaFactory(cfg.KachaBaseURL))
+	if cfg.EnableFakeProvider {
+		log.Printf("Fake payment provider enabled; do not use in production")
+		providers.Register("fake", provider.NewFake("fake").Factory())
+	}
 
-		client := kacha.NewClientWithBaseURL(req.Username, req.Password, cfg.KachaBaseURL)
-		resp, err := client.RequestPayment(req)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
+	txs, err := store.NewTransactionStore(cfg.DataPath("transactions.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		c.JSON(http.StatusOK, resp)
-	})
+	health := routing.NewHealth(routing.DefaultFailureThreshold, routing.DefaultCooldown)
+	router, err := routing.NewEngine(append([]string{cfg.PaymentProvider}, cfg.FallbackProviders...), cfg.Location, health, cfg.DataPath("routing_rules.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	r.POST("/otp/authorize", func(c *gin.Context) {
-		var req kacha.PaymentAuthorizeRequest
-		if err := c.ShouldBindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
+	limitEngine, err := limits.NewEngine(cfg.Location, cfg.DataPath("limits.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	feeEngine, err := fees.NewEngine(cfg.DataPath("fees.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		if req.Username == "" || req.Password == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "username and password are required"})
-			return
-		}
-		if req.Reference == "" || req.OTP == 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "reference and otp are required"})
-			return
-		}
+	riskEngine, err := risk.NewEngine(risk.StoreHistory(txs), cfg.Location, cfg.RiskRulesFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go riskEngine.Watch(10*time.Second, nil)
 
-		client := kacha.NewClientWithBaseURL(req.Username, req.Password, cfg.KachaBaseURL)
-		resp, err := client.AuthorizePayment(req)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
+	approvals, err := approval.NewStore(approval.Policy{
+		Threshold: cfg.ApprovalThreshold,
+		TTL:       cfg.ApprovalTTL.String(),
+	}, cfg.DataPath("approvals.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		c.JSON(http.StatusOK, resp)
-	})
-	// Push USSD payment request endpoint
-	r.POST("/pay", func(c *gin.Context) {
-		var req kacha.PSPPushUSSDRequest
-		if err := c.ShouldBindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
+	sealer, err := vault.NewSealer(cfg.CredentialsKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if sealer == nil {
+		log.Printf("CREDENTIALS_KEY not set, all merchant endpoints are disabled")
+	}
+	keyring, err := vault.NewKeyring(sealer, providers.Verify, cfg.DataPath("credentials.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	billing, err := subscription.NewStore(cfg.DataPath("subscriptions.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	invoices, err := invoice.NewStore(cfg.DataPath("invoices.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	otps, err := otp.NewStore(otp.Policy{
+		MaxAttempts:    max(cfg.OTPMaxAttempts, 1),
+		Lockout:        cfg.OTPLockout,
+		TTL:            cfg.OTPTTL,
+		MaxResends:     cfg.OTPMaxResends,
+		ResendInterval: cfg.OTPResendInterval,
+	}, cfg.DataPath("otp_sessions.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	checkouts, err := checkout.NewStore(cfg.DataPath("checkouts.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	book, err := ledger.New(cfg.DataPath("ledger.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	splits, err := split.NewStore(split.RetryPolicy{
+		MaxAttempts: max(cfg.SplitMaxAttempts, 1),
+		Delay:       max(cfg.SplitRetryDelay, time.Second),
+	}, cfg.DataPath("splits.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	escrows, err := escrow.NewStore(cfg.DataPath("escrows.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	intents, err := intent.NewStore(cfg.DataPath("intents.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	floats, err := float.NewStore(cfg.FloatEnforced, cfg.DataPath("floats.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	formats, err := response.NewStore(cfg.DataPath("response_formats.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	recon, err := reconcile.NewStore(cfg.DataPath("reconciliations.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	webhooks, err := webhook.NewDispatcher(cfg.DataPath("webhooks.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	operators, err := operator.NewStore(cfg.DataPath("operators.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	schedules, err := schedule.NewStore(cfg.Location, cfg.DataPath("schedules.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	quotes, err := quote.NewService(quoteSecret, cfg.QuoteTTL, cfg.DataPath("quotes.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		if req.Username == "" || req.Password == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "username and password are required"})
-			return
-		}
-		if req.Phone == "" || req.Amount <= 0 || req.TraceNumber == "" || req.CallbackURL == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "phone, amount, trace_number, and callback_url are required"})
-			return
-		}
+	srv := &server{
+		cfg:       cfg,
+		providers: providers,
+		router:    router,
+		health:    health,
+		limits:    limitEngine,
+		risk:      riskEngine,
+		approvals: approvals,
+		operators: operators,
+		schedules: schedules,
+		keyring:   keyring,
+		billing:   billing,
+		invoices:  invoices,
+		checkouts: checkouts,
+		otps:      otps,
+		refunds:   &refundLocks{inFlight: make(map[string]int)},
+		splits:    splits,
+		escrows:   escrows,
+		intents:   intents,
+		recon:     recon,
+		ledger:    book,
+		floats:    floats,
+		fees:      feeEngine,
+		formats:   formats,
+		webhooks:  webhooks,
+		txs:       txs,
+		quotes:    quotes,
+		names:     namematch.NewMatcher(cfg.NameMatchWarnBelow, cfg.NameMatchBlockBelow),
+	}
 
-		client := kacha.NewClientWithBaseURL(req.Username, req.Password, cfg.KachaBaseURL)
+	r := gin.Default()
+	r.SetHTMLTemplate(checkout.Templates)
 
-		kachaReq := kacha.PushUSSDRequest{
-			Phone:       req.Phone,
-			Amount:      req.Amount,
-			TraceNumber: req.TraceNumber,
-			CallbackURL: req.CallbackURL,
-			Reason:      req.Reason,
-		}
+	r.GET("/health", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
 
-		kachaResp, err := client.RequestPushUSSD(kachaReq)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
+	r.POST("/otp/pay", srv.handleOTPPay)
+	r.POST("/otp/authorize", srv.handleOTPAuthorize)
+	r.POST("/otp/resend", srv.handleOTPResend)
+	// Push USSD payment request endpoint
+	r.POST("/pay", srv.handlePushUSSD)
 
-		pspResp := utils.MapPushUSSDToPSP(kachaResp, err == nil)
-		c.JSON(http.StatusOK, pspResp)
-	})
+	r.POST("/callback", srv.handleCallback)
+	r.POST("/callback/:provider", srv.handleCallback)
 
+	r.POST("/withdrawal/validate", srv.handleValidateTransfer)
+	// B2C Transfer endpoint
+	r.POST("/withdrawal", srv.handleWithdrawal)
+	r.POST("/withdrawal/approvals/:id/approve", srv.handleApproveWithdrawal)
+	r.POST("/withdrawal/approvals/:id/reject", srv.handleRejectWithdrawal)
 
-	r.POST("/callback", func(c *gin.Context) {
-		var notification kacha.CallbackNotification
-		if err := c.ShouldBindJSON(&notification); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-		log.Printf("Received callback notification: %+v", notification)
-		c.JSON(http.StatusOK, gin.H{"success": true, "message": "Callback received"})
-	})
+	merchant := r.Group("/", srv.requireMerchant)
+	merchant.POST("/schedules", srv.handleCreateSchedule)
+	merchant.GET("/schedules", srv.handleListSchedules)
+	merchant.GET("/schedules/:id", srv.handleGetSchedule)
+	merchant.PATCH("/schedules/:id", srv.handleEditSchedule)
+	merchant.POST("/schedules/:id/pause", srv.handlePauseSchedule)
+	merchant.POST("/schedules/:id/resume", srv.handleResumeSchedule)
+	merchant.DELETE("/schedules/:id", srv.handleCancelSchedule)
 
-	r.POST("/withdrawal/validate", func(c *gin.Context) {
-		var req kacha.TransferRequest
-		if err := c.ShouldBindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
+	merchant.PUT("/merchant/credentials", srv.handleRotateCredentials)
+	merchant.GET("/merchant/format", srv.handleGetResponseFormat)
+	merchant.PUT("/merchant/format", srv.handlePutResponseFormat)
+	merchant.GET("/webhooks", srv.handleGetWebhook)
+	merchant.PUT("/webhooks", srv.handlePutWebhook)
+	merchant.DELETE("/webhooks", srv.handleDeleteWebhook)
+	merchant.GET("/webhooks/deliveries", srv.handleListWebhookDeliveries)
+	merchant.POST("/webhooks/deliveries/:id/retry", srv.handleRetryWebhookDelivery)
 
-		if req.Username == "" || req.Password == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "username and password are required"})
-			return
-		}
-		if req.To == "" || req.Amount <= 0 || req.Reason == "" || req.ShortCode == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "to, amount, reason, and short_code are required"})
-			return
-		}
+	merchant.POST("/billing/plans", srv.handleCreatePlan)
+	merchant.GET("/billing/plans", srv.handleListPlans)
+	merchant.GET("/billing/plans/:id", srv.handleGetPlan)
+	merchant.POST("/billing/plans/:id/archive", srv.handleArchivePlan)
+	merchant.POST("/billing/customers", srv.handleCreateCustomer)
+	merchant.GET("/billing/customers", srv.handleListCustomers)
+	merchant.GET("/billing/customers/:id", srv.handleGetCustomer)
+	merchant.POST("/billing/subscriptions", srv.handleSubscribe)
+	merchant.GET("/billing/subscriptions", srv.handleListSubscriptions)
+	merchant.GET("/billing/subscriptions/:id", srv.handleGetSubscription)
+	merchant.POST("/billing/subscriptions/:id/cancel", srv.handleCancelSubscription)
 
-		client := kacha.NewClientWithBaseURL(req.Username, req.Password, cfg.KachaBaseURL)
-		resp, err := client.ValidateTransfer(req)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
+	merchant.POST("/intents", srv.handleCreateIntent)
+	merchant.GET("/intents", srv.handleListIntents)
+	merchant.GET("/intents/:id", srv.handleGetIntent)
+	merchant.POST("/intents/:id/confirm", srv.handleConfirmIntent)
+	merchant.POST("/intents/:id/authorize", srv.handleAuthorizeIntent)
+	merchant.POST("/intents/:id/resend", srv.handleResendIntentOTP)
+	merchant.POST("/intents/:id/cancel", srv.handleCancelIntent)
+	merchant.POST("/payments/:trace_number/cancel", srv.handleCancelPayment)
+	merchant.POST("/payments/:trace_number/refunds", srv.handleRefundPayment)
+	merchant.GET("/payments/:trace_number/refunds", srv.handleListRefunds)
+	merchant.POST("/splits", srv.handleCreateSplit)
+	merchant.GET("/splits", srv.handleListSplits)
+	merchant.GET("/splits/:id", srv.handleGetSplit)
+	merchant.POST("/splits/:id/legs/:leg/retry", srv.handleRetrySplitLeg)
 
-		c.JSON(http.StatusOK, resp)
-	})
+	merchant.POST("/escrows", srv.handleCreateEscrow)
+	merchant.GET("/escrows", srv.handleListEscrows)
+	merchant.GET("/escrows/:id", srv.handleGetEscrow)
+	merchant.POST("/escrows/:id/release", srv.handleReleaseEscrow)
+	merchant.POST("/escrows/:id/dispute", srv.handleDisputeEscrow)
+	merchant.POST("/escrows/:id/refund", srv.handleRefundEscrow)
+	merchant.POST("/escrows/:id/cancel", srv.handleCancelEscrow)
 
+	merchant.GET("/transactions/status", srv.handleQueryTransaction)
+	merchant.GET("/balance", srv.handleGetBalance)
+	merchant.GET("/ledger/balance", srv.handleMerchantBalance)
+	merchant.GET("/ledger/entries", srv.handleMerchantLedgerEntries)
+	merchant.GET("/float", srv.handleMerchantFloat)
+	merchant.GET("/fees/preview", srv.handleMerchantFeePreview)
 
-	// B2C Transfer endpoint
-	r.POST("/withdrawal", func(c *gin.Context) {
-		var req kacha.TransferRequest
-		if err := c.ShouldBindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
+	merchant.POST("/invoices", srv.handleCreateInvoice)
+	merchant.GET("/invoices", srv.handleListInvoices)
+	merchant.GET("/invoices/:id", srv.handleGetInvoice)
+	merchant.POST("/invoices/:id/void", srv.handleVoidInvoice)
+	// Payment links: anyone with the reference may pay the invoice
+	r.GET("/i/:reference", srv.handleGetPublicInvoice)
+	r.POST("/i/:reference/pay", srv.handlePayInvoice)
+	r.POST("/i/:reference/authorize", srv.handleAuthorizeInvoicePayment)
 
-		if req.Username == "" || req.Password == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "username and password are required"})
-			return
-		}
-		if req.To == "" || req.Amount <= 0 || req.Reason == "" || req.ShortCode == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "to, amount, reason, and short_code are required"})
-			return
-		}
+	merchant.GET("/qr", srv.handleStaticQR)
+	merchant.POST("/qr", srv.handleCreateDynamicQR)
+	r.GET("/i/:reference/qr", srv.handleInvoiceQR)
+	r.POST("/qr/pay", srv.handlePayQR)
 
-		client := kacha.NewClientWithBaseURL(req.Username, req.Password, cfg.KachaBaseURL)
-		kachaResp, err := client.Transfer(req)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
+	merchant.POST("/checkout/sessions", srv.handleCreateCheckoutSession)
+	merchant.GET("/checkout/sessions/:id", srv.handleGetCheckoutSession)
+	merchant.GET("/checkout/secret", srv.handleGetCheckoutSecret)
+	merchant.POST("/checkout/secret/rotate", srv.handleRotateCheckoutSecret)
+	// Hosted checkout pages, driven by plain HTML forms
+	r.GET("/checkout/:id", srv.handleCheckoutPage)
+	r.POST("/checkout/:id/pay", srv.handleCheckoutPay)
+	r.POST("/checkout/:id/authorize", srv.handleCheckoutAuthorize)
+	r.POST("/checkout/:id/restart", srv.handleCheckoutRestart)
+	r.POST("/checkout/:id/cancel", srv.handleCheckoutCancel)
 
-		pspResp := utils.MapTransferToPSP(kachaResp, err == nil)
-		c.JSON(http.StatusOK, pspResp)
-	})
+	admin := r.Group("/admin", srv.requireAdmin)
+	admin.GET("/transactions", srv.handleListTransactions)
+	admin.GET("/transactions/unresolved", srv.handleListUnresolved)
+	admin.GET("/transactions/:id", srv.handleGetTransaction)
+	admin.POST("/transactions/:id/poll", srv.handlePollTransaction)
+	admin.GET("/providers", srv.handleProviderHealth)
+	admin.GET("/routing/rules", srv.handleGetRoutingRules)
+	admin.PUT("/routing/rules", srv.handlePutRoutingRules)
+	admin.POST("/routing/dry-run", srv.handleRoutingDryRun)
+	admin.GET("/limits", srv.handleGetLimits)
+	admin.PUT("/limits", srv.handlePutLimits)
+	admin.POST("/limits", srv.handleUpsertLimit)
+	admin.PUT("/limits/:id", srv.handleUpsertLimit)
+	admin.DELETE("/limits/:id", srv.handleDeleteLimit)
+	admin.GET("/limits/usage", srv.handleLimitUsage)
+	admin.GET("/formats", srv.handleAdminListResponseFormats)
+	admin.PUT("/formats/:merchant", srv.handleAdminPutResponseFormat)
+	admin.GET("/fees", srv.handleGetFeeSchedules)
+	admin.PUT("/fees", srv.handlePutFeeSchedules)
+	admin.POST("/fees", srv.handleUpsertFeeSchedule)
+	admin.GET("/fees/preview", srv.handleFeePreview)
+	admin.PUT("/fees/:id", srv.handleUpsertFeeSchedule)
+	admin.DELETE("/fees/:id", srv.handleDeleteFeeSchedule)
+	admin.GET("/risk/rules", srv.handleGetRiskRules)
+	admin.PUT("/risk/rules", srv.handlePutRiskRules)
+	admin.POST("/risk/evaluate", srv.handleRiskEvaluate)
+	admin.GET("/approvals", srv.handleListApprovals)
+	admin.GET("/schedules", srv.handleAdminListSchedules)
+	admin.GET("/subscriptions", srv.handleAdminListSubscriptions)
+	admin.GET("/invoices", srv.handleAdminListInvoices)
+	admin.GET("/otp/sessions", srv.handleListOTPSessions)
+	admin.GET("/refunds", srv.handleAdminListRefunds)
+	admin.GET("/splits", srv.handleAdminListSplits)
+	admin.POST("/splits/:id/legs/:leg/retry", srv.handleAdminRetrySplitLeg)
+	admin.GET("/intents", srv.handleAdminListIntents)
+	admin.GET("/intents/:id", srv.handleAdminGetIntent)
+	admin.GET("/escrows", srv.handleAdminListEscrows)
+	admin.GET("/escrows/:id", srv.handleAdminGetEscrow)
+	admin.POST("/reconciliations", srv.handleImportStatement)
+	admin.GET("/reconciliations", srv.handleListReconciliations)
+	admin.GET("/reconciliations/:id", srv.handleGetReconciliation)
+	admin.POST("/reconciliations/:id/items/:item/notes", srv.handleReconciliationNote)
+	admin.POST("/reconciliations/:id/items/:item/resolve", srv.handleResolveReconciliationItem)
+	admin.GET("/ledger/balances", srv.handleLedgerBalances)
+	admin.GET("/ledger/entries", srv.handleLedgerEntries)
+	admin.GET("/ledger/check", srv.handleLedgerCheck)
+	admin.GET("/ledger/snapshots", srv.handleListLedgerSnapshots)
+	admin.POST("/ledger/snapshots", srv.handleLedgerSnapshot)
+	admin.GET("/float", srv.handleListFloats)
+	admin.GET("/float/alerts", srv.handleFloatAlerts)
+	admin.GET("/float/:merchant", srv.handleGetFloat)
+	admin.PUT("/float/:merchant", srv.handleConfigureFloat)
+	admin.POST("/float/:merchant/topups", srv.handleFloatTopUp)
+	admin.POST("/float/:merchant/adjustments", srv.handleFloatAdjustment)
+	admin.GET("/webhooks/deliveries", srv.handleAdminListWebhookDeliveries)
+	admin.DELETE("/merchants/:merchant/credentials", srv.handleForgetCredentials)
+	admin.GET("/approvals/policy", srv.handleGetApprovalPolicy)
+	admin.PUT("/approvals/policy", srv.handlePutApprovalPolicy)
+	admin.GET("/operators", srv.handleListOperators)
+	admin.POST("/merchants/:merchant/operators", srv.handleCreateOperator)
+	admin.DELETE("/merchants/:merchant/operators/:name", srv.handleDeleteOperator)
+
+	// Background jobs, once the ledger has caught up with the transactions
+	srv.backfillLedger()
+	every(time.Minute, srv.expireTransactions)
+	every(30*time.Second, srv.pollProviderResults)
+	if cfg.LedgerSnapshotInterval > 0 {
+		every(cfg.LedgerSnapshotInterval, srv.snapshotLedger)
+	}
+	every(time.Hour, srv.checkLedger)
+	every(time.Minute, srv.checkFloats)
+	every(time.Hour, srv.pruneOTPSessions)
+	every(time.Minute, srv.expireApprovals)
+	every(30*time.Second, srv.runDueSchedules)
+	every(5*time.Second, webhooks.Deliver)
+	every(30*time.Second, srv.runSubscriptionBilling)
+	every(30*time.Second, srv.runSplitLegs)
+	every(time.Minute, srv.releaseDueEscrows)
+	every(time.Minute, srv.expireInvoices)
 
 	log.Printf("Starting on port %s", cfg.Port)
 	if err := r.Run(":" + cfg.Port); err != nil {
@@ -0,0 +1,58 @@
+package namematch
+
+import "strings"
+
+const (
+	ethiopicStart = 0x1200
+	ethiopicEnd   = 0x135A
+)
+
+// consonants of each 8-character row in the Ethiopic block, starting at U+1200.
+// Rows for the glottal stops (አ, ዐ) are empty and only carry the vowel.
+var ethiopicRows = []string{
+	"h", "l", "h", "m", "s", "r", "s", "sh",
+	"q", "qw", "q", "qw", "b", "v", "t", "ch",
+	"h", "hw", "n", "ny", "", "k", "kw", "kh",
+	"kw", "w", "", "z", "zh", "y", "d", "d",
+	"j", "g", "gw", "g", "t", "ch", "p", "ts",
+	"ts", "f", "p",
+}
+
+// vowel for each of the seven orders plus the labialized eighth order
+var ethiopicOrders = []string{"e", "u", "i", "a", "e", "", "o", "wa"}
+
+// Transliterate converts Ge'ez script to a Latin approximation so that
+// "ተስፋዬ" can be compared with "Tesfaye". Other characters pass through.
+func Transliterate(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '፡' || r == '።' || r == '፣' || r == '፤':
+			b.WriteByte(' ')
+		case r >= ethiopicStart && r < ethiopicEnd:
+			idx := int(r - ethiopicStart)
+			row, order := idx/8, idx%8
+			if row >= len(ethiopicRows) {
+				continue
+			}
+			consonant, vowel := ethiopicRows[row], ethiopicOrders[order]
+			if consonant == "" {
+				// glottal rows: አ is usually written "a" and እ "e"
+				switch order {
+				case 0:
+					vowel = "a"
+				case 5:
+					vowel = "e"
+				}
+			}
+			if strings.HasSuffix(consonant, "w") && strings.HasPrefix(vowel, "w") {
+				vowel = vowel[1:]
+			}
+			b.WriteString(consonant)
+			b.WriteString(vowel)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
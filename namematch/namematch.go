@@ -0,0 +1,232 @@
+package namematch
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+type Decision string
+
+const (
+	Allow Decision = "ALLOW"
+	Warn  Decision = "WARN"
+	Block Decision = "BLOCK"
+)
+
+const (
+	DefaultWarnBelow  = 0.85
+	DefaultBlockBelow = 0.70
+
+	// score given to an initial ("A." or "A") that matches a full name token
+	initialScore = 0.85
+	// penalty per token present in one name but not the other
+	extraTokenPenalty = 0.05
+)
+
+type Result struct {
+	Expected string   `json:"expected_name"`
+	Actual   string   `json:"account_name"`
+	Score    float64  `json:"score"`
+	Decision Decision `json:"decision"`
+}
+
+// Matcher scores an expected beneficiary name against the account holder name
+// returned by Kacha and decides whether a payout may proceed.
+type Matcher struct {
+	WarnBelow  float64
+	BlockBelow float64
+}
+
+func NewMatcher(warnBelow, blockBelow float64) *Matcher {
+	if warnBelow <= 0 {
+		warnBelow = DefaultWarnBelow
+	}
+	if blockBelow <= 0 {
+		blockBelow = DefaultBlockBelow
+	}
+	return &Matcher{WarnBelow: warnBelow, BlockBelow: blockBelow}
+}
+
+func (m *Matcher) Check(expected, actual string) Result {
+	score := Score(expected, actual)
+
+	decision := Allow
+	switch {
+	case score < m.BlockBelow:
+		decision = Block
+	case score < m.WarnBelow:
+		decision = Warn
+	}
+
+	return Result{
+		Expected: expected,
+		Actual:   actual,
+		Score:    score,
+		Decision: decision,
+	}
+}
+
+// Score returns a similarity between 0 and 1 that ignores token order, case,
+// punctuation and script, and accepts initials for full name tokens.
+func Score(a, b string) float64 {
+	ta, tb := tokens(a), tokens(b)
+	if len(ta) == 0 || len(tb) == 0 {
+		return 0
+	}
+
+	type pair struct {
+		i, j  int
+		score float64
+	}
+	pairs := make([]pair, 0, len(ta)*len(tb))
+	for i := range ta {
+		for j := range tb {
+			pairs = append(pairs, pair{i, j, tokenScore(ta[i], tb[j])})
+		}
+	}
+	sort.SliceStable(pairs, func(x, y int) bool { return pairs[x].score > pairs[y].score })
+
+	// greedily assign each token to its best still-unused counterpart
+	usedA := make([]bool, len(ta))
+	usedB := make([]bool, len(tb))
+	short := min(len(ta), len(tb))
+	var total float64
+	matched := 0
+	for _, p := range pairs {
+		if matched == short {
+			break
+		}
+		if usedA[p.i] || usedB[p.j] {
+			continue
+		}
+		usedA[p.i], usedB[p.j] = true, true
+		total += p.score
+		matched++
+	}
+
+	score := total / float64(short)
+	score -= extraTokenPenalty * float64(max(len(ta), len(tb))-short)
+	return max(score, 0)
+}
+
+func tokenScore(a, b string) float64 {
+	if len(a) == 1 || len(b) == 1 {
+		if a[0] == b[0] {
+			if a == b {
+				return 1
+			}
+			return initialScore
+		}
+		return 0
+	}
+	return jaroWinkler(phoneticKey(a), phoneticKey(b))
+}
+
+// tokens transliterates, lowercases and splits a name, dropping punctuation
+func tokens(name string) []string {
+	name = strings.ToLower(Transliterate(name))
+	return strings.FieldsFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+}
+
+var phoneticReplacer = strings.NewReplacer(
+	"ph", "f",
+	"sh", "x",
+	"ch", "c",
+	"kh", "k",
+	"ts", "s",
+	"q", "k",
+	"v", "b",
+	"ä", "e",
+	"é", "e",
+	"è", "e",
+)
+
+// phoneticKey folds the spelling variations common in Latin renderings of
+// Ethiopian names: Mohammed/Mehamed, Tesfaye/Tesfay, Gebre/Gabre.
+func phoneticKey(s string) string {
+	s = phoneticReplacer.Replace(s)
+
+	var b strings.Builder
+	var prev rune
+	for _, r := range s {
+		switch r {
+		case 'a', 'e', 'o':
+			r = 'a'
+		case 'y':
+			r = 'i'
+		}
+		if r == prev {
+			continue
+		}
+		b.WriteRune(r)
+		prev = r
+	}
+
+	key := b.String()
+	if len(key) > 2 {
+		key = strings.TrimRight(key, "ai")
+	}
+	return key
+}
+
+func jaroWinkler(a, b string) float64 {
+	if a == b {
+		return 1
+	}
+	ra, rb := []rune(a), []rune(b)
+	la, lb := len(ra), len(rb)
+	if la == 0 || lb == 0 {
+		return 0
+	}
+
+	window := max(la, lb)/2 - 1
+	window = max(window, 0)
+
+	matchA := make([]bool, la)
+	matchB := make([]bool, lb)
+	matches := 0
+	for i := range ra {
+		lo, hi := max(0, i-window), min(lb, i+window+1)
+		for j := lo; j < hi; j++ {
+			if matchB[j] || ra[i] != rb[j] {
+				continue
+			}
+			matchA[i], matchB[j] = true, true
+			matches++
+			break
+		}
+	}
+	if matches == 0 {
+		return 0
+	}
+
+	transpositions := 0
+	k := 0
+	for i := range ra {
+		if !matchA[i] {
+			continue
+		}
+		for !matchB[k] {
+			k++
+		}
+		if ra[i] != rb[k] {
+			transpositions++
+		}
+		k++
+	}
+
+	m := float64(matches)
+	jaro := (m/float64(la) + m/float64(lb) + (m-float64(transpositions)/2)/m) / 3
+
+	prefix := 0
+	for i := 0; i < min(la, lb, 4); i++ {
+		if ra[i] != rb[i] {
+			break
+		}
+		prefix++
+	}
+	return jaro + float64(prefix)*0.1*(1-jaro)
+}
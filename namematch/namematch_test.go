@@ -0,0 +1,94 @@
+package namematch
+
+import (
+	"math"
+	"testing"
+)
+
+func TestTransliterate(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"ተስፋዬ", "tesfaye"},
+		{"አበበ ከበደ", "abebe kebede"},
+		{"ሙሉጌታ", "mulugeta"},
+		{"ዓለሙ", "alemu"},
+		// labialized consonants do not double the w
+		{"ቋንቋ", "qwanqwa"},
+		{"አበበ፡ከበደ።", "abebe kebede "},
+		{"Abebe", "Abebe"},
+	}
+	for _, tt := range tests {
+		if got := Transliterate(tt.in); got != tt.want {
+			t.Errorf("Transliterate(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestJaroWinkler(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want float64
+	}{
+		{"martha", "marhta", 0.9611},
+		{"dwayne", "duane", 0.84},
+		{"dixon", "dicksonx", 0.8133},
+		{"abc", "xyz", 0},
+		{"same", "same", 1},
+	}
+	for _, tt := range tests {
+		if got := jaroWinkler(tt.a, tt.b); math.Abs(got-tt.want) > 0.0001 {
+			t.Errorf("jaroWinkler(%q, %q) = %.4f, want %.4f", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	m := NewMatcher(0, 0)
+	tests := []struct {
+		name             string
+		expected, actual string
+		want             Decision
+	}{
+		{"amharic and latin", "Tesfaye", "ተስፋዬ", Allow},
+		{"amharic full name", "Abebe Kebede", "አበበ ከበደ", Allow},
+		{"order and case", "Kebede Abebe", "ABEBE KEBEDE", Allow},
+		{"spelling variant", "Mohammed Ali", "Mehamed Ali", Allow},
+		{"dropped final vowel", "Gebre Tesfay", "Gabre Tesfaye", Allow},
+		{"initial", "A. Kebede", "Abebe Kebede", Allow},
+		{"extra middle name", "Abebe Kebede", "Abebe Kebede Tadesse", Allow},
+		{"similar surname", "Abebe Kebede", "Abebe Kedir", Warn},
+		{"similar first name", "Dawit", "Daniel", Warn},
+		{"different person", "Abebe Kebede", "Almaz Tadesse", Block},
+		{"no name", "", "Abebe Kebede", Block},
+	}
+	for _, tt := range tests {
+		if r := m.Check(tt.expected, tt.actual); r.Decision != tt.want {
+			t.Errorf("%s: Check(%q, %q) = %s with %.4f, want %s", tt.name, tt.expected, tt.actual, r.Decision, r.Score, tt.want)
+		}
+	}
+}
+
+func TestCheckThresholds(t *testing.T) {
+	score := Score("A. Kebede", "Abebe Kebede")
+	tests := []struct {
+		name    string
+		matcher *Matcher
+		want    Decision
+	}{
+		// a score equal to a threshold is not below it
+		{"at both thresholds", &Matcher{WarnBelow: score, BlockBelow: score}, Allow},
+		{"below warn", &Matcher{WarnBelow: score + 0.01, BlockBelow: score}, Warn},
+		{"below block", &Matcher{WarnBelow: score + 0.02, BlockBelow: score + 0.01}, Block},
+	}
+	for _, tt := range tests {
+		if r := tt.matcher.Check("A. Kebede", "Abebe Kebede"); r.Decision != tt.want {
+			t.Errorf("%s: Check = %s, want %s", tt.name, r.Decision, tt.want)
+		}
+	}
+
+	m := NewMatcher(0, 0)
+	if m.WarnBelow != DefaultWarnBelow || m.BlockBelow != DefaultBlockBelow {
+		t.Errorf("NewMatcher(0, 0) = %+v, want the defaults", m)
+	}
+}
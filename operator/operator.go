@@ -0,0 +1,165 @@
+package operator
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"kacha-psp/store"
+)
+
+var (
+	ErrNotFound = errors.New("operator not found")
+	ErrExists   = errors.New("operator already exists")
+	ErrBadToken = errors.New("invalid operator token")
+)
+
+// Operator is a person acting for a merchant, e.g. initiating or approving
+// transfers, who authenticates with a token of their own. Merchant
+// credentials are shared by everyone at the merchant, so they cannot tell
+// an initiator from an approver. Only a hash of the token is kept.
+type Operator struct {
+	Merchant  string    `json:"merchant"`
+	Name      string    `json:"name"`
+	TokenHash string    `json:"token_hash,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Redacted returns a copy without the token hash, for API responses
+func (o *Operator) Redacted() *Operator {
+	out := *o
+	out.TokenHash = ""
+	return &out
+}
+
+type Store struct {
+	path string
+
+	mu        sync.Mutex
+	operators map[string]*Operator
+}
+
+func NewStore(path string) (*Store, error) {
+	s := &Store{
+		path:      path,
+		operators: make(map[string]*Operator),
+	}
+	if path == "" {
+		return s, nil
+	}
+	if err := store.LoadJSON(path, &s.operators); err != nil {
+		return nil, err
+	}
+	if s.operators == nil {
+		s.operators = make(map[string]*Operator)
+	}
+	return s, nil
+}
+
+// Create adds an operator for merchant and returns their token, which is
+// not kept and cannot be shown again
+func (s *Store) Create(merchant, name string) (*Operator, string, error) {
+	if merchant == "" || name == "" {
+		return nil, "", fmt.Errorf("merchant and name are required")
+	}
+	token, err := newToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.operators[key(merchant, name)]; ok {
+		return nil, "", ErrExists
+	}
+	o := &Operator{Merchant: merchant, Name: name, TokenHash: hash(token), CreatedAt: time.Now()}
+	s.operators[key(merchant, name)] = o
+	s.persist()
+	return o.Redacted(), token, nil
+}
+
+// Authenticate returns the merchant's operator holding token
+func (s *Store) Authenticate(merchant, token string) (*Operator, error) {
+	if token == "" {
+		return nil, ErrBadToken
+	}
+	h := hash(token)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, o := range s.operators {
+		if o.Merchant == merchant && subtle.ConstantTimeCompare([]byte(o.TokenHash), []byte(h)) == 1 {
+			return o.Redacted(), nil
+		}
+	}
+	return nil, ErrBadToken
+}
+
+// List returns the operators of merchant (all merchants if empty) by name
+func (s *Store) List(merchant string) []*Operator {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := []*Operator{}
+	for _, o := range s.operators {
+		if merchant == "" || o.Merchant == merchant {
+			out = append(out, o.Redacted())
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Merchant != out[j].Merchant {
+			return out[i].Merchant < out[j].Merchant
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// Delete removes an operator, revoking their token
+func (s *Store) Delete(merchant, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.operators[key(merchant, name)]; !ok {
+		return ErrNotFound
+	}
+	delete(s.operators, key(merchant, name))
+	s.persist()
+	return nil
+}
+
+func key(merchant, name string) string {
+	return merchant + "/" + name
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "opk_" + hex.EncodeToString(b), nil
+}
+
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// persist mirrors the store to disk; caller holds s.mu
+func (s *Store) persist() {
+	if s.path == "" {
+		return
+	}
+	if err := store.SaveJSON(s.path, s.operators); err != nil {
+		log.Printf("[Operator] failed to persist state: %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"kacha-psp/operator"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// operatorHeader carries the token of the operator acting for a merchant
+const operatorHeader = "X-Operator-Token"
+
+type createOperatorRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+// actingOperator authenticates the operator acting for merchant by the token
+// in operatorHeader and returns their name. claimed, the name the request
+// gives, if any, must be theirs. Without a token no operator is acting, and a
+// claimed name is refused as nobody vouches for it.
+func (s *server) actingOperator(c *gin.Context, merchant, claimed string) (string, error) {
+	token := c.GetHeader(operatorHeader)
+	if token == "" {
+		if claimed != "" {
+			return "", newAPIError(http.StatusUnauthorized, claimed+" must authenticate with "+operatorHeader, nil)
+		}
+		return "", nil
+	}
+	op, err := s.operators.Authenticate(merchant, token)
+	if err != nil {
+		return "", newAPIError(http.StatusUnauthorized, err.Error(), nil)
+	}
+	if claimed != "" && claimed != op.Name {
+		return "", newAPIError(http.StatusForbidden, "operator token does not belong to "+claimed, nil)
+	}
+	return op.Name, nil
+}
+
+// handleCreateOperator adds an operator for a merchant and returns their
+// token, which is only shown here
+func (s *server) handleCreateOperator(c *gin.Context) {
+	var req createOperatorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	op, token, err := s.operators.Create(c.Param("merchant"), req.Name)
+	switch {
+	case errors.Is(err, operator.ErrExists):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"operator": op, "token": token})
+}
+
+func (s *server) handleListOperators(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"operators": s.operators.List(c.Query("merchant"))})
+}
+
+func (s *server) handleDeleteOperator(c *gin.Context) {
+	if err := s.operators.Delete(c.Param("merchant"), c.Param("name")); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
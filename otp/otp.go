@@ -0,0 +1,277 @@
+// Package otp guards OTP payment authorization against guessing. It tracks
+// each OTP the provider sent but never the OTP itself.
+package otp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"kacha-psp/store"
+)
+
+var (
+	ErrNotFound = errors.New("OTP session not found")
+	ErrExpired  = errors.New("OTP has expired, request a new one")
+	ErrLocked   = errors.New("too many failed OTP attempts")
+	// ErrAttemptInFlight is returned while the last allowed attempt is being checked
+	ErrAttemptInFlight = errors.New("an OTP attempt is already being checked")
+	ErrAuthorized      = errors.New("payment is already authorized")
+	ErrResendLimit     = errors.New("OTP resend limit reached")
+	ErrResendTooSoon   = errors.New("OTP was sent too recently")
+)
+
+type Status string
+
+const (
+	StatusActive     Status = "ACTIVE"
+	StatusAuthorized Status = "AUTHORIZED"
+)
+
+// Policy bounds how an OTP may be used
+type Policy struct {
+	// MaxAttempts failed attempts lock the session for Lockout
+	MaxAttempts int
+	Lockout     time.Duration
+	// TTL is how long each OTP sent can be used
+	TTL            time.Duration
+	MaxResends     int
+	ResendInterval time.Duration
+}
+
+// Session is an OTP payment awaiting authorization. It holds what is needed
+// to send the OTP again, never the OTP.
+type Session struct {
+	TransactionID string `json:"transaction_id"`
+	Merchant      string `json:"merchant"`
+	// Reference is the provider's reference for the OTP sent last
+	Reference   string `json:"reference"`
+	Phone       string `json:"phone"`
+	Amount      int    `json:"amount"`
+	TraceNumber string `json:"trace_number"`
+	Reason      string `json:"reason"`
+	Status      Status `json:"status"`
+
+	Attempts    int        `json:"attempts"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+	Resends     int        `json:"resends"`
+	SentAt      time.Time  `json:"sent_at"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// LockedError is ErrLocked with the time the lock lifts
+type LockedError struct {
+	Until time.Time
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%v, try again after %s", ErrLocked, e.Until.Format(time.RFC3339))
+}
+
+func (e *LockedError) Unwrap() error { return ErrLocked }
+
+type Store struct {
+	path   string
+	policy Policy
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func NewStore(policy Policy, path string) (*Store, error) {
+	s := &Store{
+		path:     path,
+		policy:   policy,
+		sessions: make(map[string]*Session),
+	}
+	if path == "" {
+		return s, nil
+	}
+	if err := store.LoadJSON(path, &s.sessions); err != nil {
+		return nil, err
+	}
+	if s.sessions == nil {
+		s.sessions = make(map[string]*Session)
+	}
+	return s, nil
+}
+
+// Start tracks the OTP sent for a new payment
+func (s *Store) Start(sess *Session, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess.Status = StatusActive
+	sess.Attempts, sess.Resends, sess.LockedUntil = 0, 0, nil
+	sess.SentAt, sess.CreatedAt = now, now
+	sess.ExpiresAt = now.Add(s.policy.TTL)
+	stored := *sess
+	s.sessions[sess.TransactionID] = &stored
+	s.persist()
+}
+
+// Get returns the merchant's session for the OTP sent with reference
+func (s *Store) Get(reference, merchant string) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess := s.byReference(reference, merchant)
+	if sess == nil {
+		return nil, ErrNotFound
+	}
+	out := *sess
+	return &out, nil
+}
+
+// BeginAttempt counts an authorization attempt before it reaches the
+// provider, so concurrent guesses cannot exceed MaxAttempts
+func (s *Store) BeginAttempt(reference, merchant string, now time.Time) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess := s.byReference(reference, merchant)
+	switch {
+	case sess == nil:
+		return nil, ErrNotFound
+	case sess.Status == StatusAuthorized:
+		return nil, ErrAuthorized
+	case sess.LockedUntil != nil && now.Before(*sess.LockedUntil):
+		return nil, &LockedError{Until: *sess.LockedUntil}
+	case !now.Before(sess.ExpiresAt):
+		return nil, ErrExpired
+	case sess.Attempts >= s.policy.MaxAttempts:
+		return nil, ErrAttemptInFlight
+	}
+	sess.Attempts++
+	s.persist()
+	out := *sess
+	return &out, nil
+}
+
+// FinishAttempt records the outcome of an attempt. Reaching MaxAttempts
+// failures locks the session and starts a fresh count for after the lockout.
+func (s *Store) FinishAttempt(transactionID string, authorized bool, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[transactionID]
+	if !ok {
+		return ErrNotFound
+	}
+	if authorized {
+		sess.Status = StatusAuthorized
+	} else if sess.Attempts >= s.policy.MaxAttempts {
+		until := now.Add(s.policy.Lockout)
+		sess.LockedUntil = &until
+		sess.Attempts = 0
+		log.Printf("[OTP] locked %s until %s after %d failed attempts", sess.TransactionID, until.Format(time.RFC3339), s.policy.MaxAttempts)
+	}
+	s.persist()
+	if !authorized && sess.LockedUntil != nil && now.Before(*sess.LockedUntil) {
+		return &LockedError{Until: *sess.LockedUntil}
+	}
+	return nil
+}
+
+// BeginResend reserves a resend of the OTP, rate limited by ResendInterval
+// and MaxResends
+func (s *Store) BeginResend(reference, merchant string, now time.Time) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess := s.byReference(reference, merchant)
+	switch {
+	case sess == nil:
+		return nil, ErrNotFound
+	case sess.Status == StatusAuthorized:
+		return nil, ErrAuthorized
+	case sess.LockedUntil != nil && now.Before(*sess.LockedUntil):
+		return nil, &LockedError{Until: *sess.LockedUntil}
+	case sess.Resends >= s.policy.MaxResends:
+		return nil, ErrResendLimit
+	case now.Sub(sess.SentAt) < s.policy.ResendInterval:
+		return nil, fmt.Errorf("%w, try again in %s", ErrResendTooSoon,
+			sess.SentAt.Add(s.policy.ResendInterval).Sub(now).Round(time.Second))
+	}
+	sess.Resends++
+	sess.SentAt = now
+	s.persist()
+	out := *sess
+	return &out, nil
+}
+
+// Resent records the new OTP sent for a session. It expires the old OTP and
+// clears its failed attempts.
+func (s *Store) Resent(transactionID, reference string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[transactionID]
+	if !ok {
+		return
+	}
+	if reference != "" {
+		sess.Reference = reference
+	}
+	sess.Attempts = 0
+	sess.SentAt = now
+	sess.ExpiresAt = now.Add(s.policy.TTL)
+	s.persist()
+}
+
+// List returns the merchant's sessions (all if empty), newest first
+func (s *Store) List(merchant string) []*Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := []*Session{}
+	for _, sess := range s.sessions {
+		if merchant == "" || sess.Merchant == merchant {
+			c := *sess
+			out = append(out, &c)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
+
+// Prune forgets sessions created before cutoff
+func (s *Store) Prune(cutoff time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed := false
+	for id, sess := range s.sessions {
+		if sess.CreatedAt.Before(cutoff) {
+			delete(s.sessions, id)
+			changed = true
+		}
+	}
+	if changed {
+		s.persist()
+	}
+}
+
+// byReference finds a session; caller holds s.mu
+func (s *Store) byReference(reference, merchant string) *Session {
+	for _, sess := range s.sessions {
+		if sess.Reference == reference && sess.Merchant == merchant {
+			return sess
+		}
+	}
+	return nil
+}
+
+// persist mirrors the store to disk; caller holds s.mu
+func (s *Store) persist() {
+	if s.path == "" {
+		return
+	}
+	if err := store.SaveJSON(s.path, s.sessions); err != nil {
+		log.Printf("[OTP] failed to persist sessions: %v", err)
+	}
+}
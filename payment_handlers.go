@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"io"
+	kacha "kacha-psp/kacha"
+	"kacha-psp/provider"
+	"kacha-psp/response"
+	"kacha-psp/store"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (s *server) handleOTPPay(c *gin.Context) {
+	var req kacha.PaymentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Username == "" || req.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "username and password are required"})
+		return
+	}
+	if req.Phone == "" || req.Amount <= 0 || req.TraceNumber == "" || req.Reason == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "phone, amount, trace_number, and reason are required"})
+		return
+	}
+
+	tx, resp, err := s.requestPayment(&store.Transaction{
+		Type:        store.TypeOTPPayment,
+		Merchant:    req.Username,
+		TraceNumber: req.TraceNumber,
+		Phone:       req.Phone,
+		Amount:      req.Amount,
+	}, req)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, s.providerResponse(req.Username, response.FormatRaw, resp, resp.Success, tx))
+}
+
+func (s *server) handleOTPAuthorize(c *gin.Context) {
+	var req kacha.PaymentAuthorizeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Username == "" || req.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "username and password are required"})
+		return
+	}
+	if req.Reference == "" || req.OTP == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "reference and otp are required"})
+		return
+	}
+
+	resp, err := s.authorizePayment(req)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	tx, _ := s.txs.FindByReference(req.Reference)
+	success := resp.Success && providerStatus(resp.Status, resp.Success) != store.StatusFailed
+	c.JSON(http.StatusOK, s.providerResponse(req.Username, response.FormatRaw, resp, success, tx))
+}
+
+type resendOTPRequest struct {
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	Reference string `json:"reference"`
+}
+
+func (s *server) handleOTPResend(c *gin.Context) {
+	var req resendOTPRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Username == "" || req.Password == "" || req.Reference == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "username, password and reference are required"})
+		return
+	}
+
+	resp, err := s.resendOTP(provider.Credentials{Username: req.Username, Password: req.Password}, req.Reference)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	tx, _ := s.txs.FindByReference(resp.Reference)
+	c.JSON(http.StatusOK, s.providerResponse(req.Username, response.FormatRaw, resp, resp.Success, tx))
+}
+
+// handleCancelPayment withdraws a payment request the customer has not
+// authorized yet. A push USSD prompt may still be answered; its result is
+// then reported as a late result.
+func (s *server) handleCancelPayment(c *gin.Context) {
+	tx, ok := s.merchantPayment(c)
+	if !ok {
+		return
+	}
+	if tx.Type != store.TypeOTPPayment && tx.Type != store.TypePushUSSD {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "only payment requests can be cancelled"})
+		return
+	}
+
+	cancelled, err := s.closePending(tx.ID, store.StatusCancelled, "cancelled by merchant")
+	if errors.Is(err, errNotPending) {
+		if current, err := s.txs.Get(tx.ID); err == nil {
+			tx = current
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": "payment is already " + string(tx.Status)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, cancelled)
+}
+
+func (s *server) handleListOTPSessions(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"sessions": s.otps.List(c.Query("merchant"))})
+}
+
+func (s *server) handlePushUSSD(c *gin.Context) {
+	var req kacha.PSPPushUSSDRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Username == "" || req.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "username and password are required"})
+		return
+	}
+	if req.Phone == "" || req.Amount <= 0 || req.TraceNumber == "" || req.CallbackURL == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "phone, amount, trace_number, and callback_url are required"})
+		return
+	}
+
+	kachaReq := kacha.PushUSSDRequest{
+		Phone:       req.Phone,
+		Amount:      req.Amount,
+		TraceNumber: req.TraceNumber,
+		CallbackURL: req.CallbackURL,
+		Reason:      req.Reason,
+	}
+
+	tx, kachaResp, err := s.requestPushUSSD(&store.Transaction{
+		Type:        store.TypePushUSSD,
+		Merchant:    req.Username,
+		TraceNumber: req.TraceNumber,
+		Phone:       req.Phone,
+		Amount:      req.Amount,
+	}, provider.Credentials{Username: req.Username, Password: req.Password}, kachaReq)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, s.providerResponse(req.Username, response.FormatPSP, kachaResp, true, tx))
+}
+
+func (s *server) handleCallback(c *gin.Context) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	p, err := s.providers.Get(c.Param("provider"), provider.Credentials{})
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, provider.ErrUnknownProvider) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	notification, err := p.ParseCallback(body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("Received %s callback notification: %+v", p.Name(), *notification)
+
+	// Unknown transactions are acknowledged so the provider stops retrying,
+	// while callbacks that could not be confirmed are retried
+	if err := s.applyCallback(p.Name(), c.Query("merchant"), notification); err != nil && !errors.Is(err, store.ErrNotFound) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "callback could not be confirmed with the provider: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "Callback received"})
+}
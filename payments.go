@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	kacha "kacha-psp/kacha"
+	"kacha-psp/otp"
+	"kacha-psp/provider"
+	"kacha-psp/routing"
+	"kacha-psp/store"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestPayment starts an OTP payment recorded as tx, which the caller has
+// filled in with the payment details
+func (s *server) requestPayment(tx *store.Transaction, req kacha.PaymentRequest) (*store.Transaction, *kacha.PaymentRequestResponse, error) {
+	creds := provider.Credentials{Username: req.Username, Password: req.Password}
+	p, tx, err := s.admit(tx, creds)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := sendWithFailover(s, tx.ID, p, creds, func(p provider.Provider) (*kacha.PaymentRequestResponse, error) {
+		return p.RequestPayment(req)
+	})
+	if err != nil {
+		s.failTransaction(tx.ID, err)
+		return tx, nil, err
+	}
+
+	s.updateTransaction(tx.ID, func(tx *store.Transaction) {
+		tx.Reference = resp.Reference
+		tx.Message = resp.Message
+	})
+	s.otps.Start(&otp.Session{
+		TransactionID: tx.ID,
+		Merchant:      tx.Merchant,
+		Reference:     resp.Reference,
+		Phone:         req.Phone,
+		Amount:        req.Amount,
+		TraceNumber:   req.TraceNumber,
+		Reason:        req.Reason,
+	}, time.Now())
+	return tx, resp, nil
+}
+
+// authorizePayment confirms an OTP payment with the provider that issued its
+// reference. Only references of payments started here are forwarded, and
+// each counts against the payment's OTP attempt limit.
+func (s *server) authorizePayment(req kacha.PaymentAuthorizeRequest) (*kacha.PaymentAuthorizeResponse, error) {
+	sess, err := s.otps.BeginAttempt(req.Reference, req.Username, time.Now())
+	if err != nil {
+		return nil, otpError(err)
+	}
+	tx, err := s.txs.Get(sess.TransactionID)
+	if err != nil {
+		return nil, newAPIError(http.StatusNotFound, "payment not found", nil)
+	}
+	if tx.Status.Final() {
+		s.otps.FinishAttempt(tx.ID, false, time.Now())
+		return nil, newAPIError(http.StatusConflict, "payment is already "+string(tx.Status), nil)
+	}
+
+	p, err := s.provider(tx.Provider, provider.Credentials{Username: req.Username, Password: req.Password})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.AuthorizePayment(req)
+	s.observe(p, err)
+	authorized := err == nil && resp.Success && providerStatus(resp.Status, resp.Success) != store.StatusFailed
+	lockErr := s.otps.FinishAttempt(tx.ID, authorized, time.Now())
+	if err != nil {
+		s.updateTransaction(tx.ID, func(tx *store.Transaction) { tx.Message = err.Error() })
+		if lockErr != nil {
+			return nil, otpError(lockErr)
+		}
+		return nil, err
+	}
+
+	s.recordProviderResult(tx.ID, func(tx *store.Transaction) {
+		tx.Status = providerStatus(resp.Status, resp.Success)
+		tx.ProviderTxID = resp.TransactionID
+		tx.Message = resp.Message
+	})
+	if lockErr != nil {
+		return nil, otpError(lockErr)
+	}
+	return resp, nil
+}
+
+// resendOTP asks the provider to send the customer a new OTP for a payment
+func (s *server) resendOTP(creds provider.Credentials, reference string) (*kacha.PaymentRequestResponse, error) {
+	sess, err := s.otps.BeginResend(reference, creds.Username, time.Now())
+	if err != nil {
+		return nil, otpError(err)
+	}
+	tx, err := s.txs.Get(sess.TransactionID)
+	if err != nil {
+		return nil, newAPIError(http.StatusNotFound, "payment not found", nil)
+	}
+	if tx.Status.Final() {
+		return nil, newAPIError(http.StatusConflict, "payment is already "+string(tx.Status), nil)
+	}
+
+	p, err := s.provider(tx.Provider, creds)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.RequestPayment(kacha.PaymentRequest{
+		Username:    creds.Username,
+		Password:    creds.Password,
+		Phone:       sess.Phone,
+		Amount:      sess.Amount,
+		TraceNumber: sess.TraceNumber,
+		Reason:      sess.Reason,
+	})
+	s.observe(p, err)
+	if err != nil {
+		return nil, err
+	}
+
+	s.otps.Resent(tx.ID, resp.Reference, time.Now())
+	s.updateTransaction(tx.ID, func(tx *store.Transaction) {
+		if resp.Reference != "" {
+			tx.Reference = resp.Reference
+		}
+		tx.Message = resp.Message
+	})
+	return resp, nil
+}
+
+// pruneOTPSessions forgets OTP sessions long past any use
+func (s *server) pruneOTPSessions() {
+	s.otps.Prune(time.Now().Add(-24 * time.Hour))
+}
+
+// otpError maps OTP session failures to the responses they are reported with
+func otpError(err error) error {
+	var locked *otp.LockedError
+	switch {
+	case errors.As(err, &locked):
+		return newAPIError(http.StatusTooManyRequests, err.Error(), gin.H{"locked_until": locked.Until})
+	case errors.Is(err, otp.ErrNotFound):
+		return newAPIError(http.StatusNotFound, "payment not found", nil)
+	case errors.Is(err, otp.ErrExpired):
+		return newAPIError(http.StatusGone, err.Error(), nil)
+	case errors.Is(err, otp.ErrAuthorized):
+		return newAPIError(http.StatusConflict, err.Error(), nil)
+	case errors.Is(err, otp.ErrAttemptInFlight), errors.Is(err, otp.ErrResendLimit), errors.Is(err, otp.ErrResendTooSoon):
+		return newAPIError(http.StatusTooManyRequests, err.Error(), nil)
+	}
+	return err
+}
+
+// requestPushUSSD starts a push USSD payment recorded as tx, which the
+// caller has filled in with the payment details. Without a callback URL in
+// req, the provider the payment goes to reports it back to the gateway.
+func (s *server) requestPushUSSD(tx *store.Transaction, creds provider.Credentials, req kacha.PushUSSDRequest) (*store.Transaction, *kacha.PushUSSDResponse, error) {
+	p, tx, err := s.admit(tx, creds)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := sendWithFailover(s, tx.ID, p, creds, func(p provider.Provider) (*kacha.PushUSSDResponse, error) {
+		req := req
+		if req.CallbackURL == "" {
+			req.CallbackURL = s.callbackURL(p.Name(), tx.Merchant)
+		}
+		return p.RequestPushUSSD(req)
+	})
+	if err != nil {
+		s.failTransaction(tx.ID, err)
+		return tx, nil, err
+	}
+
+	s.updateTransaction(tx.ID, func(tx *store.Transaction) {
+		tx.Status = providerStatus(resp.Status, false)
+		tx.Message = resp.Message
+	})
+	return tx, resp, nil
+}
+
+// admit runs a new C2B transaction through risk, limits and routing, and
+// records it as pending with the chosen provider
+func (s *server) admit(tx *store.Transaction, creds provider.Credentials) (provider.Provider, *store.Transaction, error) {
+	if err := s.assessRisk(tx); err != nil {
+		return nil, nil, err
+	}
+	if err := s.reserveLimits(tx); err != nil {
+		return nil, nil, err
+	}
+	s.chargeFee(tx)
+
+	p, decision, err := s.route(routing.Request{
+		Operation: string(tx.Type),
+		Merchant:  tx.Merchant,
+		Phone:     tx.Phone,
+		Amount:    tx.Amount,
+		At:        time.Now(),
+	}, creds)
+	if err != nil {
+		s.limits.Release(tx.LimitReservation)
+		return nil, nil, err
+	}
+	return p, s.newTransaction(tx, decision), nil
+}
+
+// applyCallback records the outcome a provider callback reports once a status
+// query to the provider confirms it. Callbacks are not signed, so they only
+// say which transactions to look at, and only those the provider handled for
+// the merchant named in the callback URL are.
+func (s *server) applyCallback(providerName, merchant string, notification *kacha.CallbackNotification) error {
+	txs := s.callbackTransactions(providerName, merchant, notification)
+	if len(txs) == 0 {
+		log.Printf("Callback for unknown transaction trace_number=%s reference=%s",
+			notification.TraceNumber, notification.Reference)
+		return store.ErrNotFound
+	}
+
+	var errs []error
+	for _, tx := range txs {
+		// the status query is made with the transaction's merchant's credentials
+		if _, err := s.resolveTransaction(tx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// callbackTransactions finds the transactions awaiting a result from the
+// provider that a callback may be about, by trace number or reference. Trace
+// numbers are chosen by merchants, so several merchants may share one.
+func (s *server) callbackTransactions(providerName, merchant string, notification *kacha.CallbackNotification) []*store.Transaction {
+	var out []*store.Transaction
+	for _, tx := range s.txs.List(store.Filter{Merchant: merchant}) {
+		if tx.Provider != providerName || !awaitingResult(tx) {
+			continue
+		}
+		if (notification.TraceNumber != "" && tx.TraceNumber == notification.TraceNumber) ||
+			(notification.Reference != "" && tx.Reference == notification.Reference) {
+			out = append(out, tx)
+		}
+	}
+	return out
+}
+
+// applyNotification applies a provider's report of how a transaction ended,
+// whether it came as a callback or was polled for
+func (s *server) applyNotification(id string, notification *kacha.CallbackNotification) (*store.Transaction, error) {
+	s.recordProviderResult(id, func(tx *store.Transaction) {
+		tx.Status = providerStatus(notification.Status, notification.Success)
+		tx.ProviderTxID = notification.TransactionID
+		tx.Message = notification.Message
+		if notification.Reference != "" {
+			tx.Reference = notification.Reference
+		}
+	})
+	return s.txs.Get(id)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	kacha "kacha-psp/kacha"
+	"kacha-psp/store"
+	"log"
+	"net/http"
+	"time"
+)
+
+// eventTransactionUnresolved tells the merchant the gateway gave up polling
+// a payment without learning how it ended
+const eventTransactionUnresolved = "transaction.unresolved"
+
+// pollProviderResults queries the provider for push USSD payments whose
+// callback has not arrived, and for transfers still pending, e.g. as the
+// answer to Transfer was lost. Payments the gateway expired or cancelled are
+// polled too, as the customer may still have paid them.
+func (s *server) pollProviderResults() {
+	if s.cfg.PushUSSDPollAfter <= 0 {
+		return
+	}
+	now := time.Now()
+	txs := s.txs.List(store.Filter{Type: store.TypePushUSSD})
+	txs = append(txs, s.txs.List(store.Filter{Type: store.TypeTransfer, Status: store.StatusPending})...)
+	for _, tx := range txs {
+		if !awaitingResult(tx) || tx.UnresolvedAt != nil {
+			continue
+		}
+		switch {
+		case now.Sub(tx.CreatedAt) >= s.cfg.PushUSSDPollMaxAge:
+			s.giveUpPolling(tx.ID)
+		case !now.Before(s.nextPoll(tx)):
+			s.pollTransaction(tx)
+		}
+	}
+}
+
+// awaitingResult reports whether the provider has not told the gateway how a
+// transaction ended
+func awaitingResult(tx *store.Transaction) bool {
+	switch tx.Status {
+	case store.StatusPending:
+		return true
+	case store.StatusExpired, store.StatusCancelled:
+		return tx.LateStatus == ""
+	}
+	return false
+}
+
+// nextPoll is PushUSSDPollAfter after creation, then doubles after each poll
+// up to PushUSSDPollMaxInterval
+func (s *server) nextPoll(tx *store.Transaction) time.Time {
+	if tx.PolledAt == nil {
+		return tx.CreatedAt.Add(s.cfg.PushUSSDPollAfter)
+	}
+	interval := s.cfg.PushUSSDPollAfter
+	for i := 1; i < tx.Polls && interval < s.cfg.PushUSSDPollMaxInterval; i++ {
+		interval *= 2
+	}
+	return tx.PolledAt.Add(min(interval, s.cfg.PushUSSDPollMaxInterval))
+}
+
+// pollTransaction counts a poll of a transaction and resolves it
+func (s *server) pollTransaction(tx *store.Transaction) (*store.Transaction, error) {
+	now := time.Now()
+	if _, err := s.txs.Update(tx.ID, func(tx *store.Transaction) error {
+		tx.Polls++
+		tx.PolledAt = &now
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return s.resolveTransaction(tx)
+}
+
+// resolveTransaction asks the provider how a transaction ended and applies a
+// final answer as its callback would have been
+func (s *server) resolveTransaction(tx *store.Transaction) (*store.Transaction, error) {
+	resp, err := s.queryTransaction(tx)
+	if err != nil {
+		log.Printf("[Poller] query for %s failed: %v", tx.ID, err)
+		return nil, err
+	}
+
+	if !providerStatus(resp.Status, resp.Success).Final() {
+		return s.txs.Get(tx.ID)
+	}
+	log.Printf("[Poller] %s %s reported %s by status query", tx.Type, tx.ID, resp.Status)
+	return s.applyNotification(tx.ID, &kacha.CallbackNotification{
+		Success:       resp.Success,
+		Status:        resp.Status,
+		TraceNumber:   resp.TraceNumber,
+		Reference:     resp.Reference,
+		TransactionID: resp.TransactionID,
+		Amount:        resp.Amount,
+		Phone:         resp.Phone,
+		Message:       resp.Message,
+		Timestamp:     resp.Timestamp,
+	})
+}
+
+// queryTransaction asks the provider that handled tx how it stands, with the
+// merchant's stored credentials
+func (s *server) queryTransaction(tx *store.Transaction) (*kacha.TransactionQueryResponse, error) {
+	creds, err := s.keyring.Credentials(tx.Merchant)
+	if err != nil {
+		return nil, newAPIError(http.StatusConflict, "merchant credentials are not stored: "+err.Error(), nil)
+	}
+	p, err := s.provider(tx.Provider, creds)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.QueryTransaction(kacha.TransactionQueryRequest{TraceNumber: tx.TraceNumber, Reference: tx.Reference})
+	s.observe(p, err)
+	if err != nil {
+		return nil, fmt.Errorf("transaction query failed: %w", err)
+	}
+	return resp, nil
+}
+
+// confirmPayment asks the provider how a payment the gateway holds as paid
+// stands, before money it brought in is paid out. A payment of another
+// amount than the transaction's is reported as failed.
+func (s *server) confirmPayment(tx *store.Transaction) (store.Status, error) {
+	resp, err := s.queryTransaction(tx)
+	if err != nil {
+		return "", err
+	}
+	status := providerStatus(resp.Status, resp.Success)
+	if status == store.StatusSuccess && resp.Amount != 0 && resp.Amount != tx.Amount {
+		log.Printf("ALERT: provider reports %d paid for %s %s of %d", resp.Amount, tx.Type, tx.ID, tx.Amount)
+		return store.StatusFailed, nil
+	}
+	return status, nil
+}
+
+// giveUpPolling flags a transaction still without a provider result at
+// PushUSSDPollMaxAge for someone to follow up
+func (s *server) giveUpPolling(id string) {
+	tx, err := s.txs.Update(id, func(tx *store.Transaction) error {
+		if tx.UnresolvedAt != nil || !awaitingResult(tx) {
+			return errNotPending
+		}
+		now := time.Now()
+		tx.UnresolvedAt = &now
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	log.Printf("[Poller] ALERT: %s %s of %d by %s has no provider result after %d polls; reconcile it manually",
+		tx.Type, tx.ID, tx.Amount, tx.Merchant, tx.Polls)
+	s.webhooks.Send(tx.Merchant, eventTransactionUnresolved, tx)
+}
@@ -0,0 +1,257 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"kacha-psp/kacha"
+)
+
+// Fake is an in-memory provider for local development and tests. Every call
+// succeeds unless an error is set, and payments and transfers are remembered so
+// that QueryTransaction can report them.
+type Fake struct {
+	name string
+
+	mu           sync.Mutex
+	err          error
+	AccountName  string
+	Balance      int
+	transactions map[string]*kacha.TransactionQueryResponse
+	seq          int
+}
+
+func NewFake(name string) *Fake {
+	return &Fake{
+		name:         name,
+		AccountName:  "Test Customer",
+		Balance:      1000000,
+		transactions: make(map[string]*kacha.TransactionQueryResponse),
+	}
+}
+
+// Factory returns a Factory that hands out this same fake for every merchant
+func (f *Fake) Factory() Factory {
+	return func(Credentials) Provider { return f }
+}
+
+func (f *Fake) Name() string {
+	return f.name
+}
+
+// SetError makes every subsequent call fail with err; nil restores success
+func (f *Fake) SetError(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+func (f *Fake) RequestPayment(req kacha.PaymentRequest) (*kacha.PaymentRequestResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	ref := f.nextID("REF")
+	f.transactions[req.TraceNumber] = &kacha.TransactionQueryResponse{
+		Success:     true,
+		Status:      "PENDING",
+		TraceNumber: req.TraceNumber,
+		Reference:   ref,
+		Amount:      req.Amount,
+		Phone:       req.Phone,
+	}
+	return &kacha.PaymentRequestResponse{
+		Success:     true,
+		Reference:   ref,
+		Message:     "OTP sent successfully",
+		Status:      "PENDING",
+		TraceNumber: req.TraceNumber,
+	}, nil
+}
+
+func (f *Fake) AuthorizePayment(req kacha.PaymentAuthorizeRequest) (*kacha.PaymentAuthorizeResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	txID := f.nextID("TXN")
+	for _, tx := range f.transactions {
+		if tx.Reference == req.Reference {
+			tx.Status = "SUCCESS"
+			tx.TransactionID = txID
+		}
+	}
+	return &kacha.PaymentAuthorizeResponse{
+		Success:       true,
+		Message:       "Payment authorized",
+		Status:        "SUCCESS",
+		Reference:     req.Reference,
+		TransactionID: txID,
+	}, nil
+}
+
+func (f *Fake) RequestPushUSSD(req kacha.PushUSSDRequest) (*kacha.PushUSSDResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	f.transactions[req.TraceNumber] = &kacha.TransactionQueryResponse{
+		Success:     true,
+		Status:      "PENDING",
+		TraceNumber: req.TraceNumber,
+		Amount:      req.Amount,
+		Phone:       req.Phone,
+	}
+	return &kacha.PushUSSDResponse{
+		Success:     true,
+		Message:     "Push USSD sent",
+		Status:      "PENDING",
+		TraceNumber: req.TraceNumber,
+	}, nil
+}
+
+func (f *Fake) ValidateTransfer(req kacha.TransferRequest) (*kacha.TransferValidateResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	return &kacha.TransferValidateResponse{
+		Success:   true,
+		Status:    "PREPARED",
+		Message:   "Transfer validated successfully",
+		To:        req.To,
+		Amount:    req.Amount,
+		Reason:    req.Reason,
+		ShortCode: req.ShortCode,
+		CustomerInfo: &kacha.CustomerInfo{
+			Phone: req.To,
+			Name:  f.AccountName,
+		},
+	}, nil
+}
+
+func (f *Fake) Transfer(req kacha.TransferRequest) (*kacha.TransferResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	txID := f.nextID("TXN")
+	ref := f.nextID("REF")
+	key := req.TraceNumber
+	if key == "" {
+		key = ref
+	}
+	f.transactions[key] = &kacha.TransactionQueryResponse{
+		Success:       true,
+		Status:        "SUCCESS",
+		TraceNumber:   req.TraceNumber,
+		Reference:     ref,
+		TransactionID: txID,
+		Amount:        req.Amount,
+		Phone:         req.To,
+	}
+	return &kacha.TransferResponse{
+		Success:       true,
+		Status:        "SUCCESS",
+		Message:       "Transfer completed successfully",
+		TransactionID: txID,
+		To:            req.To,
+		Amount:        req.Amount,
+		Reference:     ref,
+	}, nil
+}
+
+func (f *Fake) QueryTransaction(req kacha.TransactionQueryRequest) (*kacha.TransactionQueryResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	for key, tx := range f.transactions {
+		if key == req.TraceNumber || (req.Reference != "" && tx.Reference == req.Reference) {
+			out := *tx
+			return &out, nil
+		}
+	}
+	return nil, &kacha.StatusError{Op: "transaction query", StatusCode: http.StatusNotFound,
+		Details: &kacha.ErrorDetails{Message: "transaction not found"}}
+}
+
+func (f *Fake) GetBalance() (*kacha.BalanceResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	return &kacha.BalanceResponse{
+		Success:          true,
+		AccountName:      f.name,
+		Currency:         "ETB",
+		Balance:          f.Balance,
+		AvailableBalance: f.Balance,
+	}, nil
+}
+
+// ParseCallback decodes a callback posted to the fake by hand. The fake takes
+// it as its own, so a status query reports the payment the way it says.
+func (f *Fake) ParseCallback(body []byte) (*kacha.CallbackNotification, error) {
+	var notification kacha.CallbackNotification
+	if err := json.Unmarshal(body, &notification); err != nil {
+		return nil, fmt.Errorf("invalid callback payload: %w", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if tx, ok := f.transactions[notification.TraceNumber]; ok && notification.Status != "" {
+		tx.Success = notification.Success
+		tx.Status = notification.Status
+		if tx.TransactionID == "" {
+			tx.TransactionID = notification.TransactionID
+		}
+	}
+	return &notification, nil
+}
+
+// Complete marks a pending push USSD payment as finished, as a callback would
+func (f *Fake) Complete(traceNumber string, status string) *kacha.CallbackNotification {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tx, ok := f.transactions[traceNumber]
+	if !ok {
+		return nil
+	}
+	tx.Status = status
+	if tx.TransactionID == "" {
+		tx.TransactionID = f.nextID("TXN")
+	}
+	return &kacha.CallbackNotification{
+		Success:       status == "SUCCESS",
+		Status:        status,
+		TraceNumber:   tx.TraceNumber,
+		Reference:     tx.Reference,
+		TransactionID: tx.TransactionID,
+		Amount:        tx.Amount,
+		Phone:         tx.Phone,
+	}
+}
+
+// nextID returns a sequential id with prefix; caller holds f.mu
+func (f *Fake) nextID(prefix string) string {
+	f.seq++
+	return fmt.Sprintf("%s%06d", prefix, f.seq)
+}
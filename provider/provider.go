@@ -0,0 +1,176 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+
+	"kacha-psp/kacha"
+)
+
+var (
+	ErrUnknownProvider = errors.New("unknown payment provider")
+	// ErrUnavailable marks failures where the provider could not be reached
+	// at all, as opposed to the provider rejecting the request
+	ErrUnavailable = errors.New("payment provider unavailable")
+)
+
+var (
+	_ Provider = (*kacha.Client)(nil)
+	_ Provider = (*Fake)(nil)
+)
+
+// Provider is a payment backend the gateway can move money through. The
+// request and response types are the gateway's own API shapes, which follow
+// Kacha's; other providers map to and from them.
+type Provider interface {
+	Name() string
+
+	// C2B with OTP confirmation
+	RequestPayment(req kacha.PaymentRequest) (*kacha.PaymentRequestResponse, error)
+	AuthorizePayment(req kacha.PaymentAuthorizeRequest) (*kacha.PaymentAuthorizeResponse, error)
+
+	// C2B with push USSD confirmation, completed through a callback
+	RequestPushUSSD(req kacha.PushUSSDRequest) (*kacha.PushUSSDResponse, error)
+
+	// B2C payouts
+	ValidateTransfer(req kacha.TransferRequest) (*kacha.TransferValidateResponse, error)
+	Transfer(req kacha.TransferRequest) (*kacha.TransferResponse, error)
+
+	QueryTransaction(req kacha.TransactionQueryRequest) (*kacha.TransactionQueryResponse, error)
+	GetBalance() (*kacha.BalanceResponse, error)
+	ParseCallback(body []byte) (*kacha.CallbackNotification, error)
+}
+
+// Credentials are the merchant's credentials with a provider
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// Factory builds a provider client bound to a merchant's credentials
+type Factory func(creds Credentials) Provider
+
+type Registry struct {
+	mu          sync.RWMutex
+	factories   map[string]Factory
+	defaultName string
+}
+
+func NewRegistry(defaultName string) *Registry {
+	return &Registry{
+		factories:   make(map[string]Factory),
+		defaultName: defaultName,
+	}
+}
+
+func (r *Registry) Register(name string, factory Factory) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.factories[name] = factory
+}
+
+// Get returns the named provider bound to creds; an empty name selects the default
+func (r *Registry) Get(name string, creds Credentials) (Provider, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if name == "" {
+		name = r.defaultName
+	}
+	factory, ok := r.factories[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownProvider, name)
+	}
+	return factory(creds), nil
+}
+
+// Verify checks creds with the default provider by a balance inquiry, which
+// only succeeds for the account's own credentials
+func (r *Registry) Verify(creds Credentials) error {
+	p, err := r.Get("", creds)
+	if err != nil {
+		return err
+	}
+	_, err = p.GetBalance()
+	return err
+}
+
+func (r *Registry) Has(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.factories[name]
+	return ok
+}
+
+func (r *Registry) Default() string {
+	return r.defaultName
+}
+
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.factories))
+	for name := range r.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// KachaFactory returns a Factory for Kacha clients against baseURL
+func KachaFactory(baseURL string) Factory {
+	return func(creds Credentials) Provider {
+		return kacha.NewClientWithBaseURL(creds.Username, creds.Password, baseURL)
+	}
+}
+
+// IsRejected reports whether the provider answered the request that failed
+// with err by refusing it, so it certainly did not carry it out
+func IsRejected(err error) bool {
+	var statusErr *kacha.StatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode < http.StatusInternalServerError
+}
+
+// IsUnsent reports whether the request that failed with err never reached
+// the provider, e.g. as the connection was refused, so it is safe to send
+// again or to another provider
+func IsUnsent(err error) bool {
+	if errors.Is(err, ErrUnavailable) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// IsDefinite reports whether the provider certainly did not carry out the
+// request that failed with err. Other failures, like a timeout waiting for
+// the answer, leave the outcome unknown until a status query tells.
+func IsDefinite(err error) bool {
+	return IsRejected(err) || IsUnsent(err)
+}
+
+// IsUnavailable reports whether err means the provider could not be reached
+func IsUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrUnavailable) {
+		return true
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
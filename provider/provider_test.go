@@ -0,0 +1,115 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"kacha-psp/kacha"
+)
+
+func TestRegistry(t *testing.T) {
+	primary, backup := NewFake("primary"), NewFake("backup")
+	r := NewRegistry("primary")
+	r.Register("primary", primary.Factory())
+	r.Register("backup", backup.Factory())
+	creds := Credentials{Username: "m1", Password: "p1"}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"", "primary"},
+		{"primary", "primary"},
+		{"backup", "backup"},
+	}
+	for _, tt := range tests {
+		p, err := r.Get(tt.name, creds)
+		if err != nil || p.Name() != tt.want {
+			t.Errorf("Get(%q) = %v, %v, want %s", tt.name, p, err, tt.want)
+		}
+	}
+	if _, err := r.Get("other", creds); !errors.Is(err, ErrUnknownProvider) {
+		t.Errorf("Get(other) = %v, want ErrUnknownProvider", err)
+	}
+	if names := r.Names(); len(names) != 2 || names[0] != "backup" || names[1] != "primary" {
+		t.Errorf("Names = %v, want [backup primary]", names)
+	}
+
+	// credentials are verified with the default provider only
+	backup.SetError(ErrUnavailable)
+	if err := r.Verify(creds); err != nil {
+		t.Errorf("Verify = %v, want nil", err)
+	}
+	primary.SetError(&kacha.StatusError{Op: "balance inquiry", StatusCode: http.StatusUnauthorized})
+	if err := r.Verify(creds); !IsRejected(err) {
+		t.Errorf("Verify with refused credentials = %v, want a rejection", err)
+	}
+}
+
+func TestFakeRemembersTransactions(t *testing.T) {
+	f := NewFake("fake")
+
+	resp, err := f.Transfer(kacha.TransferRequest{To: "0911000000", Amount: 500, TraceNumber: "TRF1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := f.QueryTransaction(kacha.TransactionQueryRequest{Reference: resp.Reference})
+	if err != nil || status.Status != "SUCCESS" || status.TransactionID != resp.TransactionID {
+		t.Errorf("QueryTransaction by reference = %+v, %v, want the transfer", status, err)
+	}
+
+	if _, err := f.RequestPushUSSD(kacha.PushUSSDRequest{Phone: "0911000000", Amount: 100, TraceNumber: "PUSH1"}); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := f.QueryTransaction(kacha.TransactionQueryRequest{TraceNumber: "PUSH1"}); status.Status != "PENDING" {
+		t.Errorf("push USSD status = %s, want PENDING", status.Status)
+	}
+	if n := f.Complete("PUSH1", "SUCCESS"); n == nil || !n.Success {
+		t.Fatalf("Complete = %+v, want a successful notification", n)
+	}
+	if status, _ := f.QueryTransaction(kacha.TransactionQueryRequest{TraceNumber: "PUSH1"}); status.Status != "SUCCESS" {
+		t.Errorf("push USSD status after Complete = %s, want SUCCESS", status.Status)
+	}
+
+	if _, err := f.QueryTransaction(kacha.TransactionQueryRequest{TraceNumber: "NONE"}); !IsRejected(err) {
+		t.Errorf("QueryTransaction of an unknown transaction = %v, want a rejection", err)
+	}
+}
+
+func TestErrorClassification(t *testing.T) {
+	dial := &url.Error{Op: "Post", URL: "http://kacha", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}
+	read := &url.Error{Op: "Post", URL: "http://kacha", Err: &net.OpError{Op: "read", Err: errors.New("connection reset")}}
+	timeout := &url.Error{Op: "Post", URL: "http://kacha", Err: context.DeadlineExceeded}
+	tests := []struct {
+		name                          string
+		err                           error
+		rejected, unsent, unavailable bool
+	}{
+		{"refused by the provider", &kacha.StatusError{StatusCode: http.StatusBadRequest}, true, false, false},
+		{"provider error", &kacha.StatusError{StatusCode: http.StatusBadGateway}, false, false, false},
+		{"connection refused", fmt.Errorf("failed to transfer: %w", dial), false, true, true},
+		{"unknown host", &url.Error{Op: "Post", URL: "http://kacha", Err: &net.DNSError{Err: "no such host"}}, false, true, true},
+		{"marked unavailable", ErrUnavailable, false, true, true},
+		{"connection reset", read, false, false, true},
+		{"timeout", timeout, false, false, true},
+	}
+	for _, tt := range tests {
+		if got := IsRejected(tt.err); got != tt.rejected {
+			t.Errorf("%s: IsRejected = %v, want %v", tt.name, got, tt.rejected)
+		}
+		if got := IsUnsent(tt.err); got != tt.unsent {
+			t.Errorf("%s: IsUnsent = %v, want %v", tt.name, got, tt.unsent)
+		}
+		if got := IsDefinite(tt.err); got != (tt.rejected || tt.unsent) {
+			t.Errorf("%s: IsDefinite = %v, want %v", tt.name, got, tt.rejected || tt.unsent)
+		}
+		if got := IsUnavailable(tt.err); got != tt.unavailable {
+			t.Errorf("%s: IsUnavailable = %v, want %v", tt.name, got, tt.unavailable)
+		}
+	}
+}
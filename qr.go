@@ -0,0 +1,127 @@
+package main
+
+import (
+	"kacha-psp/emvqr"
+	"kacha-psp/invoice"
+	"kacha-psp/store"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// qrInvoiceTTL is how long a dynamic QR code can be paid by default
+const qrInvoiceTTL = 30 * time.Minute
+
+// Invoice metadata keys of dynamic QR codes
+const (
+	metaTraceNumber = "trace_number"
+	metaQRName      = "qr_name"
+	metaQRCity      = "qr_city"
+	metaQRCategory  = "qr_category"
+)
+
+// qrMerchant is how a merchant is presented in its QR codes
+type qrMerchant struct {
+	Name     string `json:"name,omitempty" form:"name"`
+	City     string `json:"city,omitempty" form:"city"`
+	Category string `json:"category,omitempty" form:"category"`
+}
+
+// staticQR is the merchant's printable QR code, which customers pay any amount to
+func (s *server) staticQR(merchant string, m qrMerchant) (string, error) {
+	return s.qrPayload(merchant, m).Encode()
+}
+
+// invoiceQR is the dynamic QR code paying what is due on inv
+func (s *server) invoiceQR(inv *invoice.Invoice) (string, error) {
+	p := s.qrPayload(inv.Merchant, qrMerchant{
+		Name:     inv.Metadata[metaQRName],
+		City:     inv.Metadata[metaQRCity],
+		Category: inv.Metadata[metaQRCategory],
+	})
+	p.Dynamic = true
+	p.Amount = inv.Due()
+	p.BillNumber = inv.Reference
+	p.ReferenceLabel = inv.Metadata[metaTraceNumber]
+	return p.Encode()
+}
+
+func (s *server) qrPayload(merchant string, m qrMerchant) *emvqr.Payload {
+	p := &emvqr.Payload{
+		AccountGUID: s.cfg.QRAccountGUID,
+		MerchantID:  merchant,
+		Category:    s.cfg.QRMerchantCategory,
+		Name:        merchant,
+		City:        s.cfg.QRMerchantCity,
+	}
+	if m.Name != "" {
+		p.Name = m.Name
+	}
+	if m.City != "" {
+		p.City = m.City
+	}
+	if m.Category != "" {
+		p.Category = m.Category
+	}
+	return p
+}
+
+// createDynamicQR opens the invoice a dynamic QR code pays. The trace number
+// and presentation are kept in its metadata so the code can be rendered again.
+func (s *server) createDynamicQR(merchant string, amount int, description, trace string, expiresAt time.Time, m qrMerchant) (*invoice.Invoice, error) {
+	if trace == "" {
+		// cut to fit the payload's 25 character reference label
+		trace = store.NewID("QR")[:20]
+	}
+	if len(trace) > 25 {
+		return nil, newAPIError(http.StatusBadRequest, "trace_number must be at most 25 characters", nil)
+	}
+	meta := map[string]string{metaTraceNumber: trace}
+	for k, v := range map[string]string{metaQRName: m.Name, metaQRCity: m.City, metaQRCategory: m.Category} {
+		if v != "" {
+			meta[k] = v
+		}
+	}
+
+	inv, events, err := s.invoices.Create(&invoice.Invoice{
+		Merchant:    merchant,
+		Amount:      amount,
+		Description: description,
+		ExpiresAt:   expiresAt,
+		Metadata:    meta,
+	})
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, err.Error(), nil)
+	}
+	s.emitInvoiceEvents(events)
+	return inv, nil
+}
+
+// scannedInvoice finds the invoice a scanned QR payload pays. Static codes
+// have no invoice, so one is opened for the amount the customer entered.
+func (s *server) scannedInvoice(payload string, amount int) (*invoice.Invoice, error) {
+	p, err := emvqr.Parse(strings.TrimSpace(payload))
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, err.Error(), nil)
+	}
+	if p.AccountGUID != s.cfg.QRAccountGUID {
+		return nil, newAPIError(http.StatusUnprocessableEntity, "QR code is not payable through this gateway", nil)
+	}
+	if p.Currency != emvqr.CurrencyETB {
+		return nil, newAPIError(http.StatusUnprocessableEntity, "QR code currency is not supported", nil)
+	}
+
+	if p.Dynamic {
+		inv, err := s.invoices.ByReference(p.BillNumber)
+		if err != nil || inv.Merchant != p.MerchantID {
+			return nil, newAPIError(http.StatusNotFound, "payment for QR code not found", nil)
+		}
+		return inv, nil
+	}
+
+	if amount <= 0 {
+		return nil, newAPIError(http.StatusBadRequest, "amount is required for a static QR code", nil)
+	}
+	return s.createDynamicQR(p.MerchantID, amount, "QR payment to "+p.Name, p.ReferenceLabel,
+		time.Now().Add(qrInvoiceTTL), qrMerchant{Name: p.Name, City: p.City, Category: p.Category})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"kacha-psp/qrcode"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type createQRRequest struct {
+	qrMerchant
+	Amount      int    `json:"amount"`
+	Description string `json:"description"`
+	// TraceNumber is the merchant's own reference, generated if empty
+	TraceNumber string `json:"trace_number,omitempty"`
+	ExpiresIn   string `json:"expires_in,omitempty"`
+}
+
+type payQRRequest struct {
+	Payload string `json:"payload"`
+	// Method is PUSH_USSD (the default) or OTP
+	Method string `json:"method,omitempty"`
+	Phone  string `json:"phone"`
+	// Amount is required for static codes, which carry none
+	Amount int `json:"amount,omitempty"`
+}
+
+// handleStaticQR renders the merchant's static QR code
+func (s *server) handleStaticQR(c *gin.Context) {
+	var m qrMerchant
+	if err := c.ShouldBindQuery(&m); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	payload, err := s.staticQR(c.GetString("merchant"), m)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	writeQR(c, payload)
+}
+
+// handleCreateDynamicQR opens an invoice and returns the QR code paying it
+func (s *server) handleCreateDynamicQR(c *gin.Context) {
+	var req createQRRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	expiresAt := time.Now().Add(qrInvoiceTTL)
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid expires_in: " + err.Error()})
+			return
+		}
+		expiresAt = time.Now().Add(d)
+	}
+
+	inv, err := s.createDynamicQR(c.GetString("merchant"), req.Amount, req.Description, req.TraceNumber, expiresAt, req.qrMerchant)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	payload, err := s.invoiceQR(inv)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	resp := gin.H{
+		"payload":      payload,
+		"trace_number": inv.Metadata[metaTraceNumber],
+		"invoice":      s.invoiceView(inv),
+	}
+	if s.cfg.PublicURL != "" {
+		resp["qr_url"] = s.cfg.PublicURL + "/i/" + inv.Reference + "/qr"
+	}
+	c.JSON(http.StatusCreated, resp)
+}
+
+// handleInvoiceQR renders the dynamic QR code of an invoice
+func (s *server) handleInvoiceQR(c *gin.Context) {
+	inv, err := s.invoices.ByReference(c.Param("reference"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if inv.Due() == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "invoice has nothing left to pay"})
+		return
+	}
+	payload, err := s.invoiceQR(inv)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	writeQR(c, payload)
+}
+
+// handlePayQR pays a scanned merchant QR code
+func (s *server) handlePayQR(c *gin.Context) {
+	var req payQRRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Payload == "" || req.Phone == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "payload and phone are required"})
+		return
+	}
+	method, err := s.invoicePaymentMethod(req.Method)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	inv, err := s.scannedInvoice(req.Payload, req.Amount)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	amount := req.Amount
+	if !inv.AllowPartial {
+		amount = 0
+	}
+	tx, resp, err := s.payInvoice(inv, method, req.Phone, amount)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"transaction_id": tx.ID,
+		"invoice":        toPublicInvoice(inv),
+		"amount":         tx.Amount,
+		"method":         method,
+		"payment":        resp,
+	})
+}
+
+// writeQR responds with payload as a PNG (the default), an SVG or as text,
+// picked by the format query parameter
+func writeQR(c *gin.Context, payload string) {
+	format := c.DefaultQuery("format", "png")
+	if format == "text" {
+		c.JSON(http.StatusOK, gin.H{"payload": payload})
+		return
+	}
+	code, err := qrcode.Encode([]byte(payload), qrcode.Medium)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	scale, err := strconv.Atoi(c.DefaultQuery("scale", "8"))
+	if err != nil || scale < 1 || scale > 40 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "scale must be between 1 and 40"})
+		return
+	}
+
+	c.Header("X-QR-Payload", payload)
+	switch format {
+	case "svg":
+		c.Data(http.StatusOK, "image/svg+xml", code.SVG(scale))
+	case "png":
+		img, err := code.PNG(scale)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Data(http.StatusOK, "image/png", img)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be png, svg or text"})
+	}
+}
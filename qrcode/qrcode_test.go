@@ -0,0 +1,118 @@
+package qrcode
+
+import (
+	"bytes"
+	"errors"
+	"image/png"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/makiuchi-d/gozxing"
+	zxqr "github.com/makiuchi-d/gozxing/qrcode"
+)
+
+var levelNames = [4]string{Low: "L", Medium: "M", Quartile: "Q", High: "H"}
+
+// decode reads the code back from its PNG with an independent decoder,
+// returning the byte segment and the error correction level it found
+func decode(t *testing.T, c *Code) ([]byte, string) {
+	t.Helper()
+	img, err := c.PNG(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := png.Decode(bytes.NewReader(img))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bmp, err := gozxing.NewBinaryBitmap(gozxing.NewHybridBinarizer(gozxing.NewLuminanceSourceFromImage(m)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := zxqr.NewQRCodeReader().Decode(bmp, map[gozxing.DecodeHintType]interface{}{
+		gozxing.DecodeHintType_PURE_BARCODE: true,
+	})
+	if err != nil {
+		t.Fatalf("version %d-%s mask %d does not decode: %v", c.Version, levelNames[c.Level], c.Mask, err)
+	}
+	meta := res.GetResultMetadata()
+	var data []byte
+	if segments, ok := meta[gozxing.ResultMetadataType_BYTE_SEGMENTS].([][]byte); ok {
+		data = bytes.Join(segments, nil)
+	}
+	level, _ := meta[gozxing.ResultMetadataType_ERROR_CORRECTION_LEVEL].(string)
+	return data, level
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	payloads := [][]byte{
+		[]byte("hello"),
+		[]byte("00020101021226230008et.kacha0107merchant5204000053032305802ET5909merchant6011Addis Ababa6304A1B2"),
+		[]byte(strings.Repeat("0123456789ABCDEF", 20)),
+	}
+	for _, n := range []int{1, 14, 15, 60, 150, 271, 500, 1000, 1273, 2331} {
+		data := make([]byte, n)
+		rnd.Read(data)
+		payloads = append(payloads, data)
+	}
+
+	for _, data := range payloads {
+		for level := Low; level <= High; level++ {
+			c, err := Encode(data, level)
+			if errors.Is(err, ErrTooLong) {
+				continue
+			}
+			if err != nil {
+				t.Fatalf("Encode(%d bytes, %s): %v", len(data), levelNames[level], err)
+			}
+			got, gotLevel := decode(t, c)
+			if !bytes.Equal(got, data) {
+				t.Errorf("version %d-%s: decoded %d bytes differing from the %d encoded",
+					c.Version, levelNames[level], len(got), len(data))
+			}
+			if gotLevel != levelNames[level] {
+				t.Errorf("version %d-%s: decoded level %s", c.Version, levelNames[level], gotLevel)
+			}
+		}
+	}
+}
+
+// TestEncodeVersion checks versions against the byte mode capacities of
+// ISO/IEC 18004 table 7
+func TestEncodeVersion(t *testing.T) {
+	tests := []struct {
+		n       int
+		level   Level
+		version int
+	}{
+		{17, Low, 1},
+		{18, Low, 2},
+		{14, Medium, 1},
+		{15, Medium, 2},
+		{7, High, 1},
+		{8, High, 2},
+		{134, Low, 6},
+		{135, Low, 7},
+		{230, Low, 9},
+		{231, Low, 10},
+		{2953, Low, 40},
+		{2331, Medium, 40},
+		{1663, Quartile, 40},
+		{1273, High, 40},
+	}
+	for _, tt := range tests {
+		c, err := Encode(make([]byte, tt.n), tt.level)
+		if err != nil {
+			t.Fatalf("Encode(%d bytes, %s): %v", tt.n, levelNames[tt.level], err)
+		}
+		if c.Version != tt.version || c.Size != 17+4*tt.version {
+			t.Errorf("Encode(%d bytes, %s) = version %d size %d, want version %d",
+				tt.n, levelNames[tt.level], c.Version, c.Size, tt.version)
+		}
+	}
+	if _, err := Encode(make([]byte, 2954), Low); !errors.Is(err, ErrTooLong) {
+		t.Errorf("Encode(2954 bytes, L) = %v, want ErrTooLong", err)
+	}
+}
@@ -0,0 +1,201 @@
+package quote
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"kacha-psp/kacha"
+	"kacha-psp/store"
+)
+
+const DefaultTTL = 5 * time.Minute
+
+var (
+	ErrInvalid  = errors.New("quote token is invalid")
+	ErrExpired  = errors.New("quote token has expired")
+	ErrMismatch = errors.New("quote token does not match the transfer request")
+	ErrUsed     = errors.New("quote token has already been used")
+)
+
+// Claims is the data captured by a successful ValidateTransfer call
+type Claims struct {
+	ID           string              `json:"id"`
+	Merchant     string              `json:"merchant"`
+	Provider     string              `json:"provider,omitempty"`
+	To           string              `json:"to"`
+	Amount       int                 `json:"amount"`
+	ShortCode    string              `json:"short_code"`
+	CustomerInfo *kacha.CustomerInfo `json:"customer_info,omitempty"`
+	IssuedAt     int64               `json:"iat"`
+	ExpiresAt    int64               `json:"exp"`
+}
+
+// Service issues and redeems signed, single-use quote tokens. The ids of
+// redeemed quotes are kept until they expire, across restarts when path is set.
+type Service struct {
+	secret []byte
+	ttl    time.Duration
+	path   string
+
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+func NewService(secret []byte, ttl time.Duration, path string) (*Service, error) {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	s := &Service{
+		secret: secret,
+		ttl:    ttl,
+		path:   path,
+		used:   make(map[string]time.Time),
+	}
+	if path == "" {
+		return s, nil
+	}
+	if err := store.LoadJSON(path, &s.used); err != nil {
+		return nil, err
+	}
+	if s.used == nil {
+		s.used = make(map[string]time.Time)
+	}
+	return s, nil
+}
+
+// Issue signs a quote for a validated transfer and returns the token with its claims
+func (s *Service) Issue(merchant, provider string, resp *kacha.TransferValidateResponse, req kacha.TransferRequest) (string, *Claims, error) {
+	id, err := newID()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate quote id: %w", err)
+	}
+
+	now := time.Now()
+	claims := &Claims{
+		ID:           id,
+		Merchant:     merchant,
+		Provider:     provider,
+		To:           req.To,
+		Amount:       req.Amount,
+		ShortCode:    req.ShortCode,
+		CustomerInfo: resp.CustomerInfo,
+		IssuedAt:     now.Unix(),
+		ExpiresAt:    now.Add(s.ttl).Unix(),
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to encode quote: %w", err)
+	}
+
+	body := base64.RawURLEncoding.EncodeToString(payload)
+	return body + "." + s.sign(body), claims, nil
+}
+
+// Verify checks the token against the transfer about to be executed without
+// using it up, so the transfer can still be refused before it is redeemed
+func (s *Service) Verify(token, merchant string, req kacha.TransferRequest) (*Claims, error) {
+	claims, err := s.parse(token)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, ErrExpired
+	}
+	if claims.Merchant != merchant || claims.To != req.To ||
+		claims.Amount != req.Amount || claims.ShortCode != req.ShortCode {
+		return nil, ErrMismatch
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.used[claims.ID]; ok {
+		return nil, ErrUsed
+	}
+	return claims, nil
+}
+
+// Redeem marks a verified quote as used. A quote can be redeemed only once.
+func (s *Service) Redeem(claims *Claims) error {
+	now := time.Now()
+	if now.Unix() >= claims.ExpiresAt {
+		return ErrExpired
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune(now)
+	if _, ok := s.used[claims.ID]; ok {
+		return ErrUsed
+	}
+	s.used[claims.ID] = time.Unix(claims.ExpiresAt, 0)
+	s.persist()
+	return nil
+}
+
+func (s *Service) parse(token string) (*Claims, error) {
+	body, sig, ok := strings.Cut(token, ".")
+	if !ok || body == "" || sig == "" {
+		return nil, ErrInvalid
+	}
+	if !hmac.Equal([]byte(sig), []byte(s.sign(body))) {
+		return nil, ErrInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return nil, ErrInvalid
+	}
+
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalid
+	}
+	return &claims, nil
+}
+
+func (s *Service) sign(body string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(body))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// prune drops used token ids whose quotes have expired anyway; caller holds s.mu
+func (s *Service) prune(now time.Time) {
+	for id, exp := range s.used {
+		if now.After(exp) {
+			delete(s.used, id)
+		}
+	}
+}
+
+// persist mirrors the used quote ids to disk; caller holds s.mu
+func (s *Service) persist() {
+	if s.path == "" {
+		return
+	}
+	if err := store.SaveJSON(s.path, s.used); err != nil {
+		log.Printf("[Quote] failed to persist used quotes: %v", err)
+	}
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,117 @@
+package quote
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"kacha-psp/kacha"
+)
+
+var transfer = kacha.TransferRequest{Username: "m1", To: "0911000000", Amount: 500, Reason: "payout", ShortCode: "1234"}
+
+func issue(t *testing.T, s *Service) (string, *Claims) {
+	t.Helper()
+	token, claims, err := s.Issue("m1", "kacha", &kacha.TransferValidateResponse{
+		CustomerInfo: &kacha.CustomerInfo{Name: "Abebe Kebede"},
+	}, transfer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token, claims
+}
+
+func newService(t *testing.T, secret string, ttl time.Duration, path string) *Service {
+	t.Helper()
+	s, err := NewService([]byte(secret), ttl, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestVerifyAndRedeem(t *testing.T) {
+	s := newService(t, "secret", time.Minute, "")
+	token, issued := issue(t, s)
+
+	claims, err := s.Verify(token, "m1", transfer)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if claims.ID != issued.ID || claims.Provider != "kacha" || claims.CustomerInfo.Name != "Abebe Kebede" {
+		t.Errorf("Verify claims = %+v, want %+v", claims, issued)
+	}
+	// verifying does not use the quote up
+	if _, err := s.Verify(token, "m1", transfer); err != nil {
+		t.Fatalf("second Verify: %v", err)
+	}
+
+	if err := s.Redeem(claims); err != nil {
+		t.Fatalf("Redeem: %v", err)
+	}
+	if err := s.Redeem(claims); !errors.Is(err, ErrUsed) {
+		t.Errorf("second Redeem = %v, want ErrUsed", err)
+	}
+	if _, err := s.Verify(token, "m1", transfer); !errors.Is(err, ErrUsed) {
+		t.Errorf("Verify after Redeem = %v, want ErrUsed", err)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	s := newService(t, "secret", time.Minute, "")
+	token, _ := issue(t, s)
+	body, sig, _ := strings.Cut(token, ".")
+
+	other := transfer
+	other.Amount++
+	tests := []struct {
+		name     string
+		token    string
+		merchant string
+		req      kacha.TransferRequest
+		want     error
+	}{
+		{"other merchant", token, "m2", transfer, ErrMismatch},
+		{"other amount", token, "m1", other, ErrMismatch},
+		{"no signature", body, "m1", transfer, ErrInvalid},
+		{"tampered body", "x" + body + "." + sig, "m1", transfer, ErrInvalid},
+		{"other secret", func() string { tok, _ := issue(t, newService(t, "other", time.Minute, "")); return tok }(), "m1", transfer, ErrInvalid},
+	}
+	for _, tt := range tests {
+		if _, err := s.Verify(tt.token, tt.merchant, tt.req); !errors.Is(err, tt.want) {
+			t.Errorf("%s: Verify = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestExpired(t *testing.T) {
+	s := newService(t, "secret", time.Minute, "")
+	token, claims := issue(t, s)
+	claims.ExpiresAt = time.Now().Unix()
+	if err := s.Redeem(claims); !errors.Is(err, ErrExpired) {
+		t.Errorf("Redeem = %v, want ErrExpired", err)
+	}
+
+	// quotes issued already expired
+	s.ttl = -time.Second
+	token, _ = issue(t, s)
+	if _, err := s.Verify(token, "m1", transfer); !errors.Is(err, ErrExpired) {
+		t.Errorf("Verify = %v, want ErrExpired", err)
+	}
+}
+
+func TestUsedQuotesPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quotes.json")
+	s := newService(t, "secret", time.Minute, path)
+	token, claims := issue(t, s)
+	if err := s.Redeem(claims); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newService(t, "secret", time.Minute, path)
+	if _, err := restarted.Verify(token, "m1", transfer); !errors.Is(err, ErrUsed) {
+		t.Errorf("Verify after restart = %v, want ErrUsed", err)
+	}
+}
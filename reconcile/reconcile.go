@@ -0,0 +1,359 @@
+// Package reconcile matches the gateway's transactions against the lines of
+// provider settlement files and tracks the exceptions until they are resolved.
+package reconcile
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"kacha-psp/store"
+)
+
+var (
+	ErrNotFound     = errors.New("reconciliation not found")
+	ErrItemNotFound = errors.New("reconciliation item not found")
+	ErrNotException = errors.New("matched items need no resolution")
+	ErrResolved     = errors.New("item is already resolved")
+)
+
+// Class is the outcome of matching a statement line or transaction
+type Class string
+
+const (
+	ClassMatched Class = "MATCHED"
+	// ClassMissingInGateway is a statement line with no gateway transaction
+	ClassMissingInGateway Class = "MISSING_IN_GATEWAY"
+	// ClassMissingAtKacha is a successful gateway transaction the statement
+	// does not list
+	ClassMissingAtKacha Class = "MISSING_AT_KACHA"
+	ClassAmountMismatch Class = "AMOUNT_MISMATCH"
+	// ClassStatusMismatch is a line and a transaction that disagree on
+	// whether the money moved
+	ClassStatusMismatch Class = "STATUS_MISMATCH"
+)
+
+type ItemStatus string
+
+const (
+	ItemOpen     ItemStatus = "OPEN"
+	ItemResolved ItemStatus = "RESOLVED"
+)
+
+// Item is a statement line, a gateway transaction or both, as matched
+type Item struct {
+	ID     string `json:"id"`
+	Class  Class  `json:"class"`
+	Detail string `json:"detail,omitempty"`
+	Line   *Line  `json:"line,omitempty"`
+
+	TransactionID string       `json:"transaction_id,omitempty"`
+	Merchant      string       `json:"merchant,omitempty"`
+	TxStatus      store.Status `json:"tx_status,omitempty"`
+	GatewayAmount int          `json:"gateway_amount"`
+
+	// Status is empty for matched items, which need no resolution
+	Status     ItemStatus `json:"status,omitempty"`
+	Notes      []Note     `json:"notes,omitempty"`
+	ResolvedBy string     `json:"resolved_by,omitempty"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+type Note struct {
+	Author string    `json:"author"`
+	Text   string    `json:"text"`
+	At     time.Time `json:"at"`
+}
+
+// Report is the result of reconciling one statement file
+type Report struct {
+	ID       string    `json:"id"`
+	Provider string    `json:"provider"`
+	FileName string    `json:"file_name,omitempty"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	Lines    int       `json:"lines"`
+	// Counts is the number of items in each class
+	Counts map[Class]int `json:"counts"`
+	// Open is the number of exceptions not resolved yet
+	Open       int       `json:"open"`
+	Items      []*Item   `json:"items,omitempty"`
+	ImportedBy string    `json:"imported_by,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Match pairs statement lines with the provider's transactions, by provider
+// transaction ID, then reference, then trace number. Successful transactions
+// created within from and to that no line lists are missing at Kacha;
+// a zero period takes all of them.
+func Match(lines []Line, txs []*store.Transaction, from, to time.Time) []*Item {
+	byTxID := make(map[string]*store.Transaction)
+	byRef := make(map[string]*store.Transaction)
+	byTrace := make(map[string]*store.Transaction)
+	add := func(index map[string]*store.Transaction, key string, tx *store.Transaction) {
+		if _, dup := index[key]; key != "" && !dup {
+			index[key] = tx
+		}
+	}
+	for _, tx := range txs {
+		add(byTxID, tx.ProviderTxID, tx)
+		add(byRef, tx.Reference, tx)
+		add(byTrace, tx.TraceNumber, tx)
+	}
+
+	var items []*Item
+	matchedRow := make(map[string]int)
+	for i := range lines {
+		line := &lines[i]
+		tx := byTxID[line.TransactionID]
+		if tx == nil {
+			tx = byRef[line.Reference]
+		}
+		if tx == nil {
+			tx = byTrace[line.TraceNumber]
+		}
+
+		item := &Item{Class: ClassMatched, Line: line}
+		switch {
+		case line.TransactionID == "" && line.Reference == "" && line.TraceNumber == "":
+			item.Class, item.Detail = ClassMissingInGateway, "line has no identifiers"
+		case tx == nil:
+			item.Class = ClassMissingInGateway
+		case matchedRow[tx.ID] != 0:
+			item.Class = ClassMissingInGateway
+			item.Detail = fmt.Sprintf("transaction %s is already matched by row %d", tx.ID, matchedRow[tx.ID])
+			tx = nil
+		}
+		if tx != nil {
+			matchedRow[tx.ID] = line.Row
+			item.setTransaction(tx)
+			switch {
+			case line.Settled() != settled(tx):
+				item.Class = ClassStatusMismatch
+				item.Detail = fmt.Sprintf("statement status %q, gateway status %s", line.Status, txStatus(tx))
+			case line.Amount != tx.Amount:
+				item.Class = ClassAmountMismatch
+				item.Detail = fmt.Sprintf("statement amount %d, gateway amount %d", line.Amount, tx.Amount)
+			}
+		}
+		items = append(items, item)
+	}
+
+	for _, tx := range txs {
+		if matchedRow[tx.ID] != 0 || !settled(tx) {
+			continue
+		}
+		if !from.IsZero() && (tx.CreatedAt.Before(from) || tx.CreatedAt.After(to)) {
+			continue
+		}
+		item := &Item{Class: ClassMissingAtKacha}
+		item.setTransaction(tx)
+		items = append(items, item)
+	}
+
+	for i, item := range items {
+		item.ID = strconv.Itoa(i + 1)
+		if item.Class != ClassMatched {
+			item.Status = ItemOpen
+		}
+	}
+	return items
+}
+
+func (item *Item) setTransaction(tx *store.Transaction) {
+	item.TransactionID = tx.ID
+	item.Merchant = tx.Merchant
+	item.TxStatus = txStatus(tx)
+	item.GatewayAmount = tx.Amount
+}
+
+// settled reports whether the customer was charged or paid, counting results
+// that arrived after the gateway gave up on the transaction
+func settled(tx *store.Transaction) bool {
+	return tx.Status == store.StatusSuccess || tx.LateStatus == store.StatusSuccess
+}
+
+func txStatus(tx *store.Transaction) store.Status {
+	if tx.LateStatus != "" {
+		return tx.LateStatus
+	}
+	return tx.Status
+}
+
+// WriteCSV writes the report's items, one per row
+func (r *Report) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"item", "class", "status", "row", "trace_number", "reference", "provider_transaction_id",
+		"statement_amount", "transaction_id", "merchant", "gateway_status", "gateway_amount", "detail", "resolved_by"})
+	for _, item := range r.Items {
+		var row, trace, ref, providerTx, amount string
+		if l := item.Line; l != nil {
+			row, trace, ref, providerTx, amount = strconv.Itoa(l.Row), l.TraceNumber, l.Reference, l.TransactionID, strconv.Itoa(l.Amount)
+		}
+		gatewayAmount := ""
+		if item.TransactionID != "" {
+			gatewayAmount = strconv.Itoa(item.GatewayAmount)
+		}
+		cw.Write([]string{item.ID, string(item.Class), string(item.Status), row, trace, ref, providerTx,
+			amount, item.TransactionID, item.Merchant, string(item.TxStatus), gatewayAmount, item.Detail, item.ResolvedBy})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (r *Report) summarize() {
+	r.Counts = make(map[Class]int)
+	r.Open = 0
+	for _, item := range r.Items {
+		r.Counts[item.Class]++
+		if item.Status == ItemOpen {
+			r.Open++
+		}
+	}
+}
+
+func (r *Report) copy(withItems bool) *Report {
+	out := *r
+	out.Counts = make(map[Class]int, len(r.Counts))
+	for k, v := range r.Counts {
+		out.Counts[k] = v
+	}
+	out.Items = nil
+	if withItems {
+		for _, item := range r.Items {
+			c := *item
+			c.Notes = append([]Note(nil), item.Notes...)
+			out.Items = append(out.Items, &c)
+		}
+	}
+	return &out
+}
+
+type Store struct {
+	path string
+
+	mu      sync.Mutex
+	reports map[string]*Report
+}
+
+func NewStore(path string) (*Store, error) {
+	s := &Store{
+		path:    path,
+		reports: make(map[string]*Report),
+	}
+	if path == "" {
+		return s, nil
+	}
+	if err := store.LoadJSON(path, &s.reports); err != nil {
+		return nil, err
+	}
+	if s.reports == nil {
+		s.reports = make(map[string]*Report)
+	}
+	return s, nil
+}
+
+// Create records a report of matched items
+func (s *Store) Create(r *Report, now time.Time) *Report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r.ID = store.NewID("rec")
+	r.CreatedAt, r.UpdatedAt = now, now
+	r.summarize()
+	s.reports[r.ID] = r
+	s.persist()
+	return r.copy(true)
+}
+
+func (s *Store) Get(id string) (*Report, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.reports[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return r.copy(true), nil
+}
+
+// List returns the reports without their items, newest first
+func (s *Store) List() []*Report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := []*Report{}
+	for _, r := range s.reports {
+		out = append(out, r.copy(false))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
+
+// AddNote adds a note to an item
+func (s *Store) AddNote(id, itemID string, note Note) (*Item, error) {
+	return s.updateItem(id, itemID, note.At, func(item *Item) error {
+		item.Notes = append(item.Notes, note)
+		return nil
+	})
+}
+
+// Resolve closes an exception, with a note saying how it was resolved
+func (s *Store) Resolve(id, itemID string, note Note) (*Item, error) {
+	return s.updateItem(id, itemID, note.At, func(item *Item) error {
+		switch item.Status {
+		case "":
+			return ErrNotException
+		case ItemResolved:
+			return ErrResolved
+		}
+		at := note.At
+		item.Status = ItemResolved
+		item.ResolvedBy = note.Author
+		item.ResolvedAt = &at
+		item.Notes = append(item.Notes, note)
+		return nil
+	})
+}
+
+func (s *Store) updateItem(id, itemID string, now time.Time, fn func(*Item) error) (*Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.reports[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	for _, item := range r.Items {
+		if item.ID != itemID {
+			continue
+		}
+		if err := fn(item); err != nil {
+			return nil, err
+		}
+		r.UpdatedAt = now
+		r.summarize()
+		s.persist()
+		out := *item
+		out.Notes = append([]Note(nil), item.Notes...)
+		return &out, nil
+	}
+	return nil, ErrItemNotFound
+}
+
+// persist mirrors the store to disk; caller holds s.mu
+func (s *Store) persist() {
+	if s.path == "" {
+		return
+	}
+	if err := store.SaveJSON(s.path, s.reports); err != nil {
+		log.Printf("[Reconcile] failed to persist reports: %v", err)
+	}
+}
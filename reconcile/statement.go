@@ -0,0 +1,184 @@
+package reconcile
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrEmptyStatement = errors.New("statement has no lines")
+
+// Line is a row of a provider settlement or statement file
+type Line struct {
+	Row           int       `json:"row"`
+	TraceNumber   string    `json:"trace_number,omitempty"`
+	Reference     string    `json:"reference,omitempty"`
+	TransactionID string    `json:"transaction_id,omitempty"`
+	Amount        int       `json:"amount"`
+	Status        string    `json:"status,omitempty"`
+	Date          time.Time `json:"date"`
+	// dateOnly is set when Date has no time of day
+	dateOnly bool
+}
+
+// Settled reports whether the provider moved the money for the line. Lines
+// without a status are taken as settled, as in settlement files.
+func (l *Line) Settled() bool {
+	switch strings.ToUpper(l.Status) {
+	case "", "SUCCESS", "SUCCESSFUL", "SETTLED", "COMPLETED", "PAID":
+		return true
+	}
+	return false
+}
+
+// columns maps the header names seen in statement files to Line fields
+var columns = map[string]string{
+	"trace_number":     "trace_number",
+	"trace":            "trace_number",
+	"trace_no":         "trace_number",
+	"reference":        "reference",
+	"ref":              "reference",
+	"reference_number": "reference",
+	"transaction_id":   "transaction_id",
+	"transaction":      "transaction_id",
+	"txn_id":           "transaction_id",
+	"tx_id":            "transaction_id",
+	"amount":           "amount",
+	"settled_amount":   "amount",
+	"status":           "status",
+	"date":             "date",
+	"transaction_date": "date",
+	"settled_at":       "date",
+	"created_at":       "date",
+}
+
+var dateLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "02/01/2006 15:04:05"}
+var dayLayouts = []string{"2006-01-02", "02/01/2006"}
+
+// ParseStatement reads a CSV statement with a header row. Columns are found
+// by name, so extra columns and any column order are accepted.
+func ParseStatement(r io.Reader) ([]Line, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, ErrEmptyStatement
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	index := make(map[string]int)
+	for i, name := range header {
+		name = strings.NewReplacer(" ", "_", "-", "_").Replace(strings.ToLower(strings.TrimSpace(name)))
+		if field, ok := columns[strings.TrimPrefix(name, "\ufeff")]; ok {
+			if _, seen := index[field]; !seen {
+				index[field] = i
+			}
+		}
+	}
+	if _, ok := index["amount"]; !ok {
+		return nil, errors.New("statement has no amount column")
+	}
+	_, hasTrace := index["trace_number"]
+	_, hasRef := index["reference"]
+	_, hasTx := index["transaction_id"]
+	if !hasTrace && !hasRef && !hasTx {
+		return nil, errors.New("statement needs a trace_number, reference or transaction_id column")
+	}
+
+	var lines []Line
+	for row := 2; ; row++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %w", row, err)
+		}
+		get := func(field string) string {
+			if i, ok := index[field]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		if strings.Join(record, "") == "" {
+			continue
+		}
+
+		line := Line{
+			Row:           row,
+			TraceNumber:   get("trace_number"),
+			Reference:     get("reference"),
+			TransactionID: get("transaction_id"),
+			Status:        get("status"),
+		}
+		if line.Amount, err = parseAmount(get("amount")); err != nil {
+			return nil, fmt.Errorf("row %d: %w", row, err)
+		}
+		if date := get("date"); date != "" {
+			if line.Date, line.dateOnly, err = parseDate(date); err != nil {
+				return nil, fmt.Errorf("row %d: %w", row, err)
+			}
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return nil, ErrEmptyStatement
+	}
+	return lines, nil
+}
+
+// Period is the time range the lines cover, zero if they carry no dates
+func Period(lines []Line) (from, to time.Time) {
+	for _, l := range lines {
+		if l.Date.IsZero() {
+			continue
+		}
+		end := l.Date
+		if l.dateOnly {
+			end = end.Add(24*time.Hour - time.Nanosecond)
+		}
+		if from.IsZero() || l.Date.Before(from) {
+			from = l.Date
+		}
+		if end.After(to) {
+			to = end
+		}
+	}
+	return from, to
+}
+
+// parseAmount reads a whole amount such as "1,500" or "1500.00". Debits may
+// be negative; only the size of the amount is compared.
+func parseAmount(s string) (int, error) {
+	v, err := strconv.ParseFloat(strings.ReplaceAll(s, ",", ""), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	v = math.Abs(v)
+	if v != math.Trunc(v) {
+		return 0, fmt.Errorf("amount %q is not a whole number", s)
+	}
+	return int(v), nil
+}
+
+func parseDate(s string) (time.Time, bool, error) {
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, false, nil
+		}
+	}
+	for _, layout := range dayLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true, nil
+		}
+	}
+	return time.Time{}, false, fmt.Errorf("invalid date %q", s)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"kacha-psp/reconcile"
+	"kacha-psp/store"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type reconcileNoteRequest struct {
+	Author string `json:"author"`
+	Note   string `json:"note"`
+}
+
+// handleImportStatement reconciles an uploaded settlement file, sent as the
+// "file" field of a form or as the raw CSV body
+func (s *server) handleImportStatement(c *gin.Context) {
+	var body io.Reader = c.Request.Body
+	fileName := c.Query("file_name")
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		fh, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		f, err := fh.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		defer f.Close()
+		body, fileName = f, fh.Filename
+	}
+
+	lines, err := reconcile.ParseStatement(body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	from, to := reconcile.Period(lines)
+	for param, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := c.Query(param); v != "" {
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + param + ": " + err.Error()})
+				return
+			}
+		}
+	}
+	if from.IsZero() != to.IsZero() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from and to must be given together"})
+		return
+	}
+
+	providerName := c.DefaultQuery("provider", "kacha")
+	var txs []*store.Transaction
+	for _, tx := range s.txs.List(store.Filter{}) {
+		if tx.Provider == providerName {
+			txs = append(txs, tx)
+		}
+	}
+	report := s.recon.Create(&reconcile.Report{
+		Provider:   providerName,
+		FileName:   fileName,
+		From:       from,
+		To:         to,
+		Lines:      len(lines),
+		Items:      reconcile.Match(lines, txs, from, to),
+		ImportedBy: c.Query("imported_by"),
+	}, time.Now())
+	c.JSON(http.StatusCreated, report)
+}
+
+func (s *server) handleListReconciliations(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"reconciliations": s.recon.List()})
+}
+
+// handleGetReconciliation returns a report, its items filtered by class and
+// status, as JSON or as CSV with format=csv
+func (s *server) handleGetReconciliation(c *gin.Context) {
+	report, err := s.recon.Get(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	class, status := reconcile.Class(c.Query("class")), reconcile.ItemStatus(c.Query("status"))
+	items := []*reconcile.Item{}
+	for _, item := range report.Items {
+		if (class == "" || item.Class == class) && (status == "" || item.Status == status) {
+			items = append(items, item)
+		}
+	}
+	report.Items = items
+
+	if c.Query("format") == "csv" {
+		c.Header("Content-Type", "text/csv")
+		c.Header("Content-Disposition", `attachment; filename="`+report.ID+`.csv"`)
+		c.Status(http.StatusOK)
+		if err := report.WriteCSV(c.Writer); err != nil {
+			c.Error(err)
+		}
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+func (s *server) handleReconciliationNote(c *gin.Context) {
+	s.updateReconciliationItem(c, s.recon.AddNote)
+}
+
+// handleResolveReconciliationItem closes an exception with a note saying how
+// it was dealt with
+func (s *server) handleResolveReconciliationItem(c *gin.Context) {
+	s.updateReconciliationItem(c, s.recon.Resolve)
+}
+
+func (s *server) updateReconciliationItem(c *gin.Context, update func(id, itemID string, note reconcile.Note) (*reconcile.Item, error)) {
+	var req reconcileNoteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Author == "" || req.Note == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "author and note are required"})
+		return
+	}
+
+	item, err := update(c.Param("id"), c.Param("item"), reconcile.Note{Author: req.Author, Text: req.Note, At: time.Now()})
+	if err != nil {
+		status := http.StatusBadRequest
+		switch {
+		case errors.Is(err, reconcile.ErrNotFound), errors.Is(err, reconcile.ErrItemNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, reconcile.ErrResolved), errors.Is(err, reconcile.ErrNotException):
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, item)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"kacha-psp/store"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type refundPaymentRequest struct {
+	// Amount is what to refund; the whole refundable amount if zero
+	Amount      int    `json:"amount,omitempty"`
+	Reason      string `json:"reason"`
+	ShortCode   string `json:"short_code"`
+	InitiatedBy string `json:"initiated_by,omitempty"`
+}
+
+// handleRefundPayment refunds all or part of a successful payment to the payer
+func (s *server) handleRefundPayment(c *gin.Context) {
+	var req refundPaymentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.ShortCode == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "short_code is required"})
+		return
+	}
+	payment, ok := s.merchantPayment(c)
+	if !ok {
+		return
+	}
+	creds, err := s.keyring.Credentials(payment.Merchant)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Reason == "" {
+		req.Reason = "Refund of " + payment.TraceNumber
+	}
+	initiatedBy, err := s.actingOperator(c, payment.Merchant, req.InitiatedBy)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	outcome, err := s.refundPayment(refundRequest{
+		Creds:       creds,
+		Payment:     payment,
+		Amount:      req.Amount,
+		Reason:      req.Reason,
+		ShortCode:   req.ShortCode,
+		InitiatedBy: initiatedBy,
+	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if outcome.Approval != nil {
+		c.JSON(http.StatusAccepted, gin.H{
+			"status":         store.StatusAwaitingApproval,
+			"transaction_id": outcome.Tx.ID,
+			"approval":       outcome.Approval,
+		})
+		return
+	}
+	c.JSON(http.StatusCreated, outcome.Tx)
+}
+
+// handleListRefunds shows a payment's refunds and what is left to refund
+func (s *server) handleListRefunds(c *gin.Context) {
+	payment, ok := s.merchantPayment(c)
+	if !ok {
+		return
+	}
+	refunded, left := s.refundedAmount(payment.ID), 0
+	if refundable(payment) {
+		left = max(payment.Amount-refunded, 0)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"payment":    payment,
+		"refunded":   refunded,
+		"refundable": left,
+		"refunds":    s.paymentRefunds(payment.ID),
+	})
+}
+
+func (s *server) handleAdminListRefunds(c *gin.Context) {
+	refunds := []*store.Transaction{}
+	for _, tx := range s.txs.List(store.Filter{Merchant: c.Query("merchant"), Type: store.TypeTransfer}) {
+		if tx.Source == sourceRefund {
+			refunds = append(refunds, tx)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"refunds": refunds})
+}
+
+// merchantPayment finds the payment named by the trace_number parameter,
+// responding 404 if it is not the merchant's
+func (s *server) merchantPayment(c *gin.Context) (*store.Transaction, bool) {
+	tx, err := s.txs.FindByTraceNumber(c.Param("trace_number"))
+	if err != nil || tx.Merchant != c.GetString("merchant") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "payment not found"})
+		return nil, false
+	}
+	return tx, true
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	kacha "kacha-psp/kacha"
+	"kacha-psp/provider"
+	"kacha-psp/routing"
+	"kacha-psp/store"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sourceRefund marks B2C transfers that refund a C2B payment, named by SourceID
+const sourceRefund = "REFUND"
+
+// refundLocks keeps refunds of the same payment from racing past its amount
+// while their transfers are being submitted
+type refundLocks struct {
+	mu       sync.Mutex
+	inFlight map[string]int
+}
+
+// refundRequest is a refund of amount (the rest if zero) of a payment
+type refundRequest struct {
+	Creds       provider.Credentials
+	Payment     *store.Transaction
+	Amount      int
+	Reason      string
+	ShortCode   string
+	InitiatedBy string
+	// TransactionID is the ID to record the refund transfer under, if set
+	TransactionID string
+}
+
+// refundPayment sends money from a successful C2B payment back to the payer's
+// phone as a B2C transfer through the provider that took the payment
+func (s *server) refundPayment(req refundRequest) (*transferOutcome, error) {
+	payment := req.Payment
+	if payment.Type != store.TypeOTPPayment && payment.Type != store.TypePushUSSD {
+		return nil, newAPIError(http.StatusBadRequest, "only C2B payments can be refunded", nil)
+	}
+	if !refundable(payment) {
+		return nil, newAPIError(http.StatusConflict, "only successful payments can be refunded", nil)
+	}
+
+	amount, err := s.holdRefund(payment, req.Amount)
+	if err != nil {
+		return nil, err
+	}
+	defer s.releaseRefund(payment.ID, amount)
+
+	p, err := s.provider(payment.Provider, req.Creds)
+	if err != nil {
+		return nil, err
+	}
+	return s.submitTransfer(transferSubmission{
+		Request: kacha.TransferRequest{
+			Username:  req.Creds.Username,
+			Password:  req.Creds.Password,
+			To:        payment.Phone,
+			Amount:    amount,
+			Reason:    req.Reason,
+			ShortCode: req.ShortCode,
+		},
+		Provider:    p,
+		Decision:    routing.Decision{Provider: p.Name(), Reason: "refund via payment provider"},
+		Tx:          &store.Transaction{ID: req.TransactionID, Source: sourceRefund, SourceID: payment.ID},
+		InitiatedBy: req.InitiatedBy,
+	})
+}
+
+// holdRefund checks a refund against what is left of the payment and holds
+// it until its transfer is recorded
+func (s *server) holdRefund(payment *store.Transaction, amount int) (int, error) {
+	s.refunds.mu.Lock()
+	defer s.refunds.mu.Unlock()
+
+	left := payment.Amount - s.refundedAmount(payment.ID) - s.refunds.inFlight[payment.ID]
+	if amount == 0 {
+		amount = left
+	}
+	switch {
+	case left <= 0:
+		return 0, newAPIError(http.StatusConflict, "payment is already fully refunded", nil)
+	case amount < 0 || amount > left:
+		return 0, newAPIError(http.StatusUnprocessableEntity, fmt.Sprintf("at most %d can be refunded", left),
+			gin.H{"refundable": left})
+	}
+	s.refunds.inFlight[payment.ID] += amount
+	return amount, nil
+}
+
+func (s *server) releaseRefund(paymentID string, amount int) {
+	s.refunds.mu.Lock()
+	defer s.refunds.mu.Unlock()
+
+	s.refunds.inFlight[paymentID] -= amount
+	if s.refunds.inFlight[paymentID] <= 0 {
+		delete(s.refunds.inFlight, paymentID)
+	}
+}
+
+// refundable reports whether the payer was charged, even if only after the
+// gateway had given up on the payment
+func refundable(payment *store.Transaction) bool {
+	return payment.Status == store.StatusSuccess || payment.LateStatus == store.StatusSuccess
+}
+
+// refundedAmount is what has been or is being refunded of a payment.
+// Refunds that failed or were rejected do not count.
+func (s *server) refundedAmount(paymentID string) int {
+	total := 0
+	for _, tx := range s.paymentRefunds(paymentID) {
+		switch tx.Status {
+		case store.StatusPending, store.StatusAwaitingApproval, store.StatusSuccess:
+			total += tx.Amount
+		}
+	}
+	return total
+}
+
+// paymentRefunds lists the refund transfers of a payment, newest first
+func (s *server) paymentRefunds(paymentID string) []*store.Transaction {
+	refunds := []*store.Transaction{}
+	for _, tx := range s.txs.List(store.Filter{Type: store.TypeTransfer}) {
+		if tx.Source == sourceRefund && tx.SourceID == paymentID {
+			refunds = append(refunds, tx)
+		}
+	}
+	return refunds
+}
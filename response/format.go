@@ -0,0 +1,96 @@
+package response
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"kacha-psp/store"
+)
+
+// Format is the shape of the provider responses a merchant gets back
+type Format string
+
+const (
+	// FormatRaw returns Kacha's response as it came
+	FormatRaw Format = "RAW"
+	// FormatPSP returns the signed PSP envelope (kacha.PSPResponse)
+	FormatPSP Format = "PSP"
+)
+
+func (f Format) Valid() bool {
+	return f == FormatRaw || f == FormatPSP
+}
+
+// Store keeps the format each merchant chose. Merchants without one get each
+// endpoint's own format.
+type Store struct {
+	path string
+
+	mu      sync.Mutex
+	formats map[string]Format
+}
+
+func NewStore(path string) (*Store, error) {
+	s := &Store{
+		path:    path,
+		formats: make(map[string]Format),
+	}
+	if path == "" {
+		return s, nil
+	}
+	if err := store.LoadJSON(path, &s.formats); err != nil {
+		return nil, err
+	}
+	if s.formats == nil {
+		s.formats = make(map[string]Format)
+	}
+	return s, nil
+}
+
+// Get returns the merchant's format, or def if they have not chosen one
+func (s *Store) Get(merchant string, def Format) Format {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.formats[merchant]; ok {
+		return f
+	}
+	return def
+}
+
+// Set chooses the merchant's format; an empty format clears the choice
+func (s *Store) Set(merchant string, f Format) error {
+	if f != "" && !f.Valid() {
+		return fmt.Errorf("format must be %s or %s", FormatRaw, FormatPSP)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f == "" {
+		delete(s.formats, merchant)
+	} else {
+		s.formats[merchant] = f
+	}
+	s.persist()
+	return nil
+}
+
+// All returns the formats merchants chose
+func (s *Store) All() map[string]Format {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]Format, len(s.formats))
+	for k, v := range s.formats {
+		out[k] = v
+	}
+	return out
+}
+
+// persist mirrors the store to disk; caller holds s.mu
+func (s *Store) persist() {
+	if s.path == "" {
+		return
+	}
+	if err := store.SaveJSON(s.path, s.formats); err != nil {
+		log.Printf("[Response] failed to persist formats: %v", err)
+	}
+}
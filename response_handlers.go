@@ -0,0 +1,54 @@
+package main
+
+import (
+	"kacha-psp/response"
+	"kacha-psp/store"
+	"kacha-psp/utils"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type responseFormatRequest struct {
+	// Format is RAW or PSP; empty goes back to each endpoint's own format
+	Format response.Format `json:"format"`
+}
+
+// providerResponse shapes a provider response in the format the merchant
+// chose: as Kacha sent it, or in the signed PSP envelope. def is the
+// endpoint's format for merchants that have not chosen one.
+func (s *server) providerResponse(merchant string, def response.Format, resp any, success bool, tx *store.Transaction) any {
+	if s.formats.Get(merchant, def) == response.FormatRaw {
+		return resp
+	}
+	return s.withFee(utils.MapToPSP(resp, success), tx)
+}
+
+func (s *server) handleGetResponseFormat(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"format": s.formats.Get(c.GetString("merchant"), "")})
+}
+
+func (s *server) handlePutResponseFormat(c *gin.Context) {
+	s.setResponseFormat(c, c.GetString("merchant"))
+}
+
+func (s *server) handleAdminListResponseFormats(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"formats": s.formats.All()})
+}
+
+func (s *server) handleAdminPutResponseFormat(c *gin.Context) {
+	s.setResponseFormat(c, c.Param("merchant"))
+}
+
+func (s *server) setResponseFormat(c *gin.Context, merchant string) {
+	var req responseFormatRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := s.formats.Set(merchant, req.Format); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"merchant": merchant, "format": req.Format})
+}
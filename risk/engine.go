@@ -0,0 +1,300 @@
+package risk
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"kacha-psp/store"
+)
+
+// DefaultLookback is how far back NEW_BENEFICIARY_AMOUNT looks for a known phone
+const DefaultLookback = 90 * 24 * time.Hour
+
+// Transaction is the money movement being evaluated, or one from history
+type Transaction struct {
+	Merchant  string
+	Operation string
+	Phone     string
+	Amount    int
+	Success   bool
+	At        time.Time
+}
+
+// History supplies a merchant's recent transactions
+type History interface {
+	Recent(merchant string, since time.Time) []Transaction
+}
+
+type Decision struct {
+	Action  Action   `json:"action"`
+	Rules   []string `json:"rules,omitempty"`
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// Engine evaluates risk rules loaded from a JSON file. The file is watched
+// and reloaded when it changes, so rules can be edited without a restart.
+type Engine struct {
+	history  History
+	location *time.Location
+	path     string
+
+	mu      sync.RWMutex
+	rules   []Rule
+	modTime time.Time
+}
+
+func NewEngine(history History, location *time.Location, path string) (*Engine, error) {
+	e := &Engine{
+		history:  history,
+		location: location,
+		path:     path,
+	}
+	if path != "" {
+		if err := e.Reload(); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+func (e *Engine) Rules() []Rule {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return append([]Rule(nil), e.rules...)
+}
+
+// SetRules validates and replaces the rules, writing them to the rules file
+func (e *Engine) SetRules(rules []Rule) error {
+	if err := validateRules(rules); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.path != "" {
+		if err := store.SaveJSON(e.path, rules); err != nil {
+			return err
+		}
+		if info, err := os.Stat(e.path); err == nil {
+			e.modTime = info.ModTime()
+		}
+	}
+	e.rules = append([]Rule(nil), rules...)
+	return nil
+}
+
+// Reload reads the rules file. Invalid files are rejected and the current
+// rules stay in effect.
+func (e *Engine) Reload() error {
+	var modTime time.Time
+	if info, err := os.Stat(e.path); err == nil {
+		modTime = info.ModTime()
+	}
+
+	var rules []Rule
+	if err := store.LoadJSON(e.path, &rules); err != nil {
+		return err
+	}
+	if err := validateRules(rules); err != nil {
+		return fmt.Errorf("%s: %w", e.path, err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rules = rules
+	e.modTime = modTime
+	return nil
+}
+
+// Watch reloads the rules file whenever its modification time changes
+func (e *Engine) Watch(interval time.Duration, stop <-chan struct{}) {
+	if e.path == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			info, err := os.Stat(e.path)
+			if err != nil {
+				continue
+			}
+			e.mu.RLock()
+			changed := !info.ModTime().Equal(e.modTime)
+			e.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := e.Reload(); err != nil {
+				log.Printf("[Risk] failed to reload rules: %v", err)
+				continue
+			}
+			log.Printf("[Risk] reloaded %d rules from %s", len(e.Rules()), e.path)
+		}
+	}
+}
+
+// Evaluate runs every applicable rule against tx and returns the most severe action
+func (e *Engine) Evaluate(tx Transaction) Decision {
+	if tx.At.IsZero() {
+		tx.At = time.Now()
+	}
+	rules := e.Rules()
+
+	var since time.Time
+	for _, r := range rules {
+		if !r.appliesTo(tx) {
+			continue
+		}
+		from := tx.At.Add(-r.Window.Duration)
+		if r.Type == NewBeneficiaryAmount {
+			from = tx.At.Add(-lookback(r))
+		}
+		if since.IsZero() || from.Before(since) {
+			since = from
+		}
+	}
+
+	decision := Decision{Action: Allow}
+	if since.IsZero() {
+		return decision
+	}
+	history := e.history.Recent(tx.Merchant, since)
+
+	for _, r := range rules {
+		if !r.appliesTo(tx) {
+			continue
+		}
+		reason, hit := e.check(r, tx, history)
+		if !hit {
+			continue
+		}
+		decision.Rules = append(decision.Rules, r.ID)
+		decision.Reasons = append(decision.Reasons, fmt.Sprintf("%s: %s", r.ID, reason))
+		if r.Action.severity() > decision.Action.severity() {
+			decision.Action = r.Action
+		}
+	}
+	return decision
+}
+
+func (e *Engine) check(r Rule, tx Transaction, history []Transaction) (string, bool) {
+	inWindow := func(h Transaction) bool {
+		return !h.At.Before(tx.At.Add(-r.Window.Duration)) &&
+			(len(r.Operations) == 0 || contains(r.Operations, h.Operation))
+	}
+
+	switch r.Type {
+	case AmountAbove:
+		if tx.Amount >= r.MinAmount {
+			return fmt.Sprintf("amount %d is at least %d", tx.Amount, r.MinAmount), true
+		}
+
+	case RepeatedSmallPayments:
+		if tx.Amount > r.MaxAmount {
+			return "", false
+		}
+		count := 1
+		for _, h := range history {
+			if inWindow(h) && h.Phone == tx.Phone && h.Amount <= r.MaxAmount {
+				count++
+			}
+		}
+		if count >= r.Count {
+			return fmt.Sprintf("%d payments of at most %d to %s within %s", count, r.MaxAmount, tx.Phone, r.Window), true
+		}
+
+	case DistinctRecipients:
+		phones := map[string]bool{tx.Phone: true}
+		for _, h := range history {
+			if inWindow(h) && h.Phone != "" {
+				phones[h.Phone] = true
+			}
+		}
+		if len(phones) >= r.Count {
+			return fmt.Sprintf("%d distinct recipients within %s", len(phones), r.Window), true
+		}
+
+	case NewBeneficiaryAmount:
+		if tx.Amount < r.MinAmount {
+			return "", false
+		}
+		from := tx.At.Add(-lookback(r))
+		for _, h := range history {
+			if h.Success && h.Phone == tx.Phone && !h.At.Before(from) {
+				return "", false
+			}
+		}
+		return fmt.Sprintf("amount %d to new beneficiary %s", tx.Amount, tx.Phone), true
+
+	case OffHoursBurst:
+		if !r.TimeWindow.Contains(tx.At.In(e.location)) {
+			return "", false
+		}
+		count := 1
+		for _, h := range history {
+			if inWindow(h) && r.TimeWindow.Contains(h.At.In(e.location)) {
+				count++
+			}
+		}
+		if count >= r.Count {
+			return fmt.Sprintf("%d transactions within %s between %s and %s", count, r.Window, r.TimeWindow.From, r.TimeWindow.To), true
+		}
+	}
+	return "", false
+}
+
+func lookback(r Rule) time.Duration {
+	if r.Lookback.Duration > 0 {
+		return r.Lookback.Duration
+	}
+	return DefaultLookback
+}
+
+func validateRules(rules []Rule) error {
+	seen := make(map[string]bool)
+	for _, r := range rules {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+		if seen[r.ID] {
+			return fmt.Errorf("duplicate rule id %s", r.ID)
+		}
+		seen[r.ID] = true
+	}
+	return nil
+}
+
+type storeHistory struct {
+	txs *store.TransactionStore
+}
+
+// StoreHistory reads history from the gateway's transaction store
+func StoreHistory(txs *store.TransactionStore) History {
+	return storeHistory{txs: txs}
+}
+
+func (h storeHistory) Recent(merchant string, since time.Time) []Transaction {
+	var out []Transaction
+	for _, tx := range h.txs.List(store.Filter{Merchant: merchant, Since: since}) {
+		if tx.Status == store.StatusBlocked {
+			continue
+		}
+		out = append(out, Transaction{
+			Merchant:  tx.Merchant,
+			Operation: string(tx.Type),
+			Phone:     tx.Phone,
+			Amount:    tx.Amount,
+			Success:   tx.Status == store.StatusSuccess,
+			At:        tx.CreatedAt,
+		})
+	}
+	return out
+}
@@ -0,0 +1,227 @@
+package risk
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"kacha-psp/routing"
+	"kacha-psp/store"
+)
+
+var at = time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+
+// history is a fixed list of a merchant's past transactions
+type history []Transaction
+
+func (h history) Recent(merchant string, since time.Time) []Transaction {
+	var out []Transaction
+	for _, tx := range h {
+		if tx.Merchant == merchant && !tx.At.Before(since) {
+			out = append(out, tx)
+		}
+	}
+	return out
+}
+
+func transfer(phone string, amount int, ago time.Duration) Transaction {
+	return Transaction{Merchant: "m1", Operation: string(store.TypeTransfer), Phone: phone, Amount: amount, Success: true, At: at.Add(-ago)}
+}
+
+func minutes(n int) Duration {
+	return Duration{time.Duration(n) * time.Minute}
+}
+
+func TestEvaluate(t *testing.T) {
+	past := history{
+		transfer("0911000001", 50, 5*time.Minute),
+		transfer("0911000001", 40, 10*time.Minute),
+		transfer("0911000002", 500, 20*time.Minute),
+		// outside every window but within the new beneficiary lookback
+		transfer("0911000003", 100, 48*time.Hour),
+		// other merchants do not count
+		{Merchant: "m2", Operation: string(store.TypeTransfer), Phone: "0911000004", Amount: 10, At: at.Add(-time.Minute)},
+	}
+	failed := transfer("0911000005", 100, time.Hour)
+	failed.Success = false
+	past = append(past, failed)
+
+	tests := []struct {
+		name string
+		rule Rule
+		tx   Transaction
+		hit  bool
+	}{
+		{"amount above", Rule{Type: AmountAbove, MinAmount: 1000}, transfer("0911000009", 1000, 0), true},
+		{"amount below", Rule{Type: AmountAbove, MinAmount: 1000}, transfer("0911000009", 999, 0), false},
+
+		// two earlier small payments to the phone plus this one
+		{"repeated small payments", Rule{Type: RepeatedSmallPayments, MaxAmount: 50, Count: 3, Window: minutes(15)}, transfer("0911000001", 30, 0), true},
+		{"repeated payments outside the window", Rule{Type: RepeatedSmallPayments, MaxAmount: 50, Count: 3, Window: minutes(7)}, transfer("0911000001", 30, 0), false},
+		{"repeated payment too large", Rule{Type: RepeatedSmallPayments, MaxAmount: 50, Count: 3, Window: minutes(15)}, transfer("0911000001", 51, 0), false},
+
+		// 0911000001, 0911000002 and a new phone
+		{"distinct recipients", Rule{Type: DistinctRecipients, Count: 3, Window: minutes(30)}, transfer("0911000009", 10, 0), true},
+		{"distinct recipients include known phones once", Rule{Type: DistinctRecipients, Count: 3, Window: minutes(30)}, transfer("0911000001", 10, 0), false},
+
+		{"new beneficiary", Rule{Type: NewBeneficiaryAmount, MinAmount: 100}, transfer("0911000009", 100, 0), true},
+		{"known beneficiary", Rule{Type: NewBeneficiaryAmount, MinAmount: 100}, transfer("0911000003", 100, 0), false},
+		{"beneficiary known before the lookback", Rule{Type: NewBeneficiaryAmount, MinAmount: 100, Lookback: minutes(60)}, transfer("0911000003", 100, 0), true},
+		{"beneficiary only failed before", Rule{Type: NewBeneficiaryAmount, MinAmount: 100}, transfer("0911000005", 100, 0), true},
+		{"new beneficiary small amount", Rule{Type: NewBeneficiaryAmount, MinAmount: 100}, transfer("0911000009", 99, 0), false},
+
+		{"off hours burst", Rule{Type: OffHoursBurst, Count: 4, Window: minutes(30), TimeWindow: &routing.TimeWindow{From: "11:00", To: "13:00"}}, transfer("0911000009", 10, 0), true},
+		{"off hours burst outside hours", Rule{Type: OffHoursBurst, Count: 1, Window: minutes(30), TimeWindow: &routing.TimeWindow{From: "22:00", To: "06:00"}}, transfer("0911000009", 10, 0), false},
+
+		{"other operation", Rule{Type: AmountAbove, MinAmount: 1, Operations: []string{string(store.TypePushUSSD)}}, transfer("0911000009", 10, 0), false},
+		{"other merchant", Rule{Type: AmountAbove, MinAmount: 1, Merchants: []string{"m2"}}, transfer("0911000009", 10, 0), false},
+		{"disabled", Rule{Type: AmountAbove, MinAmount: 1, Disabled: true}, transfer("0911000009", 10, 0), false},
+	}
+	for _, tt := range tests {
+		tt.rule.ID, tt.rule.Action = "rule", Review
+		e, err := NewEngine(past, time.UTC, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := e.SetRules([]Rule{tt.rule}); err != nil {
+			t.Fatalf("%s: SetRules: %v", tt.name, err)
+		}
+		d := e.Evaluate(tt.tx)
+		if hit := d.Action == Review; hit != tt.hit {
+			t.Errorf("%s: Evaluate = %+v, want hit %v", tt.name, d, tt.hit)
+		}
+	}
+}
+
+func TestEvaluateMostSevere(t *testing.T) {
+	e, err := NewEngine(history{}, time.UTC, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.SetRules([]Rule{
+		{ID: "review-large", Type: AmountAbove, Action: Review, MinAmount: 100},
+		{ID: "block-huge", Type: AmountAbove, Action: Block, MinAmount: 1000},
+		{ID: "review-new", Type: NewBeneficiaryAmount, Action: Review, MinAmount: 100},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := e.Evaluate(transfer("0911000009", 5000, 0))
+	if d.Action != Block || !reflect.DeepEqual(d.Rules, []string{"review-large", "block-huge", "review-new"}) {
+		t.Errorf("Evaluate = %+v, want BLOCK by every rule", d)
+	}
+	if d := e.Evaluate(transfer("0911000009", 500, 0)); d.Action != Review || len(d.Reasons) != 2 {
+		t.Errorf("Evaluate = %+v, want REVIEW with two reasons", d)
+	}
+	if d := e.Evaluate(transfer("0911000009", 50, 0)); d.Action != Allow || len(d.Rules) != 0 {
+		t.Errorf("Evaluate = %+v, want ALLOW", d)
+	}
+}
+
+func TestValidateRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+	}{
+		{"no id", Rule{Type: AmountAbove, Action: Block, MinAmount: 1}},
+		{"allow action", Rule{ID: "a", Type: AmountAbove, Action: Allow, MinAmount: 1}},
+		{"unknown type", Rule{ID: "a", Type: "VELOCITY", Action: Block}},
+		{"amount without min", Rule{ID: "a", Type: AmountAbove, Action: Block}},
+		{"repeated without max", Rule{ID: "a", Type: RepeatedSmallPayments, Action: Block, Count: 2, Window: minutes(5)}},
+		{"distinct without window", Rule{ID: "a", Type: DistinctRecipients, Action: Block, Count: 2}},
+		{"burst without hours", Rule{ID: "a", Type: OffHoursBurst, Action: Block, Count: 2, Window: minutes(5)}},
+		{"burst with bad hours", Rule{ID: "a", Type: OffHoursBurst, Action: Block, Count: 2, Window: minutes(5),
+			TimeWindow: &routing.TimeWindow{From: "9", To: "17:00"}}},
+	}
+	for _, tt := range tests {
+		if err := tt.rule.Validate(); err == nil {
+			t.Errorf("%s: Validate = nil, want an error", tt.name)
+		}
+	}
+}
+
+func writeRules(t *testing.T, path, rules string, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// file systems with coarse timestamps would otherwise hide the change
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor polls until the engine's rules have the ids, or fails after a while
+func waitFor(t *testing.T, e *Engine, ids ...string) {
+	t.Helper()
+	var got []string
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		got = nil
+		for _, r := range e.Rules() {
+			got = append(got, r.ID)
+		}
+		if reflect.DeepEqual(got, ids) {
+			return
+		}
+	}
+	t.Fatalf("rules = %v, want %v", got, ids)
+}
+
+func TestWatchReloads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "risk_rules.json")
+	start := time.Now().Add(-time.Hour)
+	writeRules(t, path, `[{"id": "large", "type": "AMOUNT_ABOVE", "action": "REVIEW", "min_amount": 1000}]`, start)
+
+	e, err := NewEngine(history{}, time.UTC, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go e.Watch(time.Millisecond, stop)
+
+	writeRules(t, path, `[{"id": "huge", "type": "AMOUNT_ABOVE", "action": "BLOCK", "min_amount": 5000}]`, start.Add(time.Minute))
+	waitFor(t, e, "huge")
+
+	bad := []string{
+		`[{"id": "huge", "type": "AMOUNT_ABOVE"`,
+		`[{"id": "huge", "type": "AMOUNT_ABOVE", "action": "BLOCK"}]`,
+		`[{"id": "a", "type": "AMOUNT_ABOVE", "action": "BLOCK", "min_amount": 1}, {"id": "a", "type": "AMOUNT_ABOVE", "action": "BLOCK", "min_amount": 2}]`,
+	}
+	for i, rules := range bad {
+		writeRules(t, path, rules, start.Add(time.Duration(i+2)*time.Minute))
+		// give the watcher time to see the file
+		time.Sleep(20 * time.Millisecond)
+		waitFor(t, e, "huge")
+		if d := e.Evaluate(transfer("0911000009", 5000, 0)); d.Action != Block {
+			t.Errorf("Evaluate after bad file %d = %+v, want the previous rules to BLOCK", i, d)
+		}
+		if err := e.Reload(); err == nil {
+			t.Errorf("Reload of bad file %d = nil, want an error", i)
+		}
+	}
+
+	// a fixed file is picked up again
+	writeRules(t, path, `[]`, start.Add(time.Hour))
+	waitFor(t, e)
+}
+
+func TestSetRulesWritesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "risk_rules.json")
+	e, err := NewEngine(history{}, time.UTC, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetRules([]Rule{{ID: "large", Type: AmountAbove, Action: Review, MinAmount: 1000}}); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := NewEngine(history{}, time.UTC, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, restarted, "large")
+}
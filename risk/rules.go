@@ -0,0 +1,155 @@
+package risk
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"kacha-psp/routing"
+)
+
+type Action string
+
+const (
+	Allow  Action = "ALLOW"
+	Review Action = "REVIEW"
+	Block  Action = "BLOCK"
+)
+
+func (a Action) severity() int {
+	switch a {
+	case Block:
+		return 2
+	case Review:
+		return 1
+	}
+	return 0
+}
+
+type RuleType string
+
+const (
+	// AmountAbove triggers on amounts of at least MinAmount
+	AmountAbove RuleType = "AMOUNT_ABOVE"
+	// RepeatedSmallPayments triggers when Count payments of at most MaxAmount
+	// go to the same phone within Window
+	RepeatedSmallPayments RuleType = "REPEATED_SMALL_PAYMENTS"
+	// DistinctRecipients triggers when a merchant reaches Count distinct
+	// phones within Window
+	DistinctRecipients RuleType = "DISTINCT_RECIPIENTS"
+	// NewBeneficiaryAmount triggers on amounts of at least MinAmount to a phone
+	// the merchant has not successfully transacted with within Lookback
+	NewBeneficiaryAmount RuleType = "NEW_BENEFICIARY_AMOUNT"
+	// OffHoursBurst triggers when a merchant reaches Count transactions within
+	// Window while inside TimeWindow
+	OffHoursBurst RuleType = "OFF_HOURS_BURST"
+)
+
+// Rule is a declarative risk check. Counts include the transaction being
+// evaluated.
+type Rule struct {
+	ID         string   `json:"id"`
+	Type       RuleType `json:"type"`
+	Action     Action   `json:"action"`
+	Disabled   bool     `json:"disabled,omitempty"`
+	Operations []string `json:"operations,omitempty"`
+	Merchants  []string `json:"merchants,omitempty"`
+
+	MinAmount  int                 `json:"min_amount,omitempty"`
+	MaxAmount  int                 `json:"max_amount,omitempty"`
+	Count      int                 `json:"count,omitempty"`
+	Window     Duration            `json:"window,omitempty"`
+	Lookback   Duration            `json:"lookback,omitempty"`
+	TimeWindow *routing.TimeWindow `json:"time_window,omitempty"`
+}
+
+func (r Rule) Validate() error {
+	if r.ID == "" {
+		return fmt.Errorf("rule id is required")
+	}
+	if r.Action != Review && r.Action != Block {
+		return fmt.Errorf("rule %s: action must be REVIEW or BLOCK", r.ID)
+	}
+
+	needCount := func() error {
+		if r.Count <= 0 || r.Window.Duration <= 0 {
+			return fmt.Errorf("rule %s: %s needs count and window", r.ID, r.Type)
+		}
+		return nil
+	}
+	switch r.Type {
+	case AmountAbove, NewBeneficiaryAmount:
+		if r.MinAmount <= 0 {
+			return fmt.Errorf("rule %s: %s needs min_amount", r.ID, r.Type)
+		}
+	case RepeatedSmallPayments:
+		if r.MaxAmount <= 0 {
+			return fmt.Errorf("rule %s: %s needs max_amount", r.ID, r.Type)
+		}
+		return needCount()
+	case DistinctRecipients:
+		return needCount()
+	case OffHoursBurst:
+		if r.TimeWindow == nil {
+			return fmt.Errorf("rule %s: %s needs time_window", r.ID, r.Type)
+		}
+		if err := r.TimeWindow.Validate(); err != nil {
+			return fmt.Errorf("rule %s: %w", r.ID, err)
+		}
+		return needCount()
+	default:
+		return fmt.Errorf("rule %s: unknown type %q", r.ID, r.Type)
+	}
+	return nil
+}
+
+func (r Rule) appliesTo(tx Transaction) bool {
+	if r.Disabled {
+		return false
+	}
+	if len(r.Operations) > 0 && !contains(r.Operations, tx.Operation) {
+		return false
+	}
+	if len(r.Merchants) > 0 && !contains(r.Merchants, tx.Merchant) {
+		return false
+	}
+	return true
+}
+
+// Duration is a time.Duration written as a string such as "30m" in JSON
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	if d.Duration == 0 {
+		return []byte(`""`), nil
+	}
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30m\": %w", err)
+	}
+	if s == "" {
+		d.Duration = 0
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func contains(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
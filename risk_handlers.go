@@ -0,0 +1,50 @@
+package main
+
+import (
+	"kacha-psp/risk"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type riskEvaluateRequest struct {
+	Merchant  string    `json:"merchant"`
+	Operation string    `json:"operation"`
+	Phone     string    `json:"phone"`
+	Amount    int       `json:"amount"`
+	At        time.Time `json:"at"`
+}
+
+func (s *server) handleGetRiskRules(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"rules": s.risk.Rules()})
+}
+
+func (s *server) handlePutRiskRules(c *gin.Context) {
+	var rules []risk.Rule
+	if err := c.ShouldBindJSON(&rules); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := s.risk.SetRules(rules); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"rules": s.risk.Rules()})
+}
+
+// handleRiskEvaluate runs the active rules against a sample transaction without recording it
+func (s *server) handleRiskEvaluate(c *gin.Context) {
+	var req riskEvaluateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, s.risk.Evaluate(risk.Transaction{
+		Merchant:  req.Merchant,
+		Operation: req.Operation,
+		Phone:     req.Phone,
+		Amount:    req.Amount,
+		At:        req.At,
+	}))
+}
@@ -0,0 +1,203 @@
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"kacha-psp/store"
+)
+
+var ErrNoProvider = errors.New("no payment provider available")
+
+// Request describes a transaction to route
+type Request struct {
+	Operation string    `json:"operation"`
+	Merchant  string    `json:"merchant"`
+	Phone     string    `json:"phone"`
+	Amount    int       `json:"amount"`
+	At        time.Time `json:"at"`
+}
+
+// Decision is the outcome of routing one transaction
+type Decision struct {
+	Provider string   `json:"provider"`
+	RuleID   string   `json:"rule_id,omitempty"`
+	Fallback bool     `json:"fallback"`
+	Reason   string   `json:"reason"`
+	Skipped  []string `json:"skipped,omitempty"`
+}
+
+type Engine struct {
+	defaults []string
+	location *time.Location
+	health   *Health
+	path     string
+
+	mu    sync.RWMutex
+	rules []Rule
+}
+
+// NewEngine creates an engine whose rules are mirrored to path, if set.
+// Transactions that match no rule go to the first available of defaults.
+func NewEngine(defaults []string, location *time.Location, health *Health, path string) (*Engine, error) {
+	e := &Engine{
+		defaults: defaults,
+		location: location,
+		health:   health,
+		path:     path,
+	}
+	if path == "" {
+		return e, nil
+	}
+
+	var rules []Rule
+	if err := store.LoadJSON(path, &rules); err != nil {
+		return nil, err
+	}
+	if err := validateRules(rules); err != nil {
+		return nil, err
+	}
+	e.rules = sortRules(rules)
+	return e, nil
+}
+
+func (e *Engine) Rules() []Rule {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return append([]Rule(nil), e.rules...)
+}
+
+// SetRules validates and replaces the rule set
+func (e *Engine) SetRules(rules []Rule) error {
+	if err := validateRules(rules); err != nil {
+		return err
+	}
+	rules = sortRules(rules)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.path != "" {
+		if err := store.SaveJSON(e.path, rules); err != nil {
+			return err
+		}
+	}
+	e.rules = rules
+	return nil
+}
+
+// Route picks a provider for req using the current rules
+func (e *Engine) Route(req Request) (Decision, error) {
+	e.mu.RLock()
+	rules := e.rules
+	e.mu.RUnlock()
+	return e.route(rules, req)
+}
+
+// DryRun routes req against rules without changing the engine, so proposed
+// rule sets can be checked before they are applied
+func (e *Engine) DryRun(rules []Rule, req Request) (Decision, error) {
+	if rules == nil {
+		return e.Route(req)
+	}
+	if err := validateRules(rules); err != nil {
+		return Decision{}, err
+	}
+	return e.route(sortRules(rules), req)
+}
+
+func (e *Engine) route(rules []Rule, req Request) (Decision, error) {
+	if req.At.IsZero() {
+		req.At = time.Now()
+	}
+
+	for _, rule := range rules {
+		if !rule.Matches(req, e.location) {
+			continue
+		}
+		return e.pick(rule.ID, rule.Providers, nil)
+	}
+	return e.pick("", e.defaults, nil)
+}
+
+// Failover picks the provider after failed for a transaction routed by the
+// rule ruleID, or by the default route if empty, whose request never reached
+// the providers in failed
+func (e *Engine) Failover(ruleID string, failed []string) (Decision, error) {
+	providers := e.defaults
+	if ruleID != "" {
+		e.mu.RLock()
+		rules := e.rules
+		e.mu.RUnlock()
+		providers = nil
+		for _, rule := range rules {
+			if rule.ID == ruleID {
+				providers = rule.Providers
+				break
+			}
+		}
+	}
+	var rest []string
+	for _, name := range providers {
+		if !slices.Contains(failed, name) {
+			rest = append(rest, name)
+		}
+	}
+	return e.pick(ruleID, rest, failed)
+}
+
+// pick chooses the first available of providers, after the failed ones
+// already tried
+func (e *Engine) pick(ruleID string, providers, failed []string) (Decision, error) {
+	d := Decision{RuleID: ruleID, Skipped: append([]string(nil), failed...)}
+	for i, name := range providers {
+		if e.health != nil && !e.health.Available(name) {
+			d.Skipped = append(d.Skipped, name)
+			continue
+		}
+		d.Provider = name
+		d.Fallback = i > 0 || len(failed) > 0
+		break
+	}
+
+	source := "default provider"
+	if ruleID != "" {
+		source = "rule " + ruleID
+	}
+	if d.Provider == "" {
+		return d, fmt.Errorf("%w: %s: %s unavailable", ErrNoProvider, source, strings.Join(d.Skipped, ", "))
+	}
+
+	d.Reason = source
+	if d.Fallback {
+		d.Reason = fmt.Sprintf("%s, failover to %s (%s unavailable)", source, d.Provider, strings.Join(d.Skipped, ", "))
+		log.Printf("[Routing] %s", d.Reason)
+	}
+	return d, nil
+}
+
+func validateRules(rules []Rule) error {
+	seen := make(map[string]bool)
+	for _, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+		if seen[rule.ID] {
+			return fmt.Errorf("duplicate rule id %s", rule.ID)
+		}
+		seen[rule.ID] = true
+	}
+	return nil
+}
+
+// sortRules orders rules by ascending priority, keeping input order for ties
+func sortRules(rules []Rule) []Rule {
+	out := append([]Rule(nil), rules...)
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Priority < out[j].Priority })
+	return out
+}
@@ -0,0 +1,191 @@
+package routing
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var noon = time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+
+func newEngine(t *testing.T, health *Health, rules ...Rule) *Engine {
+	t.Helper()
+	e, err := NewEngine([]string{"kacha", "backup"}, time.UTC, health, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetRules(rules); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestRoute(t *testing.T) {
+	e := newEngine(t, nil,
+		Rule{ID: "large", Priority: 1, MinAmount: 10000, Providers: []string{"bank"}},
+		Rule{ID: "m1-transfers", Priority: 2, Merchants: []string{"m1"}, Operations: []string{"TRANSFER"}, Providers: []string{"wallet"}},
+		Rule{ID: "safaricom", Priority: 3, PhonePrefixes: []string{"2517", "07"}, MaxAmount: 5000, Providers: []string{"mpesa"}},
+		Rule{ID: "night", Priority: 4, TimeWindow: &TimeWindow{From: "22:00", To: "06:00"}, Providers: []string{"night"}},
+	)
+	tests := []struct {
+		name string
+		req  Request
+		want string
+	}{
+		{"no rule", Request{Operation: "OTP_PAYMENT", Merchant: "m2", Phone: "0911000000", Amount: 100, At: noon}, "kacha"},
+		{"min amount", Request{Operation: "TRANSFER", Merchant: "m1", Amount: 10000, At: noon}, "bank"},
+		{"merchant and operation", Request{Operation: "TRANSFER", Merchant: "m1", Amount: 100, At: noon}, "wallet"},
+		{"merchant without operation", Request{Operation: "PUSH_USSD", Merchant: "m1", Amount: 100, At: noon}, "kacha"},
+		{"phone prefix", Request{Operation: "PUSH_USSD", Phone: "0711000000", Amount: 100, At: noon}, "mpesa"},
+		{"phone prefix over max amount", Request{Operation: "PUSH_USSD", Phone: "0711000000", Amount: 5001, At: noon}, "kacha"},
+		{"window before midnight", Request{Amount: 100, At: noon.Add(11 * time.Hour)}, "night"},
+		{"window after midnight", Request{Amount: 100, At: noon.Add(17 * time.Hour)}, "night"},
+		{"window end is exclusive", Request{Amount: 100, At: noon.Add(18 * time.Hour)}, "kacha"},
+	}
+	for _, tt := range tests {
+		d, err := e.Route(tt.req)
+		if err != nil || d.Provider != tt.want {
+			t.Errorf("%s: Route = %+v, %v, want %s", tt.name, d, err, tt.want)
+		}
+	}
+}
+
+func TestRouteSkipsUnavailable(t *testing.T) {
+	health := NewHealth(2, time.Minute)
+	e := newEngine(t, health, Rule{ID: "m1", Merchants: []string{"m1"}, Providers: []string{"wallet", "bank"}})
+	req := Request{Merchant: "m1", Amount: 100, At: noon}
+
+	// one failure is below the threshold
+	health.ReportFailure("wallet", errors.New("refused"))
+	if d, _ := e.Route(req); d.Provider != "wallet" || d.Fallback {
+		t.Errorf("Route after one failure = %+v, want wallet", d)
+	}
+	health.ReportFailure("wallet", errors.New("refused"))
+	if d, _ := e.Route(req); d.Provider != "bank" || !d.Fallback || d.RuleID != "m1" {
+		t.Errorf("Route with wallet down = %+v, want a fallback to bank", d)
+	}
+
+	health.ReportFailure("bank", nil)
+	health.ReportFailure("bank", nil)
+	if _, err := e.Route(req); !errors.Is(err, ErrNoProvider) {
+		t.Errorf("Route with every provider down = %v, want ErrNoProvider", err)
+	}
+
+	// a success puts a provider straight back into rotation
+	health.ReportSuccess("wallet")
+	if d, _ := e.Route(req); d.Provider != "wallet" {
+		t.Errorf("Route after a success = %+v, want wallet", d)
+	}
+
+	// the default route falls back too
+	health.ReportFailure("kacha", nil)
+	health.ReportFailure("kacha", nil)
+	if d, _ := e.Route(Request{Merchant: "m2", At: noon}); d.Provider != "backup" || !d.Fallback || d.RuleID != "" {
+		t.Errorf("default Route with kacha down = %+v, want a fallback to backup", d)
+	}
+}
+
+func TestHealthCooldown(t *testing.T) {
+	health := NewHealth(1, 20*time.Millisecond)
+	health.ReportFailure("kacha", errors.New("refused"))
+	if health.Available("kacha") {
+		t.Fatal("kacha available right after reaching the threshold")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if !health.Available("kacha") {
+		t.Error("kacha still unavailable after the cooldown")
+	}
+	if !health.Available("unknown") {
+		t.Error("a provider without failures is unavailable")
+	}
+}
+
+func TestFailover(t *testing.T) {
+	e := newEngine(t, nil, Rule{ID: "m1", Merchants: []string{"m1"}, Providers: []string{"wallet", "bank", "kacha"}})
+
+	tests := []struct {
+		name   string
+		ruleID string
+		failed []string
+		want   string
+	}{
+		{"next of the rule", "m1", []string{"wallet"}, "bank"},
+		{"after several", "m1", []string{"wallet", "bank"}, "kacha"},
+		{"default route", "", []string{"kacha"}, "backup"},
+	}
+	for _, tt := range tests {
+		d, err := e.Failover(tt.ruleID, tt.failed)
+		if err != nil || d.Provider != tt.want || !d.Fallback {
+			t.Errorf("%s: Failover = %+v, %v, want a fallback to %s", tt.name, d, err, tt.want)
+		}
+	}
+
+	exhausted := []struct {
+		name   string
+		ruleID string
+		failed []string
+	}{
+		{"rule exhausted", "m1", []string{"wallet", "bank", "kacha"}},
+		{"defaults exhausted", "", []string{"kacha", "backup"}},
+		// a rule removed meanwhile leaves nothing to fail over to
+		{"removed rule", "gone", []string{"wallet"}},
+	}
+	for _, tt := range exhausted {
+		if d, err := e.Failover(tt.ruleID, tt.failed); !errors.Is(err, ErrNoProvider) {
+			t.Errorf("%s: Failover = %+v, %v, want ErrNoProvider", tt.name, d, err)
+		}
+	}
+}
+
+func TestRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routing_rules.json")
+	e, err := NewEngine([]string{"kacha"}, time.UTC, nil, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.SetRules([]Rule{
+		{ID: "b", Priority: 2, Providers: []string{"b"}},
+		{ID: "a", Priority: 1, Providers: []string{"a"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rules are kept in priority order across a restart
+	restarted, err := NewEngine([]string{"kacha"}, time.UTC, nil, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules := restarted.Rules(); len(rules) != 2 || rules[0].ID != "a" {
+		t.Errorf("Rules after restart = %+v, want a then b", rules)
+	}
+
+	invalid := []struct {
+		name  string
+		rules []Rule
+	}{
+		{"no id", []Rule{{Providers: []string{"a"}}}},
+		{"no providers", []Rule{{ID: "a"}}},
+		{"min over max", []Rule{{ID: "a", MinAmount: 10, MaxAmount: 5, Providers: []string{"a"}}}},
+		{"bad window", []Rule{{ID: "a", TimeWindow: &TimeWindow{From: "25:00", To: "06:00"}, Providers: []string{"a"}}}},
+		{"duplicate id", []Rule{{ID: "a", Providers: []string{"a"}}, {ID: "a", Providers: []string{"b"}}}},
+	}
+	for _, tt := range invalid {
+		if err := e.SetRules(tt.rules); err == nil {
+			t.Errorf("%s: SetRules = nil, want an error", tt.name)
+		}
+		if _, err := e.DryRun(tt.rules, Request{}); err == nil {
+			t.Errorf("%s: DryRun = nil, want an error", tt.name)
+		}
+	}
+
+	// a dry run does not change the rules
+	d, err := e.DryRun([]Rule{{ID: "c", Providers: []string{"c"}}}, Request{At: noon})
+	if err != nil || d.Provider != "c" {
+		t.Errorf("DryRun = %+v, %v, want c", d, err)
+	}
+	if d, _ := e.Route(Request{At: noon}); d.Provider != "a" {
+		t.Errorf("Route after DryRun = %+v, want a", d)
+	}
+}
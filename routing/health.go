@@ -0,0 +1,102 @@
+package routing
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	DefaultFailureThreshold = 3
+	DefaultCooldown         = 30 * time.Second
+)
+
+// Health tracks live provider availability. A provider is taken out of
+// rotation after consecutive unavailability failures and retried once the
+// cooldown has passed.
+type Health struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu    sync.Mutex
+	state map[string]*ProviderHealth
+}
+
+type ProviderHealth struct {
+	Provider            string    `json:"provider"`
+	Available           bool      `json:"available"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastError           string    `json:"last_error,omitempty"`
+	LastFailureAt       time.Time `json:"last_failure_at,omitempty"`
+	DownUntil           time.Time `json:"down_until,omitempty"`
+}
+
+func NewHealth(threshold int, cooldown time.Duration) *Health {
+	if threshold <= 0 {
+		threshold = DefaultFailureThreshold
+	}
+	if cooldown <= 0 {
+		cooldown = DefaultCooldown
+	}
+	return &Health{
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     make(map[string]*ProviderHealth),
+	}
+}
+
+func (h *Health) Available(provider string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	st, ok := h.state[provider]
+	return !ok || time.Now().After(st.DownUntil)
+}
+
+func (h *Health) ReportSuccess(provider string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	st := h.get(provider)
+	st.ConsecutiveFailures = 0
+	st.DownUntil = time.Time{}
+}
+
+// ReportFailure records that provider could not be reached
+func (h *Health) ReportFailure(provider string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	st := h.get(provider)
+	st.ConsecutiveFailures++
+	st.LastFailureAt = time.Now()
+	if err != nil {
+		st.LastError = err.Error()
+	}
+	if st.ConsecutiveFailures >= h.threshold {
+		st.DownUntil = st.LastFailureAt.Add(h.cooldown)
+	}
+}
+
+func (h *Health) Snapshot() []ProviderHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	out := make([]ProviderHealth, 0, len(h.state))
+	for _, st := range h.state {
+		cp := *st
+		cp.Available = now.After(st.DownUntil)
+		out = append(out, cp)
+	}
+	return out
+}
+
+// get returns the state for provider, creating it; caller holds h.mu
+func (h *Health) get(provider string) *ProviderHealth {
+	st, ok := h.state[provider]
+	if !ok {
+		st = &ProviderHealth{Provider: provider}
+		h.state[provider] = st
+	}
+	return st
+}
@@ -0,0 +1,117 @@
+package routing
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Rule selects an ordered list of providers for transactions matching all of
+// its conditions. Empty conditions match everything.
+type Rule struct {
+	ID            string      `json:"id"`
+	Priority      int         `json:"priority"`
+	Operations    []string    `json:"operations,omitempty"`
+	Merchants     []string    `json:"merchants,omitempty"`
+	PhonePrefixes []string    `json:"phone_prefixes,omitempty"`
+	MinAmount     int         `json:"min_amount,omitempty"`
+	MaxAmount     int         `json:"max_amount,omitempty"`
+	TimeWindow    *TimeWindow `json:"time_window,omitempty"`
+	// Providers are tried in order; the first healthy one wins
+	Providers []string `json:"providers"`
+}
+
+// TimeWindow is a daily window in "HH:MM" local time. A window whose end is
+// before its start wraps past midnight.
+type TimeWindow struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func (r Rule) Validate() error {
+	if r.ID == "" {
+		return fmt.Errorf("rule id is required")
+	}
+	if len(r.Providers) == 0 {
+		return fmt.Errorf("rule %s: at least one provider is required", r.ID)
+	}
+	if r.MaxAmount > 0 && r.MinAmount > r.MaxAmount {
+		return fmt.Errorf("rule %s: min_amount is greater than max_amount", r.ID)
+	}
+	if r.TimeWindow != nil {
+		if err := r.TimeWindow.Validate(); err != nil {
+			return fmt.Errorf("rule %s: %w", r.ID, err)
+		}
+	}
+	return nil
+}
+
+func (r Rule) Matches(req Request, loc *time.Location) bool {
+	if len(r.Operations) > 0 && !contains(r.Operations, req.Operation) {
+		return false
+	}
+	if len(r.Merchants) > 0 && !contains(r.Merchants, req.Merchant) {
+		return false
+	}
+	if len(r.PhonePrefixes) > 0 {
+		ok := false
+		for _, prefix := range r.PhonePrefixes {
+			if strings.HasPrefix(req.Phone, prefix) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if r.MinAmount > 0 && req.Amount < r.MinAmount {
+		return false
+	}
+	if r.MaxAmount > 0 && req.Amount > r.MaxAmount {
+		return false
+	}
+	if r.TimeWindow != nil && !r.TimeWindow.Contains(req.At.In(loc)) {
+		return false
+	}
+	return true
+}
+
+func (w TimeWindow) Validate() error {
+	if _, err := parseClock(w.From); err != nil {
+		return fmt.Errorf("time_window.from: %w", err)
+	}
+	if _, err := parseClock(w.To); err != nil {
+		return fmt.Errorf("time_window.to: %w", err)
+	}
+	return nil
+}
+
+// Contains reports whether the wall clock time of t falls inside the window
+func (w TimeWindow) Contains(t time.Time) bool {
+	from, _ := parseClock(w.From)
+	to, _ := parseClock(w.To)
+	now := t.Hour()*60 + t.Minute()
+	if from <= to {
+		return now >= from && now < to
+	}
+	return now >= from || now < to
+}
+
+// parseClock converts "HH:MM" to minutes since midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("expected HH:MM, got %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func contains(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"kacha-psp/routing"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type routingDryRunRequest struct {
+	routing.Request
+	// Rules, if set, are evaluated instead of the active rule set
+	Rules []routing.Rule `json:"rules,omitempty"`
+}
+
+func (s *server) handleGetRoutingRules(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"default_provider": s.providers.Default(), "rules": s.router.Rules()})
+}
+
+func (s *server) handlePutRoutingRules(c *gin.Context) {
+	var rules []routing.Rule
+	if err := c.ShouldBindJSON(&rules); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := s.checkRuleProviders(rules); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := s.router.SetRules(rules); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"rules": s.router.Rules()})
+}
+
+func (s *server) handleRoutingDryRun(c *gin.Context) {
+	var req routingDryRunRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Operation == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "operation is required"})
+		return
+	}
+	if err := s.checkRuleProviders(req.Rules); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	decision, err := s.router.DryRun(req.Rules, req.Request)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "decision": decision})
+		return
+	}
+	c.JSON(http.StatusOK, decision)
+}
+
+func (s *server) handleProviderHealth(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"providers": s.providers.Names(), "health": s.health.Snapshot()})
+}
+
+func (s *server) checkRuleProviders(rules []routing.Rule) error {
+	for _, rule := range rules {
+		for _, name := range rule.Providers {
+			if !s.providers.Has(name) {
+				return fmt.Errorf("rule %s: unknown provider %s", rule.ID, name)
+			}
+		}
+	}
+	return nil
+}
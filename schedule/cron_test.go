@@ -0,0 +1,71 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func date(year int, month time.Month, day, hour, minute int) time.Time {
+	return time.Date(year, month, day, hour, minute, 0, 0, time.UTC)
+}
+
+func TestParseCronRejects(t *testing.T) {
+	for _, expr := range []string{
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+	} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q) = nil, want an error", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// 2026-03-10 is a Tuesday
+	tests := []struct {
+		name  string
+		expr  string
+		after time.Time
+		want  time.Time
+	}{
+		{"daily", "0 9 * * *", date(2026, 3, 10, 12, 0), date(2026, 3, 11, 9, 0)},
+		{"strictly after", "0 9 * * *", date(2026, 3, 10, 9, 0), date(2026, 3, 11, 9, 0)},
+		{"step", "*/15 * * * *", date(2026, 3, 10, 12, 7), date(2026, 3, 10, 12, 15)},
+		{"list and range", "0 8,17 * * 1-5", date(2026, 3, 13, 17, 0), date(2026, 3, 16, 8, 0)},
+		{"7 is sunday", "0 0 * * 7", date(2026, 3, 10, 12, 0), date(2026, 3, 15, 0, 0)},
+		{"day of month only", "0 9 1 * *", date(2026, 3, 10, 12, 0), date(2026, 4, 1, 9, 0)},
+		{"day of week only", "0 9 * * 1", date(2026, 3, 31, 12, 0), date(2026, 4, 6, 9, 0)},
+		// with both day fields restricted either one matches
+		{"either day, weekday first", "0 9 1 * 1", date(2026, 3, 10, 12, 0), date(2026, 3, 16, 9, 0)},
+		{"either day, month day first", "0 9 1 * 1", date(2026, 3, 31, 12, 0), date(2026, 4, 1, 9, 0)},
+		{"31st skips short months", "0 0 31 * *", date(2026, 1, 31, 12, 0), date(2026, 3, 31, 0, 0)},
+		{"leap day", "0 9 29 2 *", date(2026, 3, 10, 12, 0), date(2028, 2, 29, 9, 0)},
+	}
+	for _, tt := range tests {
+		c, err := ParseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("%s: ParseCron(%q): %v", tt.name, tt.expr, err)
+		}
+		if got, ok := c.Next(tt.after); !ok || !got.Equal(tt.want) {
+			t.Errorf("%s: Next(%s) = %s, %v, want %s", tt.name, tt.after, got, ok, tt.want)
+		}
+	}
+}
+
+func TestCronNextNever(t *testing.T) {
+	c, err := ParseCron("0 0 31 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := c.Next(date(2026, 1, 1, 0, 0)); ok {
+		t.Errorf("Next of February 31st = %s, want none", got)
+	}
+}
@@ -0,0 +1,504 @@
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"kacha-psp/store"
+)
+
+const (
+	DefaultRetryDelay = 15 * time.Minute
+	// executions kept per schedule; older ones remain in the transaction store
+	maxExecutions = 50
+)
+
+var (
+	ErrNotFound = errors.New("schedule not found")
+	ErrFinished = errors.New("schedule has already finished")
+	// ErrNotRunning is returned for a run that was claimed by no one or was
+	// recorded already
+	ErrNotRunning = errors.New("schedule is not running")
+)
+
+type Frequency string
+
+const (
+	Once    Frequency = "ONCE"
+	Daily   Frequency = "DAILY"
+	Weekly  Frequency = "WEEKLY"
+	Monthly Frequency = "MONTHLY"
+	CronExp Frequency = "CRON"
+)
+
+type Status string
+
+const (
+	StatusActive    Status = "ACTIVE"
+	StatusPaused    Status = "PAUSED"
+	StatusCancelled Status = "CANCELLED"
+	StatusCompleted Status = "COMPLETED"
+)
+
+// FailurePolicy decides what happens to a run that fails: SKIP waits for the
+// next occurrence, RETRY tries again after RetryDelay up to MaxRetries times.
+type FailurePolicy string
+
+const (
+	Skip  FailurePolicy = "SKIP"
+	Retry FailurePolicy = "RETRY"
+)
+
+// Schedule is a B2C transfer to run at a future time or on a recurrence
+type Schedule struct {
+	ID           string `json:"id"`
+	Merchant     string `json:"merchant"`
+	To           string `json:"to"`
+	Amount       int    `json:"amount"`
+	Reason       string `json:"reason"`
+	ShortCode    string `json:"short_code"`
+	ExpectedName string `json:"expected_name,omitempty"`
+	// CreatedBy is the initiator of runs that need approval
+	CreatedBy string `json:"created_by,omitempty"`
+
+	Frequency Frequency  `json:"frequency"`
+	Cron      string     `json:"cron,omitempty"`
+	StartAt   time.Time  `json:"start_at"`
+	EndAt     *time.Time `json:"end_at,omitempty"`
+	MaxRuns   int        `json:"max_runs,omitempty"`
+
+	OnFailure  FailurePolicy `json:"on_failure"`
+	MaxRetries int           `json:"max_retries,omitempty"`
+	RetryDelay string        `json:"retry_delay,omitempty"`
+
+	Status     Status      `json:"status"`
+	NextRunAt  *time.Time  `json:"next_run_at,omitempty"`
+	Runs       int         `json:"runs"`
+	Retries    int         `json:"retries,omitempty"`
+	Executions []Execution `json:"executions,omitempty"`
+	// Running is the run claimed before its transfer was submitted, kept
+	// until its outcome is known so it is never sent twice
+	Running *Execution `json:"running,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Execution is one attempt at running a schedule
+type Execution struct {
+	ScheduledFor  time.Time `json:"scheduled_for"`
+	At            time.Time `json:"at"`
+	Attempt       int       `json:"attempt"`
+	TransactionID string    `json:"transaction_id,omitempty"`
+	Status        string    `json:"status"`
+	Error         string    `json:"error,omitempty"`
+}
+
+func (e Execution) Failed() bool {
+	return e.Error != ""
+}
+
+// Validate checks the schedule's fields and fills in defaults
+func (sc *Schedule) Validate() error {
+	if sc.To == "" || sc.Amount <= 0 || sc.Reason == "" || sc.ShortCode == "" {
+		return fmt.Errorf("to, amount, reason, and short_code are required")
+	}
+	switch sc.Frequency {
+	case Once, Daily, Weekly, Monthly:
+		sc.Cron = ""
+	case CronExp:
+		if _, err := ParseCron(sc.Cron); err != nil {
+			return fmt.Errorf("invalid cron: %w", err)
+		}
+	default:
+		return fmt.Errorf("frequency must be ONCE, DAILY, WEEKLY, MONTHLY or CRON")
+	}
+	if sc.EndAt != nil && !sc.EndAt.After(sc.StartAt) {
+		return fmt.Errorf("end_at must be after start_at")
+	}
+	if sc.MaxRuns < 0 || sc.MaxRetries < 0 {
+		return fmt.Errorf("max_runs and max_retries must not be negative")
+	}
+
+	switch sc.OnFailure {
+	case "":
+		sc.OnFailure = Skip
+	case Skip, Retry:
+	default:
+		return fmt.Errorf("on_failure must be SKIP or RETRY")
+	}
+	if sc.RetryDelay != "" {
+		if d, err := time.ParseDuration(sc.RetryDelay); err != nil || d <= 0 {
+			return fmt.Errorf("invalid retry_delay %q", sc.RetryDelay)
+		}
+	}
+	return nil
+}
+
+func (sc *Schedule) retryDelay() time.Duration {
+	if d, err := time.ParseDuration(sc.RetryDelay); err == nil && d > 0 {
+		return d
+	}
+	return DefaultRetryDelay
+}
+
+// nextAfter returns the first occurrence strictly after t, or nil when the
+// schedule has no runs left. Recurrences are computed in loc so that a daily
+// 09:00 payout stays at 09:00 local time.
+func (sc *Schedule) nextAfter(t time.Time, loc *time.Location) *time.Time {
+	if sc.MaxRuns > 0 && sc.Runs >= sc.MaxRuns {
+		return nil
+	}
+
+	var next time.Time
+	start := sc.StartAt.In(loc)
+	switch sc.Frequency {
+	case Once:
+		if sc.Runs > 0 {
+			return nil
+		}
+		// a one-off that was missed, e.g. while paused, runs as soon as possible
+		next = start
+		if !next.After(t) {
+			next = t.Add(time.Second)
+		}
+	case CronExp:
+		cron, err := ParseCron(sc.Cron)
+		if err != nil {
+			return nil
+		}
+		if t.Before(start) {
+			t = start.Add(-time.Nanosecond)
+		}
+		var ok bool
+		if next, ok = cron.Next(t.In(loc)); !ok {
+			return nil
+		}
+	default:
+		next = start
+		for n := 1; !next.After(t); n++ {
+			next = occurrence(start, sc.Frequency, n)
+		}
+	}
+
+	if sc.EndAt != nil && next.After(*sc.EndAt) {
+		return nil
+	}
+	return &next
+}
+
+// occurrence returns the nth recurrence after start. Monthly runs on a day
+// the month lacks fall on its last day instead of spilling into the next.
+func occurrence(start time.Time, freq Frequency, n int) time.Time {
+	switch freq {
+	case Daily:
+		return start.AddDate(0, 0, n)
+	case Weekly:
+		return start.AddDate(0, 0, 7*n)
+	}
+	first := time.Date(start.Year(), start.Month()+time.Month(n), 1,
+		start.Hour(), start.Minute(), start.Second(), 0, start.Location())
+	last := first.AddDate(0, 1, -1).Day()
+	return first.AddDate(0, 0, min(start.Day(), last)-1)
+}
+
+type Store struct {
+	loc  *time.Location
+	path string
+
+	mu        sync.Mutex
+	schedules map[string]*Schedule
+}
+
+func NewStore(loc *time.Location, path string) (*Store, error) {
+	if loc == nil {
+		loc = time.Local
+	}
+	s := &Store{
+		loc:       loc,
+		path:      path,
+		schedules: make(map[string]*Schedule),
+	}
+	if path == "" {
+		return s, nil
+	}
+	if err := store.LoadJSON(path, &s.schedules); err != nil {
+		return nil, err
+	}
+	if s.schedules == nil {
+		s.schedules = make(map[string]*Schedule)
+	}
+	return s, nil
+}
+
+// Create validates and stores a new active schedule
+func (s *Store) Create(sc *Schedule) (*Schedule, error) {
+	now := time.Now()
+	if sc.StartAt.IsZero() {
+		sc.StartAt = now
+	}
+	if err := sc.Validate(); err != nil {
+		return nil, err
+	}
+
+	sc.ID = store.NewID("sch")
+	sc.Status = StatusActive
+	sc.Runs, sc.Retries, sc.Executions = 0, 0, nil
+	sc.NextRunAt = sc.nextAfter(now.Add(-time.Second), s.loc)
+	if sc.NextRunAt == nil {
+		return nil, fmt.Errorf("schedule has no runs before end_at")
+	}
+	sc.CreatedAt = now
+	sc.UpdatedAt = now
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *sc
+	s.schedules[sc.ID] = &stored
+	s.persist()
+
+	out := stored
+	return &out, nil
+}
+
+func (s *Store) Get(id string) (*Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sc, ok := s.schedules[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	out := *sc
+	return &out, nil
+}
+
+// List returns merchant's schedules (all merchants if empty) with status, newest first
+func (s *Store) List(merchant string, status Status) []*Schedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := []*Schedule{}
+	for _, sc := range s.schedules {
+		if merchant != "" && sc.Merchant != merchant {
+			continue
+		}
+		if status != "" && sc.Status != status {
+			continue
+		}
+		cp := *sc
+		out = append(out, &cp)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
+
+// Edit applies fn to an unfinished schedule, revalidates it and recomputes
+// its next run. Runs already made count towards MaxRuns.
+func (s *Store) Edit(id string, fn func(sc *Schedule)) (*Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sc, ok := s.schedules[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if sc.Status == StatusCancelled || sc.Status == StatusCompleted {
+		return nil, ErrFinished
+	}
+
+	edited := *sc
+	fn(&edited)
+	if err := edited.Validate(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	edited.Retries = 0
+	if edited.Status == StatusActive {
+		edited.NextRunAt = edited.nextAfter(now.Add(-time.Second), s.loc)
+		if edited.NextRunAt == nil {
+			edited.Status = StatusCompleted
+		}
+	}
+	edited.UpdatedAt = now
+	s.schedules[id] = &edited
+	s.persist()
+
+	out := edited
+	return &out, nil
+}
+
+// Pause stops an active schedule from running until it is resumed
+func (s *Store) Pause(id string) (*Schedule, error) {
+	return s.setStatus(id, StatusPaused)
+}
+
+// Resume reactivates a paused schedule. Occurrences missed while paused are
+// skipped, except for a one-off transfer that never ran.
+func (s *Store) Resume(id string) (*Schedule, error) {
+	return s.setStatus(id, StatusActive)
+}
+
+func (s *Store) Cancel(id string) (*Schedule, error) {
+	return s.setStatus(id, StatusCancelled)
+}
+
+func (s *Store) setStatus(id string, status Status) (*Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sc, ok := s.schedules[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if sc.Status == StatusCancelled || sc.Status == StatusCompleted {
+		return nil, ErrFinished
+	}
+
+	now := time.Now()
+	sc.Status = status
+	sc.NextRunAt = nil
+	if status == StatusActive {
+		sc.Retries = 0
+		sc.NextRunAt = sc.nextAfter(now.Add(-time.Second), s.loc)
+		if sc.NextRunAt == nil {
+			sc.Status = StatusCompleted
+		}
+	}
+	sc.UpdatedAt = now
+	s.persist()
+
+	out := *sc
+	return &out, nil
+}
+
+// Due returns active schedules whose next run is at or before now, oldest
+// first. Schedules with a run in flight are not due.
+func (s *Store) Due(now time.Time) []*Schedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []*Schedule
+	for _, sc := range s.schedules {
+		if sc.Status == StatusActive && sc.Running == nil && sc.NextRunAt != nil && !sc.NextRunAt.After(now) {
+			cp := *sc
+			out = append(out, &cp)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].NextRunAt.Before(*out[j].NextRunAt) })
+	return out
+}
+
+// Claim marks a due schedule's run as RUNNING with the transaction it is
+// about to submit, so a run cut short is settled from that transaction rather
+// than sent again
+func (s *Store) Claim(id, txID string, now time.Time) (*Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sc, ok := s.schedules[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if sc.Status != StatusActive || sc.Running != nil || sc.NextRunAt == nil || sc.NextRunAt.After(now) {
+		return nil, fmt.Errorf("schedule %s is not due", id)
+	}
+	sc.Running = &Execution{
+		ScheduledFor:  *sc.NextRunAt,
+		At:            now,
+		Attempt:       sc.Retries + 1,
+		TransactionID: txID,
+		Status:        "RUNNING",
+	}
+	sc.UpdatedAt = now
+	s.persist()
+
+	out := *sc
+	return &out, nil
+}
+
+// Stale lists schedules whose run was claimed before before and is still
+// running, e.g. because a restart cut it short or its outcome is unknown
+func (s *Store) Stale(before time.Time) []*Schedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []*Schedule
+	for _, sc := range s.schedules {
+		if sc.Running != nil && sc.Running.At.Before(before) {
+			cp := *sc
+			out = append(out, &cp)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Running.At.Before(out[j].Running.At) })
+	return out
+}
+
+// Record stores the outcome of the running run and moves the schedule to its
+// next run according to its failure policy. Occurrences missed while the
+// gateway was down are collapsed into the run being recorded.
+func (s *Store) Record(id string, exec Execution) (*Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sc, ok := s.schedules[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if sc.Running == nil {
+		return nil, ErrNotRunning
+	}
+	exec.ScheduledFor = sc.Running.ScheduledFor
+	sc.Running = nil
+	if sc.Status != StatusActive {
+		// paused or cancelled while the run was in flight
+		sc.Executions = appendExecution(sc.Executions, exec)
+		s.persist()
+		out := *sc
+		return &out, nil
+	}
+
+	exec.Attempt = sc.Retries + 1
+	sc.Executions = appendExecution(sc.Executions, exec)
+
+	if exec.Failed() && sc.OnFailure == Retry && sc.Retries < sc.MaxRetries {
+		sc.Retries++
+		next := exec.At.Add(sc.retryDelay())
+		sc.NextRunAt = &next
+	} else {
+		sc.Runs++
+		sc.Retries = 0
+		sc.NextRunAt = sc.nextAfter(exec.At, s.loc)
+		if sc.NextRunAt == nil {
+			sc.Status = StatusCompleted
+		}
+	}
+	sc.UpdatedAt = exec.At
+	s.persist()
+
+	out := *sc
+	return &out, nil
+}
+
+func appendExecution(execs []Execution, exec Execution) []Execution {
+	execs = append(execs, exec)
+	if len(execs) > maxExecutions {
+		execs = execs[len(execs)-maxExecutions:]
+	}
+	return execs
+}
+
+// persist mirrors the store to disk; caller holds s.mu
+func (s *Store) persist() {
+	if s.path == "" {
+		return
+	}
+	if err := store.SaveJSON(s.path, s.schedules); err != nil {
+		log.Printf("[Schedule] failed to persist state: %v", err)
+	}
+}
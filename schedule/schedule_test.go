@@ -0,0 +1,143 @@
+package schedule
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNextAfter(t *testing.T) {
+	jan31 := date(2026, 1, 31, 9, 0)
+	start := date(2026, 3, 10, 9, 0)
+	end := start.Add(36 * time.Hour)
+	onDay := start.AddDate(0, 0, 1)
+
+	tests := []struct {
+		name  string
+		sc    Schedule
+		after time.Time
+		// want is the zero time when no run is left
+		want time.Time
+	}{
+		{"monthly on the 31st in February", Schedule{Frequency: Monthly, StartAt: jan31}, jan31, date(2026, 2, 28, 9, 0)},
+		{"monthly back on the 31st", Schedule{Frequency: Monthly, StartAt: jan31}, date(2026, 2, 28, 9, 0), date(2026, 3, 31, 9, 0)},
+		{"monthly on the 31st in April", Schedule{Frequency: Monthly, StartAt: jan31}, date(2026, 3, 31, 9, 0), date(2026, 4, 30, 9, 0)},
+		{"monthly in a leap year", Schedule{Frequency: Monthly, StartAt: date(2028, 1, 31, 9, 0)}, date(2028, 1, 31, 9, 0), date(2028, 2, 29, 9, 0)},
+		{"cron on the 31st skips February", Schedule{Frequency: CronExp, Cron: "0 9 31 * *", StartAt: date(2026, 1, 1, 0, 0)}, jan31, date(2026, 3, 31, 9, 0)},
+		{"cron waits for start", Schedule{Frequency: CronExp, Cron: "0 9 * * *", StartAt: start.Add(time.Hour)}, date(2026, 1, 1, 0, 0), onDay},
+
+		{"daily", Schedule{Frequency: Daily, StartAt: start}, start, onDay},
+		{"weekly", Schedule{Frequency: Weekly, StartAt: start}, start, start.AddDate(0, 0, 7)},
+		{"first run", Schedule{Frequency: Daily, StartAt: start}, start.Add(-time.Second), start},
+		{"runs left", Schedule{Frequency: Daily, StartAt: start, MaxRuns: 2, Runs: 1}, start, onDay},
+		{"max runs reached", Schedule{Frequency: Daily, StartAt: start, MaxRuns: 2, Runs: 2}, start, time.Time{}},
+		{"before end", Schedule{Frequency: Daily, StartAt: start, EndAt: &end}, start, onDay},
+		{"on the end", Schedule{Frequency: Daily, StartAt: start, EndAt: &onDay}, start, onDay},
+		{"past the end", Schedule{Frequency: Daily, StartAt: start, EndAt: &end}, onDay, time.Time{}},
+		{"cron past the end", Schedule{Frequency: CronExp, Cron: "0 9 * * *", StartAt: start, EndAt: &end}, onDay, time.Time{}},
+
+		{"once", Schedule{Frequency: Once, StartAt: start}, start.Add(-time.Second), start},
+		{"once missed", Schedule{Frequency: Once, StartAt: start}, onDay, onDay.Add(time.Second)},
+		{"once ran", Schedule{Frequency: Once, StartAt: start, Runs: 1}, start.Add(-time.Second), time.Time{}},
+	}
+	for _, tt := range tests {
+		got := tt.sc.nextAfter(tt.after, time.UTC)
+		switch {
+		case tt.want.IsZero() && got != nil:
+			t.Errorf("%s: nextAfter = %s, want no run", tt.name, got)
+		case !tt.want.IsZero() && (got == nil || !got.Equal(tt.want)):
+			t.Errorf("%s: nextAfter = %v, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// run claims the schedule's next run and records exec for it
+func run(t *testing.T, s *Store, id string, exec Execution) *Schedule {
+	t.Helper()
+	sc, err := s.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Claim(id, "txn", *sc.NextRunAt); err != nil {
+		t.Fatal(err)
+	}
+	exec.At = *sc.NextRunAt
+	sc, err = s.Record(id, exec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sc
+}
+
+func newSchedule(t *testing.T, s *Store, sc Schedule) *Schedule {
+	t.Helper()
+	sc.To, sc.Amount, sc.Reason, sc.ShortCode = "251911000000", 500, "Salary", "123456"
+	created, err := s.Create(&sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return created
+}
+
+func TestRecordCompletesAtMaxRuns(t *testing.T) {
+	s, err := NewStore(time.UTC, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := newSchedule(t, s, Schedule{Frequency: Daily, MaxRuns: 2})
+
+	sc = run(t, s, sc.ID, Execution{Status: "SUCCESS"})
+	if sc.Status != StatusActive || sc.Runs != 1 || sc.NextRunAt == nil {
+		t.Errorf("after one run = %s with %d runs, next %v, want ACTIVE with a next run", sc.Status, sc.Runs, sc.NextRunAt)
+	}
+	// a failure skipped under SKIP still counts as a run
+	sc = run(t, s, sc.ID, Execution{Status: "FAILED", Error: "refused"})
+	if sc.Status != StatusCompleted || sc.Runs != 2 || sc.NextRunAt != nil {
+		t.Errorf("after max runs = %s with %d runs, next %v, want COMPLETED", sc.Status, sc.Runs, sc.NextRunAt)
+	}
+	if len(sc.Executions) != 2 {
+		t.Errorf("%d executions, want 2", len(sc.Executions))
+	}
+	if _, err := s.Resume(sc.ID); !errors.Is(err, ErrFinished) {
+		t.Errorf("Resume of a completed schedule = %v, want ErrFinished", err)
+	}
+}
+
+func TestRecordCompletesAtEndAt(t *testing.T) {
+	s, err := NewStore(time.UTC, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().Add(time.Minute)
+	end := start.Add(36 * time.Hour)
+	sc := newSchedule(t, s, Schedule{Frequency: Daily, StartAt: start, EndAt: &end})
+
+	if sc = run(t, s, sc.ID, Execution{Status: "SUCCESS"}); sc.Status != StatusActive {
+		t.Errorf("after the first run = %s, want ACTIVE", sc.Status)
+	}
+	if sc = run(t, s, sc.ID, Execution{Status: "SUCCESS"}); sc.Status != StatusCompleted || sc.NextRunAt != nil {
+		t.Errorf("after the last run before end_at = %s, next %v, want COMPLETED", sc.Status, sc.NextRunAt)
+	}
+}
+
+func TestRecordRetries(t *testing.T) {
+	s, err := NewStore(time.UTC, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := newSchedule(t, s, Schedule{Frequency: Daily, OnFailure: Retry, MaxRetries: 1, RetryDelay: "1h"})
+	first := *sc.NextRunAt
+
+	sc = run(t, s, sc.ID, Execution{Status: "FAILED", Error: "refused"})
+	if sc.Runs != 0 || sc.Retries != 1 || !sc.NextRunAt.Equal(first.Add(time.Hour)) {
+		t.Errorf("after a failure = %d runs, %d retries, next %v, want a retry in 1h", sc.Runs, sc.Retries, sc.NextRunAt)
+	}
+	// retries are used up, so the occurrence is skipped
+	sc = run(t, s, sc.ID, Execution{Status: "FAILED", Error: "refused"})
+	if sc.Runs != 1 || sc.Retries != 0 || !sc.NextRunAt.Equal(first.AddDate(0, 0, 1)) {
+		t.Errorf("after the last retry = %d runs, %d retries, next %v, want the next day", sc.Runs, sc.Retries, sc.NextRunAt)
+	}
+	if attempt := sc.Executions[1].Attempt; attempt != 2 {
+		t.Errorf("retry recorded as attempt %d, want 2", attempt)
+	}
+}
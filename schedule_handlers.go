@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	kacha "kacha-psp/kacha"
+	"kacha-psp/schedule"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type scheduleRequest struct {
+	To           string `json:"to"`
+	Amount       int    `json:"amount"`
+	Reason       string `json:"reason"`
+	ShortCode    string `json:"short_code"`
+	ExpectedName string `json:"expected_name,omitempty"`
+	// CreatedBy is the operator authenticated by X-Operator-Token
+	CreatedBy string `json:"created_by,omitempty"`
+
+	Frequency schedule.Frequency `json:"frequency"`
+	Cron      string             `json:"cron,omitempty"`
+	StartAt   *time.Time         `json:"start_at,omitempty"`
+	EndAt     *time.Time         `json:"end_at,omitempty"`
+	MaxRuns   int                `json:"max_runs,omitempty"`
+
+	OnFailure  schedule.FailurePolicy `json:"on_failure,omitempty"`
+	MaxRetries int                    `json:"max_retries,omitempty"`
+	RetryDelay string                 `json:"retry_delay,omitempty"`
+}
+
+// scheduleEditRequest changes only the fields that are present
+type scheduleEditRequest struct {
+	To           *string `json:"to,omitempty"`
+	Amount       *int    `json:"amount,omitempty"`
+	Reason       *string `json:"reason,omitempty"`
+	ShortCode    *string `json:"short_code,omitempty"`
+	ExpectedName *string `json:"expected_name,omitempty"`
+	CreatedBy    *string `json:"created_by,omitempty"`
+
+	Frequency *schedule.Frequency `json:"frequency,omitempty"`
+	Cron      *string             `json:"cron,omitempty"`
+	StartAt   *time.Time          `json:"start_at,omitempty"`
+	EndAt     *time.Time          `json:"end_at,omitempty"`
+	MaxRuns   *int                `json:"max_runs,omitempty"`
+
+	OnFailure  *schedule.FailurePolicy `json:"on_failure,omitempty"`
+	MaxRetries *int                    `json:"max_retries,omitempty"`
+	RetryDelay *string                 `json:"retry_delay,omitempty"`
+}
+
+func (s *server) handleCreateSchedule(c *gin.Context) {
+	var req scheduleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	merchant := c.GetString("merchant")
+	createdBy, err := s.actingOperator(c, merchant, req.CreatedBy)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	sc := &schedule.Schedule{
+		Merchant:     merchant,
+		To:           req.To,
+		Amount:       req.Amount,
+		Reason:       req.Reason,
+		ShortCode:    req.ShortCode,
+		ExpectedName: req.ExpectedName,
+		CreatedBy:    createdBy,
+		Frequency:    req.Frequency,
+		Cron:         req.Cron,
+		EndAt:        req.EndAt,
+		MaxRuns:      req.MaxRuns,
+		OnFailure:    req.OnFailure,
+		MaxRetries:   req.MaxRetries,
+		RetryDelay:   req.RetryDelay,
+	}
+	if req.StartAt != nil {
+		sc.StartAt = *req.StartAt
+	}
+	if err := sc.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := s.validateScheduledTransfer(sc); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	created, err := s.schedules.Create(sc)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, created)
+}
+
+func (s *server) handleListSchedules(c *gin.Context) {
+	schedules := s.schedules.List(c.GetString("merchant"), schedule.Status(c.Query("status")))
+	c.JSON(http.StatusOK, gin.H{"schedules": schedules})
+}
+
+func (s *server) handleGetSchedule(c *gin.Context) {
+	sc, ok := s.ownedSchedule(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, sc)
+}
+
+func (s *server) handleEditSchedule(c *gin.Context) {
+	var req scheduleEditRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sc, ok := s.ownedSchedule(c)
+	if !ok {
+		return
+	}
+	// an operator editing a schedule initiates its later runs
+	var claimed string
+	if req.CreatedBy != nil {
+		claimed = *req.CreatedBy
+	}
+	createdBy, err := s.actingOperator(c, c.GetString("merchant"), claimed)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	edit := func(sc *schedule.Schedule) {
+		setIf(&sc.To, req.To)
+		setIf(&sc.Amount, req.Amount)
+		setIf(&sc.Reason, req.Reason)
+		setIf(&sc.ShortCode, req.ShortCode)
+		setIf(&sc.ExpectedName, req.ExpectedName)
+		if createdBy != "" {
+			sc.CreatedBy = createdBy
+		}
+		setIf(&sc.Frequency, req.Frequency)
+		setIf(&sc.Cron, req.Cron)
+		setIf(&sc.StartAt, req.StartAt)
+		if req.EndAt != nil {
+			sc.EndAt = req.EndAt
+		}
+		setIf(&sc.MaxRuns, req.MaxRuns)
+		setIf(&sc.OnFailure, req.OnFailure)
+		setIf(&sc.MaxRetries, req.MaxRetries)
+		setIf(&sc.RetryDelay, req.RetryDelay)
+	}
+	// a changed transfer is validated again like a new one
+	if req.To != nil || req.Amount != nil || req.ShortCode != nil || req.ExpectedName != nil {
+		edit(sc)
+		if err := sc.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := s.validateScheduledTransfer(sc); err != nil {
+			respondError(c, err)
+			return
+		}
+	}
+
+	edited, err := s.schedules.Edit(c.Param("id"), edit)
+	if err != nil {
+		respondScheduleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, edited)
+}
+
+func (s *server) handlePauseSchedule(c *gin.Context) {
+	s.changeSchedule(c, s.schedules.Pause)
+}
+
+func (s *server) handleResumeSchedule(c *gin.Context) {
+	s.changeSchedule(c, s.schedules.Resume)
+}
+
+func (s *server) handleCancelSchedule(c *gin.Context) {
+	s.changeSchedule(c, s.schedules.Cancel)
+}
+
+func (s *server) handleAdminListSchedules(c *gin.Context) {
+	schedules := s.schedules.List(c.Query("merchant"), schedule.Status(c.Query("status")))
+	c.JSON(http.StatusOK, gin.H{"schedules": schedules})
+}
+
+// changeSchedule applies a status change to a schedule owned by the caller
+func (s *server) changeSchedule(c *gin.Context, change func(id string) (*schedule.Schedule, error)) {
+	if _, ok := s.ownedSchedule(c); !ok {
+		return
+	}
+
+	sc, err := change(c.Param("id"))
+	if err != nil {
+		respondScheduleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, sc)
+}
+
+// validateScheduledTransfer validates a schedule's transfer with its provider
+// and checks its expected_name, so bad beneficiaries fail now rather than at
+// the first run
+func (s *server) validateScheduledTransfer(sc *schedule.Schedule) error {
+	creds, err := s.keyring.Credentials(sc.Merchant)
+	if err != nil {
+		return err
+	}
+	transfer := kacha.TransferRequest{
+		Username:  creds.Username,
+		Password:  creds.Password,
+		To:        sc.To,
+		Amount:    sc.Amount,
+		Reason:    sc.Reason,
+		ShortCode: sc.ShortCode,
+	}
+	p, _, err := s.routeTransfer(transfer)
+	if err != nil {
+		return err
+	}
+	validation, err := p.ValidateTransfer(transfer)
+	s.observe(p, err)
+	if err != nil {
+		return err
+	}
+	if !validation.Success && validation.Status != "PREPARED" {
+		return newAPIError(http.StatusUnprocessableEntity, "transfer validation failed", gin.H{"validation": validation})
+	}
+	if sc.ExpectedName != "" {
+		if _, err := s.checkBeneficiary(sc.ExpectedName, validation.CustomerInfo, sc.To); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ownedSchedule loads the schedule in the path if it belongs to the merchant.
+// Other merchants' schedules are reported as not found.
+func (s *server) ownedSchedule(c *gin.Context) (*schedule.Schedule, bool) {
+	sc, err := s.schedules.Get(c.Param("id"))
+	if err == nil && sc.Merchant != c.GetString("merchant") {
+		err = schedule.ErrNotFound
+	}
+	if err != nil {
+		respondScheduleError(c, err)
+		return nil, false
+	}
+	return sc, true
+}
+
+func respondScheduleError(c *gin.Context, err error) {
+	status := http.StatusBadRequest
+	switch {
+	case errors.Is(err, schedule.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, schedule.ErrFinished):
+		status = http.StatusConflict
+	}
+	c.JSON(status, gin.H{"error": err.Error()})
+}
+
+func setIf[T any](dst *T, v *T) {
+	if v != nil {
+		*dst = *v
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	kacha "kacha-psp/kacha"
+	"kacha-psp/schedule"
+	"kacha-psp/store"
+	"log"
+	"time"
+)
+
+const sourceSchedule = "SCHEDULE"
+
+// scheduleRunStaleAfter is how long a run may stay RUNNING before it is
+// settled from its transaction, e.g. after a restart cut it short
+const scheduleRunStaleAfter = 10 * time.Minute
+
+// runDueSchedules settles runs cut short and executes every schedule whose
+// next run has come. Runs are sequential, so a slow provider delays later
+// schedules rather than overlapping them.
+func (s *server) runDueSchedules() {
+	if !s.keyring.Enabled() {
+		return
+	}
+	now := time.Now()
+	for _, sc := range s.schedules.Stale(now.Add(-scheduleRunStaleAfter)) {
+		s.settleStaleRun(sc)
+	}
+	for _, sc := range s.schedules.Due(now) {
+		sc, err := s.schedules.Claim(sc.ID, store.NewID("txn"), time.Now())
+		if err != nil {
+			continue
+		}
+		exec, known := s.runSchedule(sc)
+		if !known {
+			log.Printf("[Schedule] run of %s has an unknown outcome; awaiting the status of %s: %s",
+				sc.ID, sc.Running.TransactionID, exec.Error)
+			continue
+		}
+		s.recordRun(sc.ID, exec)
+	}
+}
+
+func (s *server) recordRun(id string, exec schedule.Execution) {
+	exec.At = time.Now()
+	if exec.Failed() {
+		log.Printf("[Schedule] run of %s failed: %s", id, exec.Error)
+	}
+	if _, err := s.schedules.Record(id, exec); err != nil && !errors.Is(err, schedule.ErrNotRunning) {
+		log.Printf("[Schedule] failed to record run of %s: %v", id, err)
+	}
+}
+
+// scheduleSettled records a run whose transfer had an unknown outcome once
+// status polling learns how it went
+func (s *server) scheduleSettled(tx *store.Transaction) {
+	if !tx.Status.Final() {
+		return
+	}
+	sc, err := s.schedules.Get(tx.SourceID)
+	if err != nil || sc.Running == nil || sc.Running.TransactionID != tx.ID {
+		return
+	}
+	s.recordRun(sc.ID, transferExecution(tx))
+}
+
+// settleStaleRun records a run left RUNNING from its transaction. A run whose
+// transaction was never recorded was never sent and is failed, so its
+// failure policy applies. One still pending at the provider is left to status
+// polling.
+func (s *server) settleStaleRun(sc *schedule.Schedule) {
+	exec := failedExecution(errors.New("run was interrupted before it was sent"))
+	if tx, err := s.txs.Get(sc.Running.TransactionID); err == nil {
+		if tx.Status == store.StatusPending {
+			return
+		}
+		exec = transferExecution(tx)
+	}
+	log.Printf("[Schedule] run of %s was left running; recording it as %s", sc.ID, exec.Status)
+	s.recordRun(sc.ID, exec)
+}
+
+// runSchedule revalidates a scheduled transfer with its provider and submits
+// it under the claimed run's transaction through the same risk, limit and
+// approval checks as /withdrawal. known is false for a transfer whose outcome
+// is not known yet.
+func (s *server) runSchedule(sc *schedule.Schedule) (exec schedule.Execution, known bool) {
+	creds, err := s.keyring.Credentials(sc.Merchant)
+	if err != nil {
+		return failedExecution(err), true
+	}
+	req := kacha.TransferRequest{
+		Username:  creds.Username,
+		Password:  creds.Password,
+		To:        sc.To,
+		Amount:    sc.Amount,
+		Reason:    sc.Reason,
+		ShortCode: sc.ShortCode,
+	}
+
+	p, decision, err := s.routeTransfer(req)
+	if err != nil {
+		return failedExecution(err), true
+	}
+	validation, err := p.ValidateTransfer(req)
+	s.observe(p, err)
+	if err != nil {
+		return failedExecution(fmt.Errorf("validation failed: %w", err)), true
+	}
+	if !validation.Success && validation.Status != "PREPARED" {
+		return failedExecution(fmt.Errorf("validation failed: %s %s", validation.Status, validation.Message)), true
+	}
+	if sc.ExpectedName != "" {
+		if _, err := s.checkBeneficiary(sc.ExpectedName, validation.CustomerInfo, sc.To); err != nil {
+			return failedExecution(err), true
+		}
+	}
+
+	outcome, err := s.submitTransfer(transferSubmission{
+		Request:     req,
+		Provider:    p,
+		Decision:    decision,
+		Tx:          &store.Transaction{ID: sc.Running.TransactionID, Source: sourceSchedule, SourceID: sc.ID},
+		InitiatedBy: sc.CreatedBy,
+		Validation:  validation,
+	})
+	if errors.Is(err, errOutcomeUnknown) {
+		return failedExecution(err), false
+	}
+	if err != nil {
+		exec := failedExecution(err)
+		// a transfer that failed at the provider is still recorded
+		if tx, err := s.txs.Get(sc.Running.TransactionID); err == nil {
+			exec.TransactionID = tx.ID
+			exec.Status = string(tx.Status)
+		}
+		return exec, true
+	}
+	return transferExecution(outcome.Tx), true
+}
+
+// transferExecution is the run a recorded transfer made
+func transferExecution(tx *store.Transaction) schedule.Execution {
+	exec := schedule.Execution{
+		TransactionID: tx.ID,
+		Status:        string(tx.Status),
+	}
+	if tx.Status == store.StatusFailed {
+		exec.Error = tx.Message
+		if exec.Error == "" {
+			exec.Error = "transfer failed"
+		}
+	}
+	return exec
+}
+
+func failedExecution(err error) schedule.Execution {
+	return schedule.Execution{Status: string(store.StatusFailed), Error: err.Error()}
+}
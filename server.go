@@ -0,0 +1,400 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"kacha-psp/approval"
+	"kacha-psp/checkout"
+	"kacha-psp/config"
+	"kacha-psp/escrow"
+	"kacha-psp/fees"
+	"kacha-psp/float"
+	"kacha-psp/intent"
+	"kacha-psp/invoice"
+	"kacha-psp/ledger"
+	"kacha-psp/limits"
+	"kacha-psp/namematch"
+	"kacha-psp/operator"
+	"kacha-psp/otp"
+	"kacha-psp/provider"
+	"kacha-psp/quote"
+	"kacha-psp/reconcile"
+	"kacha-psp/response"
+	"kacha-psp/risk"
+	"kacha-psp/routing"
+	"kacha-psp/schedule"
+	"kacha-psp/split"
+	"kacha-psp/store"
+	"kacha-psp/subscription"
+	"kacha-psp/vault"
+	"kacha-psp/webhook"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type server struct {
+	cfg       *config.AppConfig
+	providers *provider.Registry
+	router    *routing.Engine
+	health    *routing.Health
+	limits    *limits.Engine
+	risk      *risk.Engine
+	approvals *approval.Store
+	operators *operator.Store
+	schedules *schedule.Store
+	keyring   *vault.Keyring
+	billing   *subscription.Store
+	invoices  *invoice.Store
+	checkouts *checkout.Store
+	otps      *otp.Store
+	refunds   *refundLocks
+	splits    *split.Store
+	escrows   *escrow.Store
+	intents   *intent.Store
+	recon     *reconcile.Store
+	ledger    *ledger.Ledger
+	floats    *float.Store
+	fees      *fees.Engine
+	formats   *response.Store
+	webhooks  *webhook.Dispatcher
+	txs       *store.TransactionStore
+	quotes    *quote.Service
+	names     *namematch.Matcher
+}
+
+// apiError is a failure with the HTTP status and extra response fields it
+// should be reported with
+type apiError struct {
+	status  int
+	message string
+	details gin.H
+	// cause is a sentinel callers can test for with errors.Is, if any
+	cause error
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func (e *apiError) Unwrap() error {
+	return e.cause
+}
+
+func newAPIError(status int, message string, details gin.H) *apiError {
+	return &apiError{status: status, message: message, details: details}
+}
+
+// respondError writes err as a JSON error response. Errors that are not an
+// *apiError are reported as internal errors, as provider failures always were.
+func respondError(c *gin.Context, err error) {
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	body := gin.H{"error": apiErr.message}
+	for k, v := range apiErr.details {
+		body[k] = v
+	}
+	c.JSON(apiErr.status, body)
+}
+
+// route picks a provider for a new transaction
+func (s *server) route(req routing.Request, creds provider.Credentials) (provider.Provider, routing.Decision, error) {
+	decision, err := s.router.Route(req)
+	if err != nil {
+		if errors.Is(err, routing.ErrNoProvider) {
+			return nil, decision, newAPIError(http.StatusServiceUnavailable, err.Error(), nil)
+		}
+		return nil, decision, err
+	}
+
+	p, err := s.provider(decision.Provider, creds)
+	return p, decision, err
+}
+
+// sendWithFailover sends a recorded transaction's request to p, and to the
+// next providers of its route for as long as it definitely did not reach them
+func sendWithFailover[T any](s *server, txID string, p provider.Provider, creds provider.Credentials, send func(provider.Provider) (T, error)) (T, error) {
+	resp, err := send(p)
+	s.observe(p, err)
+	for tried := []string{p.Name()}; err != nil; tried = append(tried, p.Name()) {
+		next, ok := s.failover(txID, tried, creds, err)
+		if !ok {
+			break
+		}
+		p = next
+		resp, err = send(p)
+		s.observe(p, err)
+	}
+	return resp, err
+}
+
+// failover moves a transaction whose request never reached the last of the
+// providers tried to the next provider of its route, if err says so and one
+// is left. Only requests that were definitely not sent are moved, so none can
+// be paid twice.
+func (s *server) failover(txID string, tried []string, creds provider.Credentials, err error) (provider.Provider, bool) {
+	if !provider.IsUnsent(err) {
+		return nil, false
+	}
+	tx, getErr := s.txs.Get(txID)
+	if getErr != nil {
+		return nil, false
+	}
+	decision, routeErr := s.router.Failover(tx.RouteRuleID, tried)
+	if routeErr != nil {
+		log.Printf("[Routing] %s %s could not be sent: %v", tx.Type, tx.ID, routeErr)
+		return nil, false
+	}
+	p, provErr := s.provider(decision.Provider, creds)
+	if provErr != nil {
+		return nil, false
+	}
+	if _, updateErr := s.txs.Update(txID, func(tx *store.Transaction) error {
+		tx.Provider = decision.Provider
+		tx.RouteReason = decision.Reason
+		return nil
+	}); updateErr != nil {
+		return nil, false
+	}
+	log.Printf("[Routing] %s %s was not sent to %s (%v), trying %s", tx.Type, tx.ID, tried[len(tried)-1], err, p.Name())
+	return p, true
+}
+
+// provider returns the named provider bound to the merchant's credentials
+func (s *server) provider(name string, creds provider.Credentials) (provider.Provider, error) {
+	return s.providers.Get(name, creds)
+}
+
+// observe feeds the outcome of a provider call into routing health
+func (s *server) observe(p provider.Provider, err error) {
+	if provider.IsUnavailable(err) {
+		s.health.ReportFailure(p.Name(), err)
+		return
+	}
+	s.health.ReportSuccess(p.Name())
+}
+
+// newTransaction records a transaction with its routing decision
+func (s *server) newTransaction(tx *store.Transaction, decision routing.Decision) *store.Transaction {
+	tx.Provider = decision.Provider
+	tx.RouteRuleID = decision.RuleID
+	tx.RouteReason = decision.Reason
+	if tx.Status == "" {
+		tx.Status = store.StatusPending
+	}
+	if err := s.txs.Create(tx); err != nil {
+		log.Printf("Failed to record transaction: %v", err)
+	}
+	if tx.FloatReservation != "" {
+		s.floats.Attach(tx.FloatReservation, tx.ID)
+	}
+	return tx
+}
+
+// updateTransaction applies fn to a recorded transaction, logging failures
+// since the provider call has already happened by then. Limit usage is
+// settled once the transaction reaches a final status.
+func (s *server) updateTransaction(id string, fn func(tx *store.Transaction)) {
+	tx, err := s.txs.Update(id, func(tx *store.Transaction) error {
+		fn(tx)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to update transaction %s: %v", id, err)
+		return
+	}
+	s.transactionUpdated(tx)
+}
+
+// transactionUpdated settles limit usage and float and tells the
+// transaction's source once it reaches a final status
+func (s *server) transactionUpdated(tx *store.Transaction) {
+	if tx.LimitReservation != "" {
+		switch tx.Status {
+		case store.StatusSuccess:
+			s.limits.Commit(tx.LimitReservation)
+		case store.StatusFailed, store.StatusRejected, store.StatusExpired, store.StatusCancelled:
+			s.limits.Release(tx.LimitReservation)
+		}
+	}
+	if tx.FloatReservation != "" {
+		switch tx.Status {
+		case store.StatusSuccess:
+			s.floats.Capture(tx.FloatReservation, func() { s.recordInLedger(tx) })
+		case store.StatusFailed, store.StatusRejected, store.StatusExpired, store.StatusCancelled:
+			s.floats.Release(tx.FloatReservation)
+		}
+	}
+	s.recordInLedger(tx)
+	if tx.Status.Final() {
+		s.settled(tx)
+	}
+}
+
+// settled tells the feature that started a transaction how it ended. It may
+// run more than once for a transaction, e.g. on repeated callbacks.
+func (s *server) settled(tx *store.Transaction) {
+	switch tx.Source {
+	case sourceSubscription:
+		s.subscriptionCharged(tx)
+	case sourceInvoice:
+		s.invoiceSettled(tx)
+	case sourceSchedule:
+		s.scheduleSettled(tx)
+	case sourceSplit:
+		s.splitSettled(tx)
+	case sourceEscrow:
+		s.escrowSettled(tx)
+	case sourceIntent:
+		s.intentSettled(tx)
+	case sourceRefund:
+		// refunds of escrow payments
+		s.escrowTransferSettled(tx)
+	}
+}
+
+// paidLate tells the feature that started a payment that it succeeded after
+// the gateway had given up on it
+func (s *server) paidLate(tx *store.Transaction) {
+	switch tx.Source {
+	case sourceSubscription:
+		s.subscriptionPaidLate(tx)
+	case sourceInvoice:
+		s.invoiceSettled(tx)
+	case sourceSplit:
+		s.splitSettled(tx)
+	case sourceEscrow:
+		s.escrowSettled(tx)
+	case sourceIntent:
+		s.intentSettled(tx)
+	}
+}
+
+// failTransaction marks a transaction failed after a provider error
+func (s *server) failTransaction(id string, err error) {
+	s.updateTransaction(id, func(tx *store.Transaction) {
+		tx.Status = store.StatusFailed
+		tx.Message = err.Error()
+	})
+}
+
+// assessRisk evaluates the risk rules for a transaction about to be sent to
+// a provider and records the decision on it. Blocked transactions are stored
+// and returned as an error.
+func (s *server) assessRisk(tx *store.Transaction) error {
+	decision := s.risk.Evaluate(risk.Transaction{
+		Merchant:  tx.Merchant,
+		Operation: string(tx.Type),
+		Phone:     tx.Phone,
+		Amount:    tx.Amount,
+		At:        time.Now(),
+	})
+	tx.RiskAction = string(decision.Action)
+	tx.RiskReasons = decision.Reasons
+
+	switch decision.Action {
+	case risk.Block:
+		log.Printf("Blocked %s for %s: %v", tx.Type, tx.Merchant, decision.Reasons)
+		tx.Status = store.StatusBlocked
+		if err := s.txs.Create(tx); err != nil {
+			log.Printf("Failed to record transaction: %v", err)
+		}
+		return newAPIError(http.StatusForbidden, "transaction blocked by risk rules",
+			gin.H{"transaction_id": tx.ID, "risk": decision})
+	case risk.Review:
+		log.Printf("Flagged %s for %s for review: %v", tx.Type, tx.Merchant, decision.Reasons)
+	}
+	return nil
+}
+
+// reserveLimits holds limit usage for a transaction, failing if a limit
+// would be exceeded
+func (s *server) reserveLimits(tx *store.Transaction) error {
+	id, err := s.limits.Reserve(limits.Check{
+		Merchant:  tx.Merchant,
+		Operation: string(tx.Type),
+		Phone:     tx.Phone,
+		ShortCode: tx.ShortCode,
+		Amount:    tx.Amount,
+		At:        time.Now(),
+	})
+	if err != nil {
+		var exceeded *limits.ExceededError
+		if errors.As(err, &exceeded) {
+			log.Printf("Rejected %s for %s: %v", tx.Type, tx.Merchant, err)
+			return newAPIError(http.StatusUnprocessableEntity, err.Error(), gin.H{"limit": exceeded})
+		}
+		return err
+	}
+	tx.LimitReservation = id
+	return nil
+}
+
+// requireMerchant authenticates a merchant by HTTP basic auth against the
+// credentials in the keyring and stores the merchant name in the context
+func (s *server) requireMerchant(c *gin.Context) {
+	username, password, ok := c.Request.BasicAuth()
+	if !ok {
+		c.Header("WWW-Authenticate", `Basic realm="merchant"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "merchant credentials are required"})
+		return
+	}
+	err := s.keyring.Authenticate(provider.Credentials{Username: username, Password: password})
+	switch {
+	case errors.Is(err, vault.ErrDisabled), errors.Is(err, vault.ErrUnverified):
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	c.Set("merchant", username)
+	c.Next()
+}
+
+// requireAdmin guards the admin API with the ADMIN_TOKEN bearer token
+func (s *server) requireAdmin(c *gin.Context) {
+	if s.cfg.AdminToken == "" {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin API is disabled; set ADMIN_TOKEN"})
+		return
+	}
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.AdminToken)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid admin token"})
+		return
+	}
+	c.Next()
+}
+
+// providerStatus maps a provider's status string onto the gateway's. Unknown
+// statuses are treated as still pending.
+func providerStatus(status string, success bool) store.Status {
+	switch strings.ToUpper(status) {
+	case "SUCCESS", "SUCCESSFUL", "COMPLETED", "PAID":
+		return store.StatusSuccess
+	case "FAILED", "FAILURE", "DECLINED", "REJECTED", "CANCELLED", "CANCELED", "EXPIRED":
+		return store.StatusFailed
+	case "":
+		if success {
+			return store.StatusSuccess
+		}
+	}
+	return store.StatusPending
+}
+
+// every runs fn at each interval until the process exits
+func every(interval time.Duration, fn func()) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			fn()
+		}
+	}()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"kacha-psp/kacha"
+	"kacha-psp/provider"
+	"kacha-psp/routing"
+	"kacha-psp/store"
+)
+
+func TestSendWithFailover(t *testing.T) {
+	creds := provider.Credentials{Username: "m1", Password: "p1"}
+	tests := []struct {
+		name string
+		err  error
+		// sent lists the providers the transfer went to, the last one being
+		// recorded on the transaction
+		sent []string
+		ok   bool
+	}{
+		{"sent", nil, []string{"primary"}, true},
+		{"never sent", provider.ErrUnavailable, []string{"primary", "backup"}, true},
+		{"refused", &kacha.StatusError{Op: "transfer", StatusCode: http.StatusBadRequest}, []string{"primary"}, false},
+		// a timeout may have reached the provider, so it is not sent again
+		{"outcome unknown", context.DeadlineExceeded, []string{"primary"}, false},
+	}
+	for _, tt := range tests {
+		primary, backup := provider.NewFake("primary"), provider.NewFake("backup")
+		primary.SetError(tt.err)
+		providers := provider.NewRegistry("primary")
+		providers.Register("primary", primary.Factory())
+		providers.Register("backup", backup.Factory())
+		health := routing.NewHealth(routing.DefaultFailureThreshold, routing.DefaultCooldown)
+		router, err := routing.NewEngine([]string{"primary", "backup"}, time.UTC, health, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		txs, err := store.NewTransactionStore("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &server{providers: providers, router: router, health: health, txs: txs}
+
+		decision, _ := router.Route(routing.Request{Operation: string(store.TypeTransfer), Merchant: "m1"})
+		tx := &store.Transaction{Type: store.TypeTransfer, Merchant: "m1", Amount: 100, TraceNumber: "TRF1",
+			Provider: decision.Provider, Status: store.StatusPending}
+		if err := txs.Create(tx); err != nil {
+			t.Fatal(err)
+		}
+
+		var sent []string
+		p, _ := s.provider(decision.Provider, creds)
+		_, err = sendWithFailover(s, tx.ID, p, creds, func(p provider.Provider) (*kacha.TransferResponse, error) {
+			sent = append(sent, p.Name())
+			return p.Transfer(kacha.TransferRequest{To: "0911000000", Amount: 100, TraceNumber: "TRF1"})
+		})
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: sendWithFailover = %v, want success %v", tt.name, err, tt.ok)
+		}
+		if !reflect.DeepEqual(sent, tt.sent) {
+			t.Errorf("%s: sent to %v, want %v", tt.name, sent, tt.sent)
+		}
+		if got, _ := txs.Get(tx.ID); got.Provider != tt.sent[len(tt.sent)-1] {
+			t.Errorf("%s: transaction provider = %s, want %s", tt.name, got.Provider, tt.sent[len(tt.sent)-1])
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package split
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+type ShareType string
+
+const (
+	SharePercentage ShareType = "PERCENTAGE"
+	ShareFixed      ShareType = "FIXED"
+)
+
+// Rule is one payee's share of a payment: a FIXED Amount, or a PERCENTAGE
+// of what is left once fixed shares are taken out
+type Rule struct {
+	To      string    `json:"to"`
+	Name    string    `json:"name,omitempty"`
+	Type    ShareType `json:"type"`
+	Amount  int       `json:"amount,omitempty"`
+	Percent float64   `json:"percent,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+// Allocate divides amount between rules. Fixed shares are taken first and
+// percentage shares divide the rest. Percentage shares are rounded down and
+// the units lost to rounding go, one each, to the shares that lost the most,
+// earlier rules first on a tie, so the same payment always splits the same
+// way. Whatever the rules leave is the merchant's.
+func Allocate(amount int, rules []Rule) ([]int, error) {
+	if amount <= 0 {
+		return nil, fmt.Errorf("amount must be positive")
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("at least one split rule is required")
+	}
+
+	shares := make([]int, len(rules))
+	fixed, basisPoints := 0, 0
+	for i, r := range rules {
+		if r.To == "" {
+			return nil, fmt.Errorf("rule %d: to is required", i+1)
+		}
+		switch r.Type {
+		case ShareFixed:
+			if r.Amount <= 0 || r.Percent != 0 {
+				return nil, fmt.Errorf("rule %d: a FIXED share needs a positive amount and no percent", i+1)
+			}
+			shares[i] = r.Amount
+			fixed += r.Amount
+		case SharePercentage:
+			if r.Percent <= 0 || r.Amount != 0 {
+				return nil, fmt.Errorf("rule %d: a PERCENTAGE share needs a positive percent and no amount", i+1)
+			}
+			basisPoints += bps(r.Percent)
+		default:
+			return nil, fmt.Errorf("rule %d: type must be PERCENTAGE or FIXED", i+1)
+		}
+	}
+	if fixed > amount {
+		return nil, fmt.Errorf("fixed shares of %d exceed the payment of %d", fixed, amount)
+	}
+	if basisPoints > 10000 {
+		return nil, fmt.Errorf("percentage shares add up to more than 100%%")
+	}
+
+	// exact shares are rest*bps/10000; work in those units to stay exact
+	rest := amount - fixed
+	type part struct {
+		index     int
+		remainder int
+	}
+	var parts []part
+	allocated := 0
+	for i, r := range rules {
+		if r.Type != SharePercentage {
+			continue
+		}
+		exact := rest * bps(r.Percent)
+		shares[i] = exact / 10000
+		allocated += shares[i]
+		parts = append(parts, part{i, exact % 10000})
+	}
+	lost := rest*basisPoints/10000 - allocated
+	sort.SliceStable(parts, func(a, b int) bool { return parts[a].remainder > parts[b].remainder })
+	for _, p := range parts[:lost] {
+		shares[p.index]++
+	}
+
+	for i, share := range shares {
+		if share <= 0 {
+			return nil, fmt.Errorf("rule %d: share rounds to nothing", i+1)
+		}
+	}
+	return shares, nil
+}
+
+// bps converts a percentage to basis points
+func bps(percent float64) int {
+	return int(math.Round(percent * 100))
+}
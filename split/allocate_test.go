@@ -0,0 +1,126 @@
+package split
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAllocate(t *testing.T) {
+	tests := []struct {
+		name   string
+		amount int
+		rules  []Rule
+		want   []int
+	}{
+		{
+			name:   "readme example",
+			amount: 1001,
+			rules: []Rule{
+				{To: "a", Type: ShareFixed, Amount: 100},
+				{To: "b", Type: SharePercentage, Percent: 50},
+				{To: "c", Type: SharePercentage, Percent: 30},
+				{To: "d", Type: SharePercentage, Percent: 20},
+			},
+			// 901 divides into 450.5, 270.3 and 180.2
+			want: []int{100, 451, 270, 180},
+		},
+		{
+			name:   "lost unit goes to the largest fraction",
+			amount: 100,
+			rules: []Rule{
+				{To: "a", Type: SharePercentage, Percent: 33.33},
+				{To: "b", Type: SharePercentage, Percent: 33.33},
+				{To: "c", Type: SharePercentage, Percent: 33.34},
+			},
+			// 33.33, 33.33 and 33.34 lose one unit between them
+			want: []int{33, 33, 34},
+		},
+		{
+			name:   "earlier rule first on a tie",
+			amount: 10,
+			rules: []Rule{
+				{To: "a", Type: SharePercentage, Percent: 15},
+				{To: "b", Type: SharePercentage, Percent: 85},
+			},
+			// 1.5 and 8.5 lose one unit between them
+			want: []int{2, 8},
+		},
+		{
+			name:   "merchant retains what the rules leave",
+			amount: 999,
+			rules: []Rule{
+				{To: "a", Type: SharePercentage, Percent: 10},
+			},
+			// 99.9 is rounded down, as the 0.9 is not lost to another share
+			want: []int{99},
+		},
+		{
+			name:   "fixed shares only",
+			amount: 500,
+			rules: []Rule{
+				{To: "a", Type: ShareFixed, Amount: 200},
+				{To: "b", Type: ShareFixed, Amount: 300},
+			},
+			want: []int{200, 300},
+		},
+	}
+	for _, tt := range tests {
+		got, err := Allocate(tt.amount, tt.rules)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Allocate(%d) = %v, want %v", tt.name, tt.amount, got, tt.want)
+		}
+	}
+}
+
+func TestAllocateNeverExceedsAmount(t *testing.T) {
+	rules := []Rule{
+		{To: "a", Type: ShareFixed, Amount: 7},
+		{To: "b", Type: SharePercentage, Percent: 33.33},
+		{To: "c", Type: SharePercentage, Percent: 33.33},
+		{To: "d", Type: SharePercentage, Percent: 33.34},
+	}
+	for amount := 10; amount <= 2000; amount++ {
+		shares, err := Allocate(amount, rules)
+		if err != nil {
+			continue
+		}
+		total := 0
+		for _, share := range shares {
+			total += share
+		}
+		// percentages add up to 100%, so everything is paid out
+		if total != amount {
+			t.Fatalf("Allocate(%d) = %v, adding up to %d", amount, shares, total)
+		}
+	}
+}
+
+func TestAllocateRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		amount int
+		rules  []Rule
+	}{
+		{"no amount", 0, []Rule{{To: "a", Type: ShareFixed, Amount: 1}}},
+		{"no rules", 100, nil},
+		{"no payee", 100, []Rule{{Type: ShareFixed, Amount: 1}}},
+		{"unknown type", 100, []Rule{{To: "a", Type: "HALF"}}},
+		{"fixed with percent", 100, []Rule{{To: "a", Type: ShareFixed, Amount: 1, Percent: 5}}},
+		{"percentage with amount", 100, []Rule{{To: "a", Type: SharePercentage, Amount: 1, Percent: 5}}},
+		{"fixed over amount", 100, []Rule{{To: "a", Type: ShareFixed, Amount: 101}}},
+		{"over 100%", 100, []Rule{
+			{To: "a", Type: SharePercentage, Percent: 60},
+			{To: "b", Type: SharePercentage, Percent: 40.01},
+		}},
+		{"share rounds to nothing", 10, []Rule{{To: "a", Type: SharePercentage, Percent: 5}}},
+	}
+	for _, tt := range tests {
+		if shares, err := Allocate(tt.amount, tt.rules); err == nil {
+			t.Errorf("%s: Allocate = %v, want an error", tt.name, shares)
+		}
+	}
+}
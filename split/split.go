@@ -0,0 +1,453 @@
+package split
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"kacha-psp/store"
+)
+
+var (
+	ErrNotFound    = errors.New("split not found")
+	ErrLegNotFound = errors.New("split leg not found")
+	// ErrNotRetryable is returned for a leg that is not a failure to retry
+	ErrNotRetryable = errors.New("leg is not failed")
+	// ErrClaimed is returned for a leg another run has already picked up
+	ErrClaimed = errors.New("leg is already being paid")
+)
+
+type Status string
+
+const (
+	StatusAwaitingPayment Status = "AWAITING_PAYMENT"
+	StatusProcessing      Status = "PROCESSING"
+	StatusCompleted       Status = "COMPLETED"
+	// StatusFailed is a split with a leg that ran out of attempts
+	StatusFailed Status = "FAILED"
+	// StatusCancelled is a split whose payment did not go through
+	StatusCancelled Status = "CANCELLED"
+)
+
+type LegStatus string
+
+const (
+	// LegWaiting legs are paid once the payment succeeds or their retry is due
+	LegWaiting LegStatus = "WAITING"
+	LegRunning LegStatus = "RUNNING"
+	// LegPending legs have a transfer at the provider or awaiting approval
+	LegPending LegStatus = "PENDING"
+	// LegUnknown legs have a transfer the provider may or may not have made,
+	// e.g. after a timeout. It is never sent again; a status query settles it.
+	LegUnknown LegStatus = "UNKNOWN"
+	LegSuccess LegStatus = "SUCCESS"
+	LegFailed  LegStatus = "FAILED"
+)
+
+// Events sent to merchant webhooks
+const (
+	EventCompleted = "split.completed"
+	EventFailed    = "split.failed"
+	EventCancelled = "split.cancelled"
+)
+
+// RetryPolicy decides how often a failed leg is tried again. Delays double
+// from Delay with each attempt.
+type RetryPolicy struct {
+	MaxAttempts int
+	Delay       time.Duration
+}
+
+// Split is a payment collected for several payees. Once PaymentID succeeds,
+// each leg pays one payee by B2C transfer; Retained is the merchant's part.
+type Split struct {
+	ID          string `json:"id"`
+	Merchant    string `json:"merchant"`
+	PaymentID   string `json:"payment_id"`
+	TraceNumber string `json:"trace_number"`
+	Amount      int    `json:"amount"`
+	Retained    int    `json:"retained"`
+	ShortCode   string `json:"short_code"`
+	Reason      string `json:"reason,omitempty"`
+	// InitiatedBy is the initiator of legs that need approval
+	InitiatedBy string `json:"initiated_by,omitempty"`
+	Rules       []Rule `json:"rules"`
+	Legs        []Leg  `json:"legs"`
+	Status      Status `json:"status"`
+	// Error is why a split was not paid out although its payment was
+	// recorded as successful
+	Error string `json:"error,omitempty"`
+
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// Leg is the transfer of one payee's share
+type Leg struct {
+	Index         int        `json:"index"`
+	To            string     `json:"to"`
+	Name          string     `json:"name,omitempty"`
+	Amount        int        `json:"amount"`
+	Status        LegStatus  `json:"status"`
+	TransactionID string     `json:"transaction_id,omitempty"`
+	Attempts      int        `json:"attempts"`
+	Error         string     `json:"error,omitempty"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// Result is how an attempt to pay a leg went. Failures are retried unless
+// Final is set, e.g. for a transfer an approver rejected.
+type Result struct {
+	TransactionID string
+	Status        LegStatus
+	Error         string
+	Final         bool
+}
+
+// Due identifies a leg whose attempt is due
+type Due struct {
+	SplitID string
+	Index   int
+}
+
+func (sp *Split) copy() *Split {
+	out := *sp
+	out.Rules = append([]Rule(nil), sp.Rules...)
+	out.Legs = append([]Leg(nil), sp.Legs...)
+	return &out
+}
+
+// settle moves a split being paid out to its final status once no leg is
+// left to run, returning the event to report
+func (sp *Split) settle(now time.Time) string {
+	if sp.Status != StatusProcessing {
+		return ""
+	}
+	failed := false
+	for _, l := range sp.Legs {
+		switch {
+		case l.Status == LegFailed && l.NextAttemptAt == nil:
+			failed = true
+		case l.Status != LegSuccess:
+			return ""
+		}
+	}
+	sp.CompletedAt = &now
+	if failed {
+		sp.Status = StatusFailed
+		return EventFailed
+	}
+	sp.Status = StatusCompleted
+	return EventCompleted
+}
+
+// Event is a change to report to the merchant
+type Event struct {
+	Type  string
+	Split *Split
+}
+
+type Store struct {
+	policy RetryPolicy
+	path   string
+
+	mu     sync.Mutex
+	splits map[string]*Split
+}
+
+func NewStore(policy RetryPolicy, path string) (*Store, error) {
+	s := &Store{
+		policy: policy,
+		path:   path,
+		splits: make(map[string]*Split),
+	}
+	if path == "" {
+		return s, nil
+	}
+	if err := store.LoadJSON(path, &s.splits); err != nil {
+		return nil, err
+	}
+	if s.splits == nil {
+		s.splits = make(map[string]*Split)
+	}
+	return s, nil
+}
+
+// Create records a split awaiting its payment, with a leg per rule
+func (s *Store) Create(sp *Split) (*Split, error) {
+	shares, err := Allocate(sp.Amount, sp.Rules)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	sp.ID = store.NewID("spl")
+	sp.Status = StatusAwaitingPayment
+	sp.Retained = sp.Amount
+	sp.Legs = make([]Leg, len(sp.Rules))
+	for i, r := range sp.Rules {
+		sp.Legs[i] = Leg{Index: i, To: r.To, Name: r.Name, Amount: shares[i], Status: LegWaiting, UpdatedAt: now}
+		sp.Retained -= shares[i]
+	}
+	sp.CreatedAt, sp.UpdatedAt, sp.CompletedAt = now, now, nil
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := sp.copy()
+	s.splits[sp.ID] = stored
+	s.persist()
+	return stored.copy(), nil
+}
+
+// Get returns the merchant's split (any merchant's if empty)
+func (s *Store) Get(id, merchant string) (*Split, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sp, ok := s.splits[id]
+	if !ok || (merchant != "" && sp.Merchant != merchant) {
+		return nil, ErrNotFound
+	}
+	return sp.copy(), nil
+}
+
+// List returns splits for merchant (all merchants if empty) with status, newest first
+func (s *Store) List(merchant string, status Status) []*Split {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := []*Split{}
+	for _, sp := range s.splits {
+		if merchant != "" && sp.Merchant != merchant {
+			continue
+		}
+		if status != "" && sp.Status != status {
+			continue
+		}
+		out = append(out, sp.copy())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
+
+// Fund starts paying out a split whose payment succeeded. A split cancelled
+// because its payment expired is funded too if the payment succeeds late.
+// It reports false if the split was already funded.
+func (s *Store) Fund(id string, now time.Time) (*Split, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sp, ok := s.splits[id]
+	if !ok {
+		return nil, false, ErrNotFound
+	}
+	if sp.Status != StatusAwaitingPayment && sp.Status != StatusCancelled {
+		return sp.copy(), false, nil
+	}
+	sp.Status = StatusProcessing
+	sp.UpdatedAt = now
+	for i := range sp.Legs {
+		sp.Legs[i].NextAttemptAt = &now
+		sp.Legs[i].UpdatedAt = now
+	}
+	s.persist()
+	return sp.copy(), true, nil
+}
+
+// Unfunded cancels a split whose payment the provider did not confirm, so it
+// is not paid out
+func (s *Store) Unfunded(id, reason string, now time.Time) []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sp, ok := s.splits[id]
+	if !ok || (sp.Status != StatusAwaitingPayment && sp.Status != StatusCancelled) {
+		return nil
+	}
+	// a split cancelled before has been reported already
+	cancelled := sp.Status == StatusAwaitingPayment
+	sp.Status = StatusCancelled
+	sp.Error = reason
+	sp.UpdatedAt = now
+	s.persist()
+	if !cancelled {
+		return nil
+	}
+	return []Event{{EventCancelled, sp.copy()}}
+}
+
+// Cancel gives up on a split whose payment did not go through
+func (s *Store) Cancel(id string, now time.Time) []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sp, ok := s.splits[id]
+	if !ok || sp.Status != StatusAwaitingPayment {
+		return nil
+	}
+	sp.Status = StatusCancelled
+	sp.UpdatedAt = now
+	s.persist()
+	return []Event{{EventCancelled, sp.copy()}}
+}
+
+// Due lists legs of splits being paid out whose attempt has come, oldest
+// split first
+func (s *Store) Due(now time.Time) []Due {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var splits []*Split
+	for _, sp := range s.splits {
+		if sp.Status == StatusProcessing {
+			splits = append(splits, sp)
+		}
+	}
+	sort.Slice(splits, func(i, j int) bool { return splits[i].CreatedAt.Before(splits[j].CreatedAt) })
+	var out []Due
+	for _, sp := range splits {
+		for _, l := range sp.Legs {
+			if (l.Status == LegWaiting || l.Status == LegFailed) && l.NextAttemptAt != nil && !now.Before(*l.NextAttemptAt) {
+				out = append(out, Due{sp.ID, l.Index})
+			}
+		}
+	}
+	return out
+}
+
+// Claim marks a due leg as running with the transaction that will pay it and
+// counts the attempt, so concurrent runs cannot pay it twice and an attempt
+// cut short can be traced to its transfer
+func (s *Store) Claim(id string, index int, transactionID string, now time.Time) (*Split, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sp, l, err := s.leg(id, index)
+	if err != nil {
+		return nil, err
+	}
+	if sp.Status != StatusProcessing || (l.Status != LegWaiting && l.Status != LegFailed) ||
+		l.NextAttemptAt == nil || now.Before(*l.NextAttemptAt) {
+		return nil, ErrClaimed
+	}
+	l.Status = LegRunning
+	l.TransactionID = transactionID
+	l.Attempts++
+	l.NextAttemptAt = nil
+	l.UpdatedAt = now
+	s.persist()
+	return sp.copy(), nil
+}
+
+// Stale lists legs claimed before the given time that are still running, as
+// the attempt was cut short, e.g. by a restart
+func (s *Store) Stale(before time.Time) []Due {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []Due
+	for _, sp := range s.splits {
+		for _, l := range sp.Legs {
+			if l.Status == LegRunning && l.UpdatedAt.Before(before) {
+				out = append(out, Due{sp.ID, l.Index})
+			}
+		}
+	}
+	return out
+}
+
+// Record applies the result of an attempt to pay a leg, scheduling a retry
+// of a failure while attempts are left
+func (s *Store) Record(id string, index int, r Result, now time.Time) []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sp, l, err := s.leg(id, index)
+	if err != nil {
+		return nil
+	}
+	if l.Status == LegSuccess {
+		return nil
+	}
+	if r.TransactionID != "" {
+		l.TransactionID = r.TransactionID
+	}
+	l.Status = r.Status
+	l.Error = r.Error
+	l.UpdatedAt = now
+	if r.Status == LegFailed && !r.Final && l.Attempts < s.policy.MaxAttempts {
+		next := now.Add(s.policy.Delay << (l.Attempts - 1))
+		l.NextAttemptAt = &next
+	}
+	sp.UpdatedAt = now
+	var events []Event
+	if event := sp.settle(now); event != "" {
+		events = append(events, Event{event, sp.copy()})
+	}
+	s.persist()
+	return events
+}
+
+// FindLeg returns the leg paid by a transaction
+func (s *Store) FindLeg(id, transactionID string) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sp, ok := s.splits[id]; ok {
+		for _, l := range sp.Legs {
+			if l.TransactionID == transactionID {
+				return l.Index, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// Retry tries a failed leg again now, even one out of attempts
+func (s *Store) Retry(id, merchant string, index int, now time.Time) (*Split, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sp, l, err := s.leg(id, index)
+	if err != nil {
+		return nil, err
+	}
+	if merchant != "" && sp.Merchant != merchant {
+		return nil, ErrNotFound
+	}
+	if l.Status != LegFailed || (sp.Status != StatusProcessing && sp.Status != StatusFailed) {
+		return nil, ErrNotRetryable
+	}
+	l.NextAttemptAt = &now
+	l.UpdatedAt = now
+	sp.Status = StatusProcessing
+	sp.CompletedAt = nil
+	sp.UpdatedAt = now
+	s.persist()
+	return sp.copy(), nil
+}
+
+// leg finds a split's leg; caller holds s.mu
+func (s *Store) leg(id string, index int) (*Split, *Leg, error) {
+	sp, ok := s.splits[id]
+	if !ok {
+		return nil, nil, ErrNotFound
+	}
+	if index < 0 || index >= len(sp.Legs) {
+		return nil, nil, ErrLegNotFound
+	}
+	return sp, &sp.Legs[index], nil
+}
+
+// persist mirrors the store to disk; caller holds s.mu
+func (s *Store) persist() {
+	if s.path == "" {
+		return
+	}
+	if err := store.SaveJSON(s.path, s.splits); err != nil {
+		log.Printf("[Split] failed to persist state: %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"kacha-psp/response"
+	"kacha-psp/split"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type createSplitRequest struct {
+	Phone       string       `json:"phone" binding:"required"`
+	Amount      int          `json:"amount" binding:"required,gt=0"`
+	TraceNumber string       `json:"trace_number" binding:"required"`
+	Reason      string       `json:"reason"`
+	ShortCode   string       `json:"short_code" binding:"required"`
+	Rules       []split.Rule `json:"rules" binding:"required"`
+	// InitiatedBy is required when a leg needs approval, and is the operator
+	// authenticated by X-Operator-Token
+	InitiatedBy string `json:"initiated_by"`
+}
+
+// handleCreateSplit requests a push USSD payment whose amount is paid out to
+// the payees in rules once it succeeds
+func (s *server) handleCreateSplit(c *gin.Context) {
+	var req createSplitRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	initiatedBy, err := s.actingOperator(c, c.GetString("merchant"), req.InitiatedBy)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	sp, tx, resp, err := s.startSplit(&split.Split{
+		Merchant:    c.GetString("merchant"),
+		TraceNumber: req.TraceNumber,
+		Amount:      req.Amount,
+		ShortCode:   req.ShortCode,
+		Reason:      req.Reason,
+		InitiatedBy: initiatedBy,
+		Rules:       req.Rules,
+	}, req.Phone)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"split":   sp,
+		"payment": s.providerResponse(sp.Merchant, response.FormatPSP, resp, true, tx),
+	})
+}
+
+func (s *server) handleListSplits(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"splits": s.splits.List(c.GetString("merchant"), split.Status(c.Query("status")))})
+}
+
+func (s *server) handleGetSplit(c *gin.Context) {
+	sp, err := s.splits.Get(c.Param("id"), c.GetString("merchant"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, sp)
+}
+
+// handleRetrySplitLeg pays a failed leg again now, even one out of attempts
+func (s *server) handleRetrySplitLeg(c *gin.Context) {
+	s.retrySplitLeg(c, c.GetString("merchant"))
+}
+
+func (s *server) handleAdminListSplits(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"splits": s.splits.List(c.Query("merchant"), split.Status(c.Query("status")))})
+}
+
+func (s *server) handleAdminRetrySplitLeg(c *gin.Context) {
+	s.retrySplitLeg(c, "")
+}
+
+func (s *server) retrySplitLeg(c *gin.Context, merchant string) {
+	index, err := strconv.Atoi(c.Param("leg"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid leg"})
+		return
+	}
+	id := c.Param("id")
+	if _, err := s.splits.Retry(id, merchant, index, time.Now()); err != nil {
+		status := http.StatusNotFound
+		if errors.Is(err, split.ErrNotRetryable) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	s.runSplitLeg(split.Due{SplitID: id, Index: index})
+	sp, err := s.splits.Get(id, "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, sp)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	kacha "kacha-psp/kacha"
+	"kacha-psp/routing"
+	"kacha-psp/split"
+	"kacha-psp/store"
+	"log"
+	"net/http"
+	"time"
+)
+
+const sourceSplit = "SPLIT"
+
+// splitLegStaleAfter is how long a leg may stay claimed before it is taken
+// as cut short
+const splitLegStaleAfter = 10 * time.Minute
+
+// startSplit records a split and requests its payment by push USSD. The legs
+// are paid once the payment succeeds.
+func (s *server) startSplit(sp *split.Split, phone string) (*split.Split, *store.Transaction, *kacha.PushUSSDResponse, error) {
+	if s.cfg.PublicURL == "" {
+		return nil, nil, nil, newAPIError(http.StatusServiceUnavailable, "split payments need PUBLIC_URL for callbacks", nil)
+	}
+	creds, err := s.keyring.Credentials(sp.Merchant)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	sp.PaymentID = store.NewID("txn")
+	sp, err = s.splits.Create(sp)
+	if err != nil {
+		return nil, nil, nil, newAPIError(http.StatusBadRequest, err.Error(), nil)
+	}
+	reason := sp.Reason
+	if reason == "" {
+		reason = "payment " + sp.TraceNumber
+	}
+	tx, resp, err := s.requestPushUSSD(&store.Transaction{
+		ID:          sp.PaymentID,
+		Type:        store.TypePushUSSD,
+		Merchant:    sp.Merchant,
+		TraceNumber: sp.TraceNumber,
+		Phone:       phone,
+		Amount:      sp.Amount,
+		Source:      sourceSplit,
+		SourceID:    sp.ID,
+	}, creds, kacha.PushUSSDRequest{
+		Phone:       phone,
+		Amount:      sp.Amount,
+		TraceNumber: sp.TraceNumber,
+		Reason:      reason,
+	})
+	if err != nil {
+		// payments stopped before reaching the provider never settle
+		s.emitSplitEvents(s.splits.Cancel(sp.ID, time.Now()))
+		return nil, nil, nil, err
+	}
+	return sp, tx, resp, nil
+}
+
+// splitSettled funds a split once its payment succeeds, or cancels it, and
+// records how the transfer of a leg ended
+func (s *server) splitSettled(tx *store.Transaction) {
+	if tx.Type == store.TypeTransfer {
+		s.splitLegSettled(tx)
+		return
+	}
+	if tx.Status != store.StatusSuccess && tx.LateStatus != store.StatusSuccess {
+		s.emitSplitEvents(s.splits.Cancel(tx.SourceID, time.Now()))
+		return
+	}
+	s.fundSplit(tx)
+}
+
+// fundSplit starts paying out a split once the provider confirms its payment
+// by status query. A split whose confirmation could not be had is tried again
+// by runSplitLegs.
+func (s *server) fundSplit(payment *store.Transaction) {
+	status, err := s.confirmPayment(payment)
+	switch {
+	case err != nil:
+		log.Printf("[Split] cannot confirm payment %s of %s yet: %v", payment.ID, payment.SourceID, err)
+		return
+	case !status.Final():
+		log.Printf("[Split] payment %s of %s is still %s at the provider", payment.ID, payment.SourceID, status)
+		return
+	case status != store.StatusSuccess:
+		log.Printf("[Split] ALERT: payment %s of %s was recorded as paid but the provider reports it %s; not paying out",
+			payment.ID, payment.SourceID, status)
+		s.emitSplitEvents(s.splits.Unfunded(payment.SourceID, "provider reports the payment "+string(status), time.Now()))
+		return
+	}
+
+	sp, funded, err := s.splits.Fund(payment.SourceID, time.Now())
+	if err != nil {
+		log.Printf("[Split] failed to fund %s from payment %s: %v", payment.SourceID, payment.ID, err)
+		return
+	}
+	if funded {
+		log.Printf("[Split] payment for %s confirmed, paying %d legs", sp.ID, len(sp.Legs))
+		go s.runSplitLegs()
+	}
+}
+
+// splitLegSettled records a leg's transfer that settled after runSplitLeg
+// returned, e.g. once it was approved or its provider result came in
+func (s *server) splitLegSettled(tx *store.Transaction) {
+	index, ok := s.splits.FindLeg(tx.SourceID, tx.ID)
+	if !ok {
+		// runSplitLeg records it when the transfer returns
+		return
+	}
+	s.emitSplitEvents(s.splits.Record(tx.SourceID, index, legResult(tx), time.Now()))
+}
+
+// runSplitLegs funds splits whose payment is still to be confirmed, settles
+// legs whose attempt was cut short and pays the legs that are due, including
+// retries of failed ones
+func (s *server) runSplitLegs() {
+	s.fundPaidSplits()
+	now := time.Now()
+	for _, due := range s.splits.Stale(now.Add(-splitLegStaleAfter)) {
+		s.settleStaleLeg(due)
+	}
+	for _, due := range s.splits.Due(now) {
+		s.runSplitLeg(due)
+	}
+}
+
+// fundPaidSplits retries funding splits whose payment succeeded but was not
+// confirmed by the provider yet
+func (s *server) fundPaidSplits() {
+	splits := s.splits.List("", split.StatusAwaitingPayment)
+	splits = append(splits, s.splits.List("", split.StatusCancelled)...)
+	for _, sp := range splits {
+		if sp.Error != "" {
+			continue
+		}
+		payment, err := s.txs.Get(sp.PaymentID)
+		if err != nil || (payment.Status != store.StatusSuccess && payment.LateStatus != store.StatusSuccess) {
+			continue
+		}
+		s.fundSplit(payment)
+	}
+}
+
+// settleStaleLeg records a leg left running, e.g. by a restart, from its
+// transaction. A leg whose transaction was never recorded was never sent and
+// is failed to be retried.
+func (s *server) settleStaleLeg(due split.Due) {
+	sp, err := s.splits.Get(due.SplitID, "")
+	if err != nil {
+		return
+	}
+	leg := sp.Legs[due.Index]
+	result := split.Result{TransactionID: leg.TransactionID, Status: split.LegFailed, Error: "attempt was interrupted before it was sent"}
+	if tx, err := s.txs.Get(leg.TransactionID); err == nil {
+		result = legResult(tx)
+	}
+	log.Printf("[Split] leg %d of %s was left running; recording it as %s", leg.Index, sp.ID, result.Status)
+	s.emitSplitEvents(s.splits.Record(sp.ID, leg.Index, result, time.Now()))
+}
+
+func (s *server) runSplitLeg(due split.Due) {
+	txID := store.NewID("txn")
+	sp, err := s.splits.Claim(due.SplitID, due.Index, txID, time.Now())
+	if err != nil {
+		return
+	}
+	leg := sp.Legs[due.Index]
+	result := s.paySplitLeg(sp, leg)
+	switch result.Status {
+	case split.LegFailed:
+		log.Printf("[Split] leg %d of %s to %s failed (attempt %d): %s", leg.Index, sp.ID, leg.To, leg.Attempts, result.Error)
+	case split.LegUnknown:
+		log.Printf("[Split] leg %d of %s to %s has an unknown outcome; awaiting its status: %s", leg.Index, sp.ID, leg.To, result.Error)
+	}
+	s.emitSplitEvents(s.splits.Record(sp.ID, leg.Index, result, time.Now()))
+}
+
+// paySplitLeg transfers a leg's share from the provider that took the
+// payment, through the usual risk, limit, float and approval checks, as the
+// transaction the leg was claimed with. Only failures that certainly sent
+// nothing are failed and retried.
+func (s *server) paySplitLeg(sp *split.Split, leg split.Leg) split.Result {
+	failed := func(err error) split.Result {
+		return split.Result{TransactionID: leg.TransactionID, Status: split.LegFailed, Error: err.Error()}
+	}
+	payment, err := s.txs.Get(sp.PaymentID)
+	if err != nil {
+		return failed(err)
+	}
+	creds, err := s.keyring.Credentials(sp.Merchant)
+	if err != nil {
+		return failed(err)
+	}
+	p, err := s.provider(payment.Provider, creds)
+	if err != nil {
+		return failed(err)
+	}
+	reason := sp.Rules[leg.Index].Reason
+	if reason == "" {
+		reason = "split of payment " + sp.TraceNumber
+	}
+
+	outcome, err := s.submitTransfer(transferSubmission{
+		Request: kacha.TransferRequest{
+			Username:  creds.Username,
+			Password:  creds.Password,
+			To:        leg.To,
+			Amount:    leg.Amount,
+			Reason:    reason,
+			ShortCode: sp.ShortCode,
+		},
+		Provider:    p,
+		Decision:    routing.Decision{Provider: p.Name(), Reason: "split payment leg"},
+		Tx:          &store.Transaction{ID: leg.TransactionID, Source: sourceSplit, SourceID: sp.ID},
+		InitiatedBy: sp.InitiatedBy,
+	})
+	if errors.Is(err, errOutcomeUnknown) {
+		return split.Result{TransactionID: leg.TransactionID, Status: split.LegUnknown, Error: err.Error()}
+	}
+	if err != nil {
+		return failed(err)
+	}
+	return legResult(outcome.Tx)
+}
+
+// legResult maps the transfer of a leg to the leg's status. Transfers an
+// approver rejected are not retried.
+func legResult(tx *store.Transaction) split.Result {
+	r := split.Result{TransactionID: tx.ID}
+	switch tx.Status {
+	case store.StatusSuccess:
+		r.Status = split.LegSuccess
+	case store.StatusPending, store.StatusAwaitingApproval:
+		r.Status = split.LegPending
+		r.Error = tx.Message
+	default:
+		r.Status = split.LegFailed
+		r.Error = tx.Message
+		r.Final = tx.Status == store.StatusRejected
+	}
+	return r
+}
+
+func (s *server) emitSplitEvents(events []split.Event) {
+	for _, e := range events {
+		log.Printf("[Split] %s %s", e.Type, e.Split.ID)
+		s.webhooks.Send(e.Split.Merchant, e.Type, e.Split)
+	}
+}
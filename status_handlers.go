@@ -0,0 +1,89 @@
+package main
+
+import (
+	kacha "kacha-psp/kacha"
+	"kacha-psp/store"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handleQueryTransaction asks the provider for the status of one of the
+// merchant's transactions by trace_number or reference. The gateway's own
+// record is included when it has one; the query does not change it.
+func (s *server) handleQueryTransaction(c *gin.Context) {
+	req := kacha.TransactionQueryRequest{
+		TraceNumber: c.Query("trace_number"),
+		Reference:   c.Query("reference"),
+	}
+	if req.TraceNumber == "" && req.Reference == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "trace_number or reference is required"})
+		return
+	}
+	merchant := c.GetString("merchant")
+
+	resp := gin.H{}
+	providerName := c.Query("provider")
+	if tx := s.merchantTransaction(merchant, req); tx != nil {
+		resp["transaction"] = tx
+		if providerName == "" {
+			providerName = tx.Provider
+		}
+	}
+
+	creds, err := s.keyring.Credentials(merchant)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	p, err := s.provider(providerName, creds)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	result, err := p.QueryTransaction(req)
+	s.observe(p, err)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	resp["provider"] = p.Name()
+	resp["result"] = result
+	c.JSON(http.StatusOK, resp)
+}
+
+// handleGetBalance returns the merchant's business account balance with a provider
+func (s *server) handleGetBalance(c *gin.Context) {
+	creds, err := s.keyring.Credentials(c.GetString("merchant"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	p, err := s.provider(c.Query("provider"), creds)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	balance, err := p.GetBalance()
+	s.observe(p, err)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"provider": p.Name(), "balance": balance})
+}
+
+// merchantTransaction finds the merchant's transaction a status query is about
+func (s *server) merchantTransaction(merchant string, req kacha.TransactionQueryRequest) *store.Transaction {
+	if req.TraceNumber != "" {
+		if tx, err := s.txs.FindByTraceNumber(req.TraceNumber); err == nil && tx.Merchant == merchant {
+			return tx
+		}
+	}
+	if req.Reference != "" {
+		if tx, err := s.txs.FindByReference(req.Reference); err == nil && tx.Merchant == merchant {
+			return tx
+		}
+	}
+	return nil
+}
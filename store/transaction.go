@@ -0,0 +1,365 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound  = errors.New("transaction not found")
+	ErrDuplicate = errors.New("transaction already exists")
+)
+
+type Type string
+
+const (
+	TypeOTPPayment Type = "OTP_PAYMENT"
+	TypePushUSSD   Type = "PUSH_USSD"
+	TypeTransfer   Type = "TRANSFER"
+)
+
+type Status string
+
+const (
+	StatusPending Status = "PENDING"
+	StatusSuccess Status = "SUCCESS"
+	StatusFailed  Status = "FAILED"
+	// StatusBlocked transactions were stopped by the gateway before reaching a provider
+	StatusBlocked Status = "BLOCKED"
+	// StatusAwaitingApproval transfers wait for a second approver before execution
+	StatusAwaitingApproval Status = "AWAITING_APPROVAL"
+	StatusRejected         Status = "REJECTED"
+	// StatusExpired payment requests got no final status in time
+	StatusExpired Status = "EXPIRED"
+	// StatusCancelled payment requests were withdrawn by the merchant before authorization
+	StatusCancelled Status = "CANCELLED"
+)
+
+// Final reports whether a transaction in this status will not change again
+func (s Status) Final() bool {
+	switch s {
+	case StatusSuccess, StatusFailed, StatusBlocked, StatusRejected, StatusExpired, StatusCancelled:
+		return true
+	}
+	return false
+}
+
+// Transaction is the gateway's record of a single movement of money
+type Transaction struct {
+	ID           string `json:"id"`
+	Type         Type   `json:"type"`
+	Merchant     string `json:"merchant"`
+	Provider     string `json:"provider"`
+	TraceNumber  string `json:"trace_number,omitempty"`
+	Reference    string `json:"reference,omitempty"`
+	ProviderTxID string `json:"provider_tx_id,omitempty"`
+	Phone        string `json:"phone,omitempty"`
+	ShortCode    string `json:"short_code,omitempty"`
+	Amount       int    `json:"amount"`
+	Status       Status `json:"status"`
+	Message      string `json:"message,omitempty"`
+
+	// Routing decision that picked Provider
+	RouteRuleID string `json:"route_rule_id,omitempty"`
+	RouteReason string `json:"route_reason,omitempty"`
+	// Risk engine decision and the reasons for it
+	RiskAction  string   `json:"risk_action,omitempty"`
+	RiskReasons []string `json:"risk_reasons,omitempty"`
+	// Fee charged to the merchant and the schedule it was computed with
+	Fee           int    `json:"fee,omitempty"`
+	FeeScheduleID string `json:"fee_schedule_id,omitempty"`
+
+	// LimitReservation holds limit usage until the transaction settles
+	LimitReservation string `json:"limit_reservation,omitempty"`
+	// FloatReservation holds the merchant's float until a transfer settles
+	FloatReservation string `json:"float_reservation,omitempty"`
+
+	// LateStatus is a provider result that arrived after the transaction
+	// expired or was cancelled; it is recorded but does not change Status
+	LateStatus Status     `json:"late_status,omitempty"`
+	LateAt     *time.Time `json:"late_at,omitempty"`
+
+	// Status polls made because no callback arrived. UnresolvedAt is set when
+	// polling gave up without a final provider result.
+	Polls        int        `json:"polls,omitempty"`
+	PolledAt     *time.Time `json:"polled_at,omitempty"`
+	UnresolvedAt *time.Time `json:"unresolved_at,omitempty"`
+
+	// Source is the gateway feature that created the transaction, e.g. a schedule
+	Source   string `json:"source,omitempty"`
+	SourceID string `json:"source_id,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type Filter struct {
+	Merchant string
+	Type     Type
+	Status   Status
+	Since    time.Time
+	Limit    int
+}
+
+// minJournalLines is how long the journal may grow before it is folded into
+// the snapshot, however few transactions there are
+const minJournalLines = 1000
+
+// TransactionStore keeps transactions in memory, optionally mirrored to disk.
+// The file at path is a snapshot of every transaction; each change after it
+// is appended to a journal next to it, one JSON record per line, so a change
+// costs one line rather than rewriting the whole history. Once the journal
+// has as many lines as there are transactions it is folded into a new
+// snapshot, which keeps the cost per change constant.
+type TransactionStore struct {
+	mu        sync.RWMutex
+	path      string
+	byID      map[string]*Transaction
+	journal   *os.File
+	journaled int
+}
+
+func NewTransactionStore(path string) (*TransactionStore, error) {
+	s := &TransactionStore{
+		path: path,
+		byID: make(map[string]*Transaction),
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	var txs []*Transaction
+	if err := LoadJSON(path, &txs); err != nil {
+		return nil, err
+	}
+	for _, tx := range txs {
+		s.byID[tx.ID] = tx
+	}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+	f, err := os.OpenFile(s.journalPath(), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", s.journalPath(), err)
+	}
+	s.journal = f
+	if err := s.endTornLine(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// endTornLine ends a torn last line of the journal, so that the next record
+// is not appended to it
+func (s *TransactionStore) endTornLine() error {
+	info, err := s.journal.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	last := make([]byte, 1)
+	if _, err := s.journal.ReadAt(last, info.Size()-1); err != nil {
+		return fmt.Errorf("failed to read %s: %w", s.journalPath(), err)
+	}
+	if last[0] != '\n' {
+		_, err = s.journal.Write([]byte{'\n'})
+	}
+	return err
+}
+
+func (s *TransactionStore) journalPath() string {
+	return s.path + ".log"
+}
+
+// replay applies the journal to the snapshot. A record older than the one
+// already loaded is left out, as the snapshot may have been written after it
+// when the journal was about to be truncated. A torn last line, left by a
+// crash while appending, is skipped.
+func (s *TransactionStore) replay() error {
+	f, err := os.Open(s.journalPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", s.journalPath(), err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		s.journaled++
+		var tx Transaction
+		if err := json.Unmarshal(scanner.Bytes(), &tx); err != nil || tx.ID == "" {
+			log.Printf("[Store] skipping unreadable line %d of %s", line, s.journalPath())
+			continue
+		}
+		if current, ok := s.byID[tx.ID]; ok && tx.UpdatedAt.Before(current.UpdatedAt) {
+			continue
+		}
+		s.byID[tx.ID] = &tx
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", s.journalPath(), err)
+	}
+	return nil
+}
+
+func (s *TransactionStore) Create(tx *Transaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if tx.ID == "" {
+		tx.ID = NewID("txn")
+	}
+	if _, ok := s.byID[tx.ID]; ok {
+		return ErrDuplicate
+	}
+	now := time.Now()
+	tx.CreatedAt, tx.UpdatedAt = now, now
+
+	stored := *tx
+	s.byID[tx.ID] = &stored
+	s.persist(&stored)
+	return nil
+}
+
+// Update applies fn to the stored transaction under the store lock and
+// returns the updated copy. If fn returns an error nothing is changed.
+func (s *TransactionStore) Update(id string, fn func(tx *Transaction) error) (*Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.byID[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	next := *current
+	if err := fn(&next); err != nil {
+		return nil, err
+	}
+	next.UpdatedAt = time.Now()
+	s.byID[id] = &next
+	s.persist(&next)
+
+	out := next
+	return &out, nil
+}
+
+func (s *TransactionStore) Get(id string) (*Transaction, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tx, ok := s.byID[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	out := *tx
+	return &out, nil
+}
+
+// FindByTraceNumber returns the newest transaction with the trace number
+func (s *TransactionStore) FindByTraceNumber(traceNumber string) (*Transaction, error) {
+	return s.find(func(tx *Transaction) bool { return tx.TraceNumber == traceNumber })
+}
+
+// FindByReference returns the newest transaction with the provider reference
+func (s *TransactionStore) FindByReference(reference string) (*Transaction, error) {
+	return s.find(func(tx *Transaction) bool { return tx.Reference == reference })
+}
+
+func (s *TransactionStore) find(match func(*Transaction) bool) (*Transaction, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var found *Transaction
+	for _, tx := range s.byID {
+		if match(tx) && (found == nil || tx.CreatedAt.After(found.CreatedAt)) {
+			found = tx
+		}
+	}
+	if found == nil {
+		return nil, ErrNotFound
+	}
+	out := *found
+	return &out, nil
+}
+
+// List returns matching transactions, newest first
+func (s *TransactionStore) List(f Filter) []*Transaction {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var out []*Transaction
+	for _, tx := range s.byID {
+		if f.Merchant != "" && tx.Merchant != f.Merchant {
+			continue
+		}
+		if f.Type != "" && tx.Type != f.Type {
+			continue
+		}
+		if f.Status != "" && tx.Status != f.Status {
+			continue
+		}
+		if !f.Since.IsZero() && tx.CreatedAt.Before(f.Since) {
+			continue
+		}
+		cp := *tx
+		out = append(out, &cp)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	if f.Limit > 0 && len(out) > f.Limit {
+		out = out[:f.Limit]
+	}
+	return out
+}
+
+// persist appends a changed transaction to the journal and folds the journal
+// into a new snapshot once it is long enough; caller holds s.mu
+func (s *TransactionStore) persist(tx *Transaction) {
+	if s.path == "" {
+		return
+	}
+	data, err := json.Marshal(tx)
+	if err == nil {
+		_, err = s.journal.Write(append(data, '\n'))
+	}
+	if err != nil {
+		log.Printf("[Store] failed to journal transaction %s, writing a snapshot: %v", tx.ID, err)
+		s.snapshot()
+		return
+	}
+	s.journaled++
+	if s.journaled >= max(minJournalLines, len(s.byID)) {
+		s.snapshot()
+	}
+}
+
+// snapshot writes every transaction to path and empties the journal; caller
+// holds s.mu
+func (s *TransactionStore) snapshot() {
+	txs := make([]*Transaction, 0, len(s.byID))
+	for _, tx := range s.byID {
+		txs = append(txs, tx)
+	}
+	sort.Slice(txs, func(i, j int) bool { return txs[i].CreatedAt.Before(txs[j].CreatedAt) })
+	if err := SaveJSON(s.path, txs); err != nil {
+		log.Printf("[Store] failed to persist transactions: %v", err)
+		return
+	}
+	if err := s.journal.Truncate(0); err != nil {
+		log.Printf("[Store] failed to truncate %s: %v", s.journalPath(), err)
+		return
+	}
+	s.journaled = 0
+}
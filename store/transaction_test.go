@@ -0,0 +1,99 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newStore(t *testing.T, path string) *TransactionStore {
+	t.Helper()
+	s, err := NewTransactionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func lines(t *testing.T, path string) int {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(data), "\n")
+}
+
+func TestJournalSurvivesRestart(t *testing.T) {
+	// the data directory is created for the journal
+	path := filepath.Join(t.TempDir(), "data", "transactions.json")
+	s := newStore(t, path)
+	tx := &Transaction{Type: TypeTransfer, Merchant: "m1", Amount: 100, Status: StatusPending}
+	if err := s.Create(tx); err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range []Status{StatusPending, StatusSuccess} {
+		if _, err := s.Update(tx.ID, func(tx *Transaction) error { tx.Status = status; return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// each change is one line, and the snapshot is not written yet
+	if n := lines(t, path+".log"); n != 3 {
+		t.Errorf("journal has %d lines, want 3", n)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("snapshot written after 3 changes: %v", err)
+	}
+
+	restarted := newStore(t, path)
+	if got, err := restarted.Get(tx.ID); err != nil || got.Status != StatusSuccess {
+		t.Errorf("Get after restart = %+v, %v, want SUCCESS", got, err)
+	}
+}
+
+func TestJournalFoldsIntoSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transactions.json")
+	s := newStore(t, path)
+	var last *Transaction
+	for i := 0; i < minJournalLines; i++ {
+		last = &Transaction{Type: TypePushUSSD, Merchant: "m1", Amount: i + 1, Status: StatusPending}
+		if err := s.Create(last); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := lines(t, path+".log"); n != 0 {
+		t.Errorf("journal has %d lines after the snapshot, want 0", n)
+	}
+	if _, err := s.Update(last.ID, func(tx *Transaction) error { tx.Status = StatusFailed; return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	// a record older than the snapshot's, left by a crash before the journal
+	// was truncated, does not undo a later change
+	f, err := os.OpenFile(path+".log", os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id":"` + last.ID + `","status":"PENDING","updated_at":"2000-01-01T00:00:00Z"}` + "\n")
+	// and a torn line is skipped
+	f.WriteString(`{"id":"txn_torn","sta`)
+	f.Close()
+
+	restarted := newStore(t, path)
+	if n := len(restarted.List(Filter{})); n != minJournalLines {
+		t.Errorf("%d transactions after restart, want %d", n, minJournalLines)
+	}
+	if got, err := restarted.Get(last.ID); err != nil || got.Status != StatusFailed {
+		t.Errorf("Get after restart = %+v, %v, want FAILED", got, err)
+	}
+
+	// records appended after the torn line are read back
+	if _, err := restarted.Update(last.ID, func(tx *Transaction) error { tx.Message = "checked"; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := newStore(t, path).Get(last.ID); err != nil || got.Message != "checked" {
+		t.Errorf("Get after a second restart = %+v, %v, want the update", got, err)
+	}
+}
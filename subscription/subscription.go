@@ -0,0 +1,708 @@
+package subscription
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"kacha-psp/store"
+)
+
+const (
+	DefaultGracePeriod = 7 * 24 * time.Hour
+	// charges kept per subscription; all of them remain in the transaction store
+	maxCharges = 50
+)
+
+// DefaultRetryDelays are the dunning retries after a failed charge
+var DefaultRetryDelays = []string{"24h", "72h", "120h"}
+
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrWrongMerchant = errors.New("belongs to another merchant")
+	ErrPlanArchived  = errors.New("plan is archived")
+	ErrFinished      = errors.New("subscription has already ended")
+	// ErrStaleCharge is returned for the outcome of a charge the
+	// subscription is no longer waiting for
+	ErrStaleCharge = errors.New("charge is not pending for subscription")
+)
+
+type Interval string
+
+const (
+	Day   Interval = "DAY"
+	Week  Interval = "WEEK"
+	Month Interval = "MONTH"
+	Year  Interval = "YEAR"
+)
+
+type Status string
+
+const (
+	StatusTrialing Status = "TRIALING"
+	StatusActive   Status = "ACTIVE"
+	// StatusPastDue subscriptions failed a charge and are being retried
+	StatusPastDue Status = "PAST_DUE"
+	// StatusUnpaid subscriptions ran out of retries or grace period and are no longer charged
+	StatusUnpaid    Status = "UNPAID"
+	StatusCancelled Status = "CANCELLED"
+)
+
+// Lifecycle events sent to merchant webhooks
+const (
+	EventCreated         = "subscription.created"
+	EventActivated       = "subscription.activated"
+	EventRenewed         = "subscription.renewed"
+	EventPaymentFailed   = "subscription.payment_failed"
+	EventPastDue         = "subscription.past_due"
+	EventUnpaid          = "subscription.unpaid"
+	EventCancelScheduled = "subscription.cancel_scheduled"
+	EventCancelled       = "subscription.cancelled"
+)
+
+// Plan is a price charged every IntervalCount intervals. Plans cannot be
+// changed once created, only archived, so subscriptions keep their terms.
+type Plan struct {
+	ID            string   `json:"id"`
+	Merchant      string   `json:"merchant"`
+	Name          string   `json:"name"`
+	Amount        int      `json:"amount"`
+	Interval      Interval `json:"interval"`
+	IntervalCount int      `json:"interval_count"`
+	TrialDays     int      `json:"trial_days,omitempty"`
+	// RetryDelays and GracePeriod control dunning after a failed charge
+	RetryDelays []string  `json:"retry_delays,omitempty"`
+	GracePeriod string    `json:"grace_period,omitempty"`
+	Archived    bool      `json:"archived,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func (p *Plan) Validate() error {
+	if p.Name == "" || p.Amount <= 0 {
+		return fmt.Errorf("name and amount are required")
+	}
+	switch p.Interval {
+	case Day, Week, Month, Year:
+	default:
+		return fmt.Errorf("interval must be DAY, WEEK, MONTH or YEAR")
+	}
+	if p.IntervalCount == 0 {
+		p.IntervalCount = 1
+	}
+	if p.IntervalCount < 0 || p.TrialDays < 0 {
+		return fmt.Errorf("interval_count and trial_days must not be negative")
+	}
+	for _, s := range p.RetryDelays {
+		if d, err := time.ParseDuration(s); err != nil || d <= 0 {
+			return fmt.Errorf("invalid retry delay %q", s)
+		}
+	}
+	if p.GracePeriod != "" {
+		if d, err := time.ParseDuration(p.GracePeriod); err != nil || d <= 0 {
+			return fmt.Errorf("invalid grace_period %q", p.GracePeriod)
+		}
+	}
+	return nil
+}
+
+func (p *Plan) retryDelay(attempt int) (time.Duration, bool) {
+	delays := p.RetryDelays
+	if len(delays) == 0 {
+		delays = DefaultRetryDelays
+	}
+	if attempt < 1 || attempt > len(delays) {
+		return 0, false
+	}
+	d, _ := time.ParseDuration(delays[attempt-1])
+	return d, true
+}
+
+func (p *Plan) gracePeriod() time.Duration {
+	if d, err := time.ParseDuration(p.GracePeriod); err == nil && d > 0 {
+		return d
+	}
+	return DefaultGracePeriod
+}
+
+// periodStart returns the start of billing cycle n counted from anchor.
+// Monthly and yearly cycles anchored on a day a month lacks fall on that
+// month's last day rather than drifting.
+func (p *Plan) periodStart(anchor time.Time, n int) time.Time {
+	n *= p.IntervalCount
+	switch p.Interval {
+	case Day:
+		return anchor.AddDate(0, 0, n)
+	case Week:
+		return anchor.AddDate(0, 0, 7*n)
+	case Year:
+		n *= 12
+	}
+	first := time.Date(anchor.Year(), anchor.Month()+time.Month(n), 1,
+		anchor.Hour(), anchor.Minute(), anchor.Second(), anchor.Nanosecond(), anchor.Location())
+	last := first.AddDate(0, 1, -1).Day()
+	return first.AddDate(0, 0, min(anchor.Day(), last)-1)
+}
+
+// Customer is a payer a merchant bills through push USSD
+type Customer struct {
+	ID        string    `json:"id"`
+	Merchant  string    `json:"merchant"`
+	Phone     string    `json:"phone"`
+	Name      string    `json:"name,omitempty"`
+	Email     string    `json:"email,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Subscription bills a customer for a plan every cycle. Cycle counts the
+// cycles paid so far; cycle n runs from periodStart(Anchor, n).
+type Subscription struct {
+	ID         string `json:"id"`
+	Merchant   string `json:"merchant"`
+	PlanID     string `json:"plan_id"`
+	CustomerID string `json:"customer_id"`
+	Phone      string `json:"phone"`
+	Amount     int    `json:"amount"`
+	Status     Status `json:"status"`
+
+	Anchor             time.Time  `json:"anchor"`
+	Cycle              int        `json:"cycle"`
+	CurrentPeriodStart *time.Time `json:"current_period_start,omitempty"`
+	CurrentPeriodEnd   *time.Time `json:"current_period_end,omitempty"`
+	NextChargeAt       *time.Time `json:"next_charge_at,omitempty"`
+
+	// PendingTxID is the push USSD charge awaiting its callback
+	PendingTxID     string     `json:"pending_transaction_id,omitempty"`
+	ChargeStartedAt *time.Time `json:"charge_started_at,omitempty"`
+	// Attempts counts failed charges for the current cycle
+	Attempts   int        `json:"attempts,omitempty"`
+	GraceUntil *time.Time `json:"grace_until,omitempty"`
+
+	CancelAtPeriodEnd bool       `json:"cancel_at_period_end,omitempty"`
+	CancelledAt       *time.Time `json:"cancelled_at,omitempty"`
+	Charges           []Charge   `json:"charges,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Charge is one attempt to collect a cycle's payment
+type Charge struct {
+	TransactionID string    `json:"transaction_id,omitempty"`
+	Cycle         int       `json:"cycle"`
+	Attempt       int       `json:"attempt"`
+	Amount        int       `json:"amount"`
+	Paid          bool      `json:"paid"`
+	Error         string    `json:"error,omitempty"`
+	At            time.Time `json:"at"`
+}
+
+// Event is a lifecycle change to report to the merchant
+type Event struct {
+	Type         string
+	Subscription *Subscription
+}
+
+type state struct {
+	Plans         map[string]*Plan         `json:"plans"`
+	Customers     map[string]*Customer     `json:"customers"`
+	Subscriptions map[string]*Subscription `json:"subscriptions"`
+}
+
+type Store struct {
+	path string
+
+	mu sync.Mutex
+	st state
+}
+
+func NewStore(path string) (*Store, error) {
+	s := &Store{path: path}
+	if path != "" {
+		if err := store.LoadJSON(path, &s.st); err != nil {
+			return nil, err
+		}
+	}
+	if s.st.Plans == nil {
+		s.st.Plans = make(map[string]*Plan)
+	}
+	if s.st.Customers == nil {
+		s.st.Customers = make(map[string]*Customer)
+	}
+	if s.st.Subscriptions == nil {
+		s.st.Subscriptions = make(map[string]*Subscription)
+	}
+	return s, nil
+}
+
+func (s *Store) CreatePlan(p *Plan) (*Plan, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p.ID = store.NewID("plan")
+	p.Archived = false
+	p.CreatedAt = time.Now()
+	stored := *p
+	s.st.Plans[p.ID] = &stored
+	s.persist()
+	return p, nil
+}
+
+// Plan returns the merchant's plan
+func (s *Store) Plan(id, merchant string) (*Plan, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, err := s.plan(id, merchant)
+	if err != nil {
+		return nil, err
+	}
+	out := *p
+	return &out, nil
+}
+
+func (s *Store) plan(id, merchant string) (*Plan, error) {
+	p, ok := s.st.Plans[id]
+	if !ok {
+		return nil, fmt.Errorf("plan %w", ErrNotFound)
+	}
+	if merchant != "" && p.Merchant != merchant {
+		return nil, fmt.Errorf("plan %w", ErrWrongMerchant)
+	}
+	return p, nil
+}
+
+func (s *Store) Plans(merchant string) []*Plan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := []*Plan{}
+	for _, p := range s.st.Plans {
+		if merchant == "" || p.Merchant == merchant {
+			cp := *p
+			out = append(out, &cp)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
+
+// ArchivePlan stops new subscriptions to a plan; existing ones keep billing
+func (s *Store) ArchivePlan(id, merchant string) (*Plan, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, err := s.plan(id, merchant)
+	if err != nil {
+		return nil, err
+	}
+	p.Archived = true
+	s.persist()
+	out := *p
+	return &out, nil
+}
+
+func (s *Store) CreateCustomer(c *Customer) (*Customer, error) {
+	if c.Phone == "" {
+		return nil, fmt.Errorf("phone is required")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c.ID = store.NewID("cus")
+	c.CreatedAt = time.Now()
+	stored := *c
+	s.st.Customers[c.ID] = &stored
+	s.persist()
+	return c, nil
+}
+
+// Customer returns the merchant's customer
+func (s *Store) Customer(id, merchant string) (*Customer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.st.Customers[id]
+	if !ok {
+		return nil, fmt.Errorf("customer %w", ErrNotFound)
+	}
+	if c.Merchant != merchant {
+		return nil, fmt.Errorf("customer %w", ErrWrongMerchant)
+	}
+	out := *c
+	return &out, nil
+}
+
+func (s *Store) Customers(merchant string) []*Customer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := []*Customer{}
+	for _, c := range s.st.Customers {
+		if merchant == "" || c.Merchant == merchant {
+			cp := *c
+			out = append(out, &cp)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
+
+// Subscribe starts billing a customer for a plan from start, or now if
+// start is zero. Plans with a trial are first charged when the trial ends.
+func (s *Store) Subscribe(merchant, planID, customerID string, start time.Time) (*Subscription, []Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, err := s.plan(planID, merchant)
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.Archived {
+		return nil, nil, ErrPlanArchived
+	}
+	c, ok := s.st.Customers[customerID]
+	if !ok {
+		return nil, nil, fmt.Errorf("customer %w", ErrNotFound)
+	}
+	if c.Merchant != merchant {
+		return nil, nil, fmt.Errorf("customer %w", ErrWrongMerchant)
+	}
+
+	now := time.Now()
+	if start.IsZero() {
+		start = now
+	}
+	sub := &Subscription{
+		ID:         store.NewID("sub"),
+		Merchant:   merchant,
+		PlanID:     p.ID,
+		CustomerID: c.ID,
+		Phone:      c.Phone,
+		Amount:     p.Amount,
+		Status:     StatusActive,
+		Anchor:     start,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if p.TrialDays > 0 {
+		sub.Status = StatusTrialing
+		sub.Anchor = start.AddDate(0, 0, p.TrialDays)
+		trialEnd := sub.Anchor
+		sub.CurrentPeriodStart, sub.CurrentPeriodEnd = &start, &trialEnd
+	}
+	next := sub.Anchor
+	sub.NextChargeAt = &next
+
+	s.st.Subscriptions[sub.ID] = sub
+	s.persist()
+	out := *sub
+	return &out, []Event{{EventCreated, &out}}, nil
+}
+
+// Subscription returns the merchant's subscription (any merchant's if empty)
+func (s *Store) Subscription(id, merchant string) (*Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, err := s.subscription(id, merchant)
+	if err != nil {
+		return nil, err
+	}
+	out := *sub
+	return &out, nil
+}
+
+func (s *Store) subscription(id, merchant string) (*Subscription, error) {
+	sub, ok := s.st.Subscriptions[id]
+	if !ok {
+		return nil, fmt.Errorf("subscription %w", ErrNotFound)
+	}
+	if merchant != "" && sub.Merchant != merchant {
+		return nil, fmt.Errorf("subscription %w", ErrWrongMerchant)
+	}
+	return sub, nil
+}
+
+// Subscriptions returns subscriptions for merchant (all merchants if empty) with status, newest first
+func (s *Store) Subscriptions(merchant string, status Status) []*Subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := []*Subscription{}
+	for _, sub := range s.st.Subscriptions {
+		if merchant != "" && sub.Merchant != merchant {
+			continue
+		}
+		if status != "" && sub.Status != status {
+			continue
+		}
+		cp := *sub
+		out = append(out, &cp)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
+
+// Due returns subscriptions to charge now. Subscriptions set to cancel at
+// the end of their period are cancelled instead, and reported as events.
+func (s *Store) Due(now time.Time) ([]*Subscription, []Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []*Subscription
+	var events []Event
+	for _, sub := range s.st.Subscriptions {
+		if !sub.billable() || sub.PendingTxID != "" || sub.NextChargeAt == nil || sub.NextChargeAt.After(now) {
+			continue
+		}
+		if sub.CancelAtPeriodEnd {
+			sub.cancel(now)
+			out := *sub
+			events = append(events, Event{EventCancelled, &out})
+			continue
+		}
+		cp := *sub
+		due = append(due, &cp)
+	}
+	if len(events) > 0 {
+		s.persist()
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].NextChargeAt.Before(*due[j].NextChargeAt) })
+	return due, events
+}
+
+// BeginCharge records that the transaction txID is collecting the current
+// cycle's payment, so the subscription is not charged twice
+func (s *Store) BeginCharge(id, txID string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, err := s.subscription(id, "")
+	if err != nil {
+		return err
+	}
+	if !sub.billable() {
+		return ErrFinished
+	}
+	if sub.PendingTxID != "" {
+		return fmt.Errorf("subscription %s is already being charged by %s", id, sub.PendingTxID)
+	}
+	sub.PendingTxID = txID
+	sub.ChargeStartedAt = &at
+	sub.UpdatedAt = at
+	s.persist()
+	return nil
+}
+
+// CompleteCharge applies the outcome of the pending charge txID. A paid
+// charge starts the next cycle; a failed one is retried on the plan's dunning
+// schedule until retries or the grace period run out.
+func (s *Store) CompleteCharge(id, txID string, paid bool, reason string, at time.Time) (*Subscription, []Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, err := s.subscription(id, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	if sub.PendingTxID != txID {
+		return nil, nil, ErrStaleCharge
+	}
+	p, err := s.plan(sub.PlanID, "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sub.PendingTxID = ""
+	sub.ChargeStartedAt = nil
+	sub.UpdatedAt = at
+	sub.Charges = appendCharge(sub.Charges, Charge{
+		TransactionID: txID,
+		Cycle:         sub.Cycle + 1,
+		Attempt:       sub.Attempts + 1,
+		Amount:        sub.Amount,
+		Paid:          paid,
+		Error:         reason,
+		At:            at,
+	})
+
+	var events []Event
+	emit := func(eventType string) {
+		out := *sub
+		events = append(events, Event{eventType, &out})
+	}
+
+	if !sub.billable() {
+		// cancelled while the charge was in flight
+		s.persist()
+		return sub.copy(), nil, nil
+	}
+
+	if paid {
+		emit(sub.renew(p))
+		s.persist()
+		return sub.copy(), events, nil
+	}
+
+	sub.Attempts++
+	if sub.GraceUntil == nil {
+		grace := at.Add(p.gracePeriod())
+		sub.GraceUntil = &grace
+	}
+	emit(EventPaymentFailed)
+
+	delay, ok := p.retryDelay(sub.Attempts)
+	if next := at.Add(delay); ok && !next.After(*sub.GraceUntil) {
+		sub.NextChargeAt = &next
+		if sub.Status != StatusPastDue {
+			sub.Status = StatusPastDue
+			emit(EventPastDue)
+		}
+	} else {
+		sub.NextChargeAt = nil
+		sub.Status = StatusUnpaid
+		emit(EventUnpaid)
+	}
+	s.persist()
+	return sub.copy(), events, nil
+}
+
+// ChargePaidLate records that the failed charge txID was paid after all, its
+// result having arrived after the gateway gave up on it. A cycle still unpaid
+// is renewed as if the charge had succeeded, and a dunning retry in flight
+// for it is no longer waited for.
+func (s *Store) ChargePaidLate(id, txID string, at time.Time) (*Subscription, []Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, err := s.subscription(id, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	i := slices.IndexFunc(sub.Charges, func(c Charge) bool { return c.TransactionID == txID })
+	if i < 0 || sub.Charges[i].Paid {
+		return nil, nil, ErrStaleCharge
+	}
+	p, err := s.plan(sub.PlanID, "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sub.Charges[i].Paid = true
+	sub.Charges[i].Error = ""
+	sub.UpdatedAt = at
+
+	var events []Event
+	if sub.Charges[i].Cycle == sub.Cycle+1 && (sub.Status == StatusPastDue || sub.Status == StatusUnpaid) {
+		sub.PendingTxID = ""
+		sub.ChargeStartedAt = nil
+		event := sub.renew(p)
+		events = append(events, Event{event, sub.copy()})
+	}
+	s.persist()
+	return sub.copy(), events, nil
+}
+
+// renew starts the next cycle once its charge is paid and returns the event
+// to report
+func (sub *Subscription) renew(p *Plan) string {
+	start, end := p.periodStart(sub.Anchor, sub.Cycle), p.periodStart(sub.Anchor, sub.Cycle+1)
+	sub.Cycle++
+	sub.CurrentPeriodStart, sub.CurrentPeriodEnd = &start, &end
+	sub.NextChargeAt = &end
+	sub.Attempts = 0
+	sub.GraceUntil = nil
+	sub.Status = StatusActive
+	if sub.Cycle == 1 {
+		return EventActivated
+	}
+	return EventRenewed
+}
+
+// Cancel ends a subscription now, or at the end of the paid period
+func (s *Store) Cancel(id, merchant string, atPeriodEnd bool) (*Subscription, []Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, err := s.subscription(id, merchant)
+	if err != nil {
+		return nil, nil, err
+	}
+	if sub.Status == StatusCancelled {
+		return nil, nil, ErrFinished
+	}
+
+	now := time.Now()
+	event := EventCancelled
+	if atPeriodEnd && (sub.Status == StatusActive || sub.Status == StatusTrialing) {
+		sub.CancelAtPeriodEnd = true
+		sub.UpdatedAt = now
+		event = EventCancelScheduled
+	} else {
+		sub.cancel(now)
+	}
+	s.persist()
+	out := sub.copy()
+	return out, []Event{{event, out}}, nil
+}
+
+// StaleCharges returns subscriptions whose pending charge started before cutoff
+func (s *Store) StaleCharges(cutoff time.Time) []*Subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []*Subscription
+	for _, sub := range s.st.Subscriptions {
+		if sub.PendingTxID != "" && sub.ChargeStartedAt != nil && sub.ChargeStartedAt.Before(cutoff) {
+			out = append(out, sub.copy())
+		}
+	}
+	return out
+}
+
+func (sub *Subscription) billable() bool {
+	switch sub.Status {
+	case StatusTrialing, StatusActive, StatusPastDue:
+		return true
+	}
+	return false
+}
+
+func (sub *Subscription) cancel(now time.Time) {
+	sub.Status = StatusCancelled
+	sub.CancelledAt = &now
+	sub.NextChargeAt = nil
+	sub.UpdatedAt = now
+}
+
+func (sub *Subscription) copy() *Subscription {
+	out := *sub
+	return &out
+}
+
+func appendCharge(charges []Charge, c Charge) []Charge {
+	charges = append(charges, c)
+	if len(charges) > maxCharges {
+		charges = charges[len(charges)-maxCharges:]
+	}
+	return charges
+}
+
+// persist mirrors the store to disk; caller holds s.mu
+func (s *Store) persist() {
+	if s.path == "" {
+		return
+	}
+	if err := store.SaveJSON(s.path, s.st); err != nil {
+		log.Printf("[Subscription] failed to persist state: %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	kacha "kacha-psp/kacha"
+	"kacha-psp/store"
+	"kacha-psp/subscription"
+	"log"
+	"net/url"
+	"time"
+)
+
+const sourceSubscription = "SUBSCRIPTION"
+
+// runSubscriptionBilling charges due subscriptions and fails charges whose
+// callback never arrived
+func (s *server) runSubscriptionBilling() {
+	now := time.Now()
+
+	for _, sub := range s.billing.StaleCharges(now.Add(-s.cfg.SubscriptionChargeTimeout)) {
+		tx, err := s.txs.Get(sub.PendingTxID)
+		switch {
+		case err != nil:
+			s.completeCharge(sub.ID, sub.PendingTxID, false, "charge was not recorded")
+		case tx.Status.Final():
+			s.subscriptionCharged(tx)
+		default:
+			log.Printf("[Subscription] charge %s for %s timed out", tx.ID, sub.ID)
+			s.closePending(tx.ID, store.StatusExpired, "no callback received")
+		}
+	}
+
+	due, events := s.billing.Due(now)
+	s.emitSubscriptionEvents(events)
+	for _, sub := range due {
+		s.chargeSubscription(sub)
+	}
+}
+
+// chargeSubscription sends a push USSD request for the subscription's
+// current cycle. The outcome arrives later through the provider callback.
+func (s *server) chargeSubscription(sub *subscription.Subscription) {
+	creds, err := s.keyring.Credentials(sub.Merchant)
+	if err != nil {
+		log.Printf("[Subscription] cannot charge %s: %v", sub.ID, err)
+		return
+	}
+	plan, err := s.billing.Plan(sub.PlanID, "")
+	if err != nil {
+		log.Printf("[Subscription] cannot charge %s: %v", sub.ID, err)
+		return
+	}
+
+	tx := &store.Transaction{
+		ID:          store.NewID("txn"),
+		Type:        store.TypePushUSSD,
+		Merchant:    sub.Merchant,
+		TraceNumber: store.NewID("SUB"),
+		Phone:       sub.Phone,
+		Amount:      sub.Amount,
+		Source:      sourceSubscription,
+		SourceID:    sub.ID,
+	}
+	if err := s.billing.BeginCharge(sub.ID, tx.ID, time.Now()); err != nil {
+		log.Printf("[Subscription] cannot charge %s: %v", sub.ID, err)
+		return
+	}
+
+	_, _, err = s.requestPushUSSD(tx, creds, kacha.PushUSSDRequest{
+		Phone:       sub.Phone,
+		Amount:      sub.Amount,
+		TraceNumber: tx.TraceNumber,
+		Reason:      plan.Name,
+	})
+	if err != nil {
+		// a charge rejected before reaching the provider never settles
+		s.completeCharge(sub.ID, tx.ID, false, err.Error())
+	}
+}
+
+// subscriptionCharged applies a settled charge to its subscription
+func (s *server) subscriptionCharged(tx *store.Transaction) {
+	s.completeCharge(tx.SourceID, tx.ID, tx.Status == store.StatusSuccess, tx.Message)
+}
+
+// subscriptionPaidLate counts a charge that succeeded after it had expired
+// and was failed for its subscription
+func (s *server) subscriptionPaidLate(tx *store.Transaction) {
+	_, events, err := s.billing.ChargePaidLate(tx.SourceID, tx.ID, time.Now())
+	if err != nil {
+		if !errors.Is(err, subscription.ErrStaleCharge) {
+			log.Printf("[Subscription] failed to record late charge %s for %s: %v", tx.ID, tx.SourceID, err)
+		}
+		return
+	}
+	s.emitSubscriptionEvents(events)
+}
+
+func (s *server) completeCharge(subID, txID string, paid bool, reason string) {
+	if paid {
+		reason = ""
+	}
+	_, events, err := s.billing.CompleteCharge(subID, txID, paid, reason, time.Now())
+	if err != nil {
+		if !errors.Is(err, subscription.ErrStaleCharge) {
+			log.Printf("[Subscription] failed to record charge %s for %s: %v", txID, subID, err)
+		}
+		return
+	}
+	s.emitSubscriptionEvents(events)
+}
+
+func (s *server) emitSubscriptionEvents(events []subscription.Event) {
+	for _, e := range events {
+		log.Printf("[Subscription] %s %s", e.Type, e.Subscription.ID)
+		s.webhooks.Send(e.Subscription.Merchant, e.Type, e.Subscription)
+	}
+}
+
+// callbackURL is where a provider reports payments the gateway starts itself
+// for merchant
+func (s *server) callbackURL(providerName, merchant string) string {
+	return fmt.Sprintf("%s/callback/%s?merchant=%s", s.cfg.PublicURL, url.PathEscape(providerName), url.QueryEscape(merchant))
+}
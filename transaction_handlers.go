@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"kacha-psp/store"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (s *server) handleListTransactions(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	txs := s.txs.List(store.Filter{
+		Merchant: c.Query("merchant"),
+		Type:     store.Type(c.Query("type")),
+		Status:   store.Status(c.Query("status")),
+		Limit:    limit,
+	})
+	c.JSON(http.StatusOK, gin.H{"transactions": txs})
+}
+
+func (s *server) handleGetTransaction(c *gin.Context) {
+	tx, err := s.txs.Get(c.Param("id"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, store.ErrNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, tx)
+}
+
+// handleListUnresolved lists payments polling gave up on without a provider result
+func (s *server) handleListUnresolved(c *gin.Context) {
+	txs := []*store.Transaction{}
+	for _, tx := range s.txs.List(store.Filter{Merchant: c.Query("merchant")}) {
+		if tx.UnresolvedAt != nil && awaitingResult(tx) {
+			txs = append(txs, tx)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"transactions": txs})
+}
+
+// handlePollTransaction queries the provider for a payment's status now
+func (s *server) handlePollTransaction(c *gin.Context) {
+	tx, err := s.txs.Get(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if tx.Type != store.TypePushUSSD || !awaitingResult(tx) {
+		c.JSON(http.StatusConflict, gin.H{"error": "transaction is not awaiting a push USSD result"})
+		return
+	}
+	tx, err = s.pollTransaction(tx)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, tx)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	kacha "kacha-psp/kacha"
+	"kacha-psp/namematch"
+	"kacha-psp/provider"
+	"kacha-psp/quote"
+	"kacha-psp/response"
+	"kacha-psp/routing"
+	"kacha-psp/store"
+	"kacha-psp/utils"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// transferValidation is the gateway's answer to a validation: Kacha's
+// response and quote, with how the account name matched the expected one
+type transferValidation struct {
+	*kacha.PSPTransferValidateResponse
+	NameMatch *namematch.Result `json:"name_match,omitempty"`
+}
+
+func init() {
+	utils.RegisterMapper(func(v *transferValidation, success bool) kacha.PSPResponse {
+		return utils.MapValidationToPSP(v.TransferValidateResponse, v, success)
+	})
+}
+
+func (s *server) handleValidateTransfer(c *gin.Context) {
+	var pspReq kacha.PSPTransferRequest
+	if err := c.ShouldBindJSON(&pspReq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	req := toTransferRequest(pspReq)
+	if req.Username == "" || req.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "username and password are required"})
+		return
+	}
+	if req.To == "" || req.Amount <= 0 || req.Reason == "" || req.ShortCode == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "to, amount, reason, and short_code are required"})
+		return
+	}
+
+	p, _, err := s.routeTransfer(req)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	resp, err := p.ValidateTransfer(req)
+	s.observe(p, err)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	out := transferValidation{PSPTransferValidateResponse: &kacha.PSPTransferValidateResponse{TransferValidateResponse: resp}}
+	if resp.Success || resp.Status == "PREPARED" {
+		token, claims, err := s.quotes.Issue(req.Username, p.Name(), resp, req)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		out.QuoteToken = token
+		out.QuoteExpiresAt = claims.ExpiresAt
+	}
+	if pspReq.ExpectedName != "" {
+		result := s.names.Check(pspReq.ExpectedName, accountName(resp.CustomerInfo))
+		out.NameMatch = &result
+	}
+
+	success := resp.Success || resp.Status == "PREPARED"
+	c.JSON(http.StatusOK, s.providerResponse(req.Username, response.FormatRaw, &out, success, nil))
+}
+
+func (s *server) handleWithdrawal(c *gin.Context) {
+	var pspReq kacha.PSPTransferRequest
+	if err := c.ShouldBindJSON(&pspReq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	req := toTransferRequest(pspReq)
+	if req.Username == "" || req.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "username and password are required"})
+		return
+	}
+	if req.To == "" || req.Amount <= 0 || req.Reason == "" || req.ShortCode == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "to, amount, reason, and short_code are required"})
+		return
+	}
+
+	if pspReq.QuoteToken == "" && s.cfg.RequireQuoteToken {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "quote_token is required; call /withdrawal/validate first"})
+		return
+	}
+	var claims *quote.Claims
+	if pspReq.QuoteToken != "" {
+		var err error
+		claims, err = s.quotes.Verify(pspReq.QuoteToken, req.Username, req)
+		if err != nil {
+			respondError(c, quoteError(err))
+			return
+		}
+	}
+
+	// A quoted transfer goes to the provider that validated it, and the quote
+	// is only used up once the transfer passes risk, limit and float checks
+	initiatedBy, err := s.actingOperator(c, req.Username, pspReq.InitiatedBy)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	sub := transferSubmission{Request: req, InitiatedBy: initiatedBy, Quote: claims}
+	var customer *kacha.CustomerInfo
+	if claims != nil && claims.Provider != "" {
+		sub.Decision = routing.Decision{Provider: claims.Provider, Reason: "quote token"}
+		customer = claims.CustomerInfo
+		sub.Provider, err = s.provider(claims.Provider, provider.Credentials{Username: req.Username, Password: req.Password})
+	} else {
+		sub.Provider, sub.Decision, err = s.routeTransfer(req)
+	}
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if pspReq.ExpectedName != "" {
+		if customer == nil {
+			sub.Validation, err = sub.Provider.ValidateTransfer(req)
+			s.observe(sub.Provider, err)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			customer = sub.Validation.CustomerInfo
+		}
+
+		result, err := s.checkBeneficiary(pspReq.ExpectedName, customer, req.To)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		if result.Decision == namematch.Warn {
+			c.Header("X-Name-Match", nameMatchHeader(result))
+		}
+	}
+
+	outcome, err := s.submitTransfer(sub)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if outcome.Approval != nil {
+		c.JSON(http.StatusAccepted, gin.H{
+			"status":         store.StatusAwaitingApproval,
+			"transaction_id": outcome.Tx.ID,
+			"approval":       outcome.Approval,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, s.providerResponse(req.Username, response.FormatPSP, outcome.Response, true, outcome.Tx))
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"kacha-psp/approval"
+	kacha "kacha-psp/kacha"
+	"kacha-psp/namematch"
+	"kacha-psp/provider"
+	"kacha-psp/quote"
+	"kacha-psp/routing"
+	"kacha-psp/store"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errOutcomeUnknown marks a transfer the provider may have made although the
+// call failed, e.g. on a timeout. Its transaction stays PENDING until a status
+// query tells how it ended, as sending it again could pay twice.
+var errOutcomeUnknown = errors.New("transfer outcome unknown")
+
+// transferSubmission is a B2C transfer ready to go to a provider
+type transferSubmission struct {
+	Request  kacha.TransferRequest
+	Provider provider.Provider
+	Decision routing.Decision
+	// Tx is the draft transaction; callers may fill in extra fields
+	Tx *store.Transaction
+	// InitiatedBy is required when the transfer needs approval
+	InitiatedBy string
+	// Validation is a ValidateTransfer result already obtained, if any
+	Validation *kacha.TransferValidateResponse
+	// Quote is a verified quote, redeemed just before the transfer is parked
+	// or executed
+	Quote *quote.Claims
+}
+
+// transferOutcome is either an executed transfer or one parked for approval
+type transferOutcome struct {
+	Tx       *store.Transaction
+	Response *kacha.TransferResponse
+	Approval *approval.Transfer
+}
+
+// routeTransfer picks the provider for a transfer
+func (s *server) routeTransfer(req kacha.TransferRequest) (provider.Provider, routing.Decision, error) {
+	return s.route(routing.Request{
+		Operation: string(store.TypeTransfer),
+		Merchant:  req.Username,
+		Phone:     req.To,
+		Amount:    req.Amount,
+		At:        time.Now(),
+	}, provider.Credentials{Username: req.Username, Password: req.Password})
+}
+
+// checkBeneficiary matches the expected beneficiary name against the account
+// holder and fails if the payout must be blocked
+func (s *server) checkBeneficiary(expected string, customer *kacha.CustomerInfo, to string) (namematch.Result, error) {
+	result := s.names.Check(expected, accountName(customer))
+	switch result.Decision {
+	case namematch.Block:
+		log.Printf("Blocked withdrawal to %s: beneficiary name mismatch %+v", to, result)
+		return result, newAPIError(http.StatusUnprocessableEntity, "beneficiary name does not match account holder",
+			gin.H{"name_match": result})
+	case namematch.Warn:
+		log.Printf("Withdrawal to %s: weak beneficiary name match %+v", to, result)
+	}
+	return result, nil
+}
+
+// submitTransfer runs a transfer through risk and limits, then either parks
+// it for approval or executes it
+func (s *server) submitTransfer(sub transferSubmission) (*transferOutcome, error) {
+	req := sub.Request
+	tx := sub.Tx
+	if tx == nil {
+		tx = &store.Transaction{}
+	}
+	tx.Type = store.TypeTransfer
+	tx.Merchant = req.Username
+	tx.Phone = req.To
+	tx.ShortCode = req.ShortCode
+	tx.Amount = req.Amount
+	if tx.TraceNumber == "" {
+		tx.TraceNumber = store.NewID("TRF")
+	}
+	req.TraceNumber = tx.TraceNumber
+
+	if err := s.assessRisk(tx); err != nil {
+		return nil, err
+	}
+
+	needsApproval := s.approvals.Required(req.Username, req.Amount)
+	if needsApproval && sub.InitiatedBy == "" {
+		return nil, newAPIError(http.StatusBadRequest, approval.ErrMissingInitBy.Error(), nil)
+	}
+	if err := s.reserveLimits(tx); err != nil {
+		return nil, err
+	}
+	s.chargeFee(tx)
+	if err := s.reserveFloat(tx); err != nil {
+		s.limits.Release(tx.LimitReservation)
+		return nil, err
+	}
+	if needsApproval {
+		return s.parkTransfer(sub, tx)
+	}
+
+	if err := s.redeemQuote(sub, tx); err != nil {
+		return nil, err
+	}
+	tx = s.newTransaction(tx, sub.Decision)
+	resp, err := s.executeTransfer(sub.Provider, tx.ID, req)
+	if err != nil {
+		return nil, err
+	}
+	tx, _ = s.txs.Get(tx.ID)
+	return &transferOutcome{Tx: tx, Response: resp}, nil
+}
+
+// parkTransfer records a transfer that needs a second approver, together
+// with a ValidateTransfer result, instead of executing it
+func (s *server) parkTransfer(sub transferSubmission, tx *store.Transaction) (*transferOutcome, error) {
+	p, req := sub.Provider, sub.Request
+	validation := sub.Validation
+	if validation == nil {
+		var err error
+		validation, err = p.ValidateTransfer(req)
+		s.observe(p, err)
+		if err != nil {
+			s.limits.Release(tx.LimitReservation)
+			s.floats.Release(tx.FloatReservation)
+			return nil, err
+		}
+	}
+	if err := s.redeemQuote(sub, tx); err != nil {
+		return nil, err
+	}
+
+	tx.Status = store.StatusAwaitingApproval
+	tx = s.newTransaction(tx, sub.Decision)
+
+	parked, err := s.approvals.Park(&approval.Transfer{
+		TransactionID: tx.ID,
+		Merchant:      req.Username,
+		Provider:      p.Name(),
+		To:            req.To,
+		Amount:        req.Amount,
+		Reason:        req.Reason,
+		ShortCode:     req.ShortCode,
+		Validation:    validation,
+		InitiatedBy:   sub.InitiatedBy,
+	})
+	if err != nil {
+		s.failTransaction(tx.ID, err)
+		return nil, newAPIError(http.StatusBadRequest, err.Error(), nil)
+	}
+
+	log.Printf("Withdrawal %s of %d to %s awaits approval %s", tx.ID, req.Amount, req.To, parked.ID)
+	return &transferOutcome{Tx: tx, Approval: parked}, nil
+}
+
+// redeemQuote uses up the transfer's quote, if any, once all that is left is
+// to park or execute the transfer. The transfer's reservations are released
+// if the quote cannot be used.
+func (s *server) redeemQuote(sub transferSubmission, tx *store.Transaction) error {
+	if sub.Quote == nil {
+		return nil
+	}
+	if err := s.quotes.Redeem(sub.Quote); err != nil {
+		s.limits.Release(tx.LimitReservation)
+		s.floats.Release(tx.FloatReservation)
+		return quoteError(err)
+	}
+	return nil
+}
+
+// executeTransfer calls Transfer for a recorded transaction. Only a failure
+// the provider certainly did not act on fails the transaction; otherwise it
+// stays PENDING for status polling and errOutcomeUnknown is returned.
+func (s *server) executeTransfer(p provider.Provider, txID string, req kacha.TransferRequest) (*kacha.TransferResponse, error) {
+	creds := provider.Credentials{Username: req.Username, Password: req.Password}
+	resp, err := sendWithFailover(s, txID, p, creds, func(p provider.Provider) (*kacha.TransferResponse, error) {
+		return p.Transfer(req)
+	})
+	if err != nil && !provider.IsDefinite(err) {
+		log.Printf("Transfer %s outcome unknown, leaving it pending: %v", txID, err)
+		s.updateTransaction(txID, func(tx *store.Transaction) {
+			tx.Message = err.Error()
+		})
+		apiErr := newAPIError(http.StatusGatewayTimeout, "transfer outcome unknown: "+err.Error(),
+			gin.H{"transaction_id": txID, "status": store.StatusPending})
+		apiErr.cause = errOutcomeUnknown
+		return nil, apiErr
+	}
+	if err != nil {
+		s.failTransaction(txID, err)
+		return nil, err
+	}
+
+	s.updateTransaction(txID, func(tx *store.Transaction) {
+		tx.Status = providerStatus(resp.Status, resp.Success)
+		tx.Reference = resp.Reference
+		tx.ProviderTxID = resp.TransactionID
+		tx.Message = resp.Message
+	})
+	return resp, nil
+}
+
+// quoteError is the API error for a quote token that cannot be used
+func quoteError(err error) error {
+	status := http.StatusBadRequest
+	if errors.Is(err, quote.ErrUsed) {
+		status = http.StatusConflict
+	}
+	return newAPIError(status, err.Error(), nil)
+}
+
+func toTransferRequest(req kacha.PSPTransferRequest) kacha.TransferRequest {
+	return kacha.TransferRequest{
+		Username:  req.Username,
+		Password:  req.Password,
+		To:        req.To,
+		Amount:    req.Amount,
+		Reason:    req.Reason,
+		ShortCode: req.ShortCode,
+	}
+}
+
+func accountName(info *kacha.CustomerInfo) string {
+	if info == nil {
+		return ""
+	}
+	return info.Name
+}
+
+func nameMatchHeader(result namematch.Result) string {
+	return fmt.Sprintf("%s; score=%.2f", result.Decision, result.Score)
+}
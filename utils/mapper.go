@@ -11,9 +11,9 @@ import (
 func MapKachaToPSPResponse(kachaResp map[string]interface{}, success bool) kacha.PSPResponse {
 	data, _ := json.Marshal(kachaResp)
 
-	ref := fmt.Sprint(kachaResp["trace_number"])
-	id := fmt.Sprint(kachaResp["id"])
-	msg := fmt.Sprint(kachaResp["detail"])
+	ref := firstField(kachaResp, "trace_number", "reference")
+	id := firstField(kachaResp, "id", "transaction_id")
+	msg := firstField(kachaResp, "detail", "message")
 
 	status := "FAILURE"
 	if success {
@@ -33,6 +33,16 @@ func MapKachaToPSPResponse(kachaResp map[string]interface{}, success bool) kacha
 	}
 }
 
+// firstField returns the first of keys set in a Kacha response
+func firstField(kachaResp map[string]interface{}, keys ...string) string {
+	for _, key := range keys {
+		if v, ok := kachaResp[key]; ok && v != nil && v != "" {
+			return fmt.Sprint(v)
+		}
+	}
+	return ""
+}
+
 func MapPushUSSDToPSP(resp *kacha.PushUSSDResponse, success bool) kacha.PSPResponse {
 	status := "FAILURE"
 	message := "Failed to process service request."
@@ -99,6 +109,78 @@ func MapTransferToPSP(resp *kacha.TransferResponse, success bool) kacha.PSPRespo
 	}
 }
 
+func MapPaymentRequestToPSP(resp *kacha.PaymentRequestResponse, success bool) kacha.PSPResponse {
+	data, _ := json.Marshal(resp)
+	status := "FAILURE"
+	message := resp.Message
+	if success {
+		status = "SUCCESS"
+		if message == "" {
+			message = "Process service request successfully."
+		}
+	}
+
+	// the reference is what the OTP is authorized with
+	return kacha.PSPResponse{
+		ReferenceID: resp.TraceNumber,
+		Status:      status,
+		Message:     message,
+		PSPTxID:     resp.Reference,
+		PSPData:     string(data),
+		Signature:   GenerateSignature(resp.TraceNumber, message, status),
+	}
+}
+
+func MapPaymentAuthorizeToPSP(resp *kacha.PaymentAuthorizeResponse, success bool) kacha.PSPResponse {
+	data, _ := json.Marshal(resp)
+	status := "FAILURE"
+	message := resp.Message
+	if success {
+		status = "SUCCESS"
+		if message == "" {
+			message = "Process service request successfully."
+		}
+	}
+
+	return kacha.PSPResponse{
+		ReferenceID: resp.Reference,
+		Status:      status,
+		Message:     message,
+		PSPTxID:     resp.TransactionID,
+		PSPData:     string(data),
+		Signature:   GenerateSignature(resp.Reference, message, status),
+	}
+}
+
+// MapTransferValidateToPSP maps a validation, which has no transaction yet.
+// PSPData carries the whole response, e.g. the customer info and the quote
+// token of a PSPTransferValidateResponse.
+func MapTransferValidateToPSP(resp *kacha.PSPTransferValidateResponse, success bool) kacha.PSPResponse {
+	return MapValidationToPSP(resp.TransferValidateResponse, resp, success)
+}
+
+// MapValidationToPSP maps a validation with data as its PSPData, for
+// responses that wrap resp with more of the gateway's own fields
+func MapValidationToPSP(resp *kacha.TransferValidateResponse, data any, success bool) kacha.PSPResponse {
+	raw, _ := json.Marshal(data)
+	status := "FAILURE"
+	message := resp.Message
+	if success {
+		status = "SUCCESS"
+		if message == "" {
+			message = "Process service request successfully."
+		}
+	}
+
+	return kacha.PSPResponse{
+		ReferenceID: resp.To,
+		Status:      status,
+		Message:     message,
+		PSPData:     string(raw),
+		Signature:   GenerateSignature(resp.To, message, status),
+	}
+}
+
 func GenerateSignature(reference, message, status string) string {
 	raw := fmt.Sprintf("%s|%s|%s", reference, message, status)
 	hash := sha256.Sum256([]byte(raw))
@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"encoding/json"
+	"kacha-psp/kacha"
+	"reflect"
+	"sync"
+)
+
+// Mapper maps a Kacha response to the PSP envelope
+type Mapper func(resp any, success bool) kacha.PSPResponse
+
+var (
+	mappersMu sync.RWMutex
+	mappers   = map[reflect.Type]Mapper{}
+)
+
+func init() {
+	RegisterMapper(MapPaymentRequestToPSP)
+	RegisterMapper(MapPaymentAuthorizeToPSP)
+	RegisterMapper(MapPushUSSDToPSP)
+	RegisterMapper(MapTransferToPSP)
+	RegisterMapper(MapTransferValidateToPSP)
+	RegisterMapper(func(resp *kacha.TransferValidateResponse, success bool) kacha.PSPResponse {
+		return MapTransferValidateToPSP(&kacha.PSPTransferValidateResponse{TransferValidateResponse: resp}, success)
+	})
+}
+
+// RegisterMapper sets the mapper for responses of type *T, replacing any
+// registered before
+func RegisterMapper[T any](fn func(*T, bool) kacha.PSPResponse) {
+	mappersMu.Lock()
+	defer mappersMu.Unlock()
+	mappers[reflect.TypeFor[*T]()] = func(resp any, success bool) kacha.PSPResponse {
+		return fn(resp.(*T), success)
+	}
+}
+
+// MapToPSP maps any Kacha response to the PSP envelope with the mapper
+// registered for its type. Responses without one are mapped from their JSON
+// fields by MapKachaToPSPResponse, so every operation gets a signed envelope.
+func MapToPSP(resp any, success bool) kacha.PSPResponse {
+	mappersMu.RLock()
+	fn, ok := mappers[reflect.TypeOf(resp)]
+	mappersMu.RUnlock()
+	if ok {
+		return fn(resp, success)
+	}
+
+	fields := map[string]interface{}{}
+	if data, err := json.Marshal(resp); err == nil {
+		json.Unmarshal(data, &fields)
+	}
+	return MapKachaToPSPResponse(fields, success)
+}
@@ -0,0 +1,182 @@
+package vault
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"kacha-psp/provider"
+	"kacha-psp/store"
+)
+
+var (
+	ErrBadCredentials  = errors.New("invalid merchant credentials")
+	ErrUnknownMerchant = errors.New("no credentials stored for merchant")
+	ErrUnverified      = errors.New("merchant credentials could not be verified with the provider")
+)
+
+// Verifier checks credentials with the provider they belong to
+type Verifier func(creds provider.Credentials) error
+
+// Keyring keeps one set of sealed credentials per merchant for features that
+// act on the merchant's behalf later, such as subscription billing. The first
+// credentials presented for a merchant are stored once the provider accepts
+// them; afterwards the same ones must be presented until they are rotated or
+// an admin forgets them.
+type Keyring struct {
+	sealer *Sealer
+	verify Verifier
+	path   string
+
+	mu     sync.Mutex
+	sealed map[string]string
+}
+
+func NewKeyring(sealer *Sealer, verify Verifier, path string) (*Keyring, error) {
+	k := &Keyring{
+		sealer: sealer,
+		verify: verify,
+		path:   path,
+		sealed: make(map[string]string),
+	}
+	if path == "" {
+		return k, nil
+	}
+	if err := store.LoadJSON(path, &k.sealed); err != nil {
+		return nil, err
+	}
+	if k.sealed == nil {
+		k.sealed = make(map[string]string)
+	}
+	return k, nil
+}
+
+// Authenticate checks creds against the merchant's stored credentials. If
+// the merchant has none yet, creds are verified with the provider and stored.
+func (k *Keyring) Authenticate(creds provider.Credentials) error {
+	if k.sealer == nil {
+		return ErrDisabled
+	}
+	if creds.Username == "" || creds.Password == "" {
+		return ErrBadCredentials
+	}
+
+	k.mu.Lock()
+	sealed, ok := k.sealed[creds.Username]
+	k.mu.Unlock()
+	if ok {
+		return k.match(sealed, creds)
+	}
+
+	// the provider is asked without holding the lock
+	if err := k.verifyWithProvider(creds); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	// someone else may have stored the merchant's credentials meanwhile
+	if sealed, ok := k.sealed[creds.Username]; ok {
+		return k.match(sealed, creds)
+	}
+	return k.store(creds)
+}
+
+// Rotate replaces the merchant's stored password after authenticating with
+// the old one and verifying the new one with the provider
+func (k *Keyring) Rotate(creds provider.Credentials, newPassword string) error {
+	if err := k.Authenticate(creds); err != nil {
+		return err
+	}
+	if newPassword == "" {
+		return ErrBadCredentials
+	}
+	creds.Password = newPassword
+	if err := k.verifyWithProvider(creds); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.store(creds)
+}
+
+// Enabled reports whether credentials can be stored, i.e. CREDENTIALS_KEY is set
+func (k *Keyring) Enabled() bool {
+	return k.sealer != nil
+}
+
+// Credentials returns the merchant's stored credentials
+func (k *Keyring) Credentials(merchant string) (provider.Credentials, error) {
+	if k.sealer == nil {
+		return provider.Credentials{}, ErrDisabled
+	}
+
+	k.mu.Lock()
+	sealed, ok := k.sealed[merchant]
+	k.mu.Unlock()
+	if !ok {
+		return provider.Credentials{}, ErrUnknownMerchant
+	}
+	return k.sealer.OpenCredentials(sealed)
+}
+
+// Forget drops the merchant's stored credentials
+func (k *Keyring) Forget(merchant string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if _, ok := k.sealed[merchant]; !ok {
+		return false
+	}
+	delete(k.sealed, merchant)
+	k.persist()
+	return true
+}
+
+func (k *Keyring) match(sealed string, creds provider.Credentials) error {
+	if !k.sealer.Matches(sealed, creds) {
+		return ErrBadCredentials
+	}
+	return nil
+}
+
+// verifyWithProvider checks creds with the provider. Credentials the provider
+// refuses are bad; if it cannot answer, they are neither trusted nor refused.
+func (k *Keyring) verifyWithProvider(creds provider.Credentials) error {
+	if k.verify == nil {
+		return ErrUnverified
+	}
+	err := k.verify(creds)
+	switch {
+	case err == nil:
+		return nil
+	case provider.IsRejected(err):
+		log.Printf("[Vault] provider refused credentials for %s: %v", creds.Username, err)
+		return ErrBadCredentials
+	default:
+		return fmt.Errorf("%w: %v", ErrUnverified, err)
+	}
+}
+
+// store seals and saves creds; caller holds k.mu
+func (k *Keyring) store(creds provider.Credentials) error {
+	sealed, err := k.sealer.SealCredentials(creds)
+	if err != nil {
+		return err
+	}
+	k.sealed[creds.Username] = sealed
+	k.persist()
+	return nil
+}
+
+// persist mirrors the keyring to disk; caller holds k.mu
+func (k *Keyring) persist() {
+	if k.path == "" {
+		return
+	}
+	if err := store.SaveJSON(k.path, k.sealed); err != nil {
+		log.Printf("[Vault] failed to persist keyring: %v", err)
+	}
+}
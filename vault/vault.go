@@ -0,0 +1,102 @@
+package vault
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"kacha-psp/provider"
+)
+
+var ErrDisabled = errors.New("stored credentials are disabled; set CREDENTIALS_KEY")
+
+// Sealer encrypts merchant credentials that background jobs need to keep,
+// such as those of scheduled payouts, using AES-256-GCM
+type Sealer struct {
+	aead cipher.AEAD
+}
+
+// NewSealer derives the encryption key from secret. An empty secret returns
+// a nil Sealer, whose methods fail with ErrDisabled.
+func NewSealer(secret string) (*Sealer, error) {
+	if secret == "" {
+		return nil, nil
+	}
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return &Sealer{aead: aead}, nil
+}
+
+func (s *Sealer) Seal(plaintext []byte) (string, error) {
+	if s == nil {
+		return "", ErrDisabled
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := s.aead.Seal(nonce, nonce, plaintext, nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (s *Sealer) Open(sealed string) ([]byte, error) {
+	if s == nil {
+		return nil, ErrDisabled
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sealed value: %w", err)
+	}
+	n := s.aead.NonceSize()
+	if len(data) < n {
+		return nil, fmt.Errorf("invalid sealed value")
+	}
+	plaintext, err := s.aead.Open(nil, data[:n], data[n:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt sealed value: %w", err)
+	}
+	return plaintext, nil
+}
+
+func (s *Sealer) SealCredentials(creds provider.Credentials) (string, error) {
+	data, err := json.Marshal(creds)
+	if err != nil {
+		return "", err
+	}
+	return s.Seal(data)
+}
+
+func (s *Sealer) OpenCredentials(sealed string) (provider.Credentials, error) {
+	var creds provider.Credentials
+	data, err := s.Open(sealed)
+	if err != nil {
+		return creds, err
+	}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return creds, fmt.Errorf("invalid sealed credentials: %w", err)
+	}
+	return creds, nil
+}
+
+// Matches reports whether creds are the ones sealed in sealed
+func (s *Sealer) Matches(sealed string, creds provider.Credentials) bool {
+	stored, err := s.OpenCredentials(sealed)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(stored.Username), []byte(creds.Username)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(stored.Password), []byte(creds.Password)) == 1
+}
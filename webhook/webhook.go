@@ -0,0 +1,387 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"kacha-psp/store"
+)
+
+const (
+	MaxAttempts = 8
+	// delivered events are kept this long for the delivery log
+	retention = 7 * 24 * time.Hour
+	// backoff doubles from minBackoff up to maxBackoff
+	minBackoff = 30 * time.Second
+	maxBackoff = time.Hour
+)
+
+var (
+	ErrNotFound   = errors.New("webhook delivery not found")
+	ErrNoEndpoint = errors.New("no webhook endpoint configured")
+)
+
+type Status string
+
+const (
+	StatusPending   Status = "PENDING"
+	StatusDelivered Status = "DELIVERED"
+	StatusFailed    Status = "FAILED"
+)
+
+// Endpoint is where a merchant receives event notifications. Events limits
+// the event types sent; empty means all.
+type Endpoint struct {
+	Merchant  string    `json:"merchant"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret"`
+	Events    []string  `json:"events,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (e *Endpoint) wants(eventType string) bool {
+	return len(e.Events) == 0 || slices.Contains(e.Events, eventType)
+}
+
+// Event is the JSON body posted to an endpoint
+type Event struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Merchant  string    `json:"merchant"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      any       `json:"data"`
+}
+
+// Delivery tracks the attempts to post one event
+type Delivery struct {
+	ID             string          `json:"id"`
+	Merchant       string          `json:"merchant"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         Status          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	ResponseStatus int             `json:"response_status,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+}
+
+type state struct {
+	Endpoints  map[string]*Endpoint `json:"endpoints"`
+	Deliveries map[string]*Delivery `json:"deliveries"`
+}
+
+// Dispatcher queues events for merchant endpoints and delivers them with
+// retries. The queue is persisted so pending events survive restarts.
+type Dispatcher struct {
+	client *http.Client
+	path   string
+
+	mu sync.Mutex
+	st state
+}
+
+func NewDispatcher(path string) (*Dispatcher, error) {
+	d := &Dispatcher{
+		client: &http.Client{Timeout: 10 * time.Second},
+		path:   path,
+		st: state{
+			Endpoints:  make(map[string]*Endpoint),
+			Deliveries: make(map[string]*Delivery),
+		},
+	}
+	if path == "" {
+		return d, nil
+	}
+	if err := store.LoadJSON(path, &d.st); err != nil {
+		return nil, err
+	}
+	if d.st.Endpoints == nil {
+		d.st.Endpoints = make(map[string]*Endpoint)
+	}
+	if d.st.Deliveries == nil {
+		d.st.Deliveries = make(map[string]*Delivery)
+	}
+	return d, nil
+}
+
+// SetEndpoint creates or replaces the merchant's endpoint. A secret is
+// generated unless one is given, and kept when an endpoint is replaced.
+func (d *Dispatcher) SetEndpoint(ep Endpoint) (*Endpoint, error) {
+	u, err := url.Parse(ep.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("url must be an absolute http(s) URL")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	ep.CreatedAt, ep.UpdatedAt = now, now
+	if existing, ok := d.st.Endpoints[ep.Merchant]; ok {
+		ep.CreatedAt = existing.CreatedAt
+		if ep.Secret == "" {
+			ep.Secret = existing.Secret
+		}
+	}
+	if ep.Secret == "" {
+		if ep.Secret, err = newSecret(); err != nil {
+			return nil, err
+		}
+	}
+	d.st.Endpoints[ep.Merchant] = &ep
+	d.persist()
+
+	out := ep
+	return &out, nil
+}
+
+func (d *Dispatcher) Endpoint(merchant string) (*Endpoint, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ep, ok := d.st.Endpoints[merchant]
+	if !ok {
+		return nil, ErrNoEndpoint
+	}
+	out := *ep
+	return &out, nil
+}
+
+func (d *Dispatcher) RemoveEndpoint(merchant string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.st.Endpoints[merchant]; !ok {
+		return ErrNoEndpoint
+	}
+	delete(d.st.Endpoints, merchant)
+	d.persist()
+	return nil
+}
+
+// Send queues an event for the merchant's endpoint. Events the merchant has
+// no endpoint for, or has not subscribed to, are dropped.
+func (d *Dispatcher) Send(merchant, eventType string, data any) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ep, ok := d.st.Endpoints[merchant]
+	if !ok || !ep.wants(eventType) {
+		return
+	}
+
+	now := time.Now()
+	event := Event{
+		ID:        store.NewID("evt"),
+		Type:      eventType,
+		Merchant:  merchant,
+		CreatedAt: now,
+		Data:      data,
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("[Webhook] failed to encode %s event: %v", eventType, err)
+		return
+	}
+
+	d.st.Deliveries[event.ID] = &Delivery{
+		ID:            event.ID,
+		Merchant:      merchant,
+		Event:         eventType,
+		Payload:       payload,
+		Status:        StatusPending,
+		NextAttemptAt: &now,
+		CreatedAt:     now,
+	}
+	d.persist()
+}
+
+// Deliver attempts every delivery that is due. Requests are made without
+// holding the lock so that Send is never blocked by a slow endpoint.
+func (d *Dispatcher) Deliver() {
+	now := time.Now()
+
+	d.mu.Lock()
+	d.prune(now)
+	type attempt struct {
+		delivery Delivery
+		endpoint Endpoint
+	}
+	var due []attempt
+	for _, dl := range d.st.Deliveries {
+		if dl.Status != StatusPending || dl.NextAttemptAt == nil || dl.NextAttemptAt.After(now) {
+			continue
+		}
+		ep, ok := d.st.Endpoints[dl.Merchant]
+		if !ok {
+			dl.Status = StatusFailed
+			dl.NextAttemptAt = nil
+			dl.LastError = ErrNoEndpoint.Error()
+			continue
+		}
+		due = append(due, attempt{*dl, *ep})
+	}
+	d.persist()
+	d.mu.Unlock()
+
+	sort.Slice(due, func(i, j int) bool { return due[i].delivery.CreatedAt.Before(due[j].delivery.CreatedAt) })
+	for _, a := range due {
+		status, err := d.post(a.endpoint, a.delivery)
+		d.record(a.delivery.ID, status, err)
+	}
+}
+
+func (d *Dispatcher) post(ep Endpoint, dl Delivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, ep.URL, bytes.NewReader(dl.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-PSP-Event", dl.Event)
+	req.Header.Set("X-PSP-Delivery", dl.ID)
+	req.Header.Set("X-PSP-Signature", Sign(ep.Secret, time.Now(), dl.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func (d *Dispatcher) record(id string, status int, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	dl, ok := d.st.Deliveries[id]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	dl.Attempts++
+	dl.ResponseStatus = status
+	if err == nil {
+		dl.Status = StatusDelivered
+		dl.DeliveredAt = &now
+		dl.NextAttemptAt = nil
+		dl.LastError = ""
+	} else {
+		dl.LastError = err.Error()
+		if dl.Attempts >= MaxAttempts {
+			log.Printf("[Webhook] giving up on %s to %s after %d attempts: %v", dl.Event, dl.Merchant, dl.Attempts, err)
+			dl.Status = StatusFailed
+			dl.NextAttemptAt = nil
+		} else {
+			next := now.Add(backoff(dl.Attempts))
+			dl.NextAttemptAt = &next
+		}
+	}
+	d.persist()
+}
+
+// Retry requeues a failed delivery for immediate delivery
+func (d *Dispatcher) Retry(id, merchant string) (*Delivery, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	dl, ok := d.st.Deliveries[id]
+	if !ok || (merchant != "" && dl.Merchant != merchant) {
+		return nil, ErrNotFound
+	}
+	now := time.Now()
+	dl.Status = StatusPending
+	dl.Attempts = 0
+	dl.NextAttemptAt = &now
+	d.persist()
+
+	out := *dl
+	return &out, nil
+}
+
+// Deliveries returns deliveries for merchant (all merchants if empty) with status, newest first
+func (d *Dispatcher) Deliveries(merchant string, status Status) []*Delivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	out := []*Delivery{}
+	for _, dl := range d.st.Deliveries {
+		if merchant != "" && dl.Merchant != merchant {
+			continue
+		}
+		if status != "" && dl.Status != status {
+			continue
+		}
+		cp := *dl
+		out = append(out, &cp)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
+
+// Sign returns the X-PSP-Signature header value for a payload: the Unix
+// timestamp and an HMAC-SHA256 of "<timestamp>.<payload>" keyed by secret
+func Sign(secret string, at time.Time, payload []byte) string {
+	ts := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(payload)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func backoff(attempts int) time.Duration {
+	d := minBackoff << (attempts - 1)
+	if d <= 0 || d > maxBackoff {
+		return maxBackoff
+	}
+	return d
+}
+
+// prune drops finished deliveries past retention; caller holds d.mu
+func (d *Dispatcher) prune(now time.Time) {
+	for id, dl := range d.st.Deliveries {
+		if dl.Status != StatusPending && now.Sub(dl.CreatedAt) > retention {
+			delete(d.st.Deliveries, id)
+		}
+	}
+}
+
+// persist mirrors the dispatcher state to disk; caller holds d.mu
+func (d *Dispatcher) persist() {
+	if d.path == "" {
+		return
+	}
+	if err := store.SaveJSON(d.path, d.st); err != nil {
+		log.Printf("[Webhook] failed to persist state: %v", err)
+	}
+}
+
+func newSecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate webhook secret: %w", err)
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"kacha-psp/provider"
+	"kacha-psp/vault"
+	"kacha-psp/webhook"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type webhookEndpointRequest struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret,omitempty"`
+	Events []string `json:"events,omitempty"`
+}
+
+type rotateCredentialsRequest struct {
+	NewPassword string `json:"new_password"`
+}
+
+func (s *server) handleGetWebhook(c *gin.Context) {
+	ep, err := s.webhooks.Endpoint(c.GetString("merchant"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, ep)
+}
+
+func (s *server) handlePutWebhook(c *gin.Context) {
+	var req webhookEndpointRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ep, err := s.webhooks.SetEndpoint(webhook.Endpoint{
+		Merchant: c.GetString("merchant"),
+		URL:      req.URL,
+		Secret:   req.Secret,
+		Events:   req.Events,
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, ep)
+}
+
+func (s *server) handleDeleteWebhook(c *gin.Context) {
+	if err := s.webhooks.RemoveEndpoint(c.GetString("merchant")); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (s *server) handleListWebhookDeliveries(c *gin.Context) {
+	deliveries := s.webhooks.Deliveries(c.GetString("merchant"), webhook.Status(c.Query("status")))
+	c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+}
+
+func (s *server) handleRetryWebhookDelivery(c *gin.Context) {
+	delivery, err := s.webhooks.Retry(c.Param("id"), c.GetString("merchant"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, delivery)
+}
+
+func (s *server) handleAdminListWebhookDeliveries(c *gin.Context) {
+	deliveries := s.webhooks.Deliveries(c.Query("merchant"), webhook.Status(c.Query("status")))
+	c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+}
+
+// handleRotateCredentials updates the stored password after the merchant
+// changes it with the provider
+func (s *server) handleRotateCredentials(c *gin.Context) {
+	var req rotateCredentialsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	username, password, _ := c.Request.BasicAuth()
+	err := s.keyring.Rotate(provider.Credentials{Username: username, Password: password}, req.NewPassword)
+	switch {
+	case errors.Is(err, vault.ErrUnverified):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// handleForgetCredentials lets an admin reset a merchant whose stored
+// credentials no longer match, e.g. after a password reset with the provider
+func (s *server) handleForgetCredentials(c *gin.Context) {
+	if !s.keyring.Forget(c.Param("merchant")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": vault.ErrUnknownMerchant.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}